@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/piersy/tendermint-go/tendermint/keys"
+)
+
+// The files of a home directory.
+const (
+	configFile         = "config/config.json"
+	genesisFile        = "config/genesis.json"
+	nodeKeyFile        = "config/node_key.json"
+	validatorKeyFile   = "config/priv_validator_key.json"
+	validatorStateFile = "data/priv_validator_state.json"
+	dataDir            = "data"
+)
+
+// config is the configuration of a node.
+type config struct {
+	// ListenAddr is the host:port that the node accepts p2p connections on.
+	ListenAddr string `json:"listen_addr"`
+	// PersistentPeers are the id@host:port addresses of the peers the node
+	// keeps connected to. A node without persistent peers starts consensus
+	// straight away rather than first syncing blocks.
+	PersistentPeers []string `json:"persistent_peers"`
+	// RPCAddr is the host:port that the node serves RPC requests on, if
+	// empty no requests are served.
+	RPCAddr string `json:"rpc_addr"`
+	// LogLevel is the level of the messages logged, one of debug, info, warn
+	// or error.
+	LogLevel string `json:"log_level"`
+}
+
+// defaultConfig returns the configuration written by init.
+func defaultConfig() *config {
+	return &config{
+		ListenAddr:      "0.0.0.0:26656",
+		PersistentPeers: []string{},
+		RPCAddr:         "127.0.0.1:26657",
+		LogLevel:        "info",
+	}
+}
+
+// keyFile is the encoding of a key.
+type keyFile struct {
+	Address string             `json:"address"`
+	PubKey  ed25519.PublicKey  `json:"pub_key"`
+	PrivKey ed25519.PrivateKey `json:"priv_key"`
+}
+
+func generateKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+func writeKey(path string, key ed25519.PrivateKey) error {
+	pub := key.Public().(ed25519.PublicKey)
+	return writeJSON(path, &keyFile{Address: keys.FormatAddress(keys.Address(pub)), PubKey: pub, PrivKey: key}, 0o600)
+}
+
+func readKey(path string) (ed25519.PrivateKey, error) {
+	var f keyFile
+	if err := readJSON(path, &f); err != nil {
+		return nil, err
+	}
+	if len(f.PrivKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s: invalid private key", path)
+	}
+	if !f.PrivKey.Public().(ed25519.PublicKey).Equal(f.PubKey) {
+		return nil, fmt.Errorf("%s: public key does not match private key", path)
+	}
+	return f.PrivKey, nil
+}
+
+// ensureKey reads the key at path, generating it if the file does not exist.
+func ensureKey(path string) (ed25519.PrivateKey, bool, error) {
+	key, err := readKey(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return key, false, err
+	}
+	if key, err = generateKey(); err != nil {
+		return nil, false, err
+	}
+	return key, true, writeKey(path, key)
+}
+
+func readJSON(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// writeJSON writes v to path, creating its directory if needed.
+func writeJSON(path string, v any, perm os.FileMode) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), perm)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// randomChainID returns a chain id for chains created without one.
+func randomChainID() (string, error) {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "test-chain-" + hex.EncodeToString(b), nil
+}
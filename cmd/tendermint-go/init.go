@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/consensus"
+	"github.com/piersy/tendermint-go/tendermint/genesis"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/privval"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// defaultTimeoutCommit is the TimeoutCommit of the chains we create.
+const defaultTimeoutCommit = time.Second
+
+// initHome creates the configuration of a single validator chain in home,
+// files that already exist are kept.
+func initHome(home, chainID string, out io.Writer) error {
+	path := filepath.Join(home, nodeKeyFile)
+	_, created, err := ensureKey(path)
+	if err != nil {
+		return err
+	}
+	report(out, path, created)
+	keyPath, statePath := filepath.Join(home, validatorKeyFile), filepath.Join(home, validatorStateFile)
+	created = !exists(keyPath)
+	pv, err := privval.LoadOrGenFilePV(keyPath, statePath)
+	if err != nil {
+		return err
+	}
+	report(out, keyPath, created)
+	report(out, statePath, created)
+
+	path = filepath.Join(home, configFile)
+	created = !exists(path)
+	if created {
+		if err := writeJSON(path, defaultConfig(), 0o644); err != nil {
+			return err
+		}
+	}
+	report(out, path, created)
+
+	path = filepath.Join(home, genesisFile)
+	created = !exists(path)
+	if created {
+		g, err := newGenesis(chainID, []ed25519.PublicKey{pv.PubKey()}, types.DefaultValidatorUpdateDelay)
+		if err != nil {
+			return err
+		}
+		if err := g.Save(path); err != nil {
+			return err
+		}
+	}
+	report(out, path, created)
+	return nil
+}
+
+func report(out io.Writer, path string, created bool) {
+	if created {
+		fmt.Fprintln(out, "created", path)
+	} else {
+		fmt.Fprintln(out, "found", path)
+	}
+}
+
+// newGenesis returns the genesis of a chain validated by the holders of the
+// keys pubs, starting at height 1, whose validator updates take effect
+// updateDelay heights later.
+func newGenesis(chainID string, pubs []ed25519.PublicKey, updateDelay uint64) (*genesis.Genesis, error) {
+	if chainID == "" {
+		var err error
+		if chainID, err = randomChainID(); err != nil {
+			return nil, err
+		}
+	}
+	g := genesis.New(chainID, pubs)
+	g.ConsensusParams = genesis.ConsensusParams{
+		TimeoutUnit:     genesis.Duration(consensus.DefaultTimeoutUnit),
+		TimeoutCommit:   genesis.Duration(defaultTimeoutCommit),
+		MaxProposalSize: consensus.DefaultMaxProposalSize,
+		UpdateDelay:     updateDelay,
+	}
+	return g, g.Validate()
+}
+
+// testnetOptions configures testnet.
+type testnetOptions struct {
+	// dir holds the home directory of each validator, named node0, node1
+	// and so on.
+	dir        string
+	validators int
+	chainID    string
+	// host is the host the nodes listen on, node i listens for p2p
+	// connections on p2pPorts[i] and serves RPC on rpcPorts[i].
+	host     string
+	p2pPorts []int
+	rpcPorts []int
+	// updateDelay is the validator update delay of the chain.
+	updateDelay uint64
+}
+
+// testnet creates the home directories of the validators of a chain whose
+// nodes are all persistent peers of each other.
+func testnet(opts testnetOptions, out io.Writer) error {
+	if opts.validators < 1 {
+		return fmt.Errorf("a testnet needs at least one validator, got %d", opts.validators)
+	}
+	homes := make([]string, opts.validators)
+	nodeKeys := make([]ed25519.PrivateKey, opts.validators)
+	validators := make([]*privval.FilePV, opts.validators)
+	pubs := make([]ed25519.PublicKey, opts.validators)
+	addrs := make([]string, opts.validators)
+	for i := range homes {
+		homes[i] = filepath.Join(opts.dir, "node"+strconv.Itoa(i))
+		if exists(homes[i]) {
+			return fmt.Errorf("%s already exists", homes[i])
+		}
+		var err error
+		if nodeKeys[i], err = generateKey(); err != nil {
+			return err
+		}
+		validatorKey, err := generateKey()
+		if err != nil {
+			return err
+		}
+		validators[i] = privval.NewFilePV(validatorKey, filepath.Join(homes[i], validatorKeyFile), filepath.Join(homes[i], validatorStateFile))
+		pubs[i] = validators[i].PubKey()
+		id := keys.Address(nodeKeys[i].Public().(ed25519.PublicKey))
+		addrs[i] = keys.FormatAddress(id) + "@" + net.JoinHostPort(opts.host, strconv.Itoa(opts.p2pPorts[i]))
+	}
+	g, err := newGenesis(opts.chainID, pubs, opts.updateDelay)
+	if err != nil {
+		return err
+	}
+	for i, home := range homes {
+		cfg := defaultConfig()
+		cfg.ListenAddr = net.JoinHostPort(opts.host, strconv.Itoa(opts.p2pPorts[i]))
+		cfg.RPCAddr = net.JoinHostPort(opts.host, strconv.Itoa(opts.rpcPorts[i]))
+		for j, addr := range addrs {
+			if j != i {
+				cfg.PersistentPeers = append(cfg.PersistentPeers, addr)
+			}
+		}
+		if err := writeKey(filepath.Join(home, nodeKeyFile), nodeKeys[i]); err != nil {
+			return err
+		}
+		if err := validators[i].Save(); err != nil {
+			return err
+		}
+		if err := writeJSON(filepath.Join(home, configFile), cfg, 0o644); err != nil {
+			return err
+		}
+		if err := g.Save(filepath.Join(home, genesisFile)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "created %s, p2p %s, rpc %s\n", home, cfg.ListenAddr, cfg.RPCAddr)
+	}
+	return nil
+}
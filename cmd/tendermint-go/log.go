@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// logger writes the messages at or above its level as a line of key=value
+// pairs, it implements algorithm.Logger.
+type logger struct {
+	l     *log.Logger
+	level algorithm.Level
+}
+
+func newLogger(w io.Writer, level string) (*logger, error) {
+	for l := algorithm.LevelDebug; l <= algorithm.LevelError; l++ {
+		if strings.EqualFold(level, l.String()) {
+			return &logger{l: log.New(w, "", log.LstdFlags|log.Lmicroseconds), level: l}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid log level %q", level)
+}
+
+func (l *logger) Debug(msg string, args ...any) { l.log(algorithm.LevelDebug, msg, args) }
+func (l *logger) Info(msg string, args ...any)  { l.log(algorithm.LevelInfo, msg, args) }
+func (l *logger) Warn(msg string, args ...any)  { l.log(algorithm.LevelWarn, msg, args) }
+func (l *logger) Error(msg string, args ...any) { l.log(algorithm.LevelError, msg, args) }
+
+func (l *logger) log(level algorithm.Level, msg string, args []any) {
+	if level < l.level {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-5s %s", level, msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	l.l.Print(b.String())
+}
@@ -0,0 +1,124 @@
+// Command tendermint-go runs a node of a chain replicating the kvstore
+// application.
+//
+// Usage:
+//
+//	tendermint-go init [-home dir] [-chain-id id]
+//	tendermint-go start [-home dir]
+//	tendermint-go testnet [-n validators] [-o dir] [-chain-id id] [-host host] [-port port] [-update-delay heights]
+//
+// init creates the configuration of a single validator chain in the home
+// directory, keeping any files that already exist. start runs the node
+// configured in the home directory until it is interrupted. testnet creates
+// one home directory per validator of a chain whose nodes listen on
+// consecutive ports of the same host and connect to each other.
+//
+// A home directory holds
+//
+//	config/config.json             the addresses of the node and its peers
+//	config/genesis.json            the chain id, initial height and validators
+//	config/node_key.json           the key authenticating p2p connections
+//	config/priv_validator_key.json the key signing consensus messages
+//	data/priv_validator_state.json the last message signed, so that none
+//	                               conflicting with it is ever signed
+//	data/                          the decided blocks
+//
+// The node serves its metrics on /metrics of its RPC address, accepts "k=v"
+// transactions posted to /broadcast_tx, answers /query?key=k with the value of
+// k and /status with its height and application hash. Transactions of the form
+// val:<hex public key>=1 or =0 add a validator to the set or remove it, see
+// package kvstore.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+const usage = `usage: tendermint-go <command> [flags]
+
+commands:
+  init     create the configuration of a single validator chain
+  start    run a node
+  testnet  create the configurations of a multi validator local chain
+
+run tendermint-go <command> -h for the flags of a command
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run executes the command given by args.
+func run(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return flag.ErrHelp
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	switch args[0] {
+	case "init":
+		home := fs.String("home", defaultHome(), "home directory")
+		chainID := fs.String("chain-id", "", "chain id, generated if empty")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return initHome(*home, *chainID, stdout)
+	case "start":
+		home := fs.String("home", defaultHome(), "home directory")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		n, err := newNode(*home, stderr)
+		if err != nil {
+			return err
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return n.Run(ctx)
+	case "testnet":
+		opts := testnetOptions{}
+		fs.IntVar(&opts.validators, "n", 4, "number of validators")
+		fs.StringVar(&opts.dir, "o", "testnet", "output directory, holding one home directory per validator")
+		fs.StringVar(&opts.chainID, "chain-id", "", "chain id, generated if empty")
+		fs.StringVar(&opts.host, "host", "127.0.0.1", "host the nodes listen on")
+		port := fs.Int("port", 26656, "p2p port of the first node, node i listens on port+2i and serves RPC on port+2i+1")
+		fs.Uint64Var(&opts.updateDelay, "update-delay", types.DefaultValidatorUpdateDelay, "number of heights after which validator updates take effect, at least 2")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		for i := 0; i < opts.validators; i++ {
+			opts.p2pPorts = append(opts.p2pPorts, *port+2*i)
+			opts.rpcPorts = append(opts.rpcPorts, *port+2*i+1)
+		}
+		return testnet(opts, stdout)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(stdout, usage)
+		return nil
+	default:
+		fmt.Fprint(stderr, usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func defaultHome() string {
+	if dir, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(dir, ".tendermint-go")
+	}
+	return ".tendermint-go"
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/genesis"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/kvstore"
+	"github.com/piersy/tendermint-go/tendermint/privval"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTimeout = 30 * time.Second
+
+func TestInit(t *testing.T) {
+	home := t.TempDir()
+	var out strings.Builder
+	require.NoError(t, run([]string{"init", "-home", home, "-chain-id", "test"}, &out, io.Discard))
+	assert.Equal(t, 5, strings.Count(out.String(), "created"))
+
+	g, err := genesis.Load(filepath.Join(home, genesisFile))
+	require.NoError(t, err)
+	assert.Equal(t, "test", g.ChainID)
+	assert.Equal(t, uint64(1), g.InitialHeight)
+	assert.Equal(t, genesis.Duration(defaultTimeoutCommit), g.ConsensusParams.TimeoutCommit)
+	key, err := readKey(filepath.Join(home, validatorKeyFile))
+	require.NoError(t, err)
+	vs, err := g.ValidatorSet()
+	require.NoError(t, err)
+	assert.Equal(t, 1, vs.Size())
+	assert.True(t, vs.Contains(keys.Address(key.Public().(ed25519.PublicKey))))
+	pv, err := privval.LoadFilePV(filepath.Join(home, validatorKeyFile), filepath.Join(home, validatorStateFile))
+	require.NoError(t, err)
+	assert.Equal(t, privval.LastSigned{}, pv.LastSigned())
+
+	// Existing files are kept.
+	out.Reset()
+	require.NoError(t, run([]string{"init", "-home", home}, &out, io.Discard))
+	assert.Equal(t, 5, strings.Count(out.String(), "found"))
+	again, err := readKey(filepath.Join(home, validatorKeyFile))
+	require.NoError(t, err)
+	assert.Equal(t, key, again)
+
+	assert.Error(t, run([]string{"unknown"}, io.Discard, io.Discard))
+}
+
+// freePorts returns n ports that were free when it was called.
+func freePorts(t *testing.T, n int) []int {
+	ports := make([]int, n)
+	for i := range ports {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		ports[i] = l.Addr().(*net.TCPAddr).Port
+	}
+	return ports
+}
+
+func get(url string) (string, int, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), resp.StatusCode, err
+}
+
+func TestTestnet(t *testing.T) {
+	const validators = 4
+	ports := freePorts(t, 2*validators)
+	opts := testnetOptions{
+		dir:         t.TempDir(),
+		validators:  validators,
+		chainID:     "test",
+		host:        "127.0.0.1",
+		p2pPorts:    ports[:validators],
+		rpcPorts:    ports[validators:],
+		updateDelay: 3,
+	}
+	invalid := opts
+	invalid.dir, invalid.updateDelay = t.TempDir(), 1
+	assert.Error(t, testnet(invalid, io.Discard), "update delay of one")
+	require.NoError(t, testnet(opts, io.Discard))
+	assert.Error(t, testnet(opts, io.Discard), "homes already exist")
+	g, err := genesis.Load(filepath.Join(opts.dir, "node0", genesisFile))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), g.ConsensusParams.UpdateDelay)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, validators)
+	for i := 0; i < validators; i++ {
+		n, err := newNode(filepath.Join(opts.dir, "node"+strconv.Itoa(i)), io.Discard)
+		require.NoError(t, err)
+		go func() { errs <- n.Run(ctx) }()
+	}
+	defer func() {
+		cancel()
+		for i := 0; i < validators; i++ {
+			assert.NoError(t, <-errs)
+		}
+	}()
+
+	// A transaction submitted to one node is executed by all of them.
+	rpc := func(i int, path string) string {
+		return "http://" + net.JoinHostPort(opts.host, strconv.Itoa(opts.rpcPorts[i])) + path
+	}
+	require.Eventually(t, func() bool {
+		resp, err := http.Post(rpc(0, "/broadcast_tx"), "text/plain", strings.NewReader("greeting=hello"))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, testTimeout, 10*time.Millisecond)
+	_, code, err := get(rpc(1, "/broadcast_tx?tx=invalid"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, code)
+	for i := 0; i < validators; i++ {
+		require.Eventually(t, func() bool {
+			v, _, err := get(rpc(i, "/query?key=greeting"))
+			return err == nil && v == "hello"
+		}, testTimeout, 10*time.Millisecond, "node %d", i)
+	}
+
+	// Removing a validator takes effect on all nodes, and the chain carries
+	// on without it.
+	key, err := readKey(filepath.Join(opts.dir, "node3", validatorKeyFile))
+	require.NoError(t, err)
+	tx := kvstore.ValidatorTx(key.Public().(ed25519.PublicKey), true)
+	resp, err := http.Post(rpc(0, "/broadcast_tx"), "text/plain", bytes.NewReader(tx))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	validatorKey := strings.TrimSuffix(string(tx), "=0")
+	for i := 0; i < validators; i++ {
+		require.Eventually(t, func() bool {
+			_, code, err := get(rpc(i, "/query?key="+validatorKey))
+			return err == nil && code == http.StatusNotFound
+		}, testTimeout, 10*time.Millisecond, "node %d", i)
+	}
+	_, code, err = get(rpc(1, "/broadcast_tx?tx=greeting=bye"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, code)
+	for i := 0; i < validators; i++ {
+		require.Eventually(t, func() bool {
+			v, _, err := get(rpc(i, "/query?key=greeting"))
+			return err == nil && v == "bye"
+		}, testTimeout, 10*time.Millisecond, "node %d", i)
+	}
+
+	status, _, err := get(rpc(2, "/status"))
+	require.NoError(t, err)
+	assert.Contains(t, status, `"chain_id":"test"`)
+	metrics, _, err := get(rpc(3, "/metrics"))
+	require.NoError(t, err)
+	assert.Contains(t, metrics, "tendermint_consensus_height")
+
+	// Every validator records what it signed.
+	for i := 0; i < validators; i++ {
+		home := filepath.Join(opts.dir, "node"+strconv.Itoa(i))
+		pv, err := privval.LoadFilePV(filepath.Join(home, validatorKeyFile), filepath.Join(home, validatorStateFile))
+		require.NoError(t, err)
+		assert.NotZero(t, pv.LastSigned().Height, "node %d", i)
+	}
+}
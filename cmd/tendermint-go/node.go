@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/blockstore"
+	"github.com/piersy/tendermint-go/tendermint/blocksync"
+	"github.com/piersy/tendermint-go/tendermint/consensus"
+	"github.com/piersy/tendermint-go/tendermint/genesis"
+	"github.com/piersy/tendermint-go/tendermint/kvstore"
+	"github.com/piersy/tendermint-go/tendermint/mempool"
+	"github.com/piersy/tendermint-go/tendermint/metrics"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+	"github.com/piersy/tendermint-go/tendermint/privval"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// dialInterval is the interval at which a node dials the persistent peers it
+// is not connected to.
+const dialInterval = time.Second
+
+// node runs the consensus, block sync and mempool reactors of a chain
+// replicating the kvstore application.
+type node struct {
+	cfg     *config
+	genesis *genesis.Genesis
+	log     *logger
+
+	validator *privval.FilePV
+	peers     map[algorithm.NodeID]string
+
+	app       *kvstore.App
+	store     *blockstore.DecisionStore
+	schedule  *types.ValidatorSchedule
+	mempool   *mempool.Mempool
+	transport *p2p.TCPTransport
+	registry  *metrics.Registry
+	rpc       net.Listener
+}
+
+// newNode loads the node configured in home, replays the blocks it holds
+// into the application and starts listening for connections. Logs are
+// written to logOut.
+func newNode(home string, logOut io.Writer) (n *node, err error) {
+	n = &node{cfg: &config{}, peers: make(map[algorithm.NodeID]string)}
+	if err := readJSON(filepath.Join(home, configFile), n.cfg); err != nil {
+		return nil, err
+	}
+	if n.genesis, err = genesis.Load(filepath.Join(home, genesisFile)); err != nil {
+		return nil, err
+	}
+	if n.log, err = newLogger(logOut, n.cfg.LogLevel); err != nil {
+		return nil, err
+	}
+	for _, addr := range n.cfg.PersistentPeers {
+		id, _, err := p2p.ParseAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("persistent peer %s: %w", addr, err)
+		}
+		if id == nil {
+			return nil, fmt.Errorf("persistent peer %s has no id", addr)
+		}
+		n.peers[*id] = addr
+	}
+	if n.schedule, err = n.genesis.Schedule(); err != nil {
+		return nil, err
+	}
+	nodeKey, err := readKey(filepath.Join(home, nodeKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	if n.validator, err = privval.LoadFilePV(filepath.Join(home, validatorKeyFile), filepath.Join(home, validatorStateFile)); err != nil {
+		return nil, err
+	}
+
+	var validators []ed25519.PublicKey
+	for _, v := range n.genesis.Validators {
+		validators = append(validators, v.PubKey)
+	}
+	n.app = kvstore.New(kvstore.Config{Validators: validators})
+	if n.store, err = blockstore.Open(filepath.Join(home, dataDir)); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			n.close()
+			n.store.Close()
+		}
+	}()
+	if err := n.replay(); err != nil {
+		return nil, err
+	}
+	n.mempool = mempool.NewMempool(mempool.Config{}, n.app)
+	n.registry = metrics.NewRegistry()
+	if n.transport, err = p2p.ListenTCP(nodeKey, n.cfg.ListenAddr, p2p.TCPConfig{}); err != nil {
+		return nil, err
+	}
+	if n.cfg.RPCAddr != "" {
+		if n.rpc, err = net.Listen("tcp", n.cfg.RPCAddr); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// replay executes the blocks held in the store, which are trusted since they
+// were verified before being stored.
+func (n *node) replay() error {
+	if n.store.Height() == 0 {
+		return nil
+	}
+	if n.store.Base() != n.genesis.InitialHeight {
+		return fmt.Errorf("store holds heights from %d, the application must be replayed from the initial height %d", n.store.Base(), n.genesis.InitialHeight)
+	}
+	for h := n.store.Base(); h <= n.store.Height(); h++ {
+		b := n.store.Block(h)
+		if b == nil {
+			return fmt.Errorf("store lacks height %d", h)
+		}
+		if err := n.schedule.Apply(h, n.app.Execute(h, b.Payload)); err != nil {
+			return err
+		}
+	}
+	n.log.Info("replayed blocks", "height", n.store.Height(), "app_hash", n.app.AppHash())
+	return nil
+}
+
+// commit stores the block decided at height and executes it, returning the
+// validator updates it results in.
+func (n *node) commit(height uint64, b *types.Block) ([]types.ValidatorUpdate, error) {
+	if err := n.store.Add(b); err != nil {
+		return nil, err
+	}
+	updates := n.app.Execute(height, b.Payload)
+	txs, _ := mempool.DecodeTxs(b.Payload)
+	n.mempool.Update(txs)
+	n.log.Info("committed block", "height", height, "txs", len(txs), "validator_updates", len(updates), "app_hash", n.app.AppHash())
+	return updates, nil
+}
+
+// Run runs the node until ctx is done or it fails, and then releases its
+// resources.
+func (n *node) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		n.close()
+		wg.Wait()
+		n.store.Close()
+	}()
+	errc := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	}
+	goRun := func(f func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(ctx); err != nil && ctx.Err() == nil {
+				fail(err)
+			}
+		}()
+	}
+
+	mux := p2p.NewMux(n.transport, p2p.MuxConfig{})
+	consensusTransport := mux.Channels(consensus.Channel)
+	blocksyncTransport := mux.Channels(blocksync.Channel)
+	mempoolTransport := mux.Channels(mempool.Channel)
+	mux.Start()
+
+	startConsensus := func(height uint64) {
+		n.log.Info("starting consensus", "height", height)
+		// Proposals must be later than the last block, which the store
+		// holds unless height is the initial height.
+		var lastTime time.Time
+		if b := n.store.Block(height - 1); b != nil {
+			if header, err := types.ProposalHeader(b.Proposal); err == nil {
+				lastTime = header.Time
+			}
+		}
+		d := consensus.NewDriver(consensus.Config{
+			Signer:        n.validator,
+			Genesis:       n.genesis,
+			Schedule:      n.schedule,
+			Height:        height,
+			LastBlockTime: lastTime,
+			Propose: func(uint64, int) []byte {
+				return mempool.EncodeTxs(n.mempool.Reap(n.maxProposalSize()))
+			},
+			Valid: func(payload []byte) bool {
+				_, err := mempool.DecodeTxs(payload)
+				return err == nil
+			},
+			AppHash: func(uint64) tendermint.Hash { return n.app.AppHash() },
+			Decided: func(p *algorithm.ConsensusMessage, b *types.Block) []types.ValidatorUpdate {
+				updates, err := n.commit(p.Height, b)
+				if err != nil {
+					fail(fmt.Errorf("committing height %d: %w", p.Height, err))
+				}
+				return updates
+			},
+			Logger:   n.log,
+			LogLevel: algorithm.LevelDebug,
+			Metrics:  consensus.NewPrometheusMetrics(n.registry),
+		}, consensusTransport)
+		goRun(d.Run)
+	}
+	height := n.store.Height() + 1
+	if n.store.Height() == 0 {
+		height = n.genesis.InitialHeight
+	}
+	syncCfg := blocksync.Config{
+		ChainID:    n.genesis.ChainID,
+		Store:      n.store,
+		Validators: n.schedule.At,
+		Apply: func(p *algorithm.ConsensusMessage, b *types.Block) error {
+			updates, err := n.commit(p.Height, b)
+			if err != nil {
+				return err
+			}
+			return n.schedule.Apply(p.Height, updates)
+		},
+		Synced:          startConsensus,
+		MaxProposalSize: n.genesis.ConsensusParams.MaxProposalSize,
+	}
+	if len(n.peers) == 0 {
+		// There is no one to sync from.
+		startConsensus(height)
+	} else {
+		syncCfg.Height = height
+		// Small networks sync once every persistent peer is heard from.
+		if len(n.peers) < blocksync.DefaultMinPeers {
+			syncCfg.MinPeers = len(n.peers)
+		}
+	}
+	goRun(blocksync.NewReactor(syncCfg, blocksyncTransport).Run)
+	goRun(mempool.NewReactor(n.mempool, mempoolTransport).Run)
+	goRun(n.dialPeers)
+	if n.rpc != nil {
+		srv := &http.Server{Handler: n.handler()}
+		goRun(func(context.Context) error {
+			if err := srv.Serve(n.rpc); !errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+	n.log.Info("started node", "chain_id", n.genesis.ChainID, "genesis_hash", n.genesis.Hash(), "id", n.transport.ID(), "p2p", n.transport.Addr(), "height", height)
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errc:
+		return err
+	}
+}
+
+// maxProposalSize returns the largest payload the chain accepts.
+func (n *node) maxProposalSize() int {
+	if size := n.genesis.ConsensusParams.MaxProposalSize; size != 0 {
+		return size
+	}
+	return consensus.DefaultMaxProposalSize
+}
+
+// dialPeers keeps the node connected to its persistent peers.
+func (n *node) dialPeers(ctx context.Context) error {
+	ticker := time.NewTicker(dialInterval)
+	defer ticker.Stop()
+	for {
+		connected := make(map[algorithm.NodeID]bool)
+		for _, id := range n.transport.Peers() {
+			connected[id] = true
+		}
+		for id, addr := range n.peers {
+			if !connected[id] {
+				if _, err := n.transport.Dial(addr); err != nil {
+					n.log.Debug("failed to dial peer", "addr", addr, "err", err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// close stops the node accepting connections and requests.
+func (n *node) close() {
+	if n.transport != nil {
+		n.transport.Close()
+	}
+	if n.rpc != nil {
+		n.rpc.Close()
+	}
+}
+
+// status is the response to /status.
+type status struct {
+	ChainID     string `json:"chain_id"`
+	GenesisHash string `json:"genesis_hash"`
+	Height      uint64 `json:"height"`
+	AppHash     string `json:"app_hash"`
+}
+
+func (n *node) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", n.registry.Handler())
+	mux.HandleFunc("/broadcast_tx", func(w http.ResponseWriter, r *http.Request) {
+		tx := []byte(r.URL.Query().Get("tx"))
+		if r.Method == http.MethodPost {
+			var err error
+			if tx, err = io.ReadAll(io.LimitReader(r.Body, int64(n.maxProposalSize()))); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := n.mempool.CheckTx(tx); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	})
+	mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		v, ok := n.app.Query(r.URL.Query().Get("key"))
+		if !ok {
+			http.Error(w, "key not found", http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, v)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		appHash, genesisHash := n.app.AppHash(), n.genesis.Hash()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status{
+			ChainID:     n.genesis.ChainID,
+			GenesisHash: hex.EncodeToString(genesisHash[:]),
+			Height:      n.app.Height(),
+			AppHash:     hex.EncodeToString(appHash[:]),
+		})
+	})
+	return mux
+}
@@ -0,0 +1,42 @@
+package algorithm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// EncodedSize is the size in bytes of a binary encoded ConsensusMessage.
+const EncodedSize = 20 + 1 + 8 + 8 + 32 + 8
+
+// MarshalBinary encodes the message in a fixed size big endian format, the
+// encoding is deterministic so equal messages have equal encodings and
+// therefore equal hashes.
+func (cm *ConsensusMessage) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, EncodedSize)
+	b = append(b, cm.Sender[:]...)
+	b = append(b, byte(cm.MsgType))
+	b = binary.BigEndian.AppendUint64(b, cm.Height)
+	b = binary.BigEndian.AppendUint64(b, uint64(int64(cm.Round)))
+	b = append(b, cm.Value[:]...)
+	b = binary.BigEndian.AppendUint64(b, uint64(int64(cm.ValidRound)))
+	return b, nil
+}
+
+// UnmarshalBinary decodes a message encoded by MarshalBinary. It does not
+// validate the message, callers should call Validate on the result.
+func (cm *ConsensusMessage) UnmarshalBinary(b []byte) error {
+	if len(b) != EncodedSize {
+		return fmt.Errorf("encoded message has length %d, expected %d", len(b), EncodedSize)
+	}
+	copy(cm.Sender[:], b)
+	b = b[len(cm.Sender):]
+	cm.MsgType = Step(b[0])
+	b = b[1:]
+	cm.Height = binary.BigEndian.Uint64(b)
+	cm.Round = int(int64(binary.BigEndian.Uint64(b[8:])))
+	b = b[16:]
+	copy(cm.Value[:], b)
+	b = b[len(cm.Value):]
+	cm.ValidRound = int(int64(binary.BigEndian.Uint64(b)))
+	return nil
+}
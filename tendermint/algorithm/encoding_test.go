@@ -0,0 +1,27 @@
+package algorithm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	for _, m := range []*ConsensusMessage{
+		{Sender: newNodeID(t), MsgType: Propose, Height: 3, Round: 2, Value: newValue(t), ValidRound: -1},
+		{Sender: newNodeID(t), MsgType: Prevote, Height: 1 << 40, Round: 7, Value: NilValue},
+		{Sender: newNodeID(t), MsgType: Precommit, Height: 1, Round: 0, Value: newValue(t)},
+	} {
+		b, err := m.MarshalBinary()
+		require.NoError(t, err)
+		require.Len(t, b, EncodedSize)
+
+		var decoded ConsensusMessage
+		require.NoError(t, decoded.UnmarshalBinary(b))
+		assert.Equal(t, *m, decoded)
+	}
+
+	var m ConsensusMessage
+	assert.Error(t, m.UnmarshalBinary(make([]byte, EncodedSize-1)))
+}
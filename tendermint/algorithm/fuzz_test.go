@@ -0,0 +1,259 @@
+// Copyright (C) 2021 Clearmatics
+
+package algorithm
+
+import (
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const fuzzValidators = 4
+
+var (
+	fuzzValues  = []tendermint.Hash{NilValue, sha256.Sum256([]byte{1}), sha256.Sum256([]byte{2}), sha256.Sum256([]byte{3})}
+	fuzzInvalid = fuzzValues[3]
+)
+
+func fuzzValidator(i int) NodeID {
+	var id NodeID
+	id[0] = byte(i + 1)
+	return id
+}
+
+func fuzzProposer(round int) NodeID {
+	return fuzzValidator((round + 1) % fuzzValidators)
+}
+
+// decodeFuzzMessage decodes a message from the next 5 bytes of data. The
+// encoding is compact so that the fuzzer can easily find interesting
+// sequences, but it can still produce malformed messages with unknown steps,
+// negative rounds and out of range valid rounds.
+func decodeFuzzMessage(data []byte) *ConsensusMessage {
+	step := Step(data[1] % 4)
+	if data[1] >= 0xf0 {
+		step = Step(data[1])
+	}
+	return &ConsensusMessage{
+		// Validator 0 is the node under test, fuzzed messages come from
+		// the others.
+		Sender:     fuzzValidator(1 + int(data[0])%(fuzzValidators-1)),
+		MsgType:    step,
+		Height:     1,
+		Round:      int(int8(data[2])) / 16,
+		Value:      fuzzValues[data[3]%4],
+		ValidRound: int(int8(data[4])) / 16,
+	}
+}
+
+func fuzzSeeds(f *testing.F) {
+	f.Add([]byte{})
+	// A proposal from the round 0 proposer followed by prevotes and
+	// precommits for it from all the other validators.
+	f.Add([]byte{
+		0, 0, 0, 1, 0xf0,
+		0, 1, 0, 1, 0, 1, 1, 0, 1, 0, 2, 1, 0, 1, 0,
+		0, 2, 0, 1, 0, 1, 2, 0, 1, 0, 2, 2, 0, 1, 0,
+	})
+	// Equivocating votes and malformed messages.
+	f.Add([]byte{
+		0, 1, 0, 1, 0, 0, 1, 0, 2, 0, 0, 2, 0, 0, 0, 0, 2, 0, 3, 0,
+		0, 3, 0, 1, 0, 0, 0xff, 0, 1, 0, 0, 1, 0xf0, 1, 0, 0, 0, 0x10, 1, 0x20,
+	})
+	// Messages from future rounds.
+	f.Add([]byte{0, 1, 0x30, 0, 0, 1, 1, 0x30, 0, 0, 2, 2, 0x30, 0, 0})
+}
+
+// FuzzStoreAddMessage checks that the store accepts the first message from a
+// sender for a round and step, rejects conflicting messages and rejects
+// malformed messages without storing them.
+func FuzzStoreAddMessage(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(fuzzStore)
+}
+
+func fuzzStore(t *testing.T, data []byte) {
+	s := NewStore()
+	type key struct {
+		round  int
+		sender NodeID
+		step   Step
+	}
+	accepted := make(map[key]*ConsensusMessage)
+	proposals := make(map[int]*ConsensusMessage)
+	conflicting := make(map[ConsensusMessage]bool)
+	for ; len(data) >= 5; data = data[5:] {
+		m := decodeFuzzMessage(data)
+		senders := s.CountSenders(m.Round)
+		err := s.AddMessage(m, data[:5], messageHash(t, m))
+		if m.Validate() != nil {
+			require.Error(t, err)
+			assert.Equal(t, senders, s.CountSenders(m.Round))
+			continue
+		}
+		if m.MsgType == Propose {
+			first, ok := proposals[m.Round]
+			if !ok {
+				require.NoError(t, err)
+				proposals[m.Round] = m
+			} else if !conflicting[*m] {
+				// The first time we see a conflicting proposal it is
+				// reported, after that it is treated as a duplicate.
+				assert.Equal(t, *first != *m, err != nil, "%v then %v", first, m)
+				conflicting[*m] = *first != *m
+			}
+			require.NotNil(t, s.MatchingProposal(m.Round, m.Value))
+			assert.Equal(t, m.Value, s.MatchingProposal(m.Round, m.Value).Value)
+			continue
+		}
+		k := key{m.Round, m.Sender, m.MsgType}
+		first, ok := accepted[k]
+		if !ok {
+			require.NoError(t, err)
+			accepted[k] = m
+			continue
+		}
+		assert.Equal(t, *first != *m, err != nil, "%v then %v", first, m)
+	}
+
+	// Counts reflect only the first message from each sender.
+	for k, m := range accepted {
+		var prevotes, precommits int
+		for other, om := range accepted {
+			if other.round != k.round || om.Value != m.Value {
+				continue
+			}
+			if other.step == Prevote {
+				prevotes++
+			} else {
+				precommits++
+			}
+		}
+		assert.Equal(t, prevotes, s.CountPrevotes(k.round, &m.Value))
+		assert.Equal(t, precommits, s.CountPrecommits(k.round, &m.Value))
+	}
+}
+
+// fuzzNode drives a single Algorithm in the way a real node would.
+type fuzzNode struct {
+	t        *testing.T
+	id       NodeID
+	store    *Store
+	algo     *Algorithm
+	timeouts []*Timeout
+	sent     map[[2]int]*ConsensusMessage
+	decided  bool
+}
+
+func (n *fuzzNode) startRound(round int) {
+	value := NilValue
+	if fuzzProposer(round) == n.id {
+		value = fuzzValues[1+round%2]
+	}
+	n.transition(func() (*RoundChange, *ConsensusMessage, *Timeout) {
+		cm, to := n.algo.StartRound(value, round)
+		return nil, cm, to
+	})
+}
+
+func (n *fuzzNode) receive(m *ConsensusMessage) {
+	if m.MsgType == Propose && m.Sender != fuzzProposer(m.Round) {
+		return
+	}
+	if m.MsgType == Propose && m.Value != fuzzInvalid {
+		n.store.SetValid(&m.Value)
+	}
+	if err := n.store.AddMessage(m, nil, messageHash(n.t, m)); err != nil && !errors.Is(err, ErrConflictingProposal) {
+		return
+	}
+	n.transition(func() (*RoundChange, *ConsensusMessage, *Timeout) {
+		return n.algo.ReceiveMessage(m)
+	})
+}
+
+func (n *fuzzNode) timeout(i int) {
+	if len(n.timeouts) == 0 {
+		return
+	}
+	i %= len(n.timeouts)
+	to := n.timeouts[i]
+	n.timeouts = append(n.timeouts[:i], n.timeouts[i+1:]...)
+	n.transition(func() (*RoundChange, *ConsensusMessage, *Timeout) {
+		cm, rc := n.algo.OnTimeout(to)
+		return rc, cm, nil
+	})
+}
+
+// transition executes f, which should call one of the algorithm's methods,
+// checks the algorithm's invariants across the resulting state change and
+// then handles the output.
+func (n *fuzzNode) transition(f func() (*RoundChange, *ConsensusMessage, *Timeout)) {
+	before := n.algo.State()
+	rc, cm, to := f()
+	after := n.algo.State()
+	require.GreaterOrEqual(n.t, after.Round, before.Round)
+	if after.Round == before.Round {
+		require.GreaterOrEqual(n.t, after.Step, before.Step, "step went backwards in round %d", after.Round)
+	}
+	require.LessOrEqual(n.t, after.LockedRound, after.Round)
+	require.LessOrEqual(n.t, after.ValidRound, after.Round)
+	require.LessOrEqual(n.t, after.LockedRound, after.ValidRound)
+
+	if to != nil {
+		n.timeouts = append(n.timeouts, to)
+	}
+	if cm != nil {
+		// We never sign two different messages for the same round and step.
+		k := [2]int{cm.Round, int(cm.MsgType)}
+		if prev, ok := n.sent[k]; ok {
+			require.Equal(n.t, prev, cm, "equivocated")
+		}
+		n.sent[k] = cm
+		require.NoError(n.t, n.store.AddMessage(cm, nil, messageHash(n.t, cm)))
+		n.transition(func() (*RoundChange, *ConsensusMessage, *Timeout) {
+			return n.algo.ReceiveMessage(cm)
+		})
+	}
+	if rc != nil {
+		if rc.Decision != nil {
+			require.NotEqual(n.t, fuzzInvalid, rc.Decision.Value, "decided an invalid value")
+			n.decided = true
+			return
+		}
+		n.startRound(rc.Round)
+	}
+}
+
+// FuzzReceiveMessage feeds arbitrary sequences of messages and timeouts into
+// an Algorithm backed by a Store and BasicOracle and checks that it neither
+// panics nor breaks its invariants.
+func FuzzReceiveMessage(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(fuzzReceive)
+}
+
+func fuzzReceive(t *testing.T, data []byte) {
+	s := NewStore()
+	n := &fuzzNode{
+		t:     t,
+		id:    fuzzValidator(0),
+		store: s,
+		algo:  New(fuzzValidator(0), NewBasicOracle(fuzzValidators, 1, s)),
+		sent:  make(map[[2]int]*ConsensusMessage),
+	}
+	n.startRound(0)
+	for len(data) >= 5 && !n.decided {
+		// A leading byte with the top bits set fires a timeout.
+		if data[0] >= 0xe0 {
+			n.timeout(int(data[1]))
+			data = data[2:]
+			continue
+		}
+		n.receive(decodeFuzzMessage(data))
+		data = data[5:]
+	}
+}
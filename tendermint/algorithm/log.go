@@ -0,0 +1,72 @@
+package algorithm
+
+// Logger records the upon rules that the Algorithm executes, args are
+// alternating keys and values. A *slog.Logger satisfies it.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Level is the level at which the Algorithm logs.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// SetLogger makes the Algorithm log the upon rules it executes to l at the
+// given level, messages that match no rule are logged at LevelDebug. A nil l
+// disables logging, which is the default, in which case logging costs
+// nothing.
+func (a *Algorithm) SetLogger(l Logger, level Level) {
+	a.logger = l
+	a.level = level
+}
+
+// logRule logs that the upon rule of the given whitepaper line was executed
+// in the given step on receipt of cm, outcome summarises the result. cm is
+// nil for rules executed on starting a round or on a timeout.
+func (a *Algorithm) logRule(line int, step Step, cm *ConsensusMessage, outcome string) {
+	if a.logger == nil {
+		return
+	}
+	if cm == nil {
+		a.log(a.level, "upon rule", step, "line", line, "outcome", outcome)
+		return
+	}
+	a.log(a.level, "upon rule", step, "line", line, "outcome", outcome, "msg", cm)
+}
+
+func (a *Algorithm) log(level Level, msg string, step Step, args ...any) {
+	args = append([]any{"node", a.nodeID.String(), "height", a.height(), "round", a.round, "step", step.String()}, args...)
+	switch level {
+	case LevelDebug:
+		a.logger.Debug(msg, args...)
+	case LevelInfo:
+		a.logger.Info(msg, args...)
+	case LevelWarn:
+		a.logger.Warn(msg, args...)
+	default:
+		a.logger.Error(msg, args...)
+	}
+}
@@ -0,0 +1,91 @@
+package algorithm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type logRecord struct {
+	level Level
+	msg   string
+	attrs map[string]any
+}
+
+type recordingLogger struct {
+	records []logRecord
+}
+
+func (l *recordingLogger) record(level Level, msg string, args []any) {
+	attrs := make(map[string]any)
+	for i := 0; i+1 < len(args); i += 2 {
+		attrs[args[i].(string)] = args[i+1]
+	}
+	l.records = append(l.records, logRecord{level, msg, attrs})
+}
+
+func (l *recordingLogger) Debug(msg string, args ...any) { l.record(LevelDebug, msg, args) }
+func (l *recordingLogger) Info(msg string, args ...any)  { l.record(LevelInfo, msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...any)  { l.record(LevelWarn, msg, args) }
+func (l *recordingLogger) Error(msg string, args ...any) { l.record(LevelError, msg, args) }
+
+func TestLogsUponRules(t *testing.T) {
+	value := newValue(t)
+	nodeID := newNodeID(t)
+	s := NewStore()
+	o := NewBasicOracle(2, 1, s)
+	algo := New(nodeID, o)
+	l := &recordingLogger{}
+	algo.SetLogger(l, LevelInfo)
+
+	add := func(m *ConsensusMessage) *ConsensusMessage {
+		require.NoError(t, s.AddMessage(m, nil, messageHash(t, m)))
+		return m
+	}
+	proposal, _ := algo.StartRound(value, 0)
+	add(proposal)
+	s.SetValid(&value)
+	_, prevote, _ := algo.ReceiveMessage(proposal)
+	algo.ReceiveMessage(add(prevote))
+	_, precommit, _ := algo.ReceiveMessage(add(&ConsensusMessage{Sender: newNodeID(t), MsgType: Prevote, Height: 1, Value: value}))
+	algo.ReceiveMessage(add(precommit))
+	rc, _, _ := algo.ReceiveMessage(add(&ConsensusMessage{Sender: newNodeID(t), MsgType: Precommit, Height: 1, Value: value}))
+	require.NotNil(t, rc.Decision)
+
+	// Messages that match no rule are logged at debug level.
+	var lines []any
+	var levels []Level
+	for _, r := range l.records {
+		lines = append(lines, r.attrs["line"])
+		levels = append(levels, r.level)
+	}
+	assert.Equal(t, []any{14, 22, nil, 36, nil, 49}, lines)
+	assert.Equal(t, []Level{LevelInfo, LevelInfo, LevelDebug, LevelInfo, LevelDebug, LevelInfo}, levels)
+
+	r := l.records[1]
+	assert.Equal(t, "upon rule", r.msg)
+	assert.Equal(t, map[string]any{
+		"node":    nodeID.String(),
+		"height":  uint64(1),
+		"round":   0,
+		"step":    "Propose",
+		"line":    22,
+		"outcome": "val",
+		"msg":     proposal,
+	}, r.attrs)
+	assert.Equal(t, "Prevote", l.records[3].attrs["step"])
+}
+
+func TestLoggingDisabledDoesNotAllocate(t *testing.T) {
+	s := NewStore()
+	o := NewBasicOracle(4, 1, s)
+	algo := New(newNodeID(t), o)
+	algo.StartRound(NilValue, 0)
+	prevote := &ConsensusMessage{Sender: newNodeID(t), MsgType: Prevote, Height: 1, Value: newValue(t)}
+	require.NoError(t, s.AddMessage(prevote, nil, messageHash(t, prevote)))
+	allocs := testing.AllocsPerRun(100, func() {
+		algo.ReceiveMessage(prevote)
+	})
+	assert.Zero(t, allocs)
+}
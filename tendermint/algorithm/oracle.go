@@ -18,8 +18,10 @@ func NewBasicOracle(numValidators int, height uint64, store *Store) *BasicOracle
 	}
 }
 
+// FThresh returns true if more than f distinct nodes have sent a message for
+// the given round (line 55).
 func (b *BasicOracle) FThresh(round int) bool {
-	return b.store.CountFailures(round) > b.numValidators/3
+	return b.store.CountSenders(round) > b.numValidators/3
 }
 
 func (b *BasicOracle) Height() uint64 {
@@ -30,6 +32,11 @@ func (b *BasicOracle) MatchingProposal(round int, valueHash *tendermint.Hash) *C
 	return b.store.MatchingProposal(round, *valueHash)
 }
 
+// Proposals implements ProposalOracle.
+func (b *BasicOracle) Proposals(round int) []*ConsensusMessage {
+	return b.store.Proposals(round)
+}
+
 func (b *BasicOracle) PrecommitQThresh(round int, valueHash *tendermint.Hash) bool {
 	return b.store.CountPrecommits(round, valueHash) >= (b.numValidators*2/3)+1
 }
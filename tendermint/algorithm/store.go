@@ -1,26 +1,56 @@
 package algorithm
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/piersy/tendermint-go/tendermint"
 )
 
+// ErrConflictingProposal is returned by AddMessage when a proposal conflicts
+// with one already held for the same round. Unlike other equivocations the
+// proposal is still stored, and callers should still pass it to
+// ReceiveMessage, since the upon rules of the whitepaper apply to every
+// proposal received from the proposer.
+var ErrConflictingProposal = errors.New("conflicting proposal")
+
+// ErrEquivocation is returned by AddMessage when a vote conflicts with one
+// already held from the same sender for the same round and step, or when a
+// sender has already had maxConflictingProposals conflicting proposals
+// stored for the round. The message is not stored.
+var ErrEquivocation = errors.New("equivocation")
+
+// maxConflictingProposals bounds the conflicting proposals stored per sender
+// and round, so that an equivocating proposer cannot grow the store without
+// bound. One is enough to hold the proposal of a value that the network
+// decides on in place of the first one we received.
+const maxConflictingProposals = 1
+
 type Store struct {
 	// Messages is a map of arrays one per node, with the 0 element holding the
 	// prevote and the 1 element holding the precommit.
-	proposals  map[int]*ConsensusMessage
-	messages   map[int]map[NodeID][2]*ConsensusMessage
-	msgByHash  map[tendermint.Hash][]byte
-	validValue map[*tendermint.Hash]struct{}
+	proposals map[int]*ConsensusMessage
+	// conflicting holds proposals that conflict with the first proposal
+	// received for a round, they are kept so that if the network decides on
+	// one of them we are still able to find the matching proposal.
+	conflicting map[int][]*ConsensusMessage
+	messages    map[int]map[NodeID][2]*ConsensusMessage
+	msgByHash   map[tendermint.Hash][]byte
+	// raw holds the raw bytes that each stored message was added with.
+	raw        map[*ConsensusMessage][]byte
+	validValue map[tendermint.Hash]struct{}
 }
 
 func NewStore() *Store {
 	return &Store{
-		proposals:  make(map[int]*ConsensusMessage),
-		messages:   make(map[int]map[NodeID][2]*ConsensusMessage),
-		msgByHash:  make(map[tendermint.Hash][]byte),
-		validValue: make(map[*tendermint.Hash]struct{}),
+		proposals:   make(map[int]*ConsensusMessage),
+		conflicting: make(map[int][]*ConsensusMessage),
+		messages:    make(map[int]map[NodeID][2]*ConsensusMessage),
+		msgByHash:   make(map[tendermint.Hash][]byte),
+		raw:         make(map[*ConsensusMessage][]byte),
+		validValue:  make(map[tendermint.Hash]struct{}),
 	}
 }
 
@@ -30,7 +60,13 @@ func NewStore() *Store {
 // position that they have already sent a message for. E.G. Proposer sending 2
 // differetn propose messages or any node sending 2 different prevote or
 // precommit messages.
+//
+// Malformed messages (see ConsensusMessage.Validate) are rejected with an
+// error and not stored.
 func (s *Store) AddMessage(m *ConsensusMessage, raw []byte, hash tendermint.Hash) error {
+	if err := m.Validate(); err != nil {
+		return fmt.Errorf("invalid message: %w", err)
+	}
 	_, ok := s.msgByHash[hash]
 	if ok {
 		// We received duplicate message from network, ignore.
@@ -47,17 +83,23 @@ func (s *Store) AddMessage(m *ConsensusMessage, raw []byte, hash tendermint.Hash
 	switch m.MsgType {
 	case Propose:
 		if s.proposals[m.Round] != nil {
-			return fmt.Errorf("equivocation detected received %v & %v", s.proposals[m.Round], m)
+			if s.countConflicting(m.Round, m.Sender) >= maxConflictingProposals {
+				return fmt.Errorf("%w, too many conflicting proposals received %v", ErrEquivocation, m)
+			}
+			s.conflicting[m.Round] = append(s.conflicting[m.Round], m)
+			s.msgByHash[hash] = raw
+			s.raw[m] = raw
+			return fmt.Errorf("%w, equivocation detected received %v & %v", ErrConflictingProposal, s.proposals[m.Round], m)
 		}
 		s.proposals[m.Round] = m
 	case Prevote:
 		if msgs[0] != nil {
-			return fmt.Errorf("equivocation detected received %v & %v", msgs[0], m)
+			return fmt.Errorf("%w detected received %v & %v", ErrEquivocation, msgs[0], m)
 		}
 		msgs[0] = m
 	case Precommit:
 		if msgs[1] != nil {
-			return fmt.Errorf("equivocation detected received %v & %v", msgs[1], m)
+			return fmt.Errorf("%w detected received %v & %v", ErrEquivocation, msgs[1], m)
 		}
 		msgs[1] = m
 	}
@@ -65,29 +107,70 @@ func (s *Store) AddMessage(m *ConsensusMessage, raw []byte, hash tendermint.Hash
 
 	// Store raw message by hash
 	s.msgByHash[hash] = raw
+	s.raw[m] = raw
 	return nil
 }
 
+// countConflicting returns the number of conflicting proposals stored from
+// sender for round.
+func (s *Store) countConflicting(round int, sender NodeID) int {
+	count := 0
+	for _, m := range s.conflicting[round] {
+		if m.Sender == sender {
+			count++
+		}
+	}
+	return count
+}
+
+// Raw returns the raw bytes that m was added with, m must be a message
+// returned by the store.
+func (s *Store) Raw(m *ConsensusMessage) []byte {
+	return s.raw[m]
+}
+
+// Has returns true if a message with the given hash has been added.
+func (s *Store) Has(hash tendermint.Hash) bool {
+	_, ok := s.msgByHash[hash]
+	return ok
+}
+
 // SetValid sets the given value hash as valid.
 func (s *Store) SetValid(valueHash *tendermint.Hash) {
-	s.validValue[valueHash] = struct{}{}
+	s.validValue[*valueHash] = struct{}{}
 }
 
 // Valid checks the given value hash to see if it has been marked valid.
 func (s *Store) Valid(valueHash *tendermint.Hash) bool {
-	_, ok := s.validValue[valueHash]
+	_, ok := s.validValue[*valueHash]
 	return ok
 }
 
 // Returns a proposal for the given round & valueHash or nil if none exists.
+// Conflicting proposals are considered if the first proposal does not match.
 func (s *Store) MatchingProposal(round int, valueHash tendermint.Hash) *ConsensusMessage {
 	proposal := s.proposals[round]
 	if proposal != nil && proposal.Value == valueHash {
 		return proposal
 	}
+	for _, p := range s.conflicting[round] {
+		if p.Value == valueHash {
+			return p
+		}
+	}
 	return nil
 }
 
+// Proposals returns the proposal for the given round followed by any
+// conflicting proposals.
+func (s *Store) Proposals(round int) []*ConsensusMessage {
+	var result []*ConsensusMessage
+	if p := s.proposals[round]; p != nil {
+		result = append(result, p)
+	}
+	return append(result, s.conflicting[round]...)
+}
+
 // CountPrevotes returns true if a there is a quorum of prevotes for valueHash.
 // Passing nil as the valueHash acts as a wildcard and will cause all prevotes
 // for the round to be counted.
@@ -114,6 +197,35 @@ func (s *Store) CountPrecommits(round int, valueHash *tendermint.Hash) int {
 	return result
 }
 
+// CountSenders counts the number of distinct nodes that have sent any message
+// for the given round.
+func (s *Store) CountSenders(round int) int {
+	return len(s.messages[round])
+}
+
+// RoundMessages returns all the messages held for the given round, the
+// proposal (if any) comes first followed by any conflicting proposals, the
+// prevotes and then the precommits. Votes of the same type are ordered by
+// sender.
+func (s *Store) RoundMessages(round int) []*ConsensusMessage {
+	result := s.Proposals(round)
+	senders := make([]NodeID, 0, len(s.messages[round]))
+	for sender := range s.messages[round] {
+		senders = append(senders, sender)
+	}
+	sort.Slice(senders, func(i, j int) bool {
+		return bytes.Compare(senders[i][:], senders[j][:]) < 0
+	})
+	for i := 0; i < 2; i++ {
+		for _, sender := range senders {
+			if m := s.messages[round][sender][i]; m != nil {
+				result = append(result, m)
+			}
+		}
+	}
+	return result
+}
+
 // CountAll counts the number of precommit and prevote messages for the given round voting for NilValue
 func (s *Store) CountFailures(round int) int {
 	result := 0
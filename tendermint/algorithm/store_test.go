@@ -0,0 +1,157 @@
+// Copyright (C) 2021 Clearmatics
+
+package algorithm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreEquivocation(t *testing.T) {
+	var height uint64 = 1
+	sender := newNodeID(t)
+	value := newValue(t)
+	other := newValue(t)
+
+	for _, step := range []Step{Propose, Prevote, Precommit} {
+		t.Run(step.String(), func(t *testing.T) {
+			s := NewStore()
+			first := &ConsensusMessage{
+				Sender:     sender,
+				MsgType:    step,
+				Height:     height,
+				Round:      0,
+				Value:      value,
+				ValidRound: -1,
+			}
+			assert.False(t, s.Has(messageHash(t, first)))
+			require.NoError(t, s.AddMessage(first, nil, messageHash(t, first)))
+			assert.True(t, s.Has(messageHash(t, first)))
+
+			// Adding the same message again is not equivocation.
+			require.NoError(t, s.AddMessage(first, nil, messageHash(t, first)))
+
+			// A message for a different value in the same round is.
+			equivocation := ErrEquivocation
+			if step == Propose {
+				equivocation = ErrConflictingProposal
+			}
+			second := *first
+			second.Value = other
+			assert.ErrorIs(t, s.AddMessage(&second, nil, messageHash(t, &second)), equivocation)
+
+			// So is a nil vote after a vote for a value, a further
+			// conflicting proposal is rejected like an equivocating vote.
+			third := *first
+			third.Value = NilValue
+			assert.ErrorIs(t, s.AddMessage(&third, nil, messageHash(t, &third)), ErrEquivocation)
+
+			// The same message in a different round is fine.
+			fourth := *first
+			fourth.Round = 1
+			assert.NoError(t, s.AddMessage(&fourth, nil, messageHash(t, &fourth)))
+		})
+	}
+}
+
+func TestStoreKeepsConflictingProposals(t *testing.T) {
+	s := NewStore()
+	proposer := newNodeID(t)
+	first := &ConsensusMessage{Sender: proposer, MsgType: Propose, Height: 1, Round: 0, Value: newValue(t), ValidRound: -1}
+	second := &ConsensusMessage{Sender: proposer, MsgType: Propose, Height: 1, Round: 0, Value: newValue(t), ValidRound: -1}
+	require.NoError(t, s.AddMessage(first, []byte("first"), messageHash(t, first)))
+	assert.Error(t, s.AddMessage(second, []byte("second"), messageHash(t, second)))
+	assert.Equal(t, []byte("first"), s.Raw(first))
+	assert.Equal(t, []byte("second"), s.Raw(second))
+
+	// The network may decide on either proposal so both must be retrievable.
+	assert.Equal(t, first, s.MatchingProposal(0, first.Value))
+	assert.Equal(t, second, s.MatchingProposal(0, second.Value))
+	assert.Equal(t, []*ConsensusMessage{first, second}, s.RoundMessages(0))
+
+	// Further conflicting proposals from the same proposer are not stored.
+	third := &ConsensusMessage{Sender: proposer, MsgType: Propose, Height: 1, Round: 0, Value: newValue(t), ValidRound: -1}
+	assert.ErrorIs(t, s.AddMessage(third, []byte("third"), messageHash(t, third)), ErrEquivocation)
+	assert.False(t, s.Has(messageHash(t, third)))
+	assert.Nil(t, s.MatchingProposal(0, third.Value))
+	assert.Equal(t, []*ConsensusMessage{first, second}, s.RoundMessages(0))
+}
+
+func TestStoreDistinctStepsAreNotEquivocation(t *testing.T) {
+	s := NewStore()
+	sender := newNodeID(t)
+	value := newValue(t)
+	prevote := &ConsensusMessage{Sender: sender, MsgType: Prevote, Height: 1, Round: 0, Value: value}
+	precommit := &ConsensusMessage{Sender: sender, MsgType: Precommit, Height: 1, Round: 0, Value: NilValue}
+	require.NoError(t, s.AddMessage(prevote, nil, messageHash(t, prevote)))
+	require.NoError(t, s.AddMessage(precommit, nil, messageHash(t, precommit)))
+
+	assert.Equal(t, 1, s.CountPrevotes(0, &value))
+	assert.Equal(t, 0, s.CountPrecommits(0, &value))
+	assert.Equal(t, 1, s.CountPrecommits(0, &NilValue))
+	assert.Equal(t, 1, s.CountFailures(0))
+	assert.Equal(t, 1, s.CountSenders(0))
+}
+
+func TestStoreCounting(t *testing.T) {
+	s := NewStore()
+	value := newValue(t)
+	for i := 0; i < 3; i++ {
+		m := &ConsensusMessage{Sender: newNodeID(t), MsgType: Prevote, Height: 1, Round: 2, Value: value}
+		require.NoError(t, s.AddMessage(m, nil, messageHash(t, m)))
+	}
+	m := &ConsensusMessage{Sender: newNodeID(t), MsgType: Prevote, Height: 1, Round: 2, Value: NilValue}
+	require.NoError(t, s.AddMessage(m, nil, messageHash(t, m)))
+
+	assert.Equal(t, 3, s.CountPrevotes(2, &value))
+	assert.Equal(t, 1, s.CountPrevotes(2, &NilValue))
+	assert.Equal(t, 4, s.CountPrevotes(2, nil))
+	assert.Equal(t, 0, s.CountPrevotes(1, nil))
+	assert.Equal(t, 4, s.CountSenders(2))
+	assert.Len(t, s.RoundMessages(2), 4)
+}
+
+func TestStoreValid(t *testing.T) {
+	s := NewStore()
+	value := newValue(t)
+	assert.False(t, s.Valid(&value))
+
+	// Validity is a property of the value, not of the pointer used to set it.
+	s.SetValid(&value)
+	copied := value
+	assert.True(t, s.Valid(&copied))
+}
+
+func TestStoreMatchingProposal(t *testing.T) {
+	s := NewStore()
+	value := newValue(t)
+	p := &ConsensusMessage{Sender: newNodeID(t), MsgType: Propose, Height: 1, Round: 3, Value: value, ValidRound: -1}
+	require.NoError(t, s.AddMessage(p, nil, messageHash(t, p)))
+
+	assert.Equal(t, p, s.MatchingProposal(3, value))
+	assert.Nil(t, s.MatchingProposal(2, value))
+	assert.Nil(t, s.MatchingProposal(3, newValue(t)))
+	assert.Equal(t, []*ConsensusMessage{p}, s.RoundMessages(3))
+}
+
+func TestStoreRejectsMalformedMessages(t *testing.T) {
+	valid := ConsensusMessage{Sender: newNodeID(t), MsgType: Propose, Height: 1, Round: 1, Value: newValue(t), ValidRound: 0}
+	require.NoError(t, valid.Validate())
+
+	for name, mutate := range map[string]func(m *ConsensusMessage){
+		"unknown step":         func(m *ConsensusMessage) { m.MsgType = 3 },
+		"negative round":       func(m *ConsensusMessage) { m.Round = -1 },
+		"valid round too low":  func(m *ConsensusMessage) { m.ValidRound = -2 },
+		"valid round too high": func(m *ConsensusMessage) { m.ValidRound = m.Round },
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := valid
+			mutate(&m)
+			s := NewStore()
+			assert.Error(t, s.AddMessage(&m, nil, messageHash(t, &m)))
+			assert.Equal(t, 0, s.CountSenders(m.Round))
+		})
+	}
+}
@@ -88,6 +88,21 @@ type Timeout struct {
 	round       int
 }
 
+// Type returns the step that the timeout was scheduled for.
+func (t *Timeout) Type() Step {
+	return t.timeoutType
+}
+
+// Height returns the height that the timeout was scheduled at.
+func (t *Timeout) Height() uint64 {
+	return t.height
+}
+
+// Round returns the round that the timeout was scheduled in.
+func (t *Timeout) Round() int {
+	return t.round
+}
+
 // ConsensusMessage is returned to the caller to indicate that this message
 // should be broadcast to the network.
 type ConsensusMessage struct {
@@ -107,6 +122,22 @@ func (cm *ConsensusMessage) String() string {
 	return fmt.Sprintf("s:%-3s h:%-3d r:%-3d v:%-6s%s", cm.MsgType.ShortString(), cm.Height, cm.Round, cm.Value.String(), vr)
 }
 
+// Validate checks that the message is well formed, messages received from the
+// network must be validated before being passed to any other method since
+// the algorithm assumes a known step and non negative rounds.
+func (cm *ConsensusMessage) Validate() error {
+	if !cm.MsgType.In(Propose, Prevote, Precommit) {
+		return fmt.Errorf("unrecognised step value %d", cm.MsgType)
+	}
+	if cm.Round < 0 {
+		return fmt.Errorf("negative round %d", cm.Round)
+	}
+	if cm.MsgType == Propose && (cm.ValidRound < -1 || cm.ValidRound >= cm.Round) {
+		return fmt.Errorf("proposal valid round %d outside of [-1, %d)", cm.ValidRound, cm.Round)
+	}
+	return nil
+}
+
 // Oracle is used to answer questions the algorithm may have about its
 // state, such as 'Am I the proposer' or 'Have i reached prevote quorum
 // threshold for value with id v?'
@@ -127,6 +158,20 @@ type Oracle interface {
 	Height() uint64
 }
 
+// ProposalOracle is an Oracle that can also list the proposals received for a
+// round. It is optional, when the Oracle passed to New implements it the upon
+// rules of lines 28 and 36 consider every proposal of the round, as the
+// whitepaper requires should the proposer equivocate. Otherwise only the
+// proposal that MatchingProposal returns for the value of the message being
+// received is considered, so a rule that is enabled by a proposal other than
+// that one, or by our own step changing, is missed.
+type ProposalOracle interface {
+	Oracle
+	// Proposals returns all the Proposal messages received for the given
+	// round, there can be more than one if the proposer equivocated.
+	Proposals(round int) []*ConsensusMessage
+}
+
 // Algorithm implements the state transitions defined by the tendermint
 // whitepaper. There are 2 main functions, StartRound which is called at the
 // beginning of each round, and then ReceiveMessage which is called with each
@@ -143,6 +188,8 @@ type Algorithm struct {
 	line36Executed bool
 	line47Executed bool
 	oracle         Oracle
+	logger         Logger
+	level          Level
 }
 
 // New creates a new instance of Algorithm.
@@ -160,6 +207,44 @@ func New(nodeID NodeID, oracle Oracle) *Algorithm {
 	}
 }
 
+// State is a snapshot of the internal state of an Algorithm, it is intended
+// for testing and debugging.
+type State struct {
+	Round          int
+	Step           Step
+	LockedRound    int
+	LockedValue    tendermint.Hash
+	ValidRound     int
+	ValidValue     tendermint.Hash
+	Line34Executed bool
+	Line36Executed bool
+	Line47Executed bool
+}
+
+// State returns a snapshot of the algorithm's current state.
+func (a *Algorithm) State() State {
+	return State{
+		Round:          a.round,
+		Step:           a.step,
+		LockedRound:    a.lockedRound,
+		LockedValue:    a.lockedValue,
+		ValidRound:     a.validRound,
+		ValidValue:     a.validValue,
+		Line34Executed: a.line34Executed,
+		Line36Executed: a.line36Executed,
+		Line47Executed: a.line47Executed,
+	}
+}
+
+// Clone returns a copy of the algorithm that consults the given oracle, the
+// oracle should answer in the same way as the original's oracle for the
+// copy to behave identically.
+func (a *Algorithm) Clone(oracle Oracle) *Algorithm {
+	c := *a
+	c.oracle = oracle
+	return &c
+}
+
 func (a Algorithm) height() uint64 {
 	return a.oracle.Height()
 }
@@ -195,8 +280,6 @@ func (a *Algorithm) timeout(timeoutType Step) *Timeout {
 // proposal ConsensusMessage to be broadcast, otherwise it returns a Timeout to
 // be scheduled.
 func (a *Algorithm) StartRound(proposalValue tendermint.Hash, round int) (*ConsensusMessage, *Timeout) {
-	// println(a.nodeID.String(), height, "isproposer", a.oracle.Proposer(round, a.nodeID))
-
 	// sanity check
 	if round <= a.round {
 		panic(fmt.Sprintf("New round must be more than the current round. Previous round: %-3d, new round: %-3d", a.round, round))
@@ -213,9 +296,12 @@ func (a *Algorithm) StartRound(proposalValue tendermint.Hash, round int) (*Conse
 		if a.validValue != NilValue {
 			proposalValue = a.validValue
 		}
-		// println(a.nodeID.String(), a.height(), "returning message", value.String())
+		// Line 14
+		a.logRule(14, Propose, nil, "propose")
 		return a.msg(Propose, proposalValue), nil
 	} else { //nolint
+		// Line 21
+		a.logRule(21, Propose, nil, "timeout")
 		return nil, a.timeout(Propose)
 	}
 }
@@ -252,9 +338,14 @@ func (a *Algorithm) ReceiveMessage(cm *ConsensusMessage) (*RoundChange, *Consens
 	o := a.oracle
 	t := cm.MsgType
 
-	// look up matching proposal, in the case of ost message with msgType
-	// proposal the matching proposal is the message.
-	p := o.MatchingProposal(cm.Round, &cm.Value)
+	// look up matching proposal, in the case of a message with msgType
+	// proposal the matching proposal is the message, looking it up by value
+	// could return a different proposal for the same value with a different
+	// valid round.
+	p := cm
+	if t != Propose {
+		p = o.MatchingProposal(cm.Round, &cm.Value)
+	}
 
 	// Some of the checks in these upon conditions are omitted because they have already been checked.
 	//
@@ -276,97 +367,182 @@ func (a *Algorithm) ReceiveMessage(cm *ConsensusMessage) (*RoundChange, *Consens
 	// may have been met. This approach will hopefully go someway to cutting
 	// down unnecessary network traffic between nodes.
 
+	// Line 49, a decision supersedes every other outcome at this height so
+	// it is checked first. As in the whitepaper the value must be valid, a
+	// quorum of precommits for an invalid value, which only a Byzantine
+	// quorum could produce, is not decided on.
+	if t.In(Propose, Precommit) && p != nil && o.PrecommitQThresh(p.Round, &p.Value) && o.Valid(&p.Value) {
+		a.lockedRound = -1
+		a.lockedValue = NilValue
+		a.validRound = -1
+		a.validValue = NilValue
+		a.logRule(49, s, cm, "decide")
+		// Return the decided proposal
+		return &RoundChange{Round: 0, Decision: p}, nil, nil
+	}
+
 	// Line 22
 	if t.In(Propose) && cm.Round == r && cm.ValidRound == -1 && s == Propose {
 		a.step = Prevote
-		if o.Valid(&cm.Value) && a.lockedRound == -1 || a.lockedValue == cm.Value {
-			// println(a.nodeID.String(), a.height(), cm.String(), "line 22 val")
+		if o.Valid(&cm.Value) && (a.lockedRound == -1 || a.lockedValue == cm.Value) {
+			a.logRule(22, s, cm, "val")
 			return nil, a.msg(Prevote, cm.Value), nil
 		} else { //nolint
-			// println(a.nodeID.String(), a.height(), cm.String(), "line 22 nil")
+			a.logRule(22, s, cm, "nil")
 			return nil, a.msg(Prevote, NilValue), nil
 		}
 	}
 
 	// Line 28
-	if t.In(Propose, Prevote) && p != nil && p.Round == r && o.PrevoteQThresh(p.ValidRound, &p.Value) && s == Propose && (p.ValidRound >= 0 && p.ValidRound < r) {
+	if p28 := a.line28Proposal(cm, p); p28 != nil {
+		p := p28
 		a.step = Prevote
 		if o.Valid(&p.Value) && (a.lockedRound <= p.ValidRound || a.lockedValue == p.Value) {
-			// println(a.nodeID.String(), a.height(), cm.String(), "line 28 val")
+			a.logRule(28, s, cm, "val")
 			return nil, a.msg(Prevote, p.Value), nil
 		} else { //nolint
-			// println(a.nodeID.String(), a.height(), cm.String(), "line 28 nil")
+			a.logRule(28, s, cm, "nil")
 			return nil, a.msg(Prevote, NilValue), nil
 		}
 	}
 
-	////println(a.nodeId.String(), a.height(), t.In(Propose, Prevote), p != nil, p.Round == r, o.PrevoteQThresh(r, &p.Value), o.Valid(p.Value), s >= Prevote, !a.line36Executed)
 	// Line 36
-	if t.In(Propose, Prevote) && p != nil && p.Round == r && o.PrevoteQThresh(r, &p.Value) && o.Valid(&p.Value) && s >= Prevote && !a.line36Executed {
+	if p36 := a.line36Proposal(cm, p); p36 != nil {
+		p := p36
 		a.line36Executed = true
+		a.validValue = p.Value
+		a.validRound = r
+		// We only precommit if we have not already precommitted this round,
+		// otherwise we would equivocate.
 		if s == Prevote {
 			a.lockedValue = p.Value
 			a.lockedRound = r
 			a.step = Precommit
+			a.logRule(36, s, cm, "val")
+			return nil, a.msg(Precommit, p.Value), nil
 		}
-		a.validValue = p.Value
-		a.validRound = r
-		// println(a.nodeID.String(), a.height(), cm.String(), "line 36 val")
-		return nil, a.msg(Precommit, p.Value), nil
+		a.logRule(36, s, cm, "valid value")
+		return nil, nil, nil
 	}
 
 	// Line 44
 	if t.In(Prevote) && cm.Round == r && o.PrevoteQThresh(r, &NilValue) && s == Prevote {
 		a.step = Precommit
-		// println(a.nodeID.String(), a.height(), cm.String(), "line 44 nil")
+		a.logRule(44, s, cm, "nil")
 		return nil, a.msg(Precommit, NilValue), nil
 	}
 
 	// Line 34
 	if t.In(Prevote) && cm.Round == r && o.PrevoteQThresh(r, nil) && s == Prevote && !a.line34Executed {
 		a.line34Executed = true
-		// println(a.nodeID.String(), a.height(), cm.String(), "line 34 timeout")
+		a.logRule(34, s, cm, "timeout")
 		return nil, nil, a.timeout(Prevote)
 	}
 
-	// Line 49
-	if t.In(Propose, Precommit) && p != nil && o.PrecommitQThresh(p.Round, &p.Value) {
-		if o.Valid(&p.Value) {
-			a.lockedRound = -1
-			a.lockedValue = NilValue
-			a.validRound = -1
-			a.validValue = NilValue
-		}
-		// println(a.nodeID.String(), a.height(), cm.String(), "line 49 decide")
-		// Return the decided proposal
-		return &RoundChange{Round: 0, Decision: p}, nil, nil
-	}
-
 	// Line 47
 	if t.In(Precommit) && cm.Round == r && o.PrecommitQThresh(r, nil) && !a.line47Executed {
 		a.line47Executed = true
-		// println(a.nodeID.String(), a.height(), cm.String(), "line 47 timeout")
+		a.logRule(47, s, cm, "timeout")
 		return nil, nil, a.timeout(Precommit)
 	}
 
 	// Line 55
 	if cm.Round > r && o.FThresh(cm.Round) {
+		a.logRule(55, s, cm, "round skip")
 		return &RoundChange{Round: cm.Round}, nil, nil
 	}
-	// println(a.nodeID.String(), a.height(), cm.String(), "no condition match")
+	if a.logger != nil {
+		a.log(LevelDebug, "no upon rule", s, "msg", cm)
+	}
 	return nil, nil, nil
 }
 
+// line28Proposal returns the proposal that satisfies the upon condition of
+// line 28 or nil if there is none. The condition can be completed by the
+// proposal itself or by a prevote from the proposal's valid round, in the
+// latter case the matching proposal is from the current round rather than the
+// round of the prevote.
+func (a *Algorithm) line28Proposal(cm *ConsensusMessage, p *ConsensusMessage) *ConsensusMessage {
+	o := a.oracle
+	if !cm.MsgType.In(Propose, Prevote) || a.step != Propose {
+		return nil
+	}
+	candidates := []*ConsensusMessage{p}
+	if cm.MsgType == Prevote {
+		candidates = nil
+		for _, c := range a.proposals(a.round, &cm.Value) {
+			if c.ValidRound == cm.Round && c.Value == cm.Value {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+	for _, c := range candidates {
+		if c != nil && c.Round == a.round && c.ValidRound >= 0 && c.ValidRound < a.round && o.PrevoteQThresh(c.ValidRound, &c.Value) {
+			return c
+		}
+	}
+	return nil
+}
+
+// line36Proposal returns the proposal that satisfies the upon condition of
+// line 36 or nil if there is none. Usually the proposal is the one matching
+// the received message, but line 36 can also be enabled by our step changing
+// to prevote, in which case the message that triggers the evaluation is our
+// own prevote, which need not be for the value with a quorum, so on receipt
+// of a prevote all proposals for the round are considered.
+func (a *Algorithm) line36Proposal(cm *ConsensusMessage, p *ConsensusMessage) *ConsensusMessage {
+	o := a.oracle
+	if !cm.MsgType.In(Propose, Prevote) || a.step < Prevote || a.line36Executed {
+		return nil
+	}
+	candidates := []*ConsensusMessage{p}
+	if cm.MsgType == Prevote && cm.Round == a.round {
+		candidates = a.proposals(a.round, &cm.Value)
+	}
+	for _, c := range candidates {
+		if c != nil && c.Round == a.round && o.PrevoteQThresh(a.round, &c.Value) && o.Valid(&c.Value) {
+			return c
+		}
+	}
+	return nil
+}
+
+// proposals returns the proposals received for round, if the Oracle is not a
+// ProposalOracle only the proposal for valueHash, if any, is returned.
+func (a *Algorithm) proposals(round int, valueHash *tendermint.Hash) []*ConsensusMessage {
+	if po, ok := a.oracle.(ProposalOracle); ok {
+		return po.Proposals(round)
+	}
+	if p := a.oracle.MatchingProposal(round, valueHash); p != nil {
+		return []*ConsensusMessage{p}
+	}
+	return nil
+}
+
 func (a *Algorithm) OnTimeout(t *Timeout) (*ConsensusMessage, *RoundChange) {
 	if t.height == a.height() && t.round == a.round {
 		switch t.timeoutType {
 		case Propose:
+			// Line 57, the timeout is only acted upon if we have not already
+			// prevoted this round, otherwise we would equivocate.
+			if a.step != Propose {
+				return nil, nil
+			}
+			a.logRule(57, a.step, nil, "nil")
 			a.step = Prevote
 			return a.msg(Prevote, NilValue), nil
 		case Prevote:
+			// Line 61, as for line 57 the timeout is only acted upon if we
+			// have not already precommitted this round.
+			if a.step != Prevote {
+				return nil, nil
+			}
+			a.logRule(61, a.step, nil, "nil")
 			a.step = Precommit
 			return a.msg(Precommit, NilValue), nil
 		case Precommit:
+			// Line 65
+			a.logRule(65, a.step, nil, "round change")
 			return nil, &RoundChange{Round: a.round + 1}
 		default:
 			panic(fmt.Sprintf("unrecognized timeout type %d", t.timeoutType))
@@ -135,6 +135,78 @@ func TestOnTimeout(t *testing.T) {
 	}, rc)
 }
 
+// A propose timeout that fires after we have prevoted must not result in a
+// second (nil) prevote.
+func TestOnTimeoutIgnoredAfterStepChange(t *testing.T) {
+	value := newValue(t)
+	s := NewStore()
+	o := NewBasicOracle(4, 1, s)
+	algo := New(newNodeID(t), o)
+	proposal, _ := algo.StartRound(value, 0)
+	require.NoError(t, s.AddMessage(proposal, nil, messageHash(t, proposal)))
+	s.SetValid(&proposal.Value)
+	_, prevote, _ := algo.ReceiveMessage(proposal)
+	require.NotNil(t, prevote)
+
+	cm, rc := algo.OnTimeout(&Timeout{timeoutType: Propose, height: 1, round: 0})
+	assert.Nil(t, cm)
+	assert.Nil(t, rc)
+}
+
+// A prevote timeout that fires after line 36 has precommitted for a value must
+// not result in a second (nil) precommit.
+func TestOnTimeoutPrevoteIgnoredAfterPrecommit(t *testing.T) {
+	value := newValue(t)
+	s := NewStore()
+	algo := New(newNodeID(t), NewBasicOracle(4, 1, s))
+	algo.StartRound(NilValue, 0)
+	s.SetValid(&value)
+	_, prevote, _ := algo.ReceiveMessage(addMessage(t, s, Propose, 0, value, -1))
+	require.Equal(t, value, prevote.Value)
+	addMessage(t, s, Prevote, 0, value, 0)
+	addMessage(t, s, Prevote, 0, value, 0)
+	_, precommit, _ := algo.ReceiveMessage(addMessage(t, s, Prevote, 0, value, 0))
+	require.NotNil(t, precommit)
+	require.Equal(t, Precommit, precommit.MsgType)
+
+	cm, rc := algo.OnTimeout(&Timeout{timeoutType: Prevote, height: 1, round: 0})
+	assert.Nil(t, cm)
+	assert.Nil(t, rc)
+}
+
+// A prevote quorum for the proposal that completes after we have precommitted
+// nil must update validValue but must not result in a second precommit.
+func TestLine36AfterPrecommit(t *testing.T) {
+	value := newValue(t)
+	s := NewStore()
+	o := NewBasicOracle(4, 1, s)
+	algo := New(newNodeID(t), o)
+	_, to := algo.StartRound(NilValue, 0)
+	require.NotNil(t, to)
+
+	// Our propose and prevote timeouts expire so we precommit nil.
+	cm, _ := algo.OnTimeout(to)
+	require.Equal(t, NilValue, cm.Value)
+	cm, _ = algo.OnTimeout(&Timeout{timeoutType: Prevote, height: 1, round: 0})
+	require.Equal(t, Precommit, cm.MsgType)
+
+	proposal := &ConsensusMessage{Sender: newNodeID(t), MsgType: Propose, Height: 1, Round: 0, Value: value, ValidRound: -1}
+	require.NoError(t, s.AddMessage(proposal, nil, messageHash(t, proposal)))
+	s.SetValid(&value)
+	var last *ConsensusMessage
+	for i := 0; i < 3; i++ {
+		last = &ConsensusMessage{Sender: newNodeID(t), MsgType: Prevote, Height: 1, Round: 0, Value: value}
+		require.NoError(t, s.AddMessage(last, nil, messageHash(t, last)))
+	}
+	rc, cm, to := algo.ReceiveMessage(last)
+	assert.Nil(t, rc)
+	assert.Nil(t, cm)
+	assert.Nil(t, to)
+	assert.Equal(t, value, algo.validValue)
+	assert.Equal(t, 0, algo.validRound)
+	assert.Equal(t, -1, algo.lockedRound)
+}
+
 // Handling a proposal message for a new value
 func TestSuccessfulRun(t *testing.T) {
 	// proposer := newNodeID(t)
@@ -224,6 +296,248 @@ func TestSuccessfulRun(t *testing.T) {
 	require.Equal(t, expectedRoundChange, rc)
 }
 
+// addMessage adds a message from a new sender at height 1 to s.
+func addMessage(t *testing.T, s *Store, step Step, round int, value tendermint.Hash, validRound int) *ConsensusMessage {
+	m := &ConsensusMessage{Sender: newNodeID(t), MsgType: step, Height: 1, Round: round, Value: value, ValidRound: validRound}
+	require.NoError(t, s.AddMessage(m, nil, messageHash(t, m)))
+	return m
+}
+
+// plainOracle hides the Proposals method of a ProposalOracle.
+type plainOracle struct {
+	Oracle
+}
+
+// The upon rules that look for proposals by round also work with an Oracle
+// that is not a ProposalOracle, for the proposal matching the received
+// message.
+func TestOracleWithoutProposals(t *testing.T) {
+	for _, wrap := range []bool{false, true} {
+		value := newValue(t)
+		s := NewStore()
+		var o Oracle = NewBasicOracle(4, 1, s)
+		if wrap {
+			o = plainOracle{o}
+		}
+		algo := New(newNodeID(t), o)
+		algo.StartRound(NilValue, 1)
+
+		// Line 28 is enabled by the prevote that completes the quorum of
+		// the proposal's valid round.
+		proposal := addMessage(t, s, Propose, 1, value, 0)
+		s.SetValid(&value)
+		addMessage(t, s, Prevote, 0, value, 0)
+		addMessage(t, s, Prevote, 0, value, 0)
+		_, cm, _ := algo.ReceiveMessage(proposal)
+		assert.Nil(t, cm)
+		_, cm, _ = algo.ReceiveMessage(addMessage(t, s, Prevote, 0, value, 0))
+		require.NotNil(t, cm)
+		assert.Equal(t, Prevote, cm.MsgType)
+		assert.Equal(t, value, cm.Value)
+	}
+}
+
+// Line 49 is evaluated before the other upon rules, a proposal that arrives
+// after a quorum of precommits for its value is decided upon rather than
+// prevoted for, but only if its value is valid.
+func TestLine49Precedence(t *testing.T) {
+	for _, valid := range []bool{true, false} {
+		value := newValue(t)
+		s := NewStore()
+		algo := New(newNodeID(t), NewBasicOracle(4, 1, s))
+		algo.StartRound(NilValue, 0)
+		for i := 0; i < 3; i++ {
+			addMessage(t, s, Precommit, 0, value, 0)
+		}
+		if valid {
+			s.SetValid(&value)
+		}
+		proposal := addMessage(t, s, Propose, 0, value, -1)
+		rc, cm, _ := algo.ReceiveMessage(proposal)
+		if valid {
+			assert.Equal(t, &RoundChange{Round: 0, Decision: proposal}, rc)
+			assert.Nil(t, cm)
+		} else {
+			assert.Nil(t, rc)
+			require.NotNil(t, cm)
+			assert.Equal(t, Prevote, cm.MsgType)
+			assert.Equal(t, NilValue, cm.Value)
+		}
+	}
+}
+
+// Line 28 considers every proposal of the round, a proposer that
+// equivocates may propose the same value with different valid rounds and the
+// rule is enabled by the one whose valid round has a quorum.
+func TestLine28ConsidersAllProposals(t *testing.T) {
+	for _, wrap := range []bool{false, true} {
+		value := newValue(t)
+		s := NewStore()
+		var o Oracle = NewBasicOracle(4, 1, s)
+		if wrap {
+			o = plainOracle{o}
+		}
+		algo := New(newNodeID(t), o)
+		algo.StartRound(NilValue, 2)
+		s.SetValid(&value)
+		first := addMessage(t, s, Propose, 2, value, 0)
+		second := &ConsensusMessage{Sender: first.Sender, MsgType: Propose, Height: 1, Round: 2, Value: value, ValidRound: 1}
+		require.ErrorIs(t, s.AddMessage(second, nil, messageHash(t, second)), ErrConflictingProposal)
+		addMessage(t, s, Prevote, 1, value, 0)
+		addMessage(t, s, Prevote, 1, value, 0)
+		for _, m := range []*ConsensusMessage{first, second} {
+			_, cm, _ := algo.ReceiveMessage(m)
+			assert.Nil(t, cm)
+		}
+
+		_, cm, _ := algo.ReceiveMessage(addMessage(t, s, Prevote, 1, value, 0))
+		if wrap {
+			// Without ProposalOracle only the first proposal for the value
+			// is found.
+			assert.Nil(t, cm)
+			continue
+		}
+		require.NotNil(t, cm)
+		assert.Equal(t, Prevote, cm.MsgType)
+		assert.Equal(t, value, cm.Value)
+	}
+}
+
+// A received proposal is its own matching proposal, looking it up by value
+// would find the first proposal for the value, whose valid round may lack the
+// quorum that the received proposal's has.
+func TestProposalMatchesItself(t *testing.T) {
+	value := newValue(t)
+	s := NewStore()
+	algo := New(newNodeID(t), plainOracle{NewBasicOracle(4, 1, s)})
+	algo.StartRound(NilValue, 2)
+	s.SetValid(&value)
+	for i := 0; i < 3; i++ {
+		addMessage(t, s, Prevote, 1, value, 0)
+	}
+	first := addMessage(t, s, Propose, 2, value, 0)
+	second := &ConsensusMessage{Sender: first.Sender, MsgType: Propose, Height: 1, Round: 2, Value: value, ValidRound: 1}
+	require.ErrorIs(t, s.AddMessage(second, nil, messageHash(t, second)), ErrConflictingProposal)
+	_, cm, _ := algo.ReceiveMessage(first)
+	assert.Nil(t, cm)
+
+	// Line 28 is enabled by the second proposal's valid round.
+	_, cm, _ = algo.ReceiveMessage(second)
+	require.NotNil(t, cm)
+	assert.Equal(t, Prevote, cm.MsgType)
+	assert.Equal(t, value, cm.Value)
+}
+
+// Line 36 considers every proposal of the round, so it is enabled when we
+// receive our own prevote even if that prevote is not for the value with a
+// quorum.
+func TestLine36ConsidersAllProposals(t *testing.T) {
+	for _, wrap := range []bool{false, true} {
+		value := newValue(t)
+		s := NewStore()
+		var o Oracle = NewBasicOracle(4, 1, s)
+		if wrap {
+			o = plainOracle{o}
+		}
+		nodeID := newNodeID(t)
+		algo := New(nodeID, o)
+		algo.lockedRound, algo.lockedValue = 0, newValue(t)
+		algo.StartRound(NilValue, 1)
+		s.SetValid(&value)
+		for i := 0; i < 3; i++ {
+			addMessage(t, s, Prevote, 1, value, 0)
+		}
+
+		// We are locked on another value so we prevote nil.
+		_, prevote, _ := algo.ReceiveMessage(addMessage(t, s, Propose, 1, value, -1))
+		require.NotNil(t, prevote)
+		require.Equal(t, NilValue, prevote.Value)
+		require.NoError(t, s.AddMessage(prevote, nil, messageHash(t, prevote)))
+
+		_, cm, _ := algo.ReceiveMessage(prevote)
+		if wrap {
+			// Without ProposalOracle the proposal is not found.
+			assert.Nil(t, cm)
+			continue
+		}
+		require.NotNil(t, cm)
+		assert.Equal(t, &ConsensusMessage{Sender: nodeID, MsgType: Precommit, Height: 1, Round: 1, Value: value}, cm)
+		assert.Equal(t, value, algo.lockedValue)
+		assert.Equal(t, 1, algo.validRound)
+	}
+}
+
+// Line 55 skips to a later round once more than f validators sent messages
+// for it, each validator counting once whatever its messages and their
+// values.
+func TestLine55CountsSenders(t *testing.T) {
+	value := newValue(t)
+	s := NewStore()
+	algo := New(newNodeID(t), NewBasicOracle(4, 1, s))
+	algo.StartRound(NilValue, 0)
+	prevote := addMessage(t, s, Prevote, 3, NilValue, 0)
+	precommit := &ConsensusMessage{Sender: prevote.Sender, MsgType: Precommit, Height: 1, Round: 3, Value: NilValue}
+	require.NoError(t, s.AddMessage(precommit, nil, messageHash(t, precommit)))
+	rc, _, _ := algo.ReceiveMessage(precommit)
+	assert.Nil(t, rc)
+
+	rc, _, _ = algo.ReceiveMessage(addMessage(t, s, Prevote, 3, value, 0))
+	assert.Equal(t, &RoundChange{Round: 3}, rc)
+}
+
+// Values are marked valid by value, so a proposal is prevoted for whichever
+// copy of its value was marked valid.
+func TestValidByValue(t *testing.T) {
+	value := newValue(t)
+	s := NewStore()
+	algo := New(newNodeID(t), NewBasicOracle(4, 1, s))
+	algo.StartRound(NilValue, 0)
+	proposal := addMessage(t, s, Propose, 0, value, -1)
+	marked := value
+	s.SetValid(&marked)
+	_, cm, _ := algo.ReceiveMessage(proposal)
+	require.NotNil(t, cm)
+	assert.Equal(t, value, cm.Value)
+}
+
+// Line 22 prevotes for a proposal only if its value is valid, being locked on
+// the value does not make an invalid value acceptable.
+func TestLine22RequiresValidValue(t *testing.T) {
+	value := newValue(t)
+	s := NewStore()
+	algo := New(newNodeID(t), NewBasicOracle(4, 1, s))
+	algo.lockedRound, algo.lockedValue = 0, value
+	algo.StartRound(NilValue, 1)
+	_, cm, _ := algo.ReceiveMessage(addMessage(t, s, Propose, 1, value, -1))
+	require.NotNil(t, cm)
+	assert.Equal(t, Prevote, cm.MsgType)
+	assert.Equal(t, NilValue, cm.Value)
+}
+
+// Line 36 may also be enabled by the proposal arriving after the quorum of
+// prevotes, once we have precommitted nil it must only update validValue.
+func TestLine36ProposalAfterPrecommit(t *testing.T) {
+	value := newValue(t)
+	s := NewStore()
+	algo := New(newNodeID(t), NewBasicOracle(4, 1, s))
+	_, to := algo.StartRound(NilValue, 0)
+	algo.OnTimeout(to)
+	cm, _ := algo.OnTimeout(&Timeout{timeoutType: Prevote, height: 1, round: 0})
+	require.Equal(t, Precommit, cm.MsgType)
+
+	s.SetValid(&value)
+	for i := 0; i < 3; i++ {
+		addMessage(t, s, Prevote, 0, value, 0)
+	}
+	rc, cm, to := algo.ReceiveMessage(addMessage(t, s, Propose, 0, value, -1))
+	assert.Nil(t, rc)
+	assert.Nil(t, cm)
+	assert.Nil(t, to)
+	assert.Equal(t, value, algo.validValue)
+	assert.Equal(t, 0, algo.validRound)
+	assert.Equal(t, -1, algo.lockedRound)
+}
+
 func messageHash(t *testing.T, m *ConsensusMessage) [32]byte {
 	var b bytes.Buffer
 	err := gob.NewEncoder(&b).Encode(m)
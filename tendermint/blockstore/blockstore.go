@@ -0,0 +1,474 @@
+// Package blockstore persists decided heights.
+//
+// A DecisionStore keeps, for each height, the decided proposal and its raw
+// encoding, the commit certifying it, the hash of the validator set that
+// decided it and the decided payload. Decisions are appended as checksummed
+// records to a data file and located through an index file holding the offset
+// of each height's record. Every write is synced before Add returns.
+//
+// The data file is the source of truth. When a DecisionStore is opened the
+// index is checked against it and rebuilt if they disagree, records appended
+// after the last indexed one are indexed and a record left incomplete by a
+// crash is discarded. Pruning rewrites both files and atomically replaces
+// them.
+package blockstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+const (
+	dataFile  = "decisions.dat"
+	indexFile = "decisions.idx"
+)
+
+// Record framing, each record is the 4 byte length of its body, the body and
+// the 4 byte CRC-32 of the body. The body starts with the 8 byte height.
+const (
+	recordOverhead = 4 + 4
+	// maxRecordSize bounds the records we read, larger lengths can only come
+	// from corruption.
+	maxRecordSize = 1 << 30
+)
+
+// ErrNotFound is returned for heights the store does not hold.
+var ErrNotFound = errors.New("decision not found")
+
+// Decision is what the store keeps of a decided height.
+type Decision struct {
+	// Proposal is the decided proposal, decoded from Block.Proposal.
+	Proposal *algorithm.ConsensusMessage
+	// Block holds the raw proposal, the commit and the payload.
+	Block *types.Block
+	// ValidatorsHash is the hash of the validator set that decided the
+	// height.
+	ValidatorsHash tendermint.Hash
+}
+
+// Height returns the decided height.
+func (d *Decision) Height() uint64 {
+	return d.Proposal.Height
+}
+
+// DecisionStore is a file backed store of a contiguous range of decided
+// heights, it implements blocksync.Store and is safe for concurrent use.
+type DecisionStore struct {
+	dir string
+
+	mu    sync.RWMutex
+	data  *os.File
+	index *os.File
+	// size is the length of the data file, base the lowest height held and
+	// offsets the offset of the record of each height from base on.
+	size    int64
+	base    uint64
+	offsets []int64
+}
+
+// Open opens the store in dir, creating it if needed, and recovers from any
+// crash that interrupted a write.
+func Open(dir string) (*DecisionStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	data, err := os.OpenFile(filepath.Join(dir, dataFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &DecisionStore{dir: dir, data: data}
+	if err := s.recover(); err != nil {
+		data.Close()
+		return nil, err
+	}
+	if s.index, err = os.OpenFile(filepath.Join(dir, indexFile), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644); err != nil {
+		data.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover loads the index, rebuilding it from the data file if it does not
+// match, indexes the records that follow the last one indexed and truncates
+// the data file after the last complete record.
+func (s *DecisionStore) recover() error {
+	info, err := s.data.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = info.Size()
+	rewrite := false
+	s.base, s.offsets = readIndex(filepath.Join(s.dir, indexFile))
+	if !s.indexValid() {
+		s.base, s.offsets = 0, nil
+		rewrite = true
+	}
+	// Scan the records following the last one indexed.
+	offset := int64(0)
+	if len(s.offsets) > 0 {
+		last := s.offsets[len(s.offsets)-1]
+		body, err := s.readRecord(last)
+		if err != nil {
+			return err
+		}
+		offset = last + int64(len(body)) + recordOverhead
+	}
+	for offset < s.size {
+		body, err := s.readRecord(offset)
+		if err != nil {
+			break
+		}
+		height := binary.BigEndian.Uint64(body)
+		if len(s.offsets) == 0 {
+			s.base = height
+		} else if height != s.base+uint64(len(s.offsets)) {
+			break
+		}
+		s.offsets = append(s.offsets, offset)
+		offset += int64(len(body)) + recordOverhead
+		rewrite = true
+	}
+	if offset < s.size {
+		if err := s.data.Truncate(offset); err != nil {
+			return err
+		}
+		if err := s.data.Sync(); err != nil {
+			return err
+		}
+		s.size = offset
+	}
+	if rewrite {
+		return writeFile(filepath.Join(s.dir, indexFile), encodeIndex(s.base, s.offsets))
+	}
+	return nil
+}
+
+// indexValid checks the loaded index against the first and last records it
+// points to, an index left behind by an interrupted prune fails this check.
+func (s *DecisionStore) indexValid() bool {
+	if len(s.offsets) == 0 {
+		return true
+	}
+	for _, i := range []int{0, len(s.offsets) - 1} {
+		body, err := s.readRecord(s.offsets[i])
+		if err != nil || binary.BigEndian.Uint64(body) != s.base+uint64(i) {
+			return false
+		}
+	}
+	return s.offsets[0] == 0
+}
+
+// readIndex reads the index file, holding the 8 byte base followed by the
+// 8 byte offset of each height. A missing file reads as an empty index and a
+// trailing partial entry is ignored.
+func readIndex(path string) (uint64, []int64) {
+	b, err := os.ReadFile(path)
+	if err != nil || len(b) < 8 {
+		return 0, nil
+	}
+	base := binary.BigEndian.Uint64(b)
+	var offsets []int64
+	for b = b[8:]; len(b) >= 8; b = b[8:] {
+		offsets = append(offsets, int64(binary.BigEndian.Uint64(b)))
+	}
+	return base, offsets
+}
+
+func encodeIndex(base uint64, offsets []int64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, base)
+	for _, o := range offsets {
+		b = binary.BigEndian.AppendUint64(b, uint64(o))
+	}
+	return b
+}
+
+// readRecord returns the body of the record at offset, checking its length
+// and checksum.
+func (s *DecisionStore) readRecord(offset int64) ([]byte, error) {
+	var length [4]byte
+	if _, err := s.data.ReadAt(length[:], offset); err != nil {
+		return nil, fmt.Errorf("reading record at %d: %w", offset, err)
+	}
+	n := int64(binary.BigEndian.Uint32(length[:]))
+	if n < 8 || n > maxRecordSize || offset+n+recordOverhead > s.size {
+		return nil, fmt.Errorf("record at %d has invalid length %d", offset, n)
+	}
+	b := make([]byte, n+4)
+	if _, err := s.data.ReadAt(b, offset+4); err != nil {
+		return nil, fmt.Errorf("reading record at %d: %w", offset, err)
+	}
+	body := b[:n]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(b[n:]) {
+		return nil, fmt.Errorf("record at %d has invalid checksum", offset)
+	}
+	return body, nil
+}
+
+// encodeDecision encodes the body of a record as the 8 byte height, the
+// validator set hash, the 4 byte length of the raw proposal, the raw
+// proposal, the 4 byte length of the commit, the commit and the payload.
+func encodeDecision(d *Decision) ([]byte, error) {
+	commit, err := d.Block.Commit.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b := binary.BigEndian.AppendUint64(nil, d.Height())
+	b = append(b, d.ValidatorsHash[:]...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(d.Block.Proposal)))
+	b = append(b, d.Block.Proposal...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(commit)))
+	b = append(b, commit...)
+	return append(b, d.Block.Payload...), nil
+}
+
+func decodeDecision(b []byte) (*Decision, error) {
+	if len(b) < 8+32+4 {
+		return nil, fmt.Errorf("decision has length %d", len(b))
+	}
+	d := &Decision{Block: &types.Block{Commit: new(types.Commit)}}
+	copy(d.ValidatorsHash[:], b[8:])
+	b = b[40:]
+	var err error
+	if d.Block.Proposal, b, err = readBytes(b); err != nil {
+		return nil, err
+	}
+	var commit []byte
+	if commit, b, err = readBytes(b); err != nil {
+		return nil, err
+	}
+	if err := d.Block.Commit.UnmarshalBinary(commit); err != nil {
+		return nil, err
+	}
+	d.Block.Payload = b
+	if d.Proposal, _, err = types.DecodeSigned(d.Block.Proposal); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readBytes reads a 4 byte length prefixed byte slice from b, returning the
+// rest of b.
+func readBytes(b []byte) ([]byte, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("missing length")
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(n) {
+		return nil, nil, fmt.Errorf("length %d exceeds remaining %d bytes", n, len(b)-4)
+	}
+	return b[4 : 4+n], b[4+n:], nil
+}
+
+// Add persists the block decided at the height following the highest held,
+// the first block added may be for any height. The block is expected to have
+// been verified, Add only checks that its parts belong to the same height.
+func (s *DecisionStore) Add(b *types.Block) error {
+	p, _, err := types.DecodeSigned(b.Proposal)
+	if err != nil {
+		return err
+	}
+	header, err := b.Header()
+	if err != nil {
+		return err
+	}
+	if b.Commit == nil || b.Commit.Height != p.Height || b.Commit.Value != p.Value {
+		return fmt.Errorf("commit does not match proposal at height %d", p.Height)
+	}
+	body, err := encodeDecision(&Decision{Proposal: p, Block: b, ValidatorsHash: header.ValidatorsHash})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.offsets) > 0 && p.Height != s.base+uint64(len(s.offsets)) {
+		return fmt.Errorf("block for height %d added to store at height %d", p.Height, s.base+uint64(len(s.offsets))-1)
+	}
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	record = append(record, body...)
+	record = binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(body))
+	offset := s.size
+	if err := s.write(p.Height, offset, record); err != nil {
+		// Both files are truncated back so that the next Add neither follows
+		// a record that was never indexed nor appends to a partial index
+		// entry. Should that fail too the files are repaired on open.
+		_ = s.data.Truncate(offset)
+		_ = s.index.Truncate(s.indexSize())
+		return err
+	}
+	if len(s.offsets) == 0 {
+		s.base = p.Height
+	}
+	s.size += int64(len(record))
+	s.offsets = append(s.offsets, offset)
+	return nil
+}
+
+// write writes the record of height at offset in the data file and indexes
+// it, syncing both files.
+func (s *DecisionStore) write(height uint64, offset int64, record []byte) error {
+	if _, err := s.data.WriteAt(record, offset); err != nil {
+		return err
+	}
+	if err := s.data.Sync(); err != nil {
+		return err
+	}
+	// A crash before the index is written is repaired when the store is
+	// next opened, since the record is then found after the last one
+	// indexed.
+	entry := binary.BigEndian.AppendUint64(nil, uint64(offset))
+	if len(s.offsets) == 0 {
+		// The index of an empty store starts over with the new base.
+		if err := s.index.Truncate(0); err != nil {
+			return err
+		}
+		entry = encodeIndex(height, []int64{offset})
+	}
+	if _, err := s.index.Write(entry); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
+// indexSize returns the length of the index file of the heights held.
+func (s *DecisionStore) indexSize() int64 {
+	if len(s.offsets) == 0 {
+		return 0
+	}
+	return 8 + 8*int64(len(s.offsets))
+}
+
+// Base returns the lowest height held, or 0 if no heights are held.
+func (s *DecisionStore) Base() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.base
+}
+
+// Height returns the highest height held, or 0 if no heights are held.
+func (s *DecisionStore) Height() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.offsets) == 0 {
+		return 0
+	}
+	return s.base + uint64(len(s.offsets)) - 1
+}
+
+// Decision returns the decision at height, or ErrNotFound if the height is
+// not held.
+func (s *DecisionStore) Decision(height uint64) (*Decision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.offsets) == 0 || height < s.base || height-s.base >= uint64(len(s.offsets)) {
+		return nil, fmt.Errorf("height %d: %w", height, ErrNotFound)
+	}
+	body, err := s.readRecord(s.offsets[height-s.base])
+	if err != nil {
+		return nil, err
+	}
+	return decodeDecision(body)
+}
+
+// Block returns the block decided at height, or nil if it is not held or
+// can't be read.
+func (s *DecisionStore) Block(height uint64) *types.Block {
+	d, err := s.Decision(height)
+	if err != nil {
+		return nil
+	}
+	return d.Block
+}
+
+// Prune discards the heights below base, which may not exceed the highest
+// height held. The retained records are copied to new files that replace the
+// old ones.
+func (s *DecisionStore) Prune(base uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.offsets) == 0 || base <= s.base {
+		return nil
+	}
+	if height := s.base + uint64(len(s.offsets)) - 1; base > height {
+		return fmt.Errorf("pruning to %d above height %d", base, height)
+	}
+	start := s.offsets[base-s.base]
+	retained := make([]byte, s.size-start)
+	if _, err := s.data.ReadAt(retained, start); err != nil {
+		return err
+	}
+	offsets := make([]int64, 0, uint64(len(s.offsets))-(base-s.base))
+	for _, o := range s.offsets[base-s.base:] {
+		offsets = append(offsets, o-start)
+	}
+	// The data file is replaced first. If we crash before the index is
+	// replaced too the old index no longer matches and is rebuilt on open.
+	dataPath, indexPath := filepath.Join(s.dir, dataFile), filepath.Join(s.dir, indexFile)
+	if err := writeFile(dataPath, retained); err != nil {
+		return err
+	}
+	if err := writeFile(indexPath, encodeIndex(base, offsets)); err != nil {
+		return err
+	}
+	// Reopen the replaced files, the old handles refer to the unlinked ones.
+	data, err := os.OpenFile(dataPath, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	index, err := os.OpenFile(indexPath, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		data.Close()
+		return err
+	}
+	s.data.Close()
+	s.index.Close()
+	s.data, s.index = data, index
+	s.size, s.base, s.offsets = int64(len(retained)), base, offsets
+	return nil
+}
+
+// Close closes the files of the store.
+func (s *DecisionStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Join(s.data.Close(), s.index.Close())
+}
+
+// writeFile atomically replaces the file at path with b, by writing a
+// temporary file that is synced and renamed over it.
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,198 @@
+package blockstore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/blocksync"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testChainID = "test-chain"
+
+// makeBlocks returns blocks for heights 1 to n decided by a single validator,
+// payloads vary in size.
+func makeBlocks(t *testing.T, n int) []*types.Block {
+	seed := make([]byte, ed25519.SeedSize)
+	k := ed25519.NewKeyFromSeed(seed)
+	vs, err := types.NewValidatorSet([]types.Validator{types.NewValidator(k.Public().(ed25519.PublicKey))})
+	require.NoError(t, err)
+	signer := types.NewKeySigner(k)
+	var blocks []*types.Block
+	for h := uint64(1); h <= uint64(n); h++ {
+		payload := bytes.Repeat([]byte{byte(h)}, int(h)*100)
+		header := types.Header{Height: h, ValidatorsHash: vs.Hash(), NextValidatorsHash: vs.Hash(), Payload: types.NewPartSetFromData(payload).Header()}
+		p := &algorithm.ConsensusMessage{Sender: keys.Address(signer.PubKey()), MsgType: algorithm.Propose, Height: h, Round: 0, Value: header.Hash(), ValidRound: -1}
+		sig, err := signer.SignMessage(testChainID, p)
+		require.NoError(t, err)
+		m := &algorithm.ConsensusMessage{Sender: p.Sender, MsgType: algorithm.Precommit, Height: h, Round: 0, Value: p.Value}
+		precommit, err := signer.SignMessage(testChainID, m)
+		require.NoError(t, err)
+		blocks = append(blocks, &types.Block{
+			Proposal: types.EncodeProposal(p, sig, header),
+			Payload:  payload,
+			Commit:   &types.Commit{Height: h, Round: 0, Value: p.Value, Precommits: [][]byte{types.EncodeSigned(m, precommit)}},
+		})
+	}
+	return blocks
+}
+
+func open(t *testing.T, dir string) *DecisionStore {
+	s, err := Open(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func checkHeights(t *testing.T, s *DecisionStore, blocks []*types.Block, base, height uint64) {
+	t.Helper()
+	assert.Equal(t, base, s.Base())
+	assert.Equal(t, height, s.Height())
+	for h := base; h <= height && h > 0; h++ {
+		d, err := s.Decision(h)
+		require.NoError(t, err)
+		assert.Equal(t, h, d.Height())
+		assert.Equal(t, blocks[h-1], d.Block)
+		header, err := blocks[h-1].Header()
+		require.NoError(t, err)
+		assert.Equal(t, header.ValidatorsHash, d.ValidatorsHash)
+		assert.Equal(t, header.Hash(), d.Proposal.Value)
+	}
+	_, err := s.Decision(height + 1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Nil(t, s.Block(height+1))
+}
+
+func TestDecisionStore(t *testing.T) {
+	blocks := makeBlocks(t, 5)
+	dir := t.TempDir()
+	s := open(t, dir)
+	var _ blocksync.Store = s
+	checkHeights(t, s, blocks, 0, 0)
+	require.NoError(t, s.Add(blocks[1]))
+	assert.Error(t, s.Add(blocks[0]))
+	assert.Error(t, s.Add(blocks[3]))
+	for _, b := range blocks[2:] {
+		require.NoError(t, s.Add(b))
+	}
+	checkHeights(t, s, blocks, 2, 5)
+	_, err := s.Decision(1)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// The heights survive reopening.
+	require.NoError(t, s.Close())
+	s = open(t, dir)
+	checkHeights(t, s, blocks, 2, 5)
+}
+
+func TestDecisionStoreRecovers(t *testing.T) {
+	blocks := makeBlocks(t, 6)
+	dir := t.TempDir()
+	s := open(t, dir)
+	for _, b := range blocks[:5] {
+		require.NoError(t, s.Add(b))
+	}
+	require.NoError(t, s.Close())
+	dataPath, indexPath := filepath.Join(dir, dataFile), filepath.Join(dir, indexFile)
+	index, err := os.ReadFile(indexPath)
+	require.NoError(t, err)
+
+	// A crash between writing a record and indexing it loses nothing.
+	require.NoError(t, os.WriteFile(indexPath, index[:len(index)-12], 0o644))
+	s = open(t, dir)
+	checkHeights(t, s, blocks, 1, 5)
+	require.NoError(t, s.Close())
+
+	// A lost index is rebuilt.
+	require.NoError(t, os.Remove(indexPath))
+	s = open(t, dir)
+	checkHeights(t, s, blocks, 1, 5)
+	require.NoError(t, s.Close())
+
+	// A partially written record is discarded and overwritten.
+	info, err := os.Stat(dataPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(dataPath, info.Size()-10))
+	s = open(t, dir)
+	checkHeights(t, s, blocks, 1, 4)
+	require.NoError(t, s.Add(blocks[4]))
+	require.NoError(t, s.Close())
+
+	// As is a corrupted one.
+	data, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	data[len(data)-20] ^= 0xff
+	require.NoError(t, os.WriteFile(dataPath, data, 0o644))
+	s = open(t, dir)
+	checkHeights(t, s, blocks, 1, 4)
+}
+
+func TestDecisionStoreFailedAdd(t *testing.T) {
+	blocks := makeBlocks(t, 4)
+	dir := t.TempDir()
+	s := open(t, dir)
+	for _, b := range blocks[:2] {
+		require.NoError(t, s.Add(b))
+	}
+
+	// An Add whose index write fails leaves the store as it was.
+	indexPath := filepath.Join(dir, indexFile)
+	index := s.index
+	readOnly, err := os.Open(indexPath)
+	require.NoError(t, err)
+	s.index = readOnly
+	assert.Error(t, s.Add(blocks[2]))
+	s.index = index
+	readOnly.Close()
+	checkHeights(t, s, blocks, 1, 2)
+
+	// So the height can be added again, and the data file holds no trace of
+	// the failed attempt, which rebuilding the index would trip over.
+	for _, b := range blocks[2:] {
+		require.NoError(t, s.Add(b))
+	}
+	checkHeights(t, s, blocks, 1, 4)
+	require.NoError(t, s.Close())
+	require.NoError(t, os.Remove(indexPath))
+	s = open(t, dir)
+	checkHeights(t, s, blocks, 1, 4)
+}
+
+func TestDecisionStorePrune(t *testing.T) {
+	blocks := makeBlocks(t, 6)
+	dir := t.TempDir()
+	s := open(t, dir)
+	for _, b := range blocks[:5] {
+		require.NoError(t, s.Add(b))
+	}
+	assert.Error(t, s.Prune(6))
+	require.NoError(t, s.Prune(3))
+	require.NoError(t, s.Prune(2))
+	checkHeights(t, s, blocks, 3, 5)
+	assert.Nil(t, s.Block(2))
+	require.NoError(t, s.Add(blocks[5]))
+	checkHeights(t, s, blocks, 3, 6)
+	require.NoError(t, s.Close())
+
+	s = open(t, dir)
+	checkHeights(t, s, blocks, 3, 6)
+	require.NoError(t, s.Close())
+
+	// A crash after replacing the data file but before replacing the index
+	// leaves an index that is rebuilt.
+	index, err := os.ReadFile(filepath.Join(dir, indexFile))
+	require.NoError(t, err)
+	s = open(t, dir)
+	require.NoError(t, s.Prune(5))
+	require.NoError(t, s.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, indexFile), index, 0o644))
+	s = open(t, dir)
+	checkHeights(t, s, blocks, 5, 6)
+}
@@ -0,0 +1,436 @@
+// Package blocksync lets a node that is many heights behind catch up by
+// fetching decided blocks from its peers, rather than replaying consensus one
+// round at a time.
+//
+// Every node runs a Reactor, which announces the range of heights held in its
+// Store, on connecting, on change and when asked, and serves the blocks its
+// peers request. A node that is behind
+// requests the blocks it lacks from the peers that announced them, several
+// heights at a time and spread across peers. Each block is sent as the
+// decided proposal and its commit followed by the Merkle proved parts of its
+// payload, so blocks are never larger than the parts that consensus gossips.
+// Blocks are verified against the validator set of their height and applied
+// in order. Once MinPeers peers have announced their status, or SyncTimeout
+// has passed, and none of them announces a height beyond the last block
+// applied the node is synced and hands over to consensus. Peers are served at
+// most MaxServed blocks per Interval.
+package blocksync
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/consensus"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// Channel is the p2p channel that carries block sync messages.
+const Channel p2p.ChannelID = 0x40
+
+const (
+	// DefaultMaxPending is the default number of heights requested at
+	// once.
+	DefaultMaxPending = 32
+	// DefaultRequestTimeout is the default time allowed for a peer to serve
+	// a block.
+	DefaultRequestTimeout = 5 * time.Second
+	// DefaultInterval is the default interval at which the Reactor announces
+	// changes to its status and retries requests.
+	DefaultInterval = 100 * time.Millisecond
+	// DefaultMinPeers is the default number of peers that must announce
+	// their status before the Reactor considers itself synced.
+	DefaultMinPeers = 3
+	// DefaultSyncTimeout is the default time after which the Reactor may
+	// consider itself synced without hearing from MinPeers peers.
+	DefaultSyncTimeout = 30 * time.Second
+	// DefaultMaxServed is the default number of blocks served to a peer per
+	// Interval.
+	DefaultMaxServed = 2 * DefaultMaxPending
+)
+
+// ErrTransportClosed is returned by Run if the transport is closed.
+var ErrTransportClosed = errors.New("transport closed")
+
+// Config configures a Reactor.
+type Config struct {
+	// Store holds the blocks served to peers.
+	Store Store
+	// ChainID identifies the chain, blocks signed for other chains fail
+	// verification.
+	ChainID string
+	// Validators returns the validator set that decided height, or false if
+	// it is not known yet, see types.ValidatorSchedule.At. Apply is expected
+	// to apply the validator updates of each block.
+	Validators func(height uint64) (*types.ValidatorSet, bool)
+	// Height is the first height to fetch, if zero the Reactor only serves
+	// blocks.
+	Height uint64
+	// Apply is called with each fetched block, in height order, once it has
+	// been verified. It is expected to add the block to Store, an error stops
+	// the Reactor.
+	Apply func(p *algorithm.ConsensusMessage, b *types.Block) error
+	// Synced is called once the Reactor has heard from MinPeers peers, or
+	// SyncTimeout has passed since Run was called, and no peer announces a
+	// block beyond those applied. It is called with the first height that
+	// was not fetched from the goroutine executing Run.
+	Synced func(height uint64)
+	// MinPeers is the number of peers whose status must be known before the
+	// Reactor is synced, so that a few peers that are behind can't hand us
+	// over to consensus early.
+	MinPeers int
+	// SyncTimeout bounds the time spent waiting to hear from MinPeers peers,
+	// after it the peers heard from suffice, even if there are none.
+	SyncTimeout time.Duration
+	// MaxPending bounds the number of heights requested at once.
+	MaxPending int
+	// MaxServed bounds the number of blocks served to each peer per
+	// Interval, further requests in the interval are ignored and so time out
+	// at the requester.
+	MaxServed int
+	// MaxProposalSize bounds the size of the payloads we accept.
+	MaxProposalSize int
+	// RequestTimeout is the time allowed for a peer to serve a block, a peer
+	// that takes longer is no longer asked for blocks until it announces its
+	// status again.
+	RequestTimeout time.Duration
+	// Interval is the interval at which the Reactor announces changes to
+	// its status and retries timed out requests.
+	Interval time.Duration
+}
+
+func (c *Config) setDefaults() {
+	if c.MinPeers == 0 {
+		c.MinPeers = DefaultMinPeers
+	}
+	if c.SyncTimeout == 0 {
+		c.SyncTimeout = DefaultSyncTimeout
+	}
+	if c.MaxPending == 0 {
+		c.MaxPending = DefaultMaxPending
+	}
+	if c.MaxServed == 0 {
+		c.MaxServed = DefaultMaxServed
+	}
+	if c.MaxProposalSize == 0 {
+		c.MaxProposalSize = consensus.DefaultMaxProposalSize
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = DefaultRequestTimeout
+	}
+	if c.Interval == 0 {
+		c.Interval = DefaultInterval
+	}
+	if c.Apply == nil {
+		c.Apply = func(*algorithm.ConsensusMessage, *types.Block) error { return nil }
+	}
+	if c.Synced == nil {
+		c.Synced = func(uint64) {}
+	}
+}
+
+// Reactor serves blocks to peers and, if configured with a Height, fetches
+// the blocks the node lacks.
+type Reactor struct {
+	cfg       Config
+	transport p2p.Transport
+
+	// announced is the status last broadcast, peers that connect or ask
+	// for our status are sent the current one.
+	announced status
+	peers     map[algorithm.NodeID]*peer
+	// heard holds the peers that have announced their status since Run was
+	// called, whether or not they have since been dropped or reconnected,
+	// and served the number of blocks served to each peer in the current
+	// interval.
+	heard  map[algorithm.NodeID]bool
+	served map[algorithm.NodeID]int
+
+	// started is the time Run was called.
+	started time.Time
+	syncing bool
+	// next is the next height to apply, requests holds the outstanding
+	// requests by height.
+	next     uint64
+	requests map[uint64]*request
+}
+
+// peer is the status announced by a peer and the number of requests it is
+// serving.
+type peer struct {
+	status
+	pending int
+}
+
+type request struct {
+	peer algorithm.NodeID
+	sent time.Time
+	// block is set once the proposal and commit arrive, parts holds the
+	// parts of the payload as they arrive.
+	block *types.Block
+	parts *types.PartSet
+}
+
+// NewReactor creates a Reactor that communicates over t, call Run to start
+// it.
+func NewReactor(cfg Config, t p2p.Transport) *Reactor {
+	cfg.setDefaults()
+	return &Reactor{
+		cfg:       cfg,
+		transport: t,
+		peers:     make(map[algorithm.NodeID]*peer),
+		heard:     make(map[algorithm.NodeID]bool),
+		served:    make(map[algorithm.NodeID]int),
+		syncing:   cfg.Height > 0,
+		next:      cfg.Height,
+		requests:  make(map[uint64]*request),
+	}
+}
+
+// Run serves and fetches blocks until ctx is cancelled, the transport is
+// closed or Apply fails. Run must only be called once.
+func (r *Reactor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+	r.announced = r.status()
+	r.started = time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-r.transport.Receive():
+			if !ok {
+				return ErrTransportClosed
+			}
+			if e.Channel != Channel || len(e.Payload) == 0 {
+				continue
+			}
+			if err := r.receive(e); err != nil {
+				return err
+			}
+		case e, ok := <-r.transport.PeerEvents():
+			if !ok {
+				return ErrTransportClosed
+			}
+			if e.Type == p2p.PeerDown {
+				r.dropPeer(e.Peer)
+				continue
+			}
+			_ = r.transport.Send(e.Peer, Channel, r.status().encode())
+		case now := <-ticker.C:
+			r.served = make(map[algorithm.NodeID]int)
+			r.requestStatus()
+			if s := r.status(); s != r.announced {
+				r.announced = s
+				r.transport.Broadcast(Channel, s.encode())
+			}
+			for _, req := range r.requests {
+				if now.Sub(req.sent) > r.cfg.RequestTimeout {
+					r.dropPeer(req.peer)
+				}
+			}
+		}
+		r.sync()
+	}
+}
+
+func (r *Reactor) status() status {
+	return status{base: r.cfg.Store.Base(), height: r.cfg.Store.Height()}
+}
+
+func (r *Reactor) receive(e p2p.Envelope) error {
+	payload := e.Payload[1:]
+	switch e.Payload[0] {
+	case kindStatus:
+		if s, err := decodeStatus(payload); err == nil {
+			p := r.peers[e.From]
+			if p == nil {
+				p = &peer{}
+				r.peers[e.From] = p
+			}
+			p.status = s
+			r.heard[e.From] = true
+		}
+	case kindStatusRequest:
+		_ = r.transport.Send(e.From, Channel, r.status().encode())
+	case kindRequest:
+		if height, err := decodeHeight(payload); err == nil {
+			r.serve(e.From, height)
+		}
+	case kindNoBlock:
+		if height, err := decodeHeight(payload); err == nil {
+			if req := r.requests[height]; req != nil && req.peer == e.From {
+				r.dropPeer(e.From)
+			}
+		}
+	case kindBlock:
+		if m, err := decodeBlockMessage(payload); err == nil {
+			r.receiveBlock(e.From, m)
+		}
+	case kindPart:
+		if m, err := decodePartMessage(payload); err == nil {
+			return r.receivePart(e.From, m)
+		}
+	}
+	return nil
+}
+
+// requestStatus asks the connected peers whose status we don't hold for it
+// while syncing. Statuses are only announced on connecting and on change, so
+// one lost with a replaced connection would otherwise only be made up for by
+// SyncTimeout.
+func (r *Reactor) requestStatus() {
+	if !r.syncing {
+		return
+	}
+	for _, id := range r.transport.Peers() {
+		if r.peers[id] == nil {
+			_ = r.transport.Send(id, Channel, []byte{kindStatusRequest})
+		}
+	}
+}
+
+// serve sends the block at height to a peer, the payload is sent as parts.
+// Requests beyond MaxServed in an interval are ignored.
+func (r *Reactor) serve(id algorithm.NodeID, height uint64) {
+	if r.served[id] >= r.cfg.MaxServed {
+		return
+	}
+	r.served[id]++
+	b := r.cfg.Store.Block(height)
+	if b == nil {
+		_ = r.transport.Send(id, Channel, encodeHeight(kindNoBlock, height))
+		return
+	}
+	if err := r.transport.Send(id, Channel, (&blockMessage{proposal: b.Proposal, commit: b.Commit}).encode()); err != nil {
+		return
+	}
+	parts := types.NewPartSetFromData(b.Payload)
+	for i := 0; i < parts.Total(); i++ {
+		if err := r.transport.Send(id, Channel, (&partMessage{height: height, part: parts.Part(i)}).encode()); err != nil {
+			return
+		}
+	}
+}
+
+// receiveBlock starts receiving the block requested from a peer. The block is
+// only verified once complete.
+func (r *Reactor) receiveBlock(id algorithm.NodeID, m *blockMessage) {
+	req := r.requests[m.commit.Height]
+	if req == nil || req.peer != id || req.block != nil {
+		return
+	}
+	header, err := types.ProposalHeader(m.proposal)
+	if err != nil || header.Payload.Total > (r.cfg.MaxProposalSize+types.PartSize-1)/types.PartSize {
+		r.dropPeer(id)
+		return
+	}
+	req.block = &types.Block{Proposal: m.proposal, Commit: m.commit}
+	req.parts = types.NewPartSetFromHeader(header.Payload)
+}
+
+// receivePart adds a part of the payload of a block being received, once the
+// block is complete the blocks that can be are applied.
+func (r *Reactor) receivePart(id algorithm.NodeID, m *partMessage) error {
+	req := r.requests[m.height]
+	if req == nil || req.peer != id || req.parts == nil {
+		return nil
+	}
+	if _, err := req.parts.AddPart(m.part); err != nil {
+		r.dropPeer(id)
+		return nil
+	}
+	if !req.parts.IsComplete() {
+		return nil
+	}
+	req.block.Payload = req.parts.Data()
+	return r.apply()
+}
+
+// apply verifies and applies the received blocks that follow the last block
+// applied.
+func (r *Reactor) apply() error {
+	for r.syncing {
+		req := r.requests[r.next]
+		if req == nil || req.parts == nil || !req.parts.IsComplete() {
+			return nil
+		}
+		vs, ok := r.cfg.Validators(r.next)
+		if !ok {
+			return nil
+		}
+		p, err := req.block.Verify(r.cfg.ChainID, vs, r.next)
+		if err != nil {
+			r.dropPeer(req.peer)
+			return nil
+		}
+		if err := r.cfg.Apply(p, req.block); err != nil {
+			return err
+		}
+		delete(r.requests, r.next)
+		if p := r.peers[req.peer]; p != nil {
+			p.pending--
+		}
+		r.next++
+	}
+	return nil
+}
+
+// sync requests the heights that are not requested yet and finishes syncing
+// once enough peers have been heard from and none has any more blocks.
+func (r *Reactor) sync() {
+	if !r.syncing {
+		return
+	}
+	for height := r.next; height < r.next+uint64(r.cfg.MaxPending); height++ {
+		if r.requests[height] != nil {
+			continue
+		}
+		// Requests are spread across peers by sending each to the peer
+		// with the fewest outstanding requests.
+		var best *peer
+		var bestID algorithm.NodeID
+		for id, p := range r.peers {
+			if p.base <= height && height <= p.height && (best == nil || p.pending < best.pending) {
+				best, bestID = p, id
+			}
+		}
+		if best == nil {
+			continue
+		}
+		if err := r.transport.Send(bestID, Channel, encodeHeight(kindRequest, height)); err != nil {
+			continue
+		}
+		best.pending++
+		r.requests[height] = &request{peer: bestID, sent: time.Now()}
+	}
+
+	if len(r.requests) > 0 {
+		return
+	}
+	// Until SyncTimeout we wait for MinPeers statuses, and for a peer to
+	// remain after dropping those that failed to serve us.
+	if (len(r.heard) < r.cfg.MinPeers || len(r.peers) == 0) && time.Since(r.started) < r.cfg.SyncTimeout {
+		return
+	}
+	for _, p := range r.peers {
+		if p.height >= r.next {
+			return
+		}
+	}
+	r.syncing = false
+	r.cfg.Synced(r.next)
+}
+
+// dropPeer forgets the status of a peer and cancels its requests, the peer is
+// asked for blocks again once it announces its status.
+func (r *Reactor) dropPeer(id algorithm.NodeID) {
+	delete(r.peers, id)
+	for height, req := range r.requests {
+		if req.peer == id {
+			delete(r.requests, height)
+		}
+	}
+}
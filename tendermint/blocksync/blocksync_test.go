@@ -0,0 +1,453 @@
+package blocksync
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/consensus"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+	"github.com/piersy/tendermint-go/tendermint/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testTimeout = 20 * time.Second
+	testChainID = "test-chain"
+)
+
+func testKeys(n int) []ed25519.PrivateKey {
+	result := make([]ed25519.PrivateKey, n)
+	for i := range result {
+		seed := make([]byte, ed25519.SeedSize)
+		seed[0] = byte(i + 1)
+		result[i] = ed25519.NewKeyFromSeed(seed)
+	}
+	return result
+}
+
+func validatorSet(t *testing.T, ks []ed25519.PrivateKey) *types.ValidatorSet {
+	var vals []types.Validator
+	for _, k := range ks {
+		vals = append(vals, types.NewValidator(k.Public().(ed25519.PublicKey)))
+	}
+	vs, err := types.NewValidatorSet(vals)
+	require.NoError(t, err)
+	return vs
+}
+
+func id(k ed25519.PrivateKey) algorithm.NodeID {
+	return keys.Address(k.Public().(ed25519.PublicKey))
+}
+
+// makeChain returns the blocks of heights 1 to n, each decided in round 0
+// with the precommits of every validator. Payloads vary in size so that some
+// span several parts.
+func makeChain(t *testing.T, ks []ed25519.PrivateKey, n int) []*types.Block {
+	vs := validatorSet(t, ks)
+	var blocks []*types.Block
+	for h := uint64(1); h <= uint64(n); h++ {
+		payload := bytes.Repeat([]byte{byte(h)}, int(h%3)*types.PartSize+10)
+		header := types.Header{Height: h, ValidatorsHash: vs.Hash(), NextValidatorsHash: vs.Hash(), Payload: types.NewPartSetFromData(payload).Header()}
+		proposer, _ := vs.Index(vs.Proposer(h, 0))
+		p := &algorithm.ConsensusMessage{Sender: vs.Proposer(h, 0), MsgType: algorithm.Propose, Height: h, Round: 0, Value: header.Hash(), ValidRound: -1}
+		sig, err := types.NewKeySigner(ks[proposer]).SignMessage(testChainID, p)
+		require.NoError(t, err)
+		b := &types.Block{
+			Proposal: types.EncodeProposal(p, sig, header),
+			Payload:  payload,
+			Commit:   &types.Commit{Height: h, Round: 0, Value: p.Value},
+		}
+		for _, k := range ks {
+			m := &algorithm.ConsensusMessage{Sender: id(k), MsgType: algorithm.Precommit, Height: h, Round: 0, Value: p.Value}
+			sig, err := types.NewKeySigner(k).SignMessage(testChainID, m)
+			require.NoError(t, err)
+			b.Commit.Precommits = append(b.Commit.Precommits, types.EncodeSigned(m, sig))
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+func TestMessageEncoding(t *testing.T) {
+	s := status{base: 3, height: 9}
+	decodedStatus, err := decodeStatus(s.encode()[1:])
+	require.NoError(t, err)
+	assert.Equal(t, s, decodedStatus)
+	_, err = decodeStatus(status{base: 9, height: 3}.encode()[1:])
+	assert.Error(t, err)
+
+	b := makeChain(t, testKeys(4), 2)[1]
+	m := &blockMessage{proposal: b.Proposal, commit: b.Commit}
+	decodedBlock, err := decodeBlockMessage(m.encode()[1:])
+	require.NoError(t, err)
+	assert.Equal(t, m, decodedBlock)
+	_, err = decodeBlockMessage(m.encode()[1:100])
+	assert.Error(t, err)
+
+	part := &partMessage{height: 2, part: types.NewPartSetFromData(b.Payload).Part(1)}
+	decodedPart, err := decodePartMessage(part.encode()[1:])
+	require.NoError(t, err)
+	assert.Equal(t, part, decodedPart)
+}
+
+func TestMemStore(t *testing.T) {
+	blocks := makeChain(t, testKeys(4), 3)
+	s := NewMemStore()
+	assert.Equal(t, uint64(0), s.Height())
+	assert.Nil(t, s.Block(1))
+	require.NoError(t, s.Add(blocks[1]))
+	assert.Error(t, s.Add(blocks[0]))
+	require.NoError(t, s.Add(blocks[2]))
+	assert.Equal(t, uint64(2), s.Base())
+	assert.Equal(t, uint64(3), s.Height())
+	assert.Equal(t, blocks[2], s.Block(3))
+	assert.Nil(t, s.Block(1))
+	assert.Nil(t, s.Block(4))
+}
+
+// tamperingStore serves blocks whose commits lack a quorum.
+type tamperingStore struct {
+	Store
+}
+
+func (s tamperingStore) Block(height uint64) *types.Block {
+	b := *s.Store.Block(height)
+	commit := *b.Commit
+	commit.Precommits = commit.Precommits[:2]
+	b.Commit = &commit
+	return &b
+}
+
+func TestReactorSyncs(t *testing.T) {
+	ks := testKeys(4)
+	vs := validatorSet(t, ks)
+	blocks := makeChain(t, ks, 20)
+	full := NewMemStore()
+	for _, b := range blocks {
+		require.NoError(t, full.Add(b))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	validators := func(uint64) (*types.ValidatorSet, bool) { return vs, true }
+
+	// Two peers serve valid blocks and one tampers with every block it
+	// serves, the syncing node only applies valid blocks.
+	n := p2p.NewMemNetwork()
+	for i, s := range []Store{full, full, tamperingStore{full}} {
+		tr := n.Transport(algorithm.NodeID{byte(i + 1)})
+		defer tr.Close()
+		r := NewReactor(Config{Store: s, Validators: validators}, tr)
+		go func() { _ = r.Run(ctx) }()
+	}
+
+	tr := n.Transport(algorithm.NodeID{0xff})
+	defer tr.Close()
+	store := NewMemStore()
+	synced := make(chan uint64, 1)
+	r := NewReactor(Config{
+		ChainID:    testChainID,
+		Store:      store,
+		Validators: validators,
+		Height:     1,
+		Apply: func(p *algorithm.ConsensusMessage, b *types.Block) error {
+			assert.Equal(t, store.Height()+1, p.Height)
+			return store.Add(b)
+		},
+		Synced:     func(height uint64) { synced <- height },
+		MaxPending: 4,
+	}, tr)
+	go func() { _ = r.Run(ctx) }()
+
+	select {
+	case height := <-synced:
+		assert.Equal(t, uint64(21), height)
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting to sync")
+	}
+	for h := uint64(1); h <= 20; h++ {
+		assert.Equal(t, full.Block(h), store.Block(h))
+	}
+}
+
+func TestReactorWaitsForPeers(t *testing.T) {
+	ks := testKeys(4)
+	vs := validatorSet(t, ks)
+	blocks := makeChain(t, ks, 10)
+	behind, ahead := NewMemStore(), NewMemStore()
+	for i, b := range blocks {
+		if i < 3 {
+			require.NoError(t, behind.Add(b))
+		}
+		require.NoError(t, ahead.Add(b))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	validators := func(uint64) (*types.ValidatorSet, bool) { return vs, true }
+	serve := func(n *p2p.MemNetwork, id byte, s Store) {
+		tr := n.Transport(algorithm.NodeID{id})
+		t.Cleanup(func() { tr.Close() })
+		r := NewReactor(Config{Store: s, Validators: validators}, tr)
+		go func() { _ = r.Run(ctx) }()
+	}
+	syncFrom := func(n *p2p.MemNetwork, syncTimeout time.Duration) <-chan uint64 {
+		tr := n.Transport(algorithm.NodeID{0xff})
+		t.Cleanup(func() { tr.Close() })
+		store := NewMemStore()
+		synced := make(chan uint64, 1)
+		r := NewReactor(Config{
+			ChainID:     testChainID,
+			Store:       store,
+			Validators:  validators,
+			Height:      1,
+			Apply:       func(_ *algorithm.ConsensusMessage, b *types.Block) error { return store.Add(b) },
+			Synced:      func(height uint64) { synced <- height },
+			MinPeers:    2,
+			SyncTimeout: syncTimeout,
+			Interval:    5 * time.Millisecond,
+		}, tr)
+		go func() { _ = r.Run(ctx) }()
+		return synced
+	}
+
+	// A peer that is behind is not enough to hand over to consensus, the
+	// node waits to hear from a second peer.
+	n := p2p.NewMemNetwork()
+	serve(n, 1, behind)
+	synced := syncFrom(n, testTimeout)
+	select {
+	case height := <-synced:
+		t.Fatalf("synced at height %d with one peer", height)
+	case <-time.After(100 * time.Millisecond):
+	}
+	serve(n, 2, ahead)
+	select {
+	case height := <-synced:
+		assert.Equal(t, uint64(11), height)
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting to sync")
+	}
+
+	// Without a second peer the node is synced after SyncTimeout.
+	n = p2p.NewMemNetwork()
+	serve(n, 1, behind)
+	start := time.Now()
+	select {
+	case height := <-syncFrom(n, 200*time.Millisecond):
+		assert.Equal(t, uint64(4), height)
+		assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting to sync")
+	}
+}
+
+func TestReactorSyncsOverTCP(t *testing.T) {
+	ks := testKeys(4)
+	vs := validatorSet(t, ks)
+	store := NewMemStore()
+	for _, b := range makeChain(t, ks, 10) {
+		require.NoError(t, store.Add(b))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	validators := func(uint64) (*types.ValidatorSet, bool) { return vs, true }
+	listen := func(k ed25519.PrivateKey) (*p2p.TCPTransport, p2p.Transport) {
+		tr, err := p2p.ListenTCP(k, "127.0.0.1:0", p2p.TCPConfig{})
+		require.NoError(t, err)
+		t.Cleanup(func() { tr.Close() })
+		mux := p2p.NewMux(tr, p2p.MuxConfig{})
+		ch := mux.Channels(Channel)
+		mux.Start()
+		return tr, ch
+	}
+
+	// Three peers serve the chain and the syncing node waits to hear from
+	// all of them.
+	var servers []*p2p.TCPTransport
+	for _, k := range ks[:3] {
+		tr, ch := listen(k)
+		servers = append(servers, tr)
+		r := NewReactor(Config{Store: store, Validators: validators}, ch)
+		go func() { _ = r.Run(ctx) }()
+	}
+	tr, ch := listen(ks[3])
+	synced := make(chan uint64, 1)
+	r := NewReactor(Config{
+		ChainID:    testChainID,
+		Store:      NewMemStore(),
+		Validators: validators,
+		Height:     1,
+		Synced:     func(height uint64) { synced <- height },
+	}, ch)
+	go func() { _ = r.Run(ctx) }()
+
+	// Both sides of each pair dial at once, so one of the connections is
+	// replaced without any peer event and the statuses sent on it are lost.
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(2)
+		go func(s *p2p.TCPTransport) {
+			defer wg.Done()
+			_, _ = tr.Dial(s.Addr().String())
+		}(s)
+		go func(s *p2p.TCPTransport) {
+			defer wg.Done()
+			_, _ = s.Dial(tr.Addr().String())
+		}(s)
+	}
+	wg.Wait()
+
+	select {
+	case height := <-synced:
+		assert.Equal(t, uint64(11), height)
+	case <-time.After(DefaultSyncTimeout / 3):
+		t.Fatal("not synced well before SyncTimeout")
+	}
+}
+
+func TestReactorLimitsServing(t *testing.T) {
+	ks := testKeys(4)
+	vs := validatorSet(t, ks)
+	store := NewMemStore()
+	for _, b := range makeChain(t, ks, 10) {
+		require.NoError(t, store.Add(b))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := p2p.NewMemNetwork()
+	tr := n.Transport(algorithm.NodeID{1})
+	defer tr.Close()
+	r := NewReactor(Config{
+		Store:      store,
+		Validators: func(uint64) (*types.ValidatorSet, bool) { return vs, true },
+		MaxServed:  3,
+		Interval:   time.Hour,
+	}, tr)
+	go func() { _ = r.Run(ctx) }()
+
+	// A peer requesting every block at once is only served MaxServed of
+	// them in an interval.
+	requester := n.Transport(algorithm.NodeID{2})
+	defer requester.Close()
+	for h := uint64(1); h <= 10; h++ {
+		require.NoError(t, requester.Send(tr.ID(), Channel, encodeHeight(kindRequest, h)))
+	}
+	served := 0
+	timeout := time.After(200 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case e := <-requester.Receive():
+			if e.Payload[0] == kindBlock {
+				served++
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	assert.Equal(t, 3, served)
+}
+
+func TestBlocksyncHandsOverToConsensus(t *testing.T) {
+	ks := testKeys(4)
+	vs := validatorSet(t, ks)
+	validators := func(uint64) (*types.ValidatorSet, bool) { return vs, true }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The validators run consensus and serve the blocks they decide.
+	n := p2p.NewMemNetwork()
+	var stores []*MemStore
+	for _, k := range ks {
+		tr := n.Transport(id(k))
+		defer tr.Close()
+		mux := p2p.NewMux(tr, p2p.MuxConfig{})
+		consensusTransport, blocksyncTransport := mux.Channels(consensus.Channel), mux.Channels(Channel)
+		mux.Start()
+		store := NewMemStore()
+		stores = append(stores, store)
+		d := consensus.NewDriver(consensus.Config{
+			ChainID:        testChainID,
+			Signer:         types.NewKeySigner(k),
+			Validators:     vs,
+			TimeoutUnit:    20 * time.Millisecond,
+			GossipInterval: 5 * time.Millisecond,
+			Decided: func(_ *algorithm.ConsensusMessage, b *types.Block) []types.ValidatorUpdate {
+				_ = store.Add(b)
+				return nil
+			},
+		}, consensusTransport)
+		r := NewReactor(Config{Store: store, Validators: validators, Interval: 5 * time.Millisecond}, blocksyncTransport)
+		go func() { _ = d.Run(ctx) }()
+		go func() { _ = r.Run(ctx) }()
+	}
+	require.Eventually(t, func() bool { return stores[0].Height() >= 10 }, testTimeout, time.Millisecond)
+
+	// A new node syncs the decided blocks and then follows consensus.
+	tr := n.Transport(algorithm.NodeID{0xff})
+	defer tr.Close()
+	mux := p2p.NewMux(tr, p2p.MuxConfig{})
+	consensusTransport, blocksyncTransport := mux.Channels(consensus.Channel), mux.Channels(Channel)
+	mux.Start()
+	var mu sync.Mutex
+	var synced, decided []uint64
+	store := NewMemStore()
+	r := NewReactor(Config{
+		ChainID:    testChainID,
+		Store:      store,
+		Validators: validators,
+		Height:     1,
+		MinPeers:   len(ks),
+		Interval:   5 * time.Millisecond,
+		Apply: func(p *algorithm.ConsensusMessage, b *types.Block) error {
+			mu.Lock()
+			synced = append(synced, p.Height)
+			mu.Unlock()
+			return store.Add(b)
+		},
+		Synced: func(height uint64) {
+			d := consensus.NewDriver(consensus.Config{
+				ChainID:        testChainID,
+				Validators:     vs,
+				Height:         height,
+				TimeoutUnit:    20 * time.Millisecond,
+				GossipInterval: 5 * time.Millisecond,
+				Decided: func(p *algorithm.ConsensusMessage, b *types.Block) []types.ValidatorUpdate {
+					mu.Lock()
+					decided = append(decided, p.Height)
+					mu.Unlock()
+					_ = store.Add(b)
+					return nil
+				},
+			}, consensusTransport)
+			go func() { _ = d.Run(ctx) }()
+		},
+	}, blocksyncTransport)
+	go func() { _ = r.Run(ctx) }()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(decided) >= 3
+	}, testTimeout, time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	// The node waits to hear from every validator, so it syncs at least the
+	// blocks they held when it started.
+	assert.GreaterOrEqual(t, len(synced), 10)
+	// Every height was either synced or decided, in order.
+	heights := append(append([]uint64{}, synced...), decided...)
+	for i, h := range heights {
+		assert.Equal(t, uint64(i+1), h)
+	}
+	for h := uint64(1); h <= store.Height(); h++ {
+		if b := stores[0].Block(h); b != nil {
+			assert.Equal(t, b.Commit.Value, store.Block(h).Commit.Value)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package blocksync
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// The first byte of each payload on Channel identifies its kind.
+const (
+	// kindStatus is followed by an encoded status.
+	kindStatus byte = iota + 1
+	// kindRequest is followed by the big endian 8 byte height requested.
+	kindRequest
+	// kindNoBlock is followed by the big endian 8 byte height of a request
+	// that can't be served.
+	kindNoBlock
+	// kindBlock is followed by an encoded blockMessage.
+	kindBlock
+	// kindPart is followed by an encoded partMessage.
+	kindPart
+	// kindStatusRequest asks a peer to announce its status, it has no body.
+	kindStatusRequest
+)
+
+// status is the range of heights a node serves, nodes announce theirs to
+// their peers whenever it changes.
+type status struct {
+	base   uint64
+	height uint64
+}
+
+func (s status) encode() []byte {
+	b := []byte{kindStatus}
+	b = binary.BigEndian.AppendUint64(b, s.base)
+	return binary.BigEndian.AppendUint64(b, s.height)
+}
+
+func decodeStatus(b []byte) (status, error) {
+	if len(b) != 16 {
+		return status{}, fmt.Errorf("status has length %d", len(b))
+	}
+	s := status{base: binary.BigEndian.Uint64(b), height: binary.BigEndian.Uint64(b[8:])}
+	if s.base > s.height {
+		return status{}, fmt.Errorf("invalid status %+v", s)
+	}
+	return s, nil
+}
+
+func encodeHeight(kind byte, height uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte{kind}, height)
+}
+
+func decodeHeight(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("height has length %d", len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// blockMessage carries a block without its payload, the payload follows in
+// partMessages so that blocks of any size fit within a transport's frames.
+type blockMessage struct {
+	proposal []byte
+	commit   *types.Commit
+}
+
+func (m *blockMessage) encode() []byte {
+	commit, err := m.commit.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	b := make([]byte, 1, 1+len(m.proposal)+len(commit))
+	b[0] = kindBlock
+	b = append(b, m.proposal...)
+	return append(b, commit...)
+}
+
+func decodeBlockMessage(b []byte) (*blockMessage, error) {
+	if len(b) < types.SignedProposalSize {
+		return nil, fmt.Errorf("block message has length %d", len(b))
+	}
+	m := &blockMessage{proposal: b[:types.SignedProposalSize], commit: new(types.Commit)}
+	if err := m.commit.UnmarshalBinary(b[types.SignedProposalSize:]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// partMessage carries one part of the payload of the block at height.
+type partMessage struct {
+	height uint64
+	part   *types.Part
+}
+
+func (m *partMessage) encode() []byte {
+	part, err := m.part.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	b := make([]byte, 1, 9+len(part))
+	b[0] = kindPart
+	b = binary.BigEndian.AppendUint64(b, m.height)
+	return append(b, part...)
+}
+
+func decodePartMessage(b []byte) (*partMessage, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("part message has length %d", len(b))
+	}
+	part, err := types.DecodePart(b[8:])
+	if err != nil {
+		return nil, err
+	}
+	return &partMessage{height: binary.BigEndian.Uint64(b), part: part}, nil
+}
@@ -0,0 +1,73 @@
+package blocksync
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// Store holds the decided blocks that a Reactor serves to its peers, it must
+// be safe for concurrent use.
+type Store interface {
+	// Base returns the lowest height held, or 0 if no blocks are held.
+	Base() uint64
+	// Height returns the highest height held, or 0 if no blocks are held.
+	Height() uint64
+	// Block returns the block decided at height, or nil if it is not held.
+	Block(height uint64) *types.Block
+}
+
+// MemStore is a Store holding a contiguous range of blocks in memory.
+type MemStore struct {
+	mu     sync.RWMutex
+	base   uint64
+	blocks []*types.Block
+}
+
+// NewMemStore creates an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{}
+}
+
+// Add adds the block decided at the height following the highest held, the
+// first block added may be for any height.
+func (s *MemStore) Add(b *types.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	height := b.Commit.Height
+	if len(s.blocks) == 0 {
+		s.base = height
+	} else if height != s.base+uint64(len(s.blocks)) {
+		return fmt.Errorf("block for height %d added to store at height %d", height, s.base+uint64(len(s.blocks))-1)
+	}
+	s.blocks = append(s.blocks, b)
+	return nil
+}
+
+// Base implements Store.
+func (s *MemStore) Base() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.base
+}
+
+// Height implements Store.
+func (s *MemStore) Height() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.blocks) == 0 {
+		return 0
+	}
+	return s.base + uint64(len(s.blocks)) - 1
+}
+
+// Block implements Store.
+func (s *MemStore) Block(height uint64) *types.Block {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.blocks) == 0 || height < s.base || height-s.base >= uint64(len(s.blocks)) {
+		return nil
+	}
+	return s.blocks[height-s.base]
+}
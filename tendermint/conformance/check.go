@@ -0,0 +1,232 @@
+package conformance
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// Mismatch describes a step at which Algorithm's outputs differ from those
+// expected by a trace.
+type Mismatch struct {
+	Step     int
+	Input    string
+	Expected []Output
+	Actual   []Output
+}
+
+func (m *Mismatch) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "step %d (%s) produced unexpected outputs\n", m.Step, m.Input)
+	fmt.Fprintf(&b, "expected:\n")
+	for _, o := range m.Expected {
+		fmt.Fprintf(&b, "  %v\n", o)
+	}
+	fmt.Fprintf(&b, "actual:\n")
+	for _, o := range m.Actual {
+		fmt.Fprintf(&b, "  %v\n", o)
+	}
+	return b.String()
+}
+
+// Check replays t through Algorithm and returns a *Mismatch for the first
+// step at which the outputs differ from those expected. Outputs are compared
+// as sets after removing timeouts that could have no effect (see live).
+func Check(t *Trace) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	d := newDriver(t)
+	for i, s := range t.Steps {
+		if d.decided {
+			return fmt.Errorf("step %d follows a decision", i)
+		}
+		actual, err := d.apply(s)
+		if err != nil {
+			return fmt.Errorf("step %d: %w", i, err)
+		}
+		expected := append([]Output{}, s.Expect...)
+		sortOutputs(expected)
+		if !equal(expected, actual) {
+			return &Mismatch{Step: i, Input: s.String(), Expected: expected, Actual: actual}
+		}
+	}
+	return nil
+}
+
+func equal(a, b []Output) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// driver runs an Algorithm in the same way as a node would, it owns the
+// Store, marks proposed values as valid, filters proposals from non
+// proposers, delivers broadcast messages back to the Algorithm and replays
+// held messages when a new round starts.
+type driver struct {
+	trace *Trace
+	store *algorithm.Store
+	algo  *algorithm.Algorithm
+	// names maps hashes back to the values in the trace.
+	names   map[[32]byte]string
+	pending map[Timeout]*algorithm.Timeout
+	decided bool
+	out     []Output
+}
+
+func newDriver(t *Trace) *driver {
+	d := &driver{
+		trace:   t,
+		store:   algorithm.NewStore(),
+		names:   map[[32]byte]string{algorithm.NilValue: Nil},
+		pending: make(map[Timeout]*algorithm.Timeout),
+	}
+	d.algo = algorithm.New(nodeID(t.Self), algorithm.NewBasicOracle(len(t.Validators), t.Height, d.store))
+	d.name(t.Value)
+	return d
+}
+
+func (d *driver) name(value string) [32]byte {
+	h := hash(value)
+	d.names[h] = value
+	return h
+}
+
+func (d *driver) apply(s Step) ([]Output, error) {
+	d.out = nil
+	switch {
+	case s.Start != nil:
+		if *s.Start <= d.algo.State().Round {
+			return nil, fmt.Errorf("cannot start round %d from round %d", *s.Start, d.algo.State().Round)
+		}
+		d.startRound(*s.Start)
+	case s.Receive != nil:
+		cm, err := d.consensusMessage(*s.Receive)
+		if err != nil {
+			return nil, err
+		}
+		d.receive(cm)
+	case s.Timeout != nil:
+		// A timeout that Algorithm did not schedule can only be one that
+		// would have had no effect.
+		if to, ok := d.pending[*s.Timeout]; ok {
+			delete(d.pending, *s.Timeout)
+			cm, rc := d.algo.OnTimeout(to)
+			d.handle(rc, cm, nil)
+		}
+	}
+	st := d.algo.State()
+	return live(d.out, st.Round, int(st.Step), d.decided), nil
+}
+
+func (d *driver) consensusMessage(m Message) (*algorithm.ConsensusMessage, error) {
+	step, err := m.step()
+	if err != nil {
+		return nil, err
+	}
+	cm := &algorithm.ConsensusMessage{
+		Sender:  nodeID(m.Sender),
+		MsgType: step,
+		Height:  d.trace.Height,
+		Round:   m.Round,
+		Value:   d.name(m.Value),
+	}
+	if step == algorithm.Propose {
+		cm.ValidRound = m.ValidRound
+	}
+	return cm, nil
+}
+
+func (d *driver) message(cm *algorithm.ConsensusMessage) *Message {
+	m := &Message{
+		Sender: d.trace.Self,
+		Round:  cm.Round,
+		Value:  d.names[cm.Value],
+	}
+	switch cm.MsgType {
+	case algorithm.Propose:
+		m.Type = Proposal
+		m.ValidRound = cm.ValidRound
+	case algorithm.Prevote:
+		m.Type = Prevote
+	case algorithm.Precommit:
+		m.Type = Precommit
+	}
+	for _, v := range d.trace.Validators {
+		if nodeID(v) == cm.Sender {
+			m.Sender = v
+		}
+	}
+	return m
+}
+
+func (d *driver) startRound(round int) {
+	d.out = append(d.out, Output{StartRound: &round})
+	value := algorithm.NilValue
+	if d.trace.proposer(round) == d.trace.Self {
+		value = d.name(d.trace.Value)
+	}
+	cm, to := d.algo.StartRound(value, round)
+	d.handle(nil, cm, to)
+
+	// The Algorithm only evaluates upon rules on receipt of a message, so
+	// messages already held for the new round are replayed.
+	for _, m := range d.store.RoundMessages(round) {
+		if d.decided || d.algo.State().Round != round {
+			return
+		}
+		d.handle(d.algo.ReceiveMessage(m))
+	}
+}
+
+func (d *driver) receive(cm *algorithm.ConsensusMessage) {
+	if cm.Validate() != nil || !d.trace.isValidator(d.message(cm).Sender) {
+		return
+	}
+	if cm.MsgType == algorithm.Propose {
+		if cm.Sender != nodeID(d.trace.proposer(cm.Round)) {
+			return
+		}
+		if d.trace.valid(d.names[cm.Value]) {
+			d.store.SetValid(&cm.Value)
+		}
+	}
+	if err := d.store.AddMessage(cm, nil, messageHash(cm)); err != nil && !errors.Is(err, algorithm.ErrConflictingProposal) {
+		return
+	}
+	d.handle(d.algo.ReceiveMessage(cm))
+}
+
+func (d *driver) handle(rc *algorithm.RoundChange, cm *algorithm.ConsensusMessage, to *algorithm.Timeout) {
+	if to != nil {
+		t := Timeout{Type: timeoutType(to.Type()), Round: to.Round()}
+		d.pending[t] = to
+		d.out = append(d.out, Output{Schedule: &t})
+	}
+	if cm != nil {
+		d.out = append(d.out, Output{Broadcast: d.message(cm)})
+		d.receive(cm)
+	}
+	if rc != nil && !d.decided {
+		if rc.Decision != nil {
+			d.decided = true
+			d.out = append(d.out, Output{Decide: d.message(rc.Decision)})
+			return
+		}
+		d.startRound(rc.Round)
+	}
+}
+
+// messageHash identifies a message for the store.
+func messageHash(cm *algorithm.ConsensusMessage) [32]byte {
+	return hash(fmt.Sprintf("%x/%d/%d/%x/%d", cm.Sender, cm.MsgType, cm.Round, cm.Value, cm.ValidRound))
+}
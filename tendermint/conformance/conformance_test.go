@@ -0,0 +1,90 @@
+package conformance
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraces(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.json")
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			f, err := os.Open(path)
+			require.NoError(t, err)
+			defer f.Close()
+			trace, err := ReadTrace(f)
+			require.NoError(t, err)
+
+			// The reference model agrees with the hand written trace.
+			p := NewReference(trace)
+			for i, s := range trace.Steps {
+				outputs, err := p.Apply(s)
+				require.NoError(t, err)
+				require.ElementsMatch(t, s.Expect, outputs, "step %d", i)
+			}
+
+			require.NoError(t, Check(trace))
+		})
+	}
+}
+
+func TestGeneratedTracesConform(t *testing.T) {
+	decisions := 0
+	for seed := int64(0); seed < 1000; seed++ {
+		trace := Generate(seed, 200)
+		require.NoError(t, Check(trace), "seed %d", seed)
+		last := trace.Steps[len(trace.Steps)-1]
+		for _, o := range last.Expect {
+			if o.Decide != nil {
+				decisions++
+			}
+		}
+	}
+	// Make sure that the generated traces are exercising decisions.
+	assert.Greater(t, decisions, 10)
+}
+
+func TestTraceRoundTrip(t *testing.T) {
+	trace := Generate(1, 50)
+	var b bytes.Buffer
+	require.NoError(t, WriteTrace(&b, trace))
+	decoded, err := ReadTrace(&b)
+	require.NoError(t, err)
+	assert.Equal(t, trace, decoded)
+}
+
+func TestCheckReportsMismatch(t *testing.T) {
+	trace := Generate(1, 50)
+	// Drop the proposal we broadcast when starting round 0.
+	trace.Steps[0].Expect = trace.Steps[0].Expect[1:]
+	err := Check(trace)
+	require.Error(t, err)
+	var m *Mismatch
+	require.ErrorAs(t, err, &m)
+	assert.Equal(t, 0, m.Step)
+	assert.Len(t, m.Actual, len(m.Expected)+1)
+}
+
+func TestReadTraceRejectsMalformedTraces(t *testing.T) {
+	for name, trace := range map[string]string{
+		"unknown field":        `{"validators": ["p0"], "self": "p0", "value": "A", "bogus": 1}`,
+		"self not a validator": `{"validators": ["p0"], "self": "p1", "value": "A"}`,
+		"no value":             `{"validators": ["p0"], "self": "p0"}`,
+		"two inputs":           `{"validators": ["p0"], "self": "p0", "value": "A", "steps": [{"start": 0, "timeout": {"type": "PROPOSE", "round": 0}}]}`,
+		"unknown message":      `{"validators": ["p0"], "self": "p0", "value": "A", "steps": [{"receive": {"type": "VOTE", "src": "p0"}}]}`,
+		"unknown timeout":      `{"validators": ["p0"], "self": "p0", "value": "A", "steps": [{"timeout": {"type": "COMMIT"}}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ReadTrace(strings.NewReader(trace))
+			assert.Error(t, err)
+		})
+	}
+}
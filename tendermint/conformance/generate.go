@@ -0,0 +1,64 @@
+package conformance
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Generate produces a trace of the given number of steps for the first of
+// four validators by driving Reference with random inputs. The other
+// validators send arbitrary, possibly conflicting, messages for rounds close
+// to the process's current round and timeouts expire at random. Generation
+// stops early if the process decides.
+func Generate(seed int64, steps int) *Trace {
+	r := rand.New(rand.NewSource(seed))
+	t := &Trace{
+		Validators: []string{"p0", "p1", "p2", "p3"},
+		Self:       "p0",
+		Height:     1,
+		Value:      "A",
+		Invalid:    []string{"X"},
+	}
+	// A is favoured so that quorums, and so decisions, are more likely.
+	values := []string{"A", "A", "B", "X"}
+	p := NewReference(t)
+	start := 0
+	input := Step{Start: &start}
+	for i := 0; i < steps && !p.Decided(); i++ {
+		outputs, err := p.Apply(input)
+		if err != nil {
+			panic(fmt.Sprintf("generated invalid input %v: %v", input, err))
+		}
+		input.Expect = outputs
+		t.Steps = append(t.Steps, input)
+
+		pending := p.Pending()
+		if len(pending) > 0 && r.Intn(4) == 0 {
+			input = Step{Timeout: &pending[r.Intn(len(pending))]}
+			continue
+		}
+		round := p.Round() + r.Intn(4) - 1
+		if round < 0 {
+			round = 0
+		}
+		m := Message{
+			Sender: t.Validators[1+r.Intn(len(t.Validators)-1)],
+			Round:  round,
+			Value:  values[r.Intn(len(values))],
+		}
+		switch r.Intn(3) {
+		case 0:
+			m.Type = Proposal
+			m.ValidRound = r.Intn(round+1) - 1
+		case 1:
+			m.Type = Prevote
+		case 2:
+			m.Type = Precommit
+		}
+		if m.Type != Proposal && r.Intn(3) == 0 {
+			m.Value = Nil
+		}
+		input = Step{Receive: &m}
+	}
+	return t
+}
@@ -0,0 +1,414 @@
+package conformance
+
+import (
+	"fmt"
+	"sort"
+)
+
+// step values of the whitepaper, ordered so that step >= prevote can be
+// expressed directly.
+const (
+	stepPropose = iota
+	stepPrevote
+	stepPrecommit
+)
+
+// Reference is an executable model of the whitepaper pseudocode for a single
+// process at a single height. It favours following the pseudocode over
+// efficiency, after every input all upon rules are evaluated against the full
+// message log until none apply.
+type Reference struct {
+	trace *Trace
+
+	round       int
+	step        int
+	decision    *Message
+	lockedValue string
+	lockedRound int
+	validValue  string
+	validRound  int
+
+	// log holds the messages received, there is at most one prevote and
+	// one precommit per sender and round, proposals are only accepted from
+	// the proposer and at most two are kept per round, the first and one
+	// conflicting proposal.
+	log []Message
+	// pending holds scheduled timeouts that have not yet expired.
+	pending map[Timeout]bool
+	// fired records which rules guarded by 'for the first time' have fired
+	// in the current round, keyed by line number.
+	fired map[int]bool
+
+	out []Output
+}
+
+// NewReference creates a reference model for the process and height
+// described by t, the steps of t are ignored.
+func NewReference(t *Trace) *Reference {
+	return &Reference{
+		trace:       t,
+		round:       -1,
+		lockedValue: Nil,
+		lockedRound: -1,
+		validValue:  Nil,
+		validRound:  -1,
+		pending:     make(map[Timeout]bool),
+		fired:       make(map[int]bool),
+	}
+}
+
+// Round returns the current round.
+func (p *Reference) Round() int {
+	return p.round
+}
+
+// Decided returns true once the process has decided.
+func (p *Reference) Decided() bool {
+	return p.decision != nil
+}
+
+// Pending returns the timeouts that have been scheduled and not expired.
+func (p *Reference) Pending() []Timeout {
+	var result []Timeout
+	for t := range p.pending {
+		result = append(result, t)
+	}
+	sortTimeouts(result)
+	return result
+}
+
+// Apply applies the input of s and returns the outputs produced, s.Expect is
+// ignored.
+func (p *Reference) Apply(s Step) ([]Output, error) {
+	if p.decision != nil {
+		return nil, fmt.Errorf("process has already decided")
+	}
+	p.out = nil
+	switch {
+	case s.Start != nil:
+		if *s.Start <= p.round {
+			return nil, fmt.Errorf("cannot start round %d from round %d", *s.Start, p.round)
+		}
+		p.startRound(*s.Start)
+	case s.Receive != nil:
+		p.receive(*s.Receive)
+	case s.Timeout != nil:
+		if !p.pending[*s.Timeout] {
+			return nil, fmt.Errorf("%v was not scheduled", s.Timeout)
+		}
+		delete(p.pending, *s.Timeout)
+		p.expire(*s.Timeout)
+	}
+	p.run()
+	return live(p.out, p.round, p.step, p.decision != nil), nil
+}
+
+// receive adds m to the log if it would be accepted.
+func (p *Reference) receive(m Message) {
+	if !p.trace.isValidator(m.Sender) {
+		return
+	}
+	proposals := 0
+	for _, l := range p.log {
+		if l == m {
+			return
+		}
+		// Only the first vote of each type from a sender in a round
+		// counts.
+		if m.Type != Proposal && l.Type == m.Type && l.Sender == m.Sender && l.Round == m.Round {
+			return
+		}
+		if m.Type == Proposal && l.Type == Proposal && l.Sender == m.Sender && l.Round == m.Round {
+			proposals++
+		}
+	}
+	if proposals >= 2 {
+		return
+	}
+	if m.Type == Proposal {
+		if m.Sender != p.trace.proposer(m.Round) || m.ValidRound < -1 || m.ValidRound >= m.Round {
+			return
+		}
+	} else {
+		// The valid round of a vote has no meaning.
+		m.ValidRound = 0
+	}
+	if m.Round < 0 {
+		return
+	}
+	p.log = append(p.log, m)
+}
+
+func (p *Reference) broadcast(m Message) {
+	m.Sender = p.trace.Self
+	p.out = append(p.out, Output{Broadcast: &m})
+	p.receive(m)
+}
+
+func (p *Reference) schedule(t Timeout) {
+	p.pending[t] = true
+	p.out = append(p.out, Output{Schedule: &t})
+}
+
+// startRound is lines 11 to 21.
+func (p *Reference) startRound(round int) {
+	p.out = append(p.out, Output{StartRound: &round})
+	p.round = round
+	p.step = stepPropose
+	p.fired = make(map[int]bool)
+	if p.trace.proposer(round) == p.trace.Self {
+		proposal := p.trace.Value
+		if p.validValue != Nil {
+			proposal = p.validValue
+		}
+		p.broadcast(Message{Type: Proposal, Round: round, Value: proposal, ValidRound: p.validRound})
+	} else {
+		p.schedule(Timeout{Type: TimeoutPropose, Round: round})
+	}
+}
+
+// expire is lines 57 to 67.
+func (p *Reference) expire(t Timeout) {
+	if t.Round != p.round {
+		return
+	}
+	switch t.Type {
+	case TimeoutPropose:
+		if p.step == stepPropose {
+			p.broadcast(Message{Type: Prevote, Round: p.round, Value: Nil})
+			p.step = stepPrevote
+		}
+	case TimeoutPrevote:
+		if p.step == stepPrevote {
+			p.broadcast(Message{Type: Precommit, Round: p.round, Value: Nil})
+			p.step = stepPrecommit
+		}
+	case TimeoutPrecommit:
+		p.startRound(p.round + 1)
+	}
+}
+
+// run applies upon rules until none apply. Line 49 is evaluated first, once
+// the process decides it moves to the next height so no other rule of this
+// height could apply, whereas evaluating it last would allow outputs that are
+// made irrelevant by the decision.
+func (p *Reference) run() {
+	rules := []func() bool{p.line49, p.proposalRules, p.line34, p.line36, p.line44, p.line47, p.line55}
+	for p.decision == nil {
+		applied := false
+		for _, rule := range rules {
+			if rule() {
+				applied = true
+				break
+			}
+		}
+		if !applied {
+			return
+		}
+	}
+}
+
+// proposals returns the proposals received for the given round.
+func (p *Reference) proposals(round int) []Message {
+	var result []Message
+	for _, m := range p.log {
+		if m.Type == Proposal && m.Round == round {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// count counts votes of the given type and round for value, Nil counts nil
+// votes and the empty string counts votes for any value.
+func (p *Reference) count(msgType string, round int, value string) int {
+	result := 0
+	for _, m := range p.log {
+		if m.Type == msgType && m.Round == round && (value == "" || m.Value == value) {
+			result++
+		}
+	}
+	return result
+}
+
+func (p *Reference) prevote(value string) {
+	p.broadcast(Message{Type: Prevote, Round: p.round, Value: value})
+	p.step = stepPrevote
+}
+
+// line22 is upon <PROPOSAL, h, round, v, -1> from proposer(h, round) while
+// step = propose.
+func (p *Reference) line22(m Message) bool {
+	if m.ValidRound != -1 {
+		return false
+	}
+	if p.trace.valid(m.Value) && (p.lockedRound == -1 || p.lockedValue == m.Value) {
+		p.prevote(m.Value)
+	} else {
+		p.prevote(Nil)
+	}
+	return true
+}
+
+// line28 is upon <PROPOSAL, h, round, v, vr> from proposer(h, round) AND 2f+1
+// <PREVOTE, h, vr, id(v)> while step = propose AND (vr >= 0 AND vr < round).
+func (p *Reference) line28(m Message) bool {
+	vr := m.ValidRound
+	if vr < 0 || vr >= p.round || p.count(Prevote, vr, m.Value) < p.trace.quorum() {
+		return false
+	}
+	if p.trace.valid(m.Value) && (p.lockedRound <= vr || p.lockedValue == m.Value) {
+		p.prevote(m.Value)
+	} else {
+		p.prevote(Nil)
+	}
+	return true
+}
+
+// proposalRules evaluates lines 22 and 28. Both are guarded by step =
+// propose, so only one of them can fire in a round, but if the proposer
+// equivocated each could be enabled by a different proposal. The pseudocode
+// leaves the choice open, we take the proposals in the order they were
+// received.
+func (p *Reference) proposalRules() bool {
+	if p.step != stepPropose {
+		return false
+	}
+	for _, m := range p.proposals(p.round) {
+		if p.line22(m) || p.line28(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// line34 is upon 2f+1 <PREVOTE, h, round, *> while step = prevote for the
+// first time.
+func (p *Reference) line34() bool {
+	if p.step != stepPrevote || p.fired[34] || p.count(Prevote, p.round, "") < p.trace.quorum() {
+		return false
+	}
+	p.fired[34] = true
+	p.schedule(Timeout{Type: TimeoutPrevote, Round: p.round})
+	return true
+}
+
+// line36 is upon <PROPOSAL, h, round, v, *> from proposer(h, round) AND 2f+1
+// <PREVOTE, h, round, id(v)> while valid(v) AND step >= prevote for the first
+// time.
+func (p *Reference) line36() bool {
+	if p.step < stepPrevote || p.fired[36] {
+		return false
+	}
+	for _, m := range p.proposals(p.round) {
+		if !p.trace.valid(m.Value) || p.count(Prevote, p.round, m.Value) < p.trace.quorum() {
+			continue
+		}
+		p.fired[36] = true
+		if p.step == stepPrevote {
+			p.lockedValue = m.Value
+			p.lockedRound = p.round
+			p.broadcast(Message{Type: Precommit, Round: p.round, Value: m.Value})
+			p.step = stepPrecommit
+		}
+		p.validValue = m.Value
+		p.validRound = p.round
+		return true
+	}
+	return false
+}
+
+// line44 is upon 2f+1 <PREVOTE, h, round, nil> while step = prevote.
+func (p *Reference) line44() bool {
+	if p.step != stepPrevote || p.count(Prevote, p.round, Nil) < p.trace.quorum() {
+		return false
+	}
+	p.broadcast(Message{Type: Precommit, Round: p.round, Value: Nil})
+	p.step = stepPrecommit
+	return true
+}
+
+// line47 is upon 2f+1 <PRECOMMIT, h, round, *> for the first time.
+func (p *Reference) line47() bool {
+	if p.fired[47] || p.count(Precommit, p.round, "") < p.trace.quorum() {
+		return false
+	}
+	p.fired[47] = true
+	p.schedule(Timeout{Type: TimeoutPrecommit, Round: p.round})
+	return true
+}
+
+// line49 is upon <PROPOSAL, h, r, v, *> from proposer(h, r) AND 2f+1
+// <PRECOMMIT, h, r, id(v)> while decision = nil.
+func (p *Reference) line49() bool {
+	for _, m := range p.log {
+		if m.Type != Proposal || p.count(Precommit, m.Round, m.Value) < p.trace.quorum() {
+			continue
+		}
+		if !p.trace.valid(m.Value) {
+			continue
+		}
+		decision := m
+		p.decision = &decision
+		p.out = append(p.out, Output{Decide: &decision})
+		return true
+	}
+	return false
+}
+
+// line55 is upon f+1 <*, h, round, *, *> with round > round_p.
+func (p *Reference) line55() bool {
+	senders := make(map[int]map[string]bool)
+	for _, m := range p.log {
+		if m.Round <= p.round {
+			continue
+		}
+		if senders[m.Round] == nil {
+			senders[m.Round] = make(map[string]bool)
+		}
+		senders[m.Round][m.Sender] = true
+	}
+	// Should several rounds qualify, move to the lowest.
+	next := -1
+	for r, s := range senders {
+		if len(s) >= p.trace.fThreshold() && (next == -1 || r < next) {
+			next = r
+		}
+	}
+	if next == -1 {
+		return false
+	}
+	p.startRound(next)
+	return true
+}
+
+// live removes scheduled timeouts that could have no effect were they to
+// expire, given the process's round and step after handling an input. Rules
+// that schedule timeouts are sometimes superseded by rules that fire in
+// response to the same input, for instance line 34 schedules timeoutPrevote
+// but line 36 then moves the process to the precommit step, Algorithm
+// evaluates the superseding rule first and never schedules the timeout.
+// Since a process's round and step never decrease a timeout that is dead
+// stays dead, so removing them does not hide any behaviour.
+func live(outputs []Output, round, step int, decided bool) []Output {
+	var result []Output
+	for _, o := range outputs {
+		if t := o.Schedule; t != nil {
+			if decided || t.Round != round {
+				continue
+			}
+			if t.Type == TimeoutPropose && step != stepPropose || t.Type == TimeoutPrevote && step != stepPrevote {
+				continue
+			}
+		}
+		result = append(result, o)
+	}
+	sortOutputs(result)
+	return result
+}
+
+func sortTimeouts(ts []Timeout) {
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].String() < ts[j].String()
+	})
+}
@@ -0,0 +1,298 @@
+// Package conformance checks that Algorithm behaves as the pseudocode in the
+// whitepaper says it should.
+//
+// ReceiveMessage does not evaluate the upon rules in the order they appear in
+// the whitepaper and only evaluates the rules that involve the type of the
+// received message. To show that this does not change behaviour, traces of a
+// single process are replayed through Algorithm and its outputs are compared
+// to those expected by the trace. Traces can be written by hand, converted
+// from TLC counterexamples of the Tendermint TLA+ specification or generated
+// by Reference, an executable model that follows the pseudocode line by line.
+//
+// A trace describes one process at one height. Each step of a trace is a
+// single input, starting a round, receiving a message or a timeout expiring,
+// along with every output the process produces in response. Messages a
+// process broadcasts are delivered to itself immediately, so their effects
+// are part of the same step.
+package conformance
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// Message and timeout types as they appear in traces, these follow the naming
+// used by the TLA+ specification.
+const (
+	Proposal  = "PROPOSAL"
+	Prevote   = "PREVOTE"
+	Precommit = "PRECOMMIT"
+
+	TimeoutPropose   = "PROPOSE"
+	TimeoutPrevote   = "PREVOTE"
+	TimeoutPrecommit = "PRECOMMIT"
+
+	// Nil is the value used for nil votes.
+	Nil = "nil"
+)
+
+// Trace is the execution of a single process at a single height.
+type Trace struct {
+	// Validators lists the validators, all have equal voting power. The
+	// proposer of round r is Validators[r % len(Validators)].
+	Validators []string `json:"validators"`
+	// Self is the process the trace describes.
+	Self   string `json:"self"`
+	Height uint64 `json:"height"`
+	// Value is returned by getValue() when Self needs to propose.
+	Value string `json:"value"`
+	// Invalid lists the values for which valid() is false, all other values
+	// are valid.
+	Invalid []string `json:"invalid,omitempty"`
+	Steps   []Step   `json:"steps"`
+}
+
+// Step is a single input to the process along with the outputs it is
+// expected to produce. Exactly one of Start, Receive and Timeout is set.
+type Step struct {
+	// Start starts the given round, it is only used to start the first
+	// round, subsequent rounds are started by the process itself.
+	Start   *int     `json:"start,omitempty"`
+	Receive *Message `json:"receive,omitempty"`
+	Timeout *Timeout `json:"timeout,omitempty"`
+	// Expect holds the outputs produced in response to the input, their
+	// order is not significant.
+	Expect []Output `json:"expect"`
+}
+
+func (s Step) String() string {
+	switch {
+	case s.Start != nil:
+		return fmt.Sprintf("start round %d", *s.Start)
+	case s.Receive != nil:
+		return fmt.Sprintf("receive %v", s.Receive)
+	case s.Timeout != nil:
+		return fmt.Sprintf("expire %v", s.Timeout)
+	}
+	return "empty step"
+}
+
+// Message is a consensus message.
+type Message struct {
+	Type   string `json:"type"`
+	Sender string `json:"src"`
+	Round  int    `json:"round"`
+	Value  string `json:"value"`
+	// ValidRound is only meaningful for proposals.
+	ValidRound int `json:"validRound,omitempty"`
+}
+
+func (m Message) String() string {
+	if m.Type == Proposal {
+		return fmt.Sprintf("%s(%s, r:%d, %s, vr:%d)", m.Type, m.Sender, m.Round, m.Value, m.ValidRound)
+	}
+	return fmt.Sprintf("%s(%s, r:%d, %s)", m.Type, m.Sender, m.Round, m.Value)
+}
+
+// Timeout identifies a timeout by its type and round.
+type Timeout struct {
+	Type  string `json:"type"`
+	Round int    `json:"round"`
+}
+
+func (t Timeout) String() string {
+	name := t.Type
+	if len(name) > 0 {
+		name = name[:1] + strings.ToLower(name[1:])
+	}
+	return fmt.Sprintf("timeout%s(r:%d)", name, t.Round)
+}
+
+// Output is something a process does in response to an input, exactly one
+// field is set.
+type Output struct {
+	Broadcast *Message `json:"broadcast,omitempty"`
+	Schedule  *Timeout `json:"schedule,omitempty"`
+	// StartRound is set when the process starts a round.
+	StartRound *int `json:"startRound,omitempty"`
+	// Decide is set when the process decides, it holds the decided
+	// proposal.
+	Decide *Message `json:"decide,omitempty"`
+}
+
+func (o Output) String() string {
+	switch {
+	case o.Broadcast != nil:
+		return fmt.Sprintf("broadcast %v", o.Broadcast)
+	case o.Schedule != nil:
+		return fmt.Sprintf("schedule %v", o.Schedule)
+	case o.StartRound != nil:
+		return fmt.Sprintf("start round %d", *o.StartRound)
+	case o.Decide != nil:
+		return fmt.Sprintf("decide %v", o.Decide)
+	}
+	return "empty output"
+}
+
+// ReadTrace decodes a JSON encoded trace.
+func ReadTrace(r io.Reader) (*Trace, error) {
+	var t Trace
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&t); err != nil {
+		return nil, fmt.Errorf("failed to decode trace: %w", err)
+	}
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// WriteTrace JSON encodes t to w.
+func WriteTrace(w io.Writer, t *Trace) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(t)
+}
+
+func (t *Trace) validate() error {
+	if len(t.Validators) == 0 {
+		return fmt.Errorf("trace has no validators")
+	}
+	if !t.isValidator(t.Self) {
+		return fmt.Errorf("self %q is not a validator", t.Self)
+	}
+	if t.Value == "" || t.Value == Nil {
+		return fmt.Errorf("trace must provide a value to propose")
+	}
+	for _, v := range t.Validators {
+		if len(v) > len(algorithm.NodeID{}) {
+			return fmt.Errorf("validator name %q is longer than %d bytes", v, len(algorithm.NodeID{}))
+		}
+	}
+	for i, s := range t.Steps {
+		inputs := 0
+		for _, set := range []bool{s.Start != nil, s.Receive != nil, s.Timeout != nil} {
+			if set {
+				inputs++
+			}
+		}
+		if inputs != 1 {
+			return fmt.Errorf("step %d has %d inputs, expected exactly one", i, inputs)
+		}
+		if s.Receive != nil {
+			if _, err := s.Receive.step(); err != nil {
+				return fmt.Errorf("step %d: %w", i, err)
+			}
+		}
+		if s.Timeout != nil {
+			if _, err := timeoutStep(s.Timeout.Type); err != nil {
+				return fmt.Errorf("step %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Trace) isValidator(name string) bool {
+	for _, v := range t.Validators {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Trace) proposer(round int) string {
+	return t.Validators[round%len(t.Validators)]
+}
+
+func (t *Trace) valid(value string) bool {
+	if value == Nil {
+		return false
+	}
+	for _, v := range t.Invalid {
+		if v == value {
+			return false
+		}
+	}
+	return true
+}
+
+// quorum returns the voting power needed for a quorum, more than two thirds
+// of the validators. This is 2f+1 in the whitepaper when n = 3f+1.
+func (t *Trace) quorum() int {
+	return len(t.Validators)*2/3 + 1
+}
+
+// fThreshold returns the voting power needed to know that at least one
+// correct process is involved, more than a third of the validators. This is
+// f+1 in the whitepaper when n = 3f+1.
+func (t *Trace) fThreshold() int {
+	return len(t.Validators)/3 + 1
+}
+
+func (m *Message) step() (algorithm.Step, error) {
+	switch m.Type {
+	case Proposal:
+		return algorithm.Propose, nil
+	case Prevote:
+		return algorithm.Prevote, nil
+	case Precommit:
+		return algorithm.Precommit, nil
+	}
+	return 0, fmt.Errorf("unknown message type %q", m.Type)
+}
+
+func timeoutStep(t string) (algorithm.Step, error) {
+	switch t {
+	case TimeoutPropose:
+		return algorithm.Propose, nil
+	case TimeoutPrevote:
+		return algorithm.Prevote, nil
+	case TimeoutPrecommit:
+		return algorithm.Precommit, nil
+	}
+	return 0, fmt.Errorf("unknown timeout type %q", t)
+}
+
+func timeoutType(s algorithm.Step) string {
+	switch s {
+	case algorithm.Propose:
+		return TimeoutPropose
+	case algorithm.Prevote:
+		return TimeoutPrevote
+	}
+	return TimeoutPrecommit
+}
+
+// nodeID maps a validator name to a NodeID.
+func nodeID(name string) algorithm.NodeID {
+	var id algorithm.NodeID
+	copy(id[:], name)
+	return id
+}
+
+// hash maps a value to the hash that Algorithm operates on, nil maps to
+// NilValue.
+func hash(value string) tendermint.Hash {
+	if value == Nil {
+		return algorithm.NilValue
+	}
+	return sha256.Sum256([]byte(value))
+}
+
+// sortOutputs puts outputs into a canonical order so that sets of outputs can
+// be compared.
+func sortOutputs(outputs []Output) {
+	sort.Slice(outputs, func(i, j int) bool {
+		return outputs[i].String() < outputs[j].String()
+	})
+}
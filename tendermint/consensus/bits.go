@@ -0,0 +1,94 @@
+package consensus
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BitArray is a fixed size array of bits, it is used to describe which
+// validators' votes a node holds, bit i corresponding to the validator at
+// index i of the validator set.
+type BitArray struct {
+	size  int
+	words []uint64
+}
+
+// NewBitArray returns a BitArray of size bits, all unset.
+func NewBitArray(size int) *BitArray {
+	return &BitArray{size: size, words: make([]uint64, (size+63)/64)}
+}
+
+// Size returns the number of bits in the array.
+func (b *BitArray) Size() int {
+	return b.size
+}
+
+// Get returns bit i, bits outside of the array are unset.
+func (b *BitArray) Get(i int) bool {
+	if i < 0 || i >= b.size {
+		return false
+	}
+	return b.words[i/64]&(1<<(i%64)) != 0
+}
+
+// Set sets bit i, bits outside of the array are ignored.
+func (b *BitArray) Set(i int) {
+	if i < 0 || i >= b.size {
+		return
+	}
+	b.words[i/64] |= 1 << (i % 64)
+}
+
+// Or sets every bit that is set in other, other must have the same size.
+func (b *BitArray) Or(other *BitArray) {
+	for i := range b.words {
+		if i < len(other.words) {
+			b.words[i] |= other.words[i]
+		}
+	}
+}
+
+// Count returns the number of set bits.
+func (b *BitArray) Count() int {
+	count := 0
+	for i := 0; i < b.size; i++ {
+		if b.Get(i) {
+			count++
+		}
+	}
+	return count
+}
+
+// MarshalBinary encodes the array as a 2 byte big endian size followed by the
+// bits, least significant bit first.
+func (b *BitArray) MarshalBinary() ([]byte, error) {
+	if b.size > 0xffff {
+		return nil, fmt.Errorf("bit array of size %d is too large to encode", b.size)
+	}
+	result := make([]byte, 2+(b.size+7)/8)
+	binary.BigEndian.PutUint16(result, uint16(b.size))
+	for i := 0; i < b.size; i++ {
+		if b.Get(i) {
+			result[2+i/8] |= 1 << (i % 8)
+		}
+	}
+	return result, nil
+}
+
+// UnmarshalBinary decodes an array encoded by MarshalBinary.
+func (b *BitArray) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("bit array too short")
+	}
+	size := int(binary.BigEndian.Uint16(data))
+	if len(data) != 2+(size+7)/8 {
+		return fmt.Errorf("bit array of size %d has length %d", size, len(data))
+	}
+	*b = *NewBitArray(size)
+	for i := 0; i < size; i++ {
+		if data[2+i/8]&(1<<(i%8)) != 0 {
+			b.Set(i)
+		}
+	}
+	return nil
+}
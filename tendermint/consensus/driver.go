@@ -0,0 +1,760 @@
+// Package consensus runs Algorithm over a p2p.Transport.
+//
+// Algorithm is a pure state machine, the Driver supplies everything else that
+// a node needs to reach consensus. It validates and filters messages from the
+// network, adds them to the Store, feeds them to the Algorithm, signs and
+// broadcasts the Algorithm's messages, schedules its timeouts and moves
+// through rounds and heights.
+//
+// Proposals carry a header holding the proposer's time, the hashes of the
+// validator sets, the application hash resulting from the previous heights
+// and the header of the part set holding the proposed payload, the proposed
+// value is the hash of the header. The payload itself is split into Merkle
+// proved parts that are gossiped separately. A proposal is only passed to
+// the Algorithm once its payload has been reassembled and verified, and only
+// then is the value marked valid in the Store.
+//
+// Messages are gossiped rather than flooded. Each node announces its round
+// state and, periodically, a bit array of the votes it holds for its current
+// round. A node sends its own messages to all its peers and relays the
+// messages of others only to the peers that lack them, so each peer receives
+// each message about once regardless of the size of the validator set.
+// A peer that announces a round state behind ours is sent the proposal and
+// votes it needs to catch up straight away.
+//
+// The validator set may change from one height to the next. The validator
+// updates returned by Decided are applied to a types.ValidatorSchedule and
+// take effect after its delay, each height is run and its messages verified
+// with the set that the schedule gives for it.
+//
+// The state transitions of the Driver, such as new rounds, locks, votes and
+// decisions, are published as Events to an optional EventBus, and its
+// operational metrics are recorded through the Metrics interface.
+package consensus
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/genesis"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// Channel is the p2p channel that carries consensus messages.
+const Channel p2p.ChannelID = 0x20
+
+const (
+	// DefaultTimeoutUnit is the default duration of one unit of
+	// Timeout.Delay.
+	DefaultTimeoutUnit = time.Second
+	// DefaultGossipInterval is the default interval between gossip rounds.
+	DefaultGossipInterval = 100 * time.Millisecond
+	// DefaultMaxClockDrift is the default bound on how far ahead of our
+	// clock the time of a proposal may be.
+	DefaultMaxClockDrift = 10 * time.Second
+)
+
+// historySize is the number of decided heights for which we keep the
+// messages needed to help lagging peers.
+const historySize = 64
+
+// ErrTransportClosed is returned by Run if the transport is closed.
+var ErrTransportClosed = errors.New("transport closed")
+
+// Config configures a Driver.
+type Config struct {
+	// Signer signs the messages of the local validator, if nil the node
+	// follows consensus without voting.
+	Signer types.Signer
+	// Genesis, if set, gives the defaults of ChainID, Height, Validators and
+	// the fields set by its consensus params. It must have been validated.
+	Genesis *genesis.Genesis
+	// ChainID identifies the chain, our messages are signed for it and
+	// messages signed for other chains are rejected.
+	ChainID string
+	// Validators is the validator set at Height, it is only used to create a
+	// Schedule if none is given.
+	Validators *types.ValidatorSet
+	// Schedule gives the validator set of each height, it must know the set
+	// at Height. If nil a schedule starting at Height with Validators and the
+	// default delay is used.
+	Schedule *types.ValidatorSchedule
+	// Height is the first height to run, it defaults to 1.
+	Height uint64
+	// TimeoutUnit scales the Delay of timeouts returned by Algorithm.
+	TimeoutUnit time.Duration
+	// GossipInterval is the interval between gossip rounds.
+	GossipInterval time.Duration
+	// TimeoutCommit is the time waited after deciding a height before
+	// starting the next, which lets transactions accumulate for the next
+	// proposal. Messages for the next height received meanwhile are buffered.
+	TimeoutCommit time.Duration
+	// MaxProposalSize bounds the size of the payloads we accept from
+	// proposers.
+	MaxProposalSize int
+	// LastBlockTime is the time in the header decided at Height-1, the
+	// headers proposed at Height must carry a later time. It is zero at the
+	// initial height.
+	LastBlockTime time.Time
+	// MaxClockDrift bounds how far ahead of our clock the time in a proposed
+	// header may be.
+	MaxClockDrift time.Duration
+	// Propose returns the payload to propose at the given height and round,
+	// if nil a payload derived from the arguments is used.
+	Propose func(height uint64, round int) []byte
+	// Valid decides the validity of proposed payloads, if nil all payloads
+	// are considered valid.
+	Valid func(payload []byte) bool
+	// AppHash returns the hash of the application state resulting from the
+	// heights below height, which proposals for height must carry. It is
+	// called once Decided has returned for the previous height, if nil the
+	// zero hash is used.
+	AppHash func(height uint64) tendermint.Hash
+	// Decided is called with the decided proposal and the decided block at
+	// each height, it is called from the goroutine executing Run. It returns
+	// the validator updates resulting from the block, which the Driver
+	// applies to Schedule.
+	Decided func(p *algorithm.ConsensusMessage, b *types.Block) []types.ValidatorUpdate
+	// EventBus receives the Driver's events, if nil no events are
+	// published.
+	EventBus *EventBus
+	// Logger records the upon rules executed by the Algorithm at LogLevel,
+	// if nil nothing is logged.
+	Logger   algorithm.Logger
+	LogLevel algorithm.Level
+	// Metrics records the Driver's metrics, if nil they are discarded.
+	Metrics Metrics
+}
+
+func (c *Config) setDefaults(id algorithm.NodeID) {
+	if g := c.Genesis; g != nil {
+		if c.ChainID == "" {
+			c.ChainID = g.ChainID
+		}
+		if c.Height == 0 {
+			c.Height = g.InitialHeight
+		}
+		if c.Validators == nil {
+			c.Validators, _ = g.ValidatorSet()
+		}
+		if c.TimeoutUnit == 0 {
+			c.TimeoutUnit = time.Duration(g.ConsensusParams.TimeoutUnit)
+		}
+		if c.TimeoutCommit == 0 {
+			c.TimeoutCommit = time.Duration(g.ConsensusParams.TimeoutCommit)
+		}
+		if c.MaxProposalSize == 0 {
+			c.MaxProposalSize = g.ConsensusParams.MaxProposalSize
+		}
+	}
+	if c.Height == 0 {
+		c.Height = 1
+	}
+	if c.TimeoutUnit == 0 {
+		c.TimeoutUnit = DefaultTimeoutUnit
+	}
+	if c.GossipInterval == 0 {
+		c.GossipInterval = DefaultGossipInterval
+	}
+	if c.MaxProposalSize == 0 {
+		c.MaxProposalSize = DefaultMaxProposalSize
+	}
+	if c.MaxClockDrift == 0 {
+		c.MaxClockDrift = DefaultMaxClockDrift
+	}
+	if c.Propose == nil {
+		c.Propose = func(height uint64, round int) []byte {
+			b := make([]byte, 20+16)
+			copy(b, id[:])
+			binary.BigEndian.PutUint64(b[20:], height)
+			binary.BigEndian.PutUint64(b[28:], uint64(round))
+			return b
+		}
+	}
+	if c.Valid == nil {
+		c.Valid = func([]byte) bool { return true }
+	}
+	if c.AppHash == nil {
+		c.AppHash = func(uint64) tendermint.Hash { return tendermint.Hash{} }
+	}
+	if c.Decided == nil {
+		c.Decided = func(*algorithm.ConsensusMessage, *types.Block) []types.ValidatorUpdate { return nil }
+	}
+	if c.Metrics == nil {
+		c.Metrics = nopMetrics{}
+	}
+	if c.Schedule == nil {
+		// The height is not zero and the delay is the default, so this can't
+		// fail.
+		c.Schedule, _ = types.NewValidatorSchedule(c.Height, c.Validators, 0)
+	}
+}
+
+// Driver drives an Algorithm over a Transport.
+type Driver struct {
+	cfg       Config
+	id        algorithm.NodeID
+	transport p2p.Transport
+
+	height atomic.Uint64
+	round  int
+	// validators is the validator set of the current height and appHash the
+	// application hash its proposals carry. lastTime is the time in the
+	// header decided at the previous height.
+	validators *types.ValidatorSet
+	appHash    tendermint.Hash
+	lastTime   time.Time
+	store      *algorithm.Store
+	algo       *algorithm.Algorithm
+	// payloads holds the proposed payloads of the current height by value,
+	// pending holds the proposals waiting for their payload. conflicting
+	// holds the headers of conflicting proposals whose payloads we only
+	// expect once a quorum votes for their value, quorums holds the values
+	// that a quorum of prevotes or precommits has been received for.
+	payloads    map[tendermint.Hash]*payload
+	pending     map[tendermint.Hash][]*algorithm.ConsensusMessage
+	conflicting map[tendermint.Hash]types.Header
+	quorums     map[tendermint.Hash]bool
+	// future and futureParts hold the raw messages and parts received for
+	// the next height, futurePayloads the part sets of the proposals in
+	// future by value. futureHashes and futureSenders hold the hashes of
+	// the messages in future and the number of them from each sender.
+	future         [][]byte
+	futureParts    []*partMessage
+	futurePayloads map[tendermint.Hash]*types.PartSet
+	futureHashes   map[tendermint.Hash]bool
+	futureSenders  map[algorithm.NodeID]int
+	// history holds the recently decided heights.
+	history map[uint64]*decidedHeight
+
+	peers     map[algorithm.NodeID]*peerState
+	announced roundState
+	// tick counts gossip rounds, arrived holds the tick at which each
+	// message of the current height was received.
+	tick    int
+	arrived map[*algorithm.ConsensusMessage]int
+	// roundStart and stepStart are the times at which the current round and
+	// step were entered.
+	roundStart time.Time
+	stepStart  time.Time
+
+	timeouts chan *algorithm.Timeout
+	// committing is set while waiting out TimeoutCommit, at the end of which
+	// the next height is sent on commits.
+	committing bool
+	commits    chan uint64
+	done       chan struct{}
+}
+
+type decidedHeight struct {
+	store    *algorithm.Store
+	decision *algorithm.ConsensusMessage
+	payload  *payload
+	// tick is the gossip round in which we decided.
+	tick int
+}
+
+// NewDriver creates a Driver that communicates over t, call Run to start it.
+func NewDriver(cfg Config, t p2p.Transport) *Driver {
+	id := t.ID()
+	if cfg.Signer != nil {
+		id = keys.Address(cfg.Signer.PubKey())
+	}
+	cfg.setDefaults(id)
+	return &Driver{
+		cfg:       cfg,
+		id:        id,
+		transport: t,
+		lastTime:  types.CanonicalTime(cfg.LastBlockTime),
+		history:   make(map[uint64]*decidedHeight),
+		peers:     make(map[algorithm.NodeID]*peerState),
+		timeouts:  make(chan *algorithm.Timeout),
+		commits:   make(chan uint64),
+		done:      make(chan struct{}),
+	}
+}
+
+// Height returns the height that the Driver is working on, it is safe to call
+// concurrently with Run.
+func (d *Driver) Height() uint64 {
+	return d.height.Load()
+}
+
+// Run runs consensus until ctx is cancelled or the transport is closed. Run
+// must only be called once.
+func (d *Driver) Run(ctx context.Context) error {
+	defer close(d.done)
+	gossip := time.NewTicker(d.cfg.GossipInterval)
+	defer gossip.Stop()
+	d.newHeight(d.cfg.Height)
+	for {
+		d.announceState()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-d.transport.Receive():
+			if !ok {
+				return ErrTransportClosed
+			}
+			if e.Channel == Channel {
+				d.receive(e)
+			}
+		case e, ok := <-d.transport.PeerEvents():
+			if !ok {
+				return ErrTransportClosed
+			}
+			if e.Type == p2p.PeerDown {
+				delete(d.peers, e.Peer)
+				continue
+			}
+			d.peer(e.Peer)
+			_ = d.transport.Send(e.Peer, Channel, d.announced.encode())
+		case <-gossip.C:
+			d.gossip()
+		case t := <-d.timeouts:
+			d.publish(Event{Type: EventTimeoutFired, Height: t.Height(), Round: t.Round(), Step: t.Type(), Timeout: t})
+			if d.committing {
+				// The height has been decided.
+				continue
+			}
+			if t.Height() == d.Height() && t.Round() == d.round {
+				d.cfg.Metrics.Timeout(t.Type())
+			}
+			before := d.algo.State()
+			cm, rc := d.algo.OnTimeout(t)
+			d.transitions(before)
+			d.handle(rc, cm, nil)
+		case height := <-d.commits:
+			d.committing = false
+			d.newHeight(height)
+		}
+	}
+}
+
+func (d *Driver) newHeight(height uint64) {
+	vs, ok := d.cfg.Schedule.At(height)
+	if !ok {
+		panic(fmt.Sprintf("consensus: validator set of height %d is unknown", height))
+	}
+	d.height.Store(height)
+	d.validators = vs
+	d.appHash = d.cfg.AppHash(height)
+	d.store = algorithm.NewStore()
+	d.payloads = make(map[tendermint.Hash]*payload)
+	d.pending = make(map[tendermint.Hash][]*algorithm.ConsensusMessage)
+	d.conflicting = make(map[tendermint.Hash]types.Header)
+	d.quorums = make(map[tendermint.Hash]bool)
+	d.algo = algorithm.New(d.id, &proposalOracle{
+		BasicOracle: algorithm.NewBasicOracle(vs.Size(), height, d.store),
+		received:    d.received,
+	})
+	d.algo.SetLogger(d.cfg.Logger, d.cfg.LogLevel)
+	d.round = -1
+	d.arrived = make(map[*algorithm.ConsensusMessage]int)
+	delete(d.history, height-historySize)
+	d.startRound(0)
+
+	future := d.future
+	d.future = nil
+	d.futurePayloads = make(map[tendermint.Hash]*types.PartSet)
+	d.futureHashes = make(map[tendermint.Hash]bool)
+	d.futureSenders = make(map[algorithm.NodeID]int)
+	for _, raw := range future {
+		// Future messages were verified on receipt.
+		if m, _, err := types.DecodeSigned(raw); err == nil {
+			d.deliver(m, raw)
+		}
+	}
+	// Parts are delivered after the proposals they belong to.
+	futureParts := d.futureParts
+	d.futureParts = nil
+	for _, m := range futureParts {
+		if d.Height() != height {
+			return
+		}
+		if p := d.peers[m.from]; p != nil {
+			d.receivePart(p, m)
+		}
+	}
+}
+
+func (d *Driver) startRound(round int) {
+	height := d.Height()
+	d.round = round
+	value := algorithm.NilValue
+	if d.validators.Proposer(height, round) == d.id {
+		parts := types.NewPartSetFromData(d.cfg.Propose(height, round))
+		header := d.header(parts.Header())
+		d.addPayload(header, parts)
+		value = header.Hash()
+	}
+	before := d.algo.State()
+	cm, to := d.algo.StartRound(value, round)
+	d.transitions(before)
+	d.handle(nil, cm, to)
+
+	// The Algorithm only evaluates upon conditions on receipt of a message so
+	// messages for this round that arrived before we entered it are
+	// replayed.
+	for _, m := range d.store.RoundMessages(round) {
+		if d.Height() != height || d.round != round {
+			return
+		}
+		d.process(m)
+	}
+}
+
+func (d *Driver) receive(e p2p.Envelope) {
+	if len(e.Payload) == 0 {
+		return
+	}
+	payload := e.Payload[1:]
+	switch e.Payload[0] {
+	case kindMessage:
+		m, _, err := types.DecodeSigned(payload)
+		if err != nil {
+			return
+		}
+		vs, ok := d.cfg.Schedule.At(m.Height)
+		if !ok {
+			return
+		}
+		if _, err := types.VerifySigned(d.cfg.ChainID, vs, payload); err != nil {
+			return
+		}
+		p := d.peer(e.From)
+		p.advance(m.Height)
+		p.mark(m, payload, d.index(m))
+		if m.Height >= d.Height() {
+			d.deliver(m, payload)
+		}
+	case kindRoundState:
+		if s, err := decodeRoundState(payload); err == nil {
+			if p := d.peer(e.From); p.setState(s) {
+				d.catchUp(e.From, p)
+			}
+		}
+	case kindVotes:
+		if v, err := decodeVoteSet(payload); err == nil && d.nearRound(v.height, v.round) {
+			d.peer(e.From).setVotes(v)
+		}
+	case kindPart:
+		if m, err := decodePartMessage(payload); err == nil {
+			m.from = e.From
+			d.receivePart(d.peer(e.From), m)
+		}
+	case kindParts:
+		if a, err := decodePartsAnnouncement(payload); err == nil && d.holdsPayload(a.height, a.value, a.parts.Size()) {
+			d.peer(e.From).setParts(a)
+		}
+	}
+}
+
+// deliver adds a verified message to the store and passes it to the
+// Algorithm, raw is the signed encoding of m.
+func (d *Driver) deliver(m *algorithm.ConsensusMessage, raw []byte) {
+	height := d.Height()
+	if m.Height > height {
+		// Only the next height is buffered, a node further behind than that
+		// has to be helped by its peers.
+		if m.Height == height+1 {
+			d.bufferFuture(m, raw)
+		}
+		return
+	}
+	var header types.Header
+	if m.MsgType == algorithm.Propose {
+		if m.Sender != d.validators.Proposer(m.Height, m.Round) {
+			return
+		}
+		var err error
+		if header, err = types.ProposalHeader(raw); err != nil || header.Payload.Total > d.maxParts() {
+			return
+		}
+	}
+	hash := sha256.Sum256(raw)
+	duplicate := d.store.Has(hash)
+	err := d.store.AddMessage(m, raw, hash)
+	if errors.Is(err, algorithm.ErrEquivocation) || errors.Is(err, algorithm.ErrConflictingProposal) {
+		d.cfg.Metrics.Equivocation(m.MsgType)
+	}
+	if err != nil && !errors.Is(err, algorithm.ErrConflictingProposal) {
+		return
+	}
+	if duplicate {
+		d.cfg.Metrics.Duplicate()
+	} else if m.MsgType != algorithm.Propose {
+		d.voted(m)
+	}
+	if _, ok := d.arrived[m]; !ok {
+		d.arrived[m] = d.tick
+	}
+	if m.MsgType == algorithm.Propose && !d.received(m.Value) {
+		if !duplicate {
+			d.pending[m.Value] = append(d.pending[m.Value], m)
+		}
+		// An equivocating proposer could otherwise have us allocate a part
+		// set for each of its proposals, so the payload of a conflicting
+		// proposal is only expected once a quorum votes for its value.
+		_, parked := d.conflicting[m.Value]
+		if (parked || errors.Is(err, algorithm.ErrConflictingProposal)) && d.payloads[m.Value] == nil && !d.quorums[m.Value] {
+			d.conflicting[m.Value] = header
+			return
+		}
+		delete(d.conflicting, m.Value)
+		d.expect(header)
+		return
+	}
+	d.process(m)
+}
+
+// maxFuturePerSender bounds the messages buffered for the next height from
+// each sender, enough for a proposal and two votes in each of the rounds
+// buffered.
+const maxFuturePerSender = 3 * (roundWindow + 1)
+
+// bufferFuture buffers a verified message for the next height, raw is the
+// signed encoding of m. Only the first rounds of the next height are
+// buffered, since we will start there, and at most maxFuturePerSender
+// messages from each sender, so a validator cannot fill our memory with
+// messages for rounds we may never reach.
+func (d *Driver) bufferFuture(m *algorithm.ConsensusMessage, raw []byte) {
+	hash := sha256.Sum256(raw)
+	if m.Round > roundWindow || d.futureHashes[hash] || d.futureSenders[m.Sender] >= maxFuturePerSender {
+		return
+	}
+	if m.MsgType == algorithm.Propose && !d.expectFuture(m, raw) {
+		return
+	}
+	d.future = append(d.future, raw)
+	d.futureHashes[hash] = true
+	d.futureSenders[m.Sender]++
+}
+
+// header returns the header of a proposal at the current height for the
+// payload with the given part set header. Its time is our clock's, unless
+// that is not later than the previous height's.
+func (d *Driver) header(payload types.PartSetHeader) types.Header {
+	// The schedule's delay ensures that the next set is known.
+	next, _ := d.cfg.Schedule.At(d.Height() + 1)
+	now := types.CanonicalTime(time.Now())
+	if !now.After(d.lastTime) {
+		now = d.lastTime.Add(time.Nanosecond)
+	}
+	return types.Header{
+		Height:             d.Height(),
+		Time:               now,
+		ValidatorsHash:     d.validators.Hash(),
+		NextValidatorsHash: next.Hash(),
+		AppHash:            d.appHash,
+		Payload:            payload,
+	}
+}
+
+// index returns the position of the sender of m in the validator set of m's
+// height, m must have been verified.
+func (d *Driver) index(m *algorithm.ConsensusMessage) int {
+	vs, _ := d.cfg.Schedule.At(m.Height)
+	index, _ := vs.Index(m.Sender)
+	return index
+}
+
+// maxParts returns the number of parts of the largest payload we accept.
+func (d *Driver) maxParts() int {
+	return (d.cfg.MaxProposalSize + types.PartSize - 1) / types.PartSize
+}
+
+func (d *Driver) process(m *algorithm.ConsensusMessage) {
+	if d.committing {
+		// Late messages for the decided height are kept in the store, for
+		// peers that need them, but there is nothing left to decide.
+		return
+	}
+	if m.MsgType == algorithm.Propose && !d.received(m.Value) {
+		// The proposal is processed once its payload is complete.
+		return
+	}
+	before := d.algo.State()
+	rc, cm, to := d.algo.ReceiveMessage(m)
+	d.transitions(before)
+	d.handle(rc, cm, to)
+}
+
+func (d *Driver) handle(rc *algorithm.RoundChange, cm *algorithm.ConsensusMessage, to *algorithm.Timeout) {
+	if cm != nil {
+		d.broadcast(cm)
+	}
+	if to != nil {
+		d.schedule(to)
+	}
+	if rc != nil {
+		if rc.Decision != nil {
+			d.decide(rc.Decision)
+			return
+		}
+		d.startRound(rc.Round)
+	}
+}
+
+// broadcast signs one of our messages, sends it to all our peers and delivers
+// it locally. Messages that can't be signed are dropped, as are all messages
+// of a node without a Signer or that is not a validator at the current height.
+func (d *Driver) broadcast(cm *algorithm.ConsensusMessage) {
+	if d.cfg.Signer == nil || !d.validators.Contains(d.id) {
+		return
+	}
+	sig, err := d.cfg.Signer.SignMessage(d.cfg.ChainID, cm)
+	if err != nil {
+		return
+	}
+	// Our proposals are for payloads that we either created or received, so
+	// we hold their parts.
+	var pl *payload
+	raw := types.EncodeSigned(cm, sig)
+	if cm.MsgType == algorithm.Propose {
+		pl = d.payloads[cm.Value]
+		raw = types.EncodeProposal(cm, sig, pl.header)
+	}
+	// Peers learn of our new round state before they receive the message
+	// that it produced.
+	d.announceState()
+	for id, p := range d.peers {
+		d.send(id, p, cm, raw)
+		if pl != nil {
+			d.sendParts(id, p, cm.Height, pl, true)
+		}
+	}
+	d.deliver(cm, raw)
+}
+
+// decide records the decision and moves to the next height, once
+// TimeoutCommit has passed. handle returns straight after calling decide since
+// the state it was handling belongs to the decided height.
+func (d *Driver) decide(p *algorithm.ConsensusMessage) {
+	height := d.Height()
+	pl := d.payloads[p.Value]
+	d.history[height] = &decidedHeight{store: d.store, decision: p, payload: pl, tick: d.tick}
+	d.lastTime = pl.header.Time
+	step := d.algo.State().Step
+	d.publish(Event{Type: EventDecision, Height: height, Round: p.Round, Step: step, Value: p.Value, Message: p})
+	d.cfg.Metrics.StepDuration(step, time.Since(d.stepStart))
+	d.cfg.Metrics.Decided(d.round + 1)
+	updates := d.cfg.Decided(p, &types.Block{
+		Proposal: d.store.Raw(p),
+		Payload:  pl.parts.Data(),
+		Commit:   types.NewCommit(d.store, p),
+	})
+	// Invalid updates are ignored, as they are by every other node.
+	_ = d.cfg.Schedule.Apply(height, updates)
+	if d.cfg.TimeoutCommit == 0 {
+		d.newHeight(height + 1)
+		return
+	}
+	d.committing = true
+	time.AfterFunc(d.cfg.TimeoutCommit, func() {
+		select {
+		case d.commits <- height + 1:
+		case <-d.done:
+		}
+	})
+}
+
+func (d *Driver) schedule(t *algorithm.Timeout) {
+	d.publish(Event{Type: EventTimeoutScheduled, Height: t.Height(), Round: t.Round(), Step: t.Type(), Timeout: t})
+	time.AfterFunc(time.Duration(t.Delay)*d.cfg.TimeoutUnit, func() {
+		select {
+		case d.timeouts <- t:
+		case <-d.done:
+		}
+	})
+}
+
+func (d *Driver) publish(e Event) {
+	if d.cfg.EventBus != nil {
+		d.cfg.EventBus.Publish(e)
+	}
+}
+
+// transitions publishes the events for the changes to the Algorithm's state
+// since before.
+func (d *Driver) transitions(before algorithm.State) {
+	after := d.algo.State()
+	if after.Round != before.Round || after.Step != before.Step {
+		d.enterStep(before, after)
+	}
+	if d.cfg.EventBus == nil {
+		return
+	}
+	e := Event{Height: d.Height(), Round: after.Round, Step: after.Step}
+	switch {
+	case after.Round != before.Round:
+		e.Type = EventNewRound
+		d.publish(e)
+	case after.Step != before.Step:
+		e.Type = EventStepChange
+		d.publish(e)
+	}
+	if after.LockedRound != before.LockedRound || after.LockedValue != before.LockedValue {
+		e := e
+		if after.LockedRound == -1 {
+			e.Type, e.Value = EventUnlock, before.LockedValue
+		} else {
+			e.Type, e.Round, e.Value = EventLock, after.LockedRound, after.LockedValue
+		}
+		d.publish(e)
+	}
+	if after.ValidRound >= 0 && (after.ValidRound != before.ValidRound || after.ValidValue != before.ValidValue) {
+		e := e
+		e.Type, e.Round, e.Value = EventValidValueUpdated, after.ValidRound, after.ValidValue
+		d.publish(e)
+	}
+}
+
+// enterStep records the metrics of entering a new round or step.
+func (d *Driver) enterStep(before, after algorithm.State) {
+	now := time.Now()
+	// The Algorithm of a new height starts before its first round.
+	if before.Round >= 0 {
+		d.cfg.Metrics.StepDuration(before.Step, now.Sub(d.stepStart))
+	}
+	d.stepStart = now
+	if after.Round != before.Round {
+		d.roundStart = now
+	}
+	d.cfg.Metrics.State(d.Height(), after.Round, after.Step)
+}
+
+// voted publishes the events and records the metrics for a vote of the
+// current height that was newly added to the Store.
+func (d *Driver) voted(m *algorithm.ConsensusMessage) {
+	d.publish(Event{Type: EventVote, Height: m.Height, Round: m.Round, Step: m.MsgType, Value: m.Value, Message: m})
+	d.cfg.Metrics.Vote(m.MsgType)
+	count := d.store.CountPrevotes(m.Round, &m.Value)
+	if m.MsgType == algorithm.Precommit {
+		count = d.store.CountPrecommits(m.Round, &m.Value)
+	}
+	// Votes are added one at a time so the quorum is reached exactly once.
+	if count != d.validators.Quorum() {
+		return
+	}
+	if m.Round == d.round {
+		d.cfg.Metrics.Quorum(m.MsgType, time.Since(d.roundStart))
+	}
+	d.quorums[m.Value] = true
+	if header, ok := d.conflicting[m.Value]; ok {
+		delete(d.conflicting, m.Value)
+		d.expect(header)
+	}
+	if m.MsgType == algorithm.Prevote {
+		d.publish(Event{Type: EventPolka, Height: m.Height, Round: m.Round, Step: algorithm.Prevote, Value: m.Value})
+	}
+}
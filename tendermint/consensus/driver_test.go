@@ -0,0 +1,432 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/genesis"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+	"github.com/piersy/tendermint-go/tendermint/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testTimeout = 20 * time.Second
+	testChainID = "test-chain"
+)
+
+func testKeys(n int) []ed25519.PrivateKey {
+	result := make([]ed25519.PrivateKey, n)
+	for i := range result {
+		seed := make([]byte, ed25519.SeedSize)
+		seed[0] = byte(i + 1)
+		result[i] = ed25519.NewKeyFromSeed(seed)
+	}
+	return result
+}
+
+func validatorSet(t *testing.T, ks []ed25519.PrivateKey) *types.ValidatorSet {
+	var vals []types.Validator
+	for _, k := range ks {
+		vals = append(vals, types.NewValidator(k.Public().(ed25519.PublicKey)))
+	}
+	vs, err := types.NewValidatorSet(vals)
+	require.NoError(t, err)
+	return vs
+}
+
+// memCluster creates a fully connected MemNetwork with a transport for each
+// key.
+func memCluster(t *testing.T, ks []ed25519.PrivateKey) (*p2p.MemNetwork, []p2p.Transport) {
+	n := p2p.NewMemNetwork()
+	var transports []p2p.Transport
+	for _, k := range ks {
+		tr := n.Transport(keys.Address(k.Public().(ed25519.PublicKey)))
+		t.Cleanup(func() { tr.Close() })
+		transports = append(transports, tr)
+	}
+	return n, transports
+}
+
+// testDriver returns a Driver at height 1 that is not running, for tests
+// that feed it messages directly. It signs with the first key and never
+// times out.
+func testDriver(t *testing.T, ks []ed25519.PrivateKey) *Driver {
+	_, transports := memCluster(t, ks)
+	d := NewDriver(Config{
+		ChainID:        testChainID,
+		Signer:         types.NewKeySigner(ks[0]),
+		Validators:     validatorSet(t, ks),
+		TimeoutUnit:    time.Hour,
+		GossipInterval: time.Hour,
+	}, transports[0])
+	t.Cleanup(func() { close(d.done) })
+	d.newHeight(1)
+	return d
+}
+
+// signedProposal returns the envelope of a proposal for the payload of
+// parts, signed with the key of the given sender.
+func signedProposal(t *testing.T, ks []ed25519.PrivateKey, sender algorithm.NodeID, height uint64, round int, parts *types.PartSet) p2p.Envelope {
+	header := types.Header{Height: height, Payload: parts.Header()}
+	cm := &algorithm.ConsensusMessage{MsgType: algorithm.Propose, Height: height, Round: round, Value: header.Hash(), ValidRound: -1, Sender: sender}
+	raw := types.EncodeProposal(cm, sign(t, ks, cm), header)
+	return p2p.Envelope{From: sender, Channel: Channel, Payload: append([]byte{kindMessage}, raw...)}
+}
+
+// signedVote returns the envelope of a vote for value, signed with the key of
+// the given sender.
+func signedVote(t *testing.T, ks []ed25519.PrivateKey, sender algorithm.NodeID, msgType algorithm.Step, height uint64, round int, value tendermint.Hash) p2p.Envelope {
+	cm := &algorithm.ConsensusMessage{MsgType: msgType, Height: height, Round: round, Value: value, ValidRound: -1, Sender: sender}
+	raw := types.EncodeSigned(cm, sign(t, ks, cm))
+	return p2p.Envelope{From: sender, Channel: Channel, Payload: append([]byte{kindMessage}, raw...)}
+}
+
+// sign signs cm with the key of its sender.
+func sign(t *testing.T, ks []ed25519.PrivateKey, cm *algorithm.ConsensusMessage) []byte {
+	for _, k := range ks {
+		if keys.Address(k.Public().(ed25519.PublicKey)) == cm.Sender {
+			sig, err := types.NewKeySigner(k).SignMessage(testChainID, cm)
+			require.NoError(t, err)
+			return sig
+		}
+	}
+	t.Fatalf("no key for %v", cm.Sender)
+	return nil
+}
+
+type decision struct {
+	node     algorithm.NodeID
+	proposal *algorithm.ConsensusMessage
+}
+
+// runCluster runs a Driver for each transport, signing with the key of the
+// same index, until every driver has decided the given number of heights. All
+// keys are validators unless configure sets a Schedule, there may be fewer
+// transports than keys. It returns
+// the decisions of each node indexed by height - 1.
+func runCluster(t *testing.T, ks []ed25519.PrivateKey, transports []p2p.Transport, heights uint64, configure func(algorithm.NodeID, *Config)) map[algorithm.NodeID][]*algorithm.ConsensusMessage {
+	vs := validatorSet(t, ks)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	decisions := make(chan decision)
+	errs := make(chan error, len(transports))
+	for i, tr := range transports {
+		id := tr.ID()
+		schedule, err := types.NewValidatorSchedule(1, vs, 0)
+		require.NoError(t, err)
+		var cfg Config
+		cfg = Config{
+			ChainID:        testChainID,
+			Signer:         types.NewKeySigner(ks[i]),
+			Schedule:       schedule,
+			TimeoutUnit:    20 * time.Millisecond,
+			GossipInterval: 5 * time.Millisecond,
+			Decided: func(p *algorithm.ConsensusMessage, b *types.Block) []types.ValidatorUpdate {
+				// Every decision comes with a commit that proves it.
+				vs, _ := cfg.Schedule.At(p.Height)
+				if _, err := b.Verify(cfg.ChainID, vs, p.Height); err != nil {
+					t.Errorf("invalid block decided by %v: %v", id, err)
+				}
+				select {
+				case decisions <- decision{id, p}:
+				case <-ctx.Done():
+				}
+				return nil
+			},
+		}
+		if configure != nil {
+			configure(id, &cfg)
+		}
+		d := NewDriver(cfg, tr)
+		go func() { errs <- d.Run(ctx) }()
+	}
+
+	result := make(map[algorithm.NodeID][]*algorithm.ConsensusMessage)
+	done := 0
+	timeout := time.After(testTimeout)
+	for done < len(transports) {
+		select {
+		case d := <-decisions:
+			result[d.node] = append(result[d.node], d.proposal)
+			if uint64(len(result[d.node])) == heights {
+				done++
+			}
+		case err := <-errs:
+			t.Fatalf("driver stopped: %v", err)
+		case <-timeout:
+			t.Fatalf("timed out with decisions %v", result)
+		}
+	}
+	return result
+}
+
+func checkAgreement(t *testing.T, decisions map[algorithm.NodeID][]*algorithm.ConsensusMessage, heights uint64) {
+	var first []*algorithm.ConsensusMessage
+	for _, ds := range decisions {
+		for h, d := range ds[:heights] {
+			assert.Equal(t, uint64(h+1), d.Height)
+		}
+		if first == nil {
+			first = ds[:heights]
+			continue
+		}
+		for h := range first {
+			assert.Equal(t, first[h].Value, ds[h].Value, "disagreement at height %d", h+1)
+		}
+	}
+}
+
+func TestDriverMemNetwork(t *testing.T) {
+	ks := testKeys(4)
+	_, transports := memCluster(t, ks)
+	decisions := runCluster(t, ks, transports, 5, nil)
+	checkAgreement(t, decisions, 5)
+}
+
+func TestDriverTimeoutCommit(t *testing.T) {
+	ks := testKeys(4)
+	_, transports := memCluster(t, ks)
+	const timeoutCommit = 50 * time.Millisecond
+	var mu sync.Mutex
+	decidedAt := make(map[algorithm.NodeID][]time.Time)
+	decisions := runCluster(t, ks, transports, 4, func(id algorithm.NodeID, c *Config) {
+		c.TimeoutCommit = timeoutCommit
+		decided := c.Decided
+		c.Decided = func(p *algorithm.ConsensusMessage, b *types.Block) []types.ValidatorUpdate {
+			mu.Lock()
+			decidedAt[id] = append(decidedAt[id], time.Now())
+			mu.Unlock()
+			return decided(p, b)
+		}
+	})
+	checkAgreement(t, decisions, 4)
+
+	// Each height starts once the previous one's timeout has passed.
+	mu.Lock()
+	defer mu.Unlock()
+	for id, times := range decidedAt {
+		for i := 1; i < len(times); i++ {
+			assert.GreaterOrEqual(t, times[i].Sub(times[i-1]), timeoutCommit, "node %v height %d", id, i+1)
+		}
+	}
+}
+
+func TestDriverGenesis(t *testing.T) {
+	ks := testKeys(4)
+	var pubs []ed25519.PublicKey
+	for _, k := range ks {
+		pubs = append(pubs, k.Public().(ed25519.PublicKey))
+	}
+	g := genesis.New("test-chain", pubs)
+	g.InitialHeight = 7
+	g.ConsensusParams = genesis.ConsensusParams{TimeoutUnit: genesis.Duration(20 * time.Millisecond), MaxProposalSize: 1 << 16}
+	require.NoError(t, g.Validate())
+
+	// Fields that are set take precedence over the genesis.
+	cfg := Config{Genesis: g, MaxProposalSize: 1 << 10}
+	cfg.setDefaults(algorithm.NodeID{})
+	assert.Equal(t, uint64(7), cfg.Height)
+	assert.Equal(t, 20*time.Millisecond, cfg.TimeoutUnit)
+	assert.Zero(t, cfg.TimeoutCommit)
+	assert.Equal(t, 1<<10, cfg.MaxProposalSize)
+	vs, ok := cfg.Schedule.At(7)
+	require.True(t, ok)
+	assert.Equal(t, validatorSet(t, ks).Hash(), vs.Hash())
+
+	// A chain configured by its genesis starts at its initial height.
+	_, transports := memCluster(t, ks)
+	decisions := runCluster(t, ks, transports, 2, func(_ algorithm.NodeID, c *Config) {
+		var err error
+		c.Schedule, err = g.Schedule()
+		require.NoError(t, err)
+		c.Genesis = g
+		c.TimeoutUnit = 0
+	})
+	for _, ds := range decisions {
+		assert.Equal(t, uint64(7), ds[0].Height)
+		assert.Equal(t, uint64(8), ds[1].Height)
+	}
+}
+
+func TestDriverToleratesCrashedValidator(t *testing.T) {
+	ks := testKeys(4)
+	// The last validator never starts, rounds it proposes time out.
+	_, transports := memCluster(t, ks[:3])
+	decisions := runCluster(t, ks, transports, 5, nil)
+	checkAgreement(t, decisions, 5)
+}
+
+func TestDriverRejectsOtherChains(t *testing.T) {
+	ks := testKeys(4)
+	_, transports := memCluster(t, ks)
+	// The last validator signs for another chain, the others reject its
+	// messages but still form a quorum, and it rejects theirs.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var decided atomic.Bool
+	other := NewDriver(Config{
+		ChainID:        "other-chain",
+		Signer:         types.NewKeySigner(ks[3]),
+		Validators:     validatorSet(t, ks),
+		TimeoutUnit:    20 * time.Millisecond,
+		GossipInterval: 5 * time.Millisecond,
+		Decided: func(*algorithm.ConsensusMessage, *types.Block) []types.ValidatorUpdate {
+			decided.Store(true)
+			return nil
+		},
+	}, transports[3])
+	go func() { _ = other.Run(ctx) }()
+
+	decisions := runCluster(t, ks, transports[:3], 5, nil)
+	checkAgreement(t, decisions, 5)
+	for _, d := range decisions[transports[0].ID()] {
+		assert.NotEqual(t, transports[3].ID(), d.Sender)
+	}
+	assert.False(t, decided.Load())
+}
+
+func TestDriverInvalidProposals(t *testing.T) {
+	ks := testKeys(4)
+	_, transports := memCluster(t, ks)
+	// The first validator proposes invalid values, so no value it proposes
+	// is ever decided.
+	invalid := []byte("invalid")
+	decisions := runCluster(t, ks, transports, 4, func(id algorithm.NodeID, c *Config) {
+		c.Valid = func(payload []byte) bool { return !bytes.Equal(payload, invalid) }
+		if id == transports[0].ID() {
+			c.Propose = func(uint64, int) []byte { return invalid }
+		}
+	})
+	checkAgreement(t, decisions, 4)
+	for _, d := range decisions[transports[1].ID()] {
+		assert.NotEqual(t, transports[0].ID(), d.Sender)
+	}
+}
+
+func TestDriverTCP(t *testing.T) {
+	ks := testKeys(4)
+	var transports []p2p.Transport
+	var tcp []*p2p.TCPTransport
+	for _, k := range ks {
+		tr, err := p2p.ListenTCP(k, "127.0.0.1:0", p2p.TCPConfig{})
+		require.NoError(t, err)
+		defer tr.Close()
+		transports = append(transports, tr)
+		tcp = append(tcp, tr)
+	}
+	for i, a := range tcp {
+		for _, b := range tcp[i+1:] {
+			_, err := a.Dial(b.Addr().String())
+			require.NoError(t, err)
+		}
+	}
+	for _, tr := range tcp {
+		require.Eventually(t, func() bool { return len(tr.Peers()) == len(ks)-1 }, testTimeout, time.Millisecond)
+	}
+	decisions := runCluster(t, ks, transports, 3, nil)
+	checkAgreement(t, decisions, 3)
+}
+
+func TestDriverHelpsLaggingNode(t *testing.T) {
+	ks := testKeys(4)
+	n, transports := memCluster(t, ks)
+	// Cut the last validator off, it misses the first heights entirely
+	// until it is reconnected and then catches up with help from its
+	// peers.
+	last := transports[3].ID()
+	for _, tr := range transports[:3] {
+		n.Disconnect(tr.ID(), last)
+	}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		for _, tr := range transports[:3] {
+			n.Connect(tr.ID(), last)
+		}
+	}()
+	decisions := runCluster(t, ks, transports, 3, nil)
+	checkAgreement(t, decisions, 3)
+}
+
+func TestDriverValidatorSetChanges(t *testing.T) {
+	ks := testKeys(5)
+	_, transports := memCluster(t, ks)
+	// The last node joins the set with the updates of height 2, the first
+	// leaves it with those of height 4.
+	initial, joined, left := validatorSet(t, ks[:4]), validatorSet(t, ks), validatorSet(t, ks[1:])
+	expected := func(height uint64) *types.ValidatorSet {
+		switch {
+		case height >= 6:
+			return left
+		case height >= 4:
+			return joined
+		}
+		return initial
+	}
+	var mu sync.Mutex
+	headers := make(map[algorithm.NodeID][]types.Header)
+	decisions := runCluster(t, ks, transports, 8, func(id algorithm.NodeID, c *Config) {
+		schedule, err := types.NewValidatorSchedule(1, initial, 0)
+		require.NoError(t, err)
+		c.Schedule = schedule
+		decided := c.Decided
+		c.Decided = func(p *algorithm.ConsensusMessage, b *types.Block) []types.ValidatorUpdate {
+			header, err := b.Header()
+			assert.NoError(t, err)
+			mu.Lock()
+			headers[id] = append(headers[id], header)
+			mu.Unlock()
+			decided(p, b)
+			switch p.Height {
+			case 2:
+				return []types.ValidatorUpdate{{PubKey: ks[4].Public().(ed25519.PublicKey)}}
+			case 4:
+				return []types.ValidatorUpdate{{PubKey: ks[0].Public().(ed25519.PublicKey), Remove: true}}
+			}
+			return nil
+		}
+	})
+	checkAgreement(t, decisions, 8)
+	mu.Lock()
+	defer mu.Unlock()
+	for id, hs := range headers {
+		for _, h := range hs[:8] {
+			assert.Equal(t, expected(h.Height).Hash(), h.ValidatorsHash, "node %v height %d", id, h.Height)
+			assert.Equal(t, expected(h.Height+1).Hash(), h.NextValidatorsHash, "node %v height %d", id, h.Height)
+		}
+	}
+	for _, d := range decisions[transports[1].ID()][5:] {
+		assert.NotEqual(t, transports[0].ID(), d.Sender)
+	}
+}
+
+func TestDriverBoundsFutureMessages(t *testing.T) {
+	ks := testKeys(4)
+	d := testDriver(t, ks)
+	sender := validatorSet(t, ks).IDs()[1]
+
+	// Messages for rounds of the next height beyond the window, duplicates
+	// and messages beyond the limit of their sender are dropped.
+	d.receive(signedVote(t, ks, sender, algorithm.Prevote, 2, roundWindow+1, algorithm.NilValue))
+	assert.Empty(t, d.future)
+	vote := signedVote(t, ks, sender, algorithm.Prevote, 2, 0, algorithm.NilValue)
+	d.receive(vote)
+	d.receive(vote)
+	assert.Len(t, d.future, 1)
+	for i := 0; i < 2*maxFuturePerSender; i++ {
+		d.receive(signedVote(t, ks, sender, algorithm.Precommit, 2, i%(roundWindow+1), tendermint.Hash{byte(i)}))
+	}
+	assert.Len(t, d.future, maxFuturePerSender)
+	other := validatorSet(t, ks).IDs()[2]
+	d.receive(signedVote(t, ks, other, algorithm.Prevote, 2, 0, algorithm.NilValue))
+	assert.Len(t, d.future, maxFuturePerSender+1)
+}
@@ -0,0 +1,188 @@
+package consensus
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// DefaultEventBufferSize is the default number of events buffered for each
+// subscription.
+const DefaultEventBufferSize = 100
+
+// EventType identifies the kind of an Event.
+type EventType uint8
+
+const (
+	// EventNewRound is published when a round starts, the step is Propose.
+	EventNewRound EventType = iota + 1
+	// EventStepChange is published when the step changes within a round.
+	EventStepChange
+	// EventLock is published when a value is locked, Round is the locked
+	// round and Value the locked value.
+	EventLock
+	// EventUnlock is published when the locked value is released, which
+	// happens on a decision, Value is the released value.
+	EventUnlock
+	// EventValidValueUpdated is published when the valid value changes,
+	// Round is the valid round and Value the valid value.
+	EventValidValueUpdated
+	// EventTimeoutScheduled is published when a timeout is scheduled.
+	EventTimeoutScheduled
+	// EventTimeoutFired is published when a timeout fires, whether or not it
+	// is still current.
+	EventTimeoutFired
+	// EventVote is published for each distinct prevote and precommit added
+	// to the Store, including our own.
+	EventVote
+	// EventPolka is published when the prevotes for a value, or for nil,
+	// reach a quorum in a round.
+	EventPolka
+	// EventDecision is published when a height is decided, Message is the
+	// decided proposal.
+	EventDecision
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventNewRound:
+		return "NewRound"
+	case EventStepChange:
+		return "StepChange"
+	case EventLock:
+		return "Lock"
+	case EventUnlock:
+		return "Unlock"
+	case EventValidValueUpdated:
+		return "ValidValueUpdated"
+	case EventTimeoutScheduled:
+		return "TimeoutScheduled"
+	case EventTimeoutFired:
+		return "TimeoutFired"
+	case EventVote:
+		return "Vote"
+	case EventPolka:
+		return "Polka"
+	case EventDecision:
+		return "Decision"
+	default:
+		return fmt.Sprintf("EventType(%d)", t)
+	}
+}
+
+// Event describes a consensus state transition of a Driver.
+type Event struct {
+	Type   EventType
+	Height uint64
+	Round  int
+	// Step is the step entered for NewRound and StepChange, the timeout's
+	// type for timeout events, the vote's type for Vote and Prevote for
+	// Polka. For other events it is the current step.
+	Step algorithm.Step
+	// Value is the value locked, made valid, voted for, with a polka or
+	// decided.
+	Value tendermint.Hash
+	// Message is the vote for Vote and the decided proposal for Decision.
+	Message *algorithm.ConsensusMessage
+	// Timeout is set for timeout events.
+	Timeout *algorithm.Timeout
+}
+
+// EventFilter selects the events delivered to a subscription.
+type EventFilter struct {
+	// Types are the types of the events delivered, all types if empty.
+	Types []EventType
+	// Height is the height of the events delivered, all heights if 0.
+	Height uint64
+}
+
+func (f EventFilter) match(e Event) bool {
+	if f.Height != 0 && f.Height != e.Height {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription receives the events matching its filter.
+type Subscription struct {
+	filter  EventFilter
+	events  chan Event
+	dropped atomic.Uint64
+}
+
+// Events returns the channel on which events are delivered, it is closed
+// when the subscription is cancelled.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns the number of events that were dropped because the
+// subscription's buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// EventBus delivers published events to subscribers. Publishing never
+// blocks, a subscriber that does not keep up misses the events that do not
+// fit in its buffer. It is safe for concurrent use.
+type EventBus struct {
+	bufferSize int
+
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+// NewEventBus creates an EventBus that buffers bufferSize events for each
+// subscription, 0 selects DefaultEventBufferSize.
+func NewEventBus(bufferSize int) *EventBus {
+	if bufferSize == 0 {
+		bufferSize = DefaultEventBufferSize
+	}
+	return &EventBus{bufferSize: bufferSize, subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe returns a subscription to the events matching f.
+func (b *EventBus) Subscribe(f EventFilter) *Subscription {
+	s := &Subscription{filter: f, events: make(chan Event, b.bufferSize)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// Unsubscribe cancels s, it does nothing if s is already cancelled.
+func (b *EventBus) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.events)
+	}
+}
+
+// Publish delivers e to the matching subscriptions.
+func (b *EventBus) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		if !s.filter.match(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package consensus
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// drain returns the events buffered by s.
+func drain(s *Subscription) []Event {
+	var result []Event
+	for {
+		select {
+		case e := <-s.Events():
+			result = append(result, e)
+		default:
+			return result
+		}
+	}
+}
+
+func eventTypes(events []Event) []EventType {
+	var result []EventType
+	for _, e := range events {
+		result = append(result, e.Type)
+	}
+	return result
+}
+
+func TestEventBus(t *testing.T) {
+	b := NewEventBus(2)
+	all := b.Subscribe(EventFilter{})
+	votes := b.Subscribe(EventFilter{Types: []EventType{EventVote, EventPolka}, Height: 2})
+	b.Publish(Event{Type: EventVote, Height: 1})
+	b.Publish(Event{Type: EventVote, Height: 2})
+	b.Publish(Event{Type: EventNewRound, Height: 2})
+	b.Publish(Event{Type: EventPolka, Height: 2})
+
+	// Events that do not fit in the buffer are dropped rather than blocking
+	// the publisher.
+	assert.Equal(t, []Event{{Type: EventVote, Height: 1}, {Type: EventVote, Height: 2}}, drain(all))
+	assert.Equal(t, uint64(2), all.Dropped())
+	assert.Equal(t, []Event{{Type: EventVote, Height: 2}, {Type: EventPolka, Height: 2}}, drain(votes))
+	assert.Zero(t, votes.Dropped())
+
+	b.Unsubscribe(votes)
+	b.Unsubscribe(votes)
+	b.Publish(Event{Type: EventVote, Height: 2})
+	_, ok := <-votes.Events()
+	assert.False(t, ok)
+	assert.Len(t, drain(all), 1)
+}
+
+func TestDriverPublishesEvents(t *testing.T) {
+	ks := testKeys(4)
+	vs := validatorSet(t, ks)
+	_, transports := memCluster(t, ks)
+	bus := NewEventBus(1000)
+	sub := bus.Subscribe(EventFilter{Height: 1})
+	id := transports[0].ID()
+	decisions := runCluster(t, ks, transports, 2, func(node algorithm.NodeID, cfg *Config) {
+		// Timeouts are long so that the height is decided in round 0.
+		cfg.TimeoutUnit = time.Second
+		if node == id {
+			cfg.EventBus = bus
+		}
+	})
+	decided := decisions[id][0]
+
+	// The height starts with a new round, the decided value gets a polka and
+	// is locked, the lock is released on the decision. Timeouts scheduled
+	// at the height may still fire after the decision.
+	events := drain(sub)
+	require.NotEmpty(t, events)
+	assert.Equal(t, Event{Type: EventNewRound, Height: 1, Round: 0, Step: algorithm.Propose}, events[0])
+	index := make(map[EventType]int)
+	votes := 0
+	for i, e := range events {
+		assert.Equal(t, uint64(1), e.Height)
+		if _, ok := index[e.Type]; ok {
+			assert.Contains(t, []EventType{EventStepChange, EventVote, EventTimeoutScheduled, EventTimeoutFired}, e.Type)
+		} else {
+			index[e.Type] = i
+		}
+		switch e.Type {
+		case EventVote:
+			votes++
+			assert.Equal(t, e.Message.Value, e.Value)
+		case EventPolka, EventLock, EventValidValueUpdated, EventUnlock, EventDecision:
+			assert.Equal(t, decided.Value, e.Value, e.Type.String())
+		}
+	}
+	for _, typ := range []EventType{EventStepChange, EventPolka, EventLock, EventValidValueUpdated, EventUnlock, EventDecision} {
+		assert.Contains(t, index, typ, typ.String())
+	}
+	assert.Less(t, index[EventPolka], index[EventLock])
+	assert.Equal(t, index[EventUnlock]+1, index[EventDecision])
+	assert.Equal(t, decided, events[index[EventDecision]].Message)
+	// A quorum of prevotes and of precommits is needed to decide.
+	assert.GreaterOrEqual(t, votes, 2*vs.Quorum())
+	if vs.Proposer(1, 0) != id {
+		assert.Contains(t, index, EventTimeoutScheduled)
+	}
+}
+
+func TestDriverPublishesTimeouts(t *testing.T) {
+	ks := testKeys(4)
+	vs := validatorSet(t, ks)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A validator running alone that is not the first proposer times out
+	// waiting for the proposal and prevotes nil.
+	var k ed25519.PrivateKey
+	for _, k = range ks {
+		if vs.Proposer(1, 0) != keys.Address(k.Public().(ed25519.PublicKey)) {
+			break
+		}
+	}
+	_, transports := memCluster(t, []ed25519.PrivateKey{k})
+	bus := NewEventBus(0)
+	sub := bus.Subscribe(EventFilter{})
+	d := NewDriver(Config{
+		ChainID:     testChainID,
+		Signer:      types.NewKeySigner(k),
+		Validators:  vs,
+		TimeoutUnit: 10 * time.Millisecond,
+		EventBus:    bus,
+	}, transports[0])
+	go func() { _ = d.Run(ctx) }()
+
+	var events []Event
+	for e := range sub.Events() {
+		events = append(events, e)
+		if e.Type == EventVote {
+			break
+		}
+	}
+	assert.Equal(t, []EventType{EventNewRound, EventTimeoutScheduled, EventTimeoutFired, EventStepChange, EventVote}, eventTypes(events))
+	fired := events[2]
+	assert.Equal(t, events[1].Timeout, fired.Timeout)
+	assert.Equal(t, algorithm.Propose, fired.Step)
+	assert.Equal(t, algorithm.Prevote, events[3].Step)
+	assert.Equal(t, algorithm.NilValue, events[4].Value)
+}
@@ -0,0 +1,491 @@
+package consensus
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// The first byte of each payload on Channel identifies its kind.
+const (
+	// kindMessage is followed by a signed consensus message, see
+	// types.EncodeSigned.
+	kindMessage byte = iota + 1
+	// kindRoundState is followed by an encoded roundState.
+	kindRoundState
+	// kindVotes is followed by an encoded voteSet.
+	kindVotes
+	// kindPart is followed by an encoded partMessage.
+	kindPart
+	// kindParts is followed by an encoded partsAnnouncement.
+	kindParts
+)
+
+// roundState is the position of a node in consensus, nodes announce theirs
+// to their peers whenever it changes.
+type roundState struct {
+	height uint64
+	round  int
+	step   algorithm.Step
+}
+
+func (s roundState) encode() []byte {
+	b := make([]byte, 18)
+	b[0] = kindRoundState
+	binary.BigEndian.PutUint64(b[1:], s.height)
+	binary.BigEndian.PutUint64(b[9:], uint64(s.round))
+	b[17] = byte(s.step)
+	return b
+}
+
+func decodeRoundState(b []byte) (roundState, error) {
+	if len(b) != 17 {
+		return roundState{}, fmt.Errorf("round state has length %d", len(b))
+	}
+	s := roundState{
+		height: binary.BigEndian.Uint64(b),
+		round:  int(int64(binary.BigEndian.Uint64(b[8:]))),
+		step:   algorithm.Step(b[16]),
+	}
+	if s.round < 0 || s.step > algorithm.Precommit {
+		return roundState{}, fmt.Errorf("invalid round state %+v", s)
+	}
+	return s, nil
+}
+
+// voteSet describes the messages a node holds for a round, nodes announce
+// the set for their current round on every gossip round so that their peers
+// know not to send them those messages.
+type voteSet struct {
+	height   uint64
+	round    int
+	proposal bool
+	// votes holds the prevotes and precommits, indexed by the position of
+	// their sender in the validator set.
+	votes [2]*BitArray
+}
+
+func (v *voteSet) encode() []byte {
+	b := make([]byte, 18, 18+2*(4+(v.votes[0].Size()+7)/8))
+	b[0] = kindVotes
+	binary.BigEndian.PutUint64(b[1:], v.height)
+	binary.BigEndian.PutUint64(b[9:], uint64(v.round))
+	if v.proposal {
+		b[17] = 1
+	}
+	for _, bits := range v.votes {
+		encoded, err := bits.MarshalBinary()
+		if err != nil {
+			panic(err)
+		}
+		b = append(b, encoded...)
+	}
+	return b
+}
+
+func decodeVoteSet(b []byte) (*voteSet, error) {
+	if len(b) < 21 {
+		return nil, fmt.Errorf("vote set has length %d", len(b))
+	}
+	v := &voteSet{
+		height:   binary.BigEndian.Uint64(b),
+		round:    int(int64(binary.BigEndian.Uint64(b[8:]))),
+		proposal: b[16] == 1,
+	}
+	if v.round < 0 {
+		return nil, fmt.Errorf("invalid round %d", v.round)
+	}
+	b = b[17:]
+	// Both arrays have the same size so the first size determines where
+	// the second array starts.
+	length := 2 + (int(binary.BigEndian.Uint16(b))+7)/8
+	if len(b) != 2*length {
+		return nil, fmt.Errorf("vote set bit arrays have length %d", len(b))
+	}
+	for i := range v.votes {
+		v.votes[i] = new(BitArray)
+		if err := v.votes[i].UnmarshalBinary(b[i*length : (i+1)*length]); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// peerState is our view of a peer, its round state and the messages it holds
+// at its height. The view is built from the peer's announcements and from
+// the messages exchanged with the peer, so the peer may hold messages that we
+// don't know about but never lacks a message that we think it holds.
+type peerState struct {
+	roundState
+	// size returns the size of the validator set at a height, or zero if it
+	// is unknown.
+	size func(height uint64) int
+	// heights holds the messages the peer holds at its height and at the
+	// next height, since a peer one height behind us receives our messages
+	// for the next height before it gets there.
+	heights [2]*peerHeight
+	// regressed is set if the last round state the peer announced was for
+	// a height below its own and was ignored.
+	regressed bool
+}
+
+type peerHeight struct {
+	rounds map[int]*peerRound
+	// parts holds the parts the peer holds of each proposed payload.
+	parts map[tendermint.Hash]*BitArray
+}
+
+func newPeerHeight() *peerHeight {
+	return &peerHeight{rounds: make(map[int]*peerRound), parts: make(map[tendermint.Hash]*BitArray)}
+}
+
+type peerRound struct {
+	// proposals holds the hashes of the raw proposals the peer holds.
+	proposals map[tendermint.Hash]bool
+	// proposal is set if the peer announced holding a proposal, not knowing
+	// which we assume it is the first one we received.
+	proposal bool
+	votes    [2]*BitArray
+}
+
+func newPeerState(size func(height uint64) int) *peerState {
+	return &peerState{size: size, heights: [2]*peerHeight{newPeerHeight(), newPeerHeight()}}
+}
+
+// setState records the peer's round state, moving to a new height discards
+// what we know about the messages it holds at other heights. A state for a
+// height below the peer's is taken to be stale, overtaken by a message that
+// advanced the peer, and is ignored. A peer that restarted keeps announcing
+// its lower height, and messages of its previous connection may have
+// advanced it after we saw it disconnect, so a second such state in a row is
+// recorded. It returns false if the state was ignored.
+func (p *peerState) setState(s roundState) bool {
+	regressed := s.height < p.height
+	if regressed && !p.regressed {
+		p.regressed = true
+		return false
+	}
+	p.regressed = false
+	switch {
+	case s.height == p.height:
+	case s.height == p.height+1:
+		p.heights = [2]*peerHeight{p.heights[1], newPeerHeight()}
+	default:
+		p.heights = [2]*peerHeight{newPeerHeight(), newPeerHeight()}
+	}
+	p.roundState = s
+	return true
+}
+
+// advance moves the peer to height if it is behind it, it is called when the
+// peer sends us a message for height, showing that the peer reached height
+// even if we have not yet heard its new round state.
+func (p *peerState) advance(height uint64) {
+	if height > p.height {
+		p.setState(roundState{height: height})
+	}
+}
+
+// forHeight returns the messages the peer holds at height, or nil if height
+// is not one we track.
+func (p *peerState) forHeight(height uint64) *peerHeight {
+	if height != p.height && height != p.height+1 {
+		return nil
+	}
+	return p.heights[height-p.height]
+}
+
+// forRound returns the messages the peer holds for a round, creating the
+// entry if create is set. It returns nil if height is not one we track or we
+// don't know its validator set.
+func (p *peerState) forRound(height uint64, r int, create bool) *peerRound {
+	ph := p.forHeight(height)
+	if ph == nil {
+		return nil
+	}
+	rounds := ph.rounds
+	pr := rounds[r]
+	if size := p.size(height); pr == nil && create && size > 0 {
+		pr = &peerRound{
+			proposals: make(map[tendermint.Hash]bool),
+			votes:     [2]*BitArray{NewBitArray(size), NewBitArray(size)},
+		}
+		rounds[r] = pr
+	}
+	return pr
+}
+
+// setVotes records the messages the peer announced holding.
+func (p *peerState) setVotes(v *voteSet) {
+	p.advance(v.height)
+	if size := p.size(v.height); v.votes[0].Size() != size || v.votes[1].Size() != size {
+		return
+	}
+	pr := p.forRound(v.height, v.round, true)
+	if pr == nil {
+		return
+	}
+	pr.proposal = pr.proposal || v.proposal
+	pr.votes[0].Or(v.votes[0])
+	pr.votes[1].Or(v.votes[1])
+}
+
+// has returns true if the peer holds m, first is set if m is the first
+// proposal that we received for its round and index is the position of m's
+// sender in the validator set.
+func (p *peerState) has(m *algorithm.ConsensusMessage, raw []byte, first bool, index int) bool {
+	pr := p.forRound(m.Height, m.Round, false)
+	if pr == nil {
+		return false
+	}
+	if m.MsgType == algorithm.Propose {
+		return (first && pr.proposal) || pr.proposals[sha256.Sum256(raw)]
+	}
+	return pr.votes[m.MsgType-algorithm.Prevote].Get(index)
+}
+
+// mark records that the peer holds m, see has.
+func (p *peerState) mark(m *algorithm.ConsensusMessage, raw []byte, index int) {
+	pr := p.forRound(m.Height, m.Round, true)
+	if pr == nil {
+		return
+	}
+	if m.MsgType == algorithm.Propose {
+		pr.proposals[sha256.Sum256(raw)] = true
+		return
+	}
+	pr.votes[m.MsgType-algorithm.Prevote].Set(index)
+}
+
+// forParts returns the parts the peer holds of the payload with the given
+// value, creating the entry if create is set. It returns nil if height is not
+// one we track.
+func (p *peerState) forParts(height uint64, value tendermint.Hash, total int, create bool) *BitArray {
+	ph := p.forHeight(height)
+	if ph == nil {
+		return nil
+	}
+	bits := ph.parts[value]
+	if bits == nil && create {
+		bits = NewBitArray(total)
+		ph.parts[value] = bits
+	}
+	return bits
+}
+
+// hasPart returns true if the peer holds part i of the payload with the given
+// value.
+func (p *peerState) hasPart(height uint64, value tendermint.Hash, i int) bool {
+	bits := p.forParts(height, value, 0, false)
+	return bits != nil && bits.Get(i)
+}
+
+// markPart records that the peer holds part i of a payload of total parts.
+func (p *peerState) markPart(height uint64, value tendermint.Hash, total, i int) {
+	if bits := p.forParts(height, value, total, true); bits != nil {
+		bits.Set(i)
+	}
+}
+
+// setParts records the parts the peer announced holding.
+func (p *peerState) setParts(a *partsAnnouncement) {
+	p.advance(a.height)
+	bits := p.forParts(a.height, a.value, a.parts.Size(), true)
+	if bits != nil && bits.Size() == a.parts.Size() {
+		bits.Or(a.parts)
+	}
+}
+
+// roundWindow bounds the distance from our round of the rounds whose vote
+// sets peers may announce, so that a peer cannot make us track arbitrarily
+// many rounds. Peers further away are sent messages regardless of what they
+// announced, at the cost of some duplicates.
+const roundWindow = 2
+
+// nearRound returns true if round r of height is within roundWindow of our
+// round.
+func (d *Driver) nearRound(height uint64, r int) bool {
+	return height == d.Height() && r >= d.round-roundWindow && r <= d.round+roundWindow
+}
+
+// holdsPayload returns true if we hold the payload of a proposal with the
+// given value at height, of total parts. Announcements of the parts of other
+// payloads are ignored since we have no parts of them to send.
+func (d *Driver) holdsPayload(height uint64, value tendermint.Hash, total int) bool {
+	var pl *payload
+	if height == d.Height() {
+		pl = d.payloads[value]
+	} else if h := d.history[height]; h != nil && h.decision.Value == value {
+		pl = h.payload
+	}
+	return pl != nil && pl.parts.Total() == total
+}
+
+// peer returns our view of a peer, creating it if needed since a peer's
+// messages may be received before the event announcing it.
+func (d *Driver) peer(id algorithm.NodeID) *peerState {
+	p := d.peers[id]
+	if p == nil {
+		p = newPeerState(d.setSize)
+		d.peers[id] = p
+	}
+	return p
+}
+
+// setSize returns the size of the validator set at height, or zero if it is
+// unknown.
+func (d *Driver) setSize(height uint64) int {
+	if vs, ok := d.cfg.Schedule.At(height); ok {
+		return vs.Size()
+	}
+	return 0
+}
+
+// announceState sends our round state to our peers if it has changed since it
+// was last sent.
+func (d *Driver) announceState() {
+	s := d.roundState()
+	if s == d.announced {
+		return
+	}
+	d.announced = s
+	d.transport.Broadcast(Channel, s.encode())
+}
+
+func (d *Driver) roundState() roundState {
+	return roundState{height: d.Height(), round: d.round, step: d.algo.State().Step}
+}
+
+// send sends a stored message to a peer and records that the peer holds it.
+func (d *Driver) send(id algorithm.NodeID, p *peerState, m *algorithm.ConsensusMessage, raw []byte) {
+	if err := d.transport.Send(id, Channel, append([]byte{kindMessage}, raw...)); err != nil {
+		// The peer will be offered the message again in the next gossip
+		// round.
+		return
+	}
+	p.mark(m, raw, d.index(m))
+}
+
+// gossip announces the messages we hold for our current round and sends
+// each peer the messages it lacks.
+func (d *Driver) gossip() {
+	d.tick++
+	v := &voteSet{
+		height: d.Height(),
+		round:  d.round,
+		votes:  [2]*BitArray{NewBitArray(d.validators.Size()), NewBitArray(d.validators.Size())},
+	}
+	for _, m := range d.store.RoundMessages(d.round) {
+		if m.MsgType == algorithm.Propose {
+			v.proposal = true
+			continue
+		}
+		index, _ := d.validators.Index(m.Sender)
+		v.votes[m.MsgType-algorithm.Prevote].Set(index)
+	}
+	d.transport.Broadcast(Channel, v.encode())
+	d.announceParts()
+
+	for id, p := range d.peers {
+		switch {
+		case p.height == d.Height():
+			d.gossipRounds(id, p)
+		case p.height < d.Height():
+			d.gossipDecision(id, p)
+		}
+	}
+}
+
+// gossipRounds sends a peer at our height the messages it lacks for the
+// rounds it may need, the round it is in, our round if it is behind us and
+// the valid rounds of the proposals for its round.
+func (d *Driver) gossipRounds(id algorithm.NodeID, p *peerState) {
+	rounds := []int{p.round}
+	if d.round > p.round {
+		rounds = append(rounds, d.round)
+	}
+	for _, m := range d.store.Proposals(p.round) {
+		if m.ValidRound >= 0 && m.ValidRound != p.round {
+			rounds = append(rounds, m.ValidRound)
+		}
+	}
+	for _, r := range rounds {
+		d.sendRound(id, p, r, true)
+	}
+}
+
+// catchUp responds to the round state announced by a peer that is behind us.
+// A peer in an earlier round of our height is sent the messages of our round
+// straight away, rather than on the next gossip rounds, so that it can skip to
+// our round on the f+1 messages it receives instead of timing out in each of
+// the rounds in between. The proposal of our round comes with the messages of
+// its valid round, which the peer needs to accept it. A peer at an earlier
+// height is sent the decision of its height.
+func (d *Driver) catchUp(id algorithm.NodeID, p *peerState) {
+	switch {
+	case p.height < d.Height():
+		d.gossipDecision(id, p)
+	case p.height == d.Height() && p.round < d.round:
+		d.sendRound(id, p, d.round, false)
+		for _, m := range d.store.Proposals(d.round) {
+			if m.ValidRound >= 0 {
+				d.sendRound(id, p, m.ValidRound, false)
+			}
+		}
+	}
+}
+
+// sendRound sends a peer at our height the messages it lacks of round r and
+// the parts of the proposed payloads. If wait is set messages we received
+// recently are skipped.
+func (d *Driver) sendRound(id algorithm.NodeID, p *peerState, r int, wait bool) {
+	proposals := 0
+	for _, m := range d.store.RoundMessages(r) {
+		first := m.MsgType == algorithm.Propose && proposals == 0
+		if m.MsgType == algorithm.Propose {
+			proposals++
+		}
+		// Messages we received recently are likely to reach the peer by
+		// other paths, we wait until the peer has had the chance to announce
+		// them before sending them ourselves. So that this holds regardless
+		// of the order in which gossip rounds and messages interleave the
+		// wait is at least one full gossip interval.
+		if wait && d.tick-d.arrived[m] < 2 {
+			continue
+		}
+		raw := d.store.Raw(m)
+		if !p.has(m, raw, first, d.index(m)) {
+			d.send(id, p, m, raw)
+		}
+		if pl := d.payloads[m.Value]; m.MsgType == algorithm.Propose && pl != nil {
+			d.sendParts(id, p, m.Height, pl, !wait)
+		}
+	}
+}
+
+// gossipDecision sends a lagging peer the messages it lacks of the proposal
+// and precommits that decided its height. Without this a node that misses the
+// precommits for a height would never progress.
+func (d *Driver) gossipDecision(id algorithm.NodeID, p *peerState) {
+	h := d.history[p.height]
+	// As with messages of the current height, a peer that has only just
+	// fallen behind is likely to receive the decision by other paths.
+	if h == nil || d.tick-h.tick < 2 {
+		return
+	}
+	for _, m := range h.store.RoundMessages(h.decision.Round) {
+		if m.Value != h.decision.Value || m.MsgType == algorithm.Prevote {
+			continue
+		}
+		raw := h.store.Raw(m)
+		if !p.has(m, raw, false, d.index(m)) {
+			d.send(id, p, m, raw)
+		}
+		if m.MsgType == algorithm.Propose {
+			d.sendParts(id, p, m.Height, h.payload, true)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package consensus
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+	"github.com/piersy/tendermint-go/tendermint/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitArray(t *testing.T) {
+	b := NewBitArray(70)
+	b.Set(0)
+	b.Set(65)
+	b.Set(70)
+	assert.True(t, b.Get(0))
+	assert.True(t, b.Get(65))
+	assert.False(t, b.Get(1))
+	assert.False(t, b.Get(70))
+	assert.Equal(t, 2, b.Count())
+
+	other := NewBitArray(70)
+	other.Set(3)
+	b.Or(other)
+	assert.Equal(t, 3, b.Count())
+
+	encoded, err := b.MarshalBinary()
+	require.NoError(t, err)
+	assert.Len(t, encoded, 2+9)
+	decoded := new(BitArray)
+	require.NoError(t, decoded.UnmarshalBinary(encoded))
+	assert.Equal(t, b, decoded)
+	assert.Error(t, decoded.UnmarshalBinary(encoded[:5]))
+}
+
+func TestGossipEncoding(t *testing.T) {
+	s := roundState{height: 7, round: 3, step: algorithm.Precommit}
+	decodedState, err := decodeRoundState(s.encode()[1:])
+	require.NoError(t, err)
+	assert.Equal(t, s, decodedState)
+	_, err = decodeRoundState(roundState{height: 7, round: -1}.encode()[1:])
+	assert.Error(t, err)
+
+	v := &voteSet{height: 7, round: 3, proposal: true, votes: [2]*BitArray{NewBitArray(10), NewBitArray(10)}}
+	v.votes[0].Set(2)
+	v.votes[1].Set(9)
+	decodedVotes, err := decodeVoteSet(v.encode()[1:])
+	require.NoError(t, err)
+	assert.Equal(t, v, decodedVotes)
+	_, err = decodeVoteSet(v.encode()[1:20])
+	assert.Error(t, err)
+}
+
+// A round state for an earlier height than the peer's, overtaken by a message
+// that advanced the peer, keeps what we know about the messages the peer
+// holds, a later height or a second earlier one in a row discards it.
+func TestPeerStateIgnoresStaleHeights(t *testing.T) {
+	p := newPeerState(func(uint64) int { return 4 })
+	value := tendermint.Hash{1}
+	p.advance(5)
+	p.forRound(5, 0, true).votes[0].Set(2)
+	p.markPart(5, value, 3, 1)
+
+	assert.False(t, p.setState(roundState{height: 4, round: 2}))
+	assert.Equal(t, roundState{height: 5}, p.roundState)
+	assert.True(t, p.forRound(5, 0, false).votes[0].Get(2))
+	assert.True(t, p.hasPart(5, value, 1))
+
+	assert.True(t, p.setState(roundState{height: 5, round: 1}))
+	assert.True(t, p.forRound(5, 0, false).votes[0].Get(2))
+	assert.True(t, p.hasPart(5, value, 1))
+
+	assert.True(t, p.setState(roundState{height: 7}))
+	assert.Nil(t, p.forRound(5, 0, false))
+	assert.False(t, p.hasPart(5, value, 1))
+
+	// A peer that restarted keeps announcing its lower height.
+	p.forRound(7, 0, true).votes[0].Set(2)
+	assert.False(t, p.setState(roundState{height: 1}))
+	assert.True(t, p.forRound(7, 0, false).votes[0].Get(2))
+	assert.True(t, p.setState(roundState{height: 1, round: 1}))
+	assert.Equal(t, roundState{height: 1, round: 1}, p.roundState)
+	assert.Nil(t, p.forRound(7, 0, false))
+}
+
+func TestDriverRelaysMessages(t *testing.T) {
+	ks := testKeys(4)
+	n, transports := memCluster(t, ks)
+	// Connect the validators in a line, so that the messages of each
+	// validator only reach half of the others if they are relayed.
+	for i := range transports {
+		for j := i + 2; j < len(transports); j++ {
+			n.Disconnect(transports[i].ID(), transports[j].ID())
+		}
+	}
+	decisions := runCluster(t, ks, transports, 3, func(_ algorithm.NodeID, c *Config) {
+		c.TimeoutUnit = 50 * time.Millisecond
+	})
+	checkAgreement(t, decisions, 3)
+}
+
+// countingTransport counts the consensus messages it receives.
+type countingTransport struct {
+	p2p.Transport
+	out chan p2p.Envelope
+
+	mu       sync.Mutex
+	received map[[32]byte]int
+}
+
+func newCountingTransport(tr p2p.Transport) *countingTransport {
+	c := &countingTransport{Transport: tr, out: make(chan p2p.Envelope), received: make(map[[32]byte]int)}
+	go func() {
+		defer close(c.out)
+		for e := range tr.Receive() {
+			if e.Channel == Channel && len(e.Payload) > 0 && e.Payload[0] == kindMessage {
+				c.mu.Lock()
+				c.received[sha256.Sum256(e.Payload)]++
+				c.mu.Unlock()
+			}
+			c.out <- e
+		}
+	}()
+	return c
+}
+
+func (c *countingTransport) Receive() <-chan p2p.Envelope {
+	return c.out
+}
+
+// counts returns the number of distinct messages received and the number of
+// receipts of messages that had already been received.
+func (c *countingTransport) counts() (unique, duplicates int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, count := range c.received {
+		unique++
+		duplicates += count - 1
+	}
+	return unique, duplicates
+}
+
+func TestDriverGossipAvoidsDuplicates(t *testing.T) {
+	ks := testKeys(7)
+	_, transports := memCluster(t, ks)
+	var counting []*countingTransport
+	for i, tr := range transports {
+		c := newCountingTransport(tr)
+		counting = append(counting, c)
+		transports[i] = c
+	}
+	decisions := runCluster(t, ks, transports, 5, func(_ algorithm.NodeID, c *Config) {
+		// Suppressing duplicates relies on peers announcing the messages
+		// they hold within a gossip interval, slow test runs need a long
+		// interval for that to hold. In a full mesh all messages arrive
+		// directly so the interval does not slow consensus.
+		c.TimeoutUnit = 100 * time.Millisecond
+		c.GossipInterval = 200 * time.Millisecond
+	})
+	checkAgreement(t, decisions, 5)
+
+	// Flooding would deliver each message to each node once per peer, with
+	// gossip duplicates only arise when a message is relayed before the
+	// relayer learns that the recipient holds it.
+	for _, c := range counting {
+		unique, duplicates := c.counts()
+		assert.Less(t, duplicates, unique, "node %v", c.ID())
+	}
+}
+
+func TestDriverFollower(t *testing.T) {
+	ks := testKeys(4)
+	n, transports := memCluster(t, ks)
+	// A node without a signer follows the validators without voting.
+	tr := n.Transport(algorithm.NodeID{0xff})
+	defer tr.Close()
+	decided := make(chan *algorithm.ConsensusMessage, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	follower := NewDriver(Config{
+		ChainID:        testChainID,
+		Validators:     validatorSet(t, ks),
+		TimeoutUnit:    20 * time.Millisecond,
+		GossipInterval: 5 * time.Millisecond,
+		Decided: func(p *algorithm.ConsensusMessage, _ *types.Block) []types.ValidatorUpdate {
+			select {
+			case decided <- p:
+			case <-ctx.Done():
+			}
+			return nil
+		},
+	}, tr)
+	go func() { _ = follower.Run(ctx) }()
+
+	decisions := runCluster(t, ks, transports, 5, nil)
+	checkAgreement(t, decisions, 5)
+	for h := 0; h < 3; h++ {
+		select {
+		case p := <-decided:
+			assert.Equal(t, decisions[transports[0].ID()][h].Value, p.Value)
+		case <-time.After(testTimeout):
+			t.Fatalf("follower did not decide height %d", h+1)
+		}
+	}
+}
+
+func TestDriverCatchUp(t *testing.T) {
+	ks := testKeys(4)
+	_, transports := memCluster(t, ks)
+	vs := validatorSet(t, ks)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Every payload is invalid so the validators move through the rounds
+	// of the first height without deciding. Gossip rounds never happen so
+	// messages are only relayed in response to announced round states.
+	// The test plays the second validator, which proposes in the first
+	// round, so that no messages are sent before the drivers know their
+	// peers.
+	lagging, helper := transports[1], transports[0].ID()
+	for i, tr := range transports {
+		if tr == lagging {
+			continue
+		}
+		d := NewDriver(Config{
+			ChainID:        testChainID,
+			Signer:         types.NewKeySigner(ks[i]),
+			Validators:     vs,
+			TimeoutUnit:    10 * time.Millisecond,
+			GossipInterval: time.Hour,
+			Valid:          func([]byte) bool { return false },
+		}, tr)
+		go func() { _ = d.Run(ctx) }()
+	}
+
+	// The lagging validator records the messages of others relayed to it by
+	// the first validator.
+	var mu sync.Mutex
+	round := 0
+	relayed := make(map[algorithm.NodeID]bool)
+	go func() {
+		for e := range lagging.Receive() {
+			if e.From != helper || len(e.Payload) == 0 || e.Payload[0] != kindMessage {
+				continue
+			}
+			m, _, err := types.DecodeSigned(e.Payload[1:])
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			if m.Sender == helper && m.Round > round {
+				round = m.Round
+			}
+			if m.Sender != helper && m.Round > 0 {
+				relayed[m.Sender] = true
+			}
+			mu.Unlock()
+		}
+	}()
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return round >= 3
+	}, testTimeout, time.Millisecond)
+	mu.Lock()
+	assert.Empty(t, relayed)
+	mu.Unlock()
+
+	// Announcing that we are still in the first round gets us the messages
+	// of the helper's round, enough to skip to it.
+	stuck := roundState{height: 1, round: 0, step: algorithm.Propose}
+	assert.Eventually(t, func() bool {
+		require.NoError(t, lagging.Send(helper, Channel, stuck.encode()))
+		mu.Lock()
+		defer mu.Unlock()
+		return len(relayed) >= 2
+	}, testTimeout, 5*time.Millisecond)
+}
+
+func TestDriverBoundsAnnouncements(t *testing.T) {
+	ks := testKeys(4)
+	d := testDriver(t, ks)
+	vs := validatorSet(t, ks)
+	from := vs.IDs()[1]
+	announce := func(payload []byte) {
+		d.receive(p2p.Envelope{From: from, Channel: Channel, Payload: payload})
+	}
+
+	// Only the vote sets of rounds near ours are tracked.
+	for _, r := range []int{roundWindow, roundWindow + 1, 1000} {
+		v := &voteSet{height: 1, round: r, votes: [2]*BitArray{NewBitArray(vs.Size()), NewBitArray(vs.Size())}}
+		announce(v.encode())
+	}
+	p := d.peer(from)
+	assert.NotNil(t, p.forRound(1, roundWindow, false))
+	assert.Nil(t, p.forRound(1, roundWindow+1, false))
+	assert.Nil(t, p.forRound(1, 1000, false))
+
+	// Only the parts of payloads we hold are tracked, with their size.
+	parts := types.NewPartSetFromData(testPayload(1, 0))
+	value := types.Header{Height: 1, Payload: parts.Header()}.Hash()
+	announce((&partsAnnouncement{height: 1, value: value, parts: NewBitArray(parts.Total())}).encode())
+	assert.Nil(t, p.forParts(1, value, 0, false))
+	d.receive(signedProposal(t, ks, vs.Proposer(1, 0), 1, 0, parts))
+	announce((&partsAnnouncement{height: 1, value: value, parts: NewBitArray(1 << 15)}).encode())
+	assert.Nil(t, p.forParts(1, value, 0, false))
+	announce((&partsAnnouncement{height: 1, value: value, parts: NewBitArray(parts.Total())}).encode())
+	assert.NotNil(t, p.forParts(1, value, 0, false))
+}
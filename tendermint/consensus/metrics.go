@@ -0,0 +1,123 @@
+package consensus
+
+import (
+	"strings"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/metrics"
+)
+
+// Metrics records the operational metrics of a Driver, its methods are called
+// from the goroutine executing Run.
+type Metrics interface {
+	// State records the height, round and step entered.
+	State(height uint64, round int, step algorithm.Step)
+	// StepDuration records the time spent in a step.
+	StepDuration(step algorithm.Step, d time.Duration)
+	// Decided records the number of rounds that a height took to decide.
+	Decided(rounds int)
+	// Timeout records a timeout that fired in the height and round it was
+	// scheduled in.
+	Timeout(step algorithm.Step)
+	// Vote records a vote added to the Store.
+	Vote(step algorithm.Step)
+	// Equivocation records a message that conflicts with one held from the
+	// same validator.
+	Equivocation(step algorithm.Step)
+	// Quorum records the time from the start of a round to the forming of a
+	// quorum of votes of the given step for a single value in that round.
+	Quorum(step algorithm.Step, d time.Duration)
+	// Duplicate records a message that was already held.
+	Duplicate()
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) State(uint64, int, algorithm.Step)          {}
+func (nopMetrics) StepDuration(algorithm.Step, time.Duration) {}
+func (nopMetrics) Decided(int)                                {}
+func (nopMetrics) Timeout(algorithm.Step)                     {}
+func (nopMetrics) Vote(algorithm.Step)                        {}
+func (nopMetrics) Equivocation(algorithm.Step)                {}
+func (nopMetrics) Quorum(algorithm.Step, time.Duration)       {}
+func (nopMetrics) Duplicate()                                 {}
+
+// PrometheusMetrics implements Metrics with metrics held in a
+// metrics.Registry.
+type PrometheusMetrics struct {
+	height        *metrics.Gauge
+	round         *metrics.Gauge
+	step          *metrics.Gauge
+	stepDuration  *metrics.Histogram
+	rounds        *metrics.Histogram
+	timeouts      *metrics.Counter
+	votes         *metrics.Counter
+	equivocations *metrics.Counter
+	quorum        *metrics.Histogram
+	duplicates    *metrics.Counter
+}
+
+// NewPrometheusMetrics registers the consensus metrics with r, their names
+// are prefixed with tendermint_consensus_.
+func NewPrometheusMetrics(r *metrics.Registry) *PrometheusMetrics {
+	const prefix = "tendermint_consensus_"
+	return &PrometheusMetrics{
+		height:        r.Gauge(prefix+"height", "Current height."),
+		round:         r.Gauge(prefix+"round", "Current round."),
+		step:          r.Gauge(prefix+"step", "Current step, 0 for propose, 1 for prevote and 2 for precommit."),
+		stepDuration:  r.Histogram(prefix+"step_duration_seconds", "Time spent in each step.", nil, "step"),
+		rounds:        r.Histogram(prefix+"rounds", "Number of rounds taken to decide a height.", []float64{1, 2, 3, 5, 10, 20}),
+		timeouts:      r.Counter(prefix+"timeouts_total", "Timeouts that fired in the round they were scheduled in, by type.", "step"),
+		votes:         r.Counter(prefix+"votes_total", "Votes received, by step.", "step"),
+		equivocations: r.Counter(prefix+"equivocations_total", "Conflicting messages received from validators, by step.", "step"),
+		quorum:        r.Histogram(prefix+"quorum_latency_seconds", "Time from the start of a round to a quorum of votes for a single value, by step.", nil, "step"),
+		duplicates:    r.Counter(prefix+"duplicate_messages_total", "Messages received that were already held."),
+	}
+}
+
+func stepLabel(step algorithm.Step) string {
+	return strings.ToLower(step.String())
+}
+
+// State implements Metrics.
+func (m *PrometheusMetrics) State(height uint64, round int, step algorithm.Step) {
+	m.height.Set(float64(height))
+	m.round.Set(float64(round))
+	m.step.Set(float64(step))
+}
+
+// StepDuration implements Metrics.
+func (m *PrometheusMetrics) StepDuration(step algorithm.Step, d time.Duration) {
+	m.stepDuration.Observe(d.Seconds(), stepLabel(step))
+}
+
+// Decided implements Metrics.
+func (m *PrometheusMetrics) Decided(rounds int) {
+	m.rounds.Observe(float64(rounds))
+}
+
+// Timeout implements Metrics.
+func (m *PrometheusMetrics) Timeout(step algorithm.Step) {
+	m.timeouts.Inc(stepLabel(step))
+}
+
+// Vote implements Metrics.
+func (m *PrometheusMetrics) Vote(step algorithm.Step) {
+	m.votes.Inc(stepLabel(step))
+}
+
+// Equivocation implements Metrics.
+func (m *PrometheusMetrics) Equivocation(step algorithm.Step) {
+	m.equivocations.Inc(stepLabel(step))
+}
+
+// Quorum implements Metrics.
+func (m *PrometheusMetrics) Quorum(step algorithm.Step, d time.Duration) {
+	m.quorum.Observe(d.Seconds(), stepLabel(step))
+}
+
+// Duplicate implements Metrics.
+func (m *PrometheusMetrics) Duplicate() {
+	m.duplicates.Inc()
+}
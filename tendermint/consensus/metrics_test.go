@@ -0,0 +1,122 @@
+package consensus
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/metrics"
+	"github.com/piersy/tendermint-go/tendermint/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scrape returns the value of each series served by h, keyed by the series
+// name and labels.
+func scrape(t *testing.T, h http.Handler) map[string]float64 {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	result := make(map[string]float64)
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		require.NoError(t, err, line)
+		result[line[:i]] = v
+	}
+	return result
+}
+
+func TestDriverMetrics(t *testing.T) {
+	ks := testKeys(4)
+	vs := validatorSet(t, ks)
+	_, transports := memCluster(t, ks)
+	r := metrics.NewRegistry()
+	id := transports[0].ID()
+	runCluster(t, ks, transports, 3, func(node algorithm.NodeID, cfg *Config) {
+		// Timeouts are long so that heights are decided in round 0.
+		cfg.TimeoutUnit = time.Second
+		if node == id {
+			cfg.Metrics = NewPrometheusMetrics(r)
+		}
+	})
+
+	// Metrics for a decision are recorded before Decided is called, the
+	// node may have decided further heights since.
+	m := scrape(t, r.Handler())
+	decided := m["tendermint_consensus_rounds_count"]
+	assert.GreaterOrEqual(t, decided, 3.0)
+	assert.GreaterOrEqual(t, m["tendermint_consensus_height"], decided)
+	assert.Equal(t, decided, m[`tendermint_consensus_rounds_bucket{le="1"}`])
+	assert.GreaterOrEqual(t, m[`tendermint_consensus_votes_total{step="precommit"}`], decided*float64(vs.Quorum()))
+	assert.Equal(t, decided, m[`tendermint_consensus_quorum_latency_seconds_count{step="precommit"}`])
+	assert.GreaterOrEqual(t, m[`tendermint_consensus_step_duration_seconds_count{step="propose"}`], 3.0)
+	assert.GreaterOrEqual(t, m[`tendermint_consensus_step_duration_seconds_count{step="precommit"}`], 3.0)
+	assert.Zero(t, m[`tendermint_consensus_equivocations_total{step="prevote"}`])
+}
+
+func TestDriverMetricsFaults(t *testing.T) {
+	ks := testKeys(4)
+	vs := validatorSet(t, ks)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A validator that is not the first proposer runs with another that the
+	// test plays, which sends a duplicate and then an equivocating prevote.
+	var k, other ed25519.PrivateKey
+	for _, c := range ks {
+		if vs.Proposer(1, 0) == keys.Address(c.Public().(ed25519.PublicKey)) {
+			continue
+		}
+		if k == nil {
+			k = c
+		} else {
+			other = c
+		}
+	}
+	_, transports := memCluster(t, []ed25519.PrivateKey{k, other})
+	r := metrics.NewRegistry()
+	d := NewDriver(Config{
+		ChainID:     testChainID,
+		Signer:      types.NewKeySigner(k),
+		Validators:  vs,
+		TimeoutUnit: 10 * time.Millisecond,
+		Metrics:     NewPrometheusMetrics(r),
+	}, transports[0])
+	go func() { _ = d.Run(ctx) }()
+
+	signer := types.NewKeySigner(other)
+	send := func(value tendermint.Hash) {
+		cm := &algorithm.ConsensusMessage{Sender: keys.Address(signer.PubKey()), MsgType: algorithm.Prevote, Height: 1, Value: value}
+		sig, err := signer.SignMessage(testChainID, cm)
+		require.NoError(t, err)
+		payload := append([]byte{kindMessage}, types.EncodeSigned(cm, sig)...)
+		require.NoError(t, transports[1].Send(transports[0].ID(), Channel, payload))
+	}
+	send(algorithm.NilValue)
+	send(algorithm.NilValue)
+	send(tendermint.Hash{1})
+
+	// The validator times out waiting for a proposal and prevotes nil, the
+	// messages from the other validator are handled in order.
+	require.Eventually(t, func() bool {
+		m := scrape(t, r.Handler())
+		return m[`tendermint_consensus_timeouts_total{step="propose"}`] == 1 && m[`tendermint_consensus_equivocations_total{step="prevote"}`] == 1
+	}, testTimeout, time.Millisecond)
+	m := scrape(t, r.Handler())
+	assert.Equal(t, 1.0, m["tendermint_consensus_duplicate_messages_total"])
+	assert.Equal(t, 2.0, m[`tendermint_consensus_votes_total{step="prevote"}`])
+	assert.Equal(t, 1.0, m["tendermint_consensus_height"])
+	assert.Equal(t, float64(algorithm.Prevote), m["tendermint_consensus_step"])
+}
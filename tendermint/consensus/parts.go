@@ -0,0 +1,265 @@
+package consensus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// DefaultMaxProposalSize is the default bound on the size of a proposed
+// payload.
+const DefaultMaxProposalSize = 4 << 20
+
+// partMessage carries one part of the payload proposed with value.
+type partMessage struct {
+	// from is the peer that sent the message.
+	from   algorithm.NodeID
+	height uint64
+	value  tendermint.Hash
+	part   *types.Part
+}
+
+func (m *partMessage) encode() []byte {
+	part, err := m.part.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	b := make([]byte, 1, 41+len(part))
+	b[0] = kindPart
+	b = binary.BigEndian.AppendUint64(b, m.height)
+	b = append(b, m.value[:]...)
+	return append(b, part...)
+}
+
+func decodePartMessage(b []byte) (*partMessage, error) {
+	if len(b) < 40 {
+		return nil, fmt.Errorf("part message has length %d", len(b))
+	}
+	m := &partMessage{height: binary.BigEndian.Uint64(b)}
+	copy(m.value[:], b[8:])
+	part, err := types.DecodePart(b[40:])
+	if err != nil {
+		return nil, err
+	}
+	m.part = part
+	return m, nil
+}
+
+// partsAnnouncement describes the parts a node holds of the payload proposed
+// with value, nodes announce the parts of the payloads proposed in their
+// current round on every gossip round.
+type partsAnnouncement struct {
+	height uint64
+	value  tendermint.Hash
+	parts  *BitArray
+}
+
+func (a *partsAnnouncement) encode() []byte {
+	bits, err := a.parts.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	b := make([]byte, 1, 41+len(bits))
+	b[0] = kindParts
+	b = binary.BigEndian.AppendUint64(b, a.height)
+	b = append(b, a.value[:]...)
+	return append(b, bits...)
+}
+
+func decodePartsAnnouncement(b []byte) (*partsAnnouncement, error) {
+	if len(b) < 40 {
+		return nil, fmt.Errorf("parts announcement has length %d", len(b))
+	}
+	a := &partsAnnouncement{height: binary.BigEndian.Uint64(b), parts: new(BitArray)}
+	copy(a.value[:], b[8:])
+	if err := a.parts.UnmarshalBinary(b[40:]); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// payload holds the parts of a proposed payload as they arrive.
+type payload struct {
+	// header is the header of the proposals of the payload.
+	header types.Header
+	parts  *types.PartSet
+	// arrived holds the gossip round in which each part was received.
+	arrived []int
+}
+
+// proposalOracle hides the proposals whose payload has not been received from
+// the Algorithm. To the Algorithm a proposal is only received once its
+// payload is, otherwise a proposal whose payload is still in flight would be
+// taken to be invalid.
+type proposalOracle struct {
+	*algorithm.BasicOracle
+	received func(tendermint.Hash) bool
+}
+
+// MatchingProposal implements algorithm.Oracle.
+func (o *proposalOracle) MatchingProposal(round int, valueHash *tendermint.Hash) *algorithm.ConsensusMessage {
+	if !o.received(*valueHash) {
+		return nil
+	}
+	return o.BasicOracle.MatchingProposal(round, valueHash)
+}
+
+// Proposals implements algorithm.ProposalOracle.
+func (o *proposalOracle) Proposals(round int) []*algorithm.ConsensusMessage {
+	var result []*algorithm.ConsensusMessage
+	for _, p := range o.BasicOracle.Proposals(round) {
+		if o.received(p.Value) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// received returns true if we hold the complete payload proposed with value.
+func (d *Driver) received(value tendermint.Hash) bool {
+	p := d.payloads[value]
+	return p != nil && p.parts.IsComplete()
+}
+
+// expect prepares to receive the parts of the payload of a proposal with the
+// given header.
+func (d *Driver) expect(header types.Header) *payload {
+	value := header.Hash()
+	p := d.payloads[value]
+	if p == nil {
+		p = &payload{header: header, parts: types.NewPartSetFromHeader(header.Payload), arrived: make([]int, header.Payload.Total)}
+		d.payloads[value] = p
+	}
+	return p
+}
+
+// addPayload records a complete payload of our own.
+func (d *Driver) addPayload(header types.Header, parts *types.PartSet) {
+	value := header.Hash()
+	if d.payloads[value] == nil {
+		d.payloads[value] = &payload{header: header, parts: parts, arrived: make([]int, parts.Total())}
+		d.complete(value)
+	}
+}
+
+// expectFuture prepares to buffer the parts of a proposal for the next
+// height, it returns false if the proposal would be dropped at the next
+// height, because it is not from the proposer or its payload is too large.
+func (d *Driver) expectFuture(m *algorithm.ConsensusMessage, raw []byte) bool {
+	vs, ok := d.cfg.Schedule.At(m.Height)
+	if !ok || m.Sender != vs.Proposer(m.Height, m.Round) {
+		return false
+	}
+	header, err := types.ProposalHeader(raw)
+	if err != nil || header.Payload.Total > d.maxParts() {
+		return false
+	}
+	if value := header.Hash(); d.futurePayloads[value] == nil {
+		d.futurePayloads[value] = types.NewPartSetFromHeader(header.Payload)
+	}
+	return true
+}
+
+// receivePart adds a part received from a peer, m is dropped unless we have
+// received the proposal whose payload it belongs to. Parts for the next
+// height are verified against the header of their proposal and buffered
+// once, so the buffer never holds more than the payloads of the proposals
+// buffered for the next height.
+func (d *Driver) receivePart(p *peerState, m *partMessage) {
+	height := d.Height()
+	if m.height == height+1 {
+		ps := d.futurePayloads[m.value]
+		if ps == nil {
+			return
+		}
+		if added, err := ps.AddPart(m.part); err == nil && added {
+			d.futureParts = append(d.futureParts, m)
+		}
+		return
+	}
+	pl := d.payloads[m.value]
+	if m.height != height || pl == nil {
+		return
+	}
+	added, err := pl.parts.AddPart(m.part)
+	if err != nil {
+		return
+	}
+	p.markPart(m.height, m.value, pl.parts.Total(), m.part.Index)
+	if !added {
+		return
+	}
+	pl.arrived[m.part.Index] = d.tick
+	if pl.parts.IsComplete() {
+		d.complete(m.value)
+	}
+}
+
+// complete is called once the payload proposed with value has been received,
+// only then is its validity known so only then are the proposals of the
+// payload passed to the Algorithm. A value is valid if its payload and header
+// are, see validHeader.
+func (d *Driver) complete(value tendermint.Hash) {
+	pl := d.payloads[value]
+	if d.cfg.Valid(pl.parts.Data()) && d.validHeader(pl.header) {
+		d.store.SetValid(&value)
+	}
+	height := d.Height()
+	pending := d.pending[value]
+	delete(d.pending, value)
+	for _, m := range pending {
+		if d.Height() != height {
+			return
+		}
+		d.process(m)
+	}
+}
+
+// validHeader returns true if h is the header we would have proposed at this
+// height for its payload, but for its time. The time must be later than the
+// previous height's and at most MaxClockDrift ahead of our clock.
+func (d *Driver) validHeader(h types.Header) bool {
+	expected := d.header(h.Payload)
+	expected.Time = h.Time
+	return h == expected && h.Time.After(d.lastTime) && !h.Time.After(time.Now().Add(d.cfg.MaxClockDrift))
+}
+
+// sendParts sends a peer the parts it lacks of the payload proposed with
+// value, parts received in the last gossip round are skipped unless all is
+// set.
+func (d *Driver) sendParts(id algorithm.NodeID, p *peerState, height uint64, pl *payload, all bool) {
+	value := pl.header.Hash()
+	for i := 0; i < pl.parts.Total(); i++ {
+		if !pl.parts.Has(i) || p.hasPart(height, value, i) || (!all && d.tick-pl.arrived[i] < 2) {
+			continue
+		}
+		m := &partMessage{height: height, value: value, part: pl.parts.Part(i)}
+		if err := d.transport.Send(id, Channel, m.encode()); err != nil {
+			return
+		}
+		p.markPart(height, value, pl.parts.Total(), i)
+	}
+}
+
+// announceParts announces the parts we hold of the payloads proposed in our
+// current round.
+func (d *Driver) announceParts() {
+	for _, m := range d.store.Proposals(d.round) {
+		pl := d.payloads[m.Value]
+		if pl == nil {
+			continue
+		}
+		bits := NewBitArray(pl.parts.Total())
+		for i := 0; i < pl.parts.Total(); i++ {
+			if pl.parts.Has(i) {
+				bits.Set(i)
+			}
+		}
+		a := &partsAnnouncement{height: d.Height(), value: m.Value, parts: bits}
+		d.transport.Broadcast(Channel, a.encode())
+	}
+}
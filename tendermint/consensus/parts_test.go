@@ -0,0 +1,207 @@
+package consensus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+	"github.com/piersy/tendermint-go/tendermint/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartEncoding(t *testing.T) {
+	parts := types.NewPartSetFromData(make([]byte, types.PartSize+1))
+	m := &partMessage{height: 3, value: parts.Header().Hash(), part: parts.Part(1)}
+	decoded, err := decodePartMessage(m.encode()[1:])
+	require.NoError(t, err)
+	assert.Equal(t, m, decoded)
+	_, err = decodePartMessage(m.encode()[1:40])
+	assert.Error(t, err)
+
+	a := &partsAnnouncement{height: 3, value: m.value, parts: NewBitArray(2)}
+	a.parts.Set(1)
+	decodedAnnouncement, err := decodePartsAnnouncement(a.encode()[1:])
+	require.NoError(t, err)
+	assert.Equal(t, a, decodedAnnouncement)
+}
+
+func TestProposalOracleHidesIncompleteProposals(t *testing.T) {
+	store := algorithm.NewStore()
+	p := &algorithm.ConsensusMessage{MsgType: algorithm.Propose, Height: 1, Round: 0, Value: tendermint.Hash{1}, ValidRound: -1}
+	require.NoError(t, store.AddMessage(p, nil, tendermint.Hash{2}))
+	received := false
+	o := &proposalOracle{
+		BasicOracle: algorithm.NewBasicOracle(4, 1, store),
+		received:    func(tendermint.Hash) bool { return received },
+	}
+	assert.Nil(t, o.MatchingProposal(0, &p.Value))
+	assert.Empty(t, o.Proposals(0))
+	received = true
+	assert.Equal(t, p, o.MatchingProposal(0, &p.Value))
+	assert.Equal(t, []*algorithm.ConsensusMessage{p}, o.Proposals(0))
+}
+
+// testPayload returns a payload spanning several parts whose contents are
+// determined by height and round, so that any corruption is detectable.
+func testPayload(height uint64, round int) []byte {
+	var seed [16]byte
+	binary.BigEndian.PutUint64(seed[:], height)
+	binary.BigEndian.PutUint64(seed[8:], uint64(round))
+	block := sha256.Sum256(seed[:])
+	return bytes.Repeat(block[:], (3*types.PartSize-7)/len(block))
+}
+
+func TestDriverLargeProposals(t *testing.T) {
+	ks := testKeys(4)
+	n, transports := memCluster(t, ks)
+	// Connect the validators in a line so that parts have to be relayed.
+	for i := range transports {
+		for j := i + 2; j < len(transports); j++ {
+			n.Disconnect(transports[i].ID(), transports[j].ID())
+		}
+	}
+	var mu sync.Mutex
+	payloads := make(map[algorithm.NodeID][][]byte)
+	raws := make(map[algorithm.NodeID][][]byte)
+	decisions := runCluster(t, ks, transports, 3, func(id algorithm.NodeID, c *Config) {
+		c.TimeoutUnit = 50 * time.Millisecond
+		c.Propose = testPayload
+		c.Valid = func(payload []byte) bool {
+			return len(payload) > 0 && bytes.Equal(payload, bytes.Repeat(payload[:32], len(payload)/32))
+		}
+		decided := c.Decided
+		c.Decided = func(p *algorithm.ConsensusMessage, b *types.Block) []types.ValidatorUpdate {
+			mu.Lock()
+			payloads[id] = append(payloads[id], b.Payload)
+			raws[id] = append(raws[id], b.Proposal)
+			mu.Unlock()
+			return decided(p, b)
+		}
+	})
+	checkAgreement(t, decisions, 3)
+	mu.Lock()
+	defer mu.Unlock()
+	for id, ds := range decisions {
+		for h, d := range ds[:3] {
+			assert.Equal(t, testPayload(d.Height, d.Round), payloads[id][h])
+			header, err := types.ProposalHeader(raws[id][h])
+			require.NoError(t, err)
+			assert.Equal(t, types.NewPartSetFromData(payloads[id][h]).Header(), header.Payload)
+		}
+	}
+}
+
+func TestDriverBuffersVerifiedFutureParts(t *testing.T) {
+	ks := testKeys(4)
+	d := testDriver(t, ks)
+	vs := validatorSet(t, ks)
+	parts := types.NewPartSetFromData(testPayload(2, 0))
+	value := types.Header{Height: 2, Payload: parts.Header()}.Hash()
+	proposer := vs.Proposer(2, 0)
+	receivePart := func(value tendermint.Hash, part *types.Part) {
+		m := &partMessage{height: 2, value: value, part: part}
+		d.receive(p2p.Envelope{From: proposer, Channel: Channel, Payload: m.encode()})
+	}
+
+	// Parts of proposals we don't hold are dropped, as are proposals that
+	// are not from the proposer.
+	receivePart(value, parts.Part(0))
+	assert.Empty(t, d.futureParts)
+	var other algorithm.NodeID
+	for _, id := range vs.IDs() {
+		if id != proposer {
+			other = id
+		}
+	}
+	d.receive(signedProposal(t, ks, other, 2, 0, parts))
+	assert.Empty(t, d.future)
+	receivePart(value, parts.Part(0))
+	assert.Empty(t, d.futureParts)
+
+	// Once the proposal is held its parts are buffered, once each and only
+	// if they match its header.
+	d.receive(signedProposal(t, ks, proposer, 2, 0, parts))
+	assert.Len(t, d.future, 1)
+	forged := types.NewPartSetFromData(testPayload(3, 0))
+	receivePart(value, forged.Part(0))
+	assert.Empty(t, d.futureParts)
+	for i := 0; i < parts.Total(); i++ {
+		receivePart(value, parts.Part(i))
+		receivePart(value, parts.Part(i))
+	}
+	assert.Len(t, d.futureParts, parts.Total())
+}
+
+func TestDriverChecksHeaderTimes(t *testing.T) {
+	d := testDriver(t, testKeys(4))
+	payload := types.NewPartSetFromData(testPayload(1, 0)).Header()
+	d.lastTime = types.CanonicalTime(time.Now().Add(-time.Minute))
+	header := d.header(payload)
+	assert.True(t, d.validHeader(header))
+
+	// The time must be later than the previous height's and not too far
+	// ahead of ours.
+	for _, tm := range []time.Time{{}, d.lastTime, d.lastTime.Add(-time.Second), time.Now().Add(2 * DefaultMaxClockDrift)} {
+		h := header
+		h.Time = types.CanonicalTime(tm)
+		assert.False(t, d.validHeader(h), "time %v", tm)
+	}
+
+	// A proposer whose clock is behind the previous height's time still
+	// proposes a later time.
+	d.lastTime = types.CanonicalTime(time.Now().Add(time.Second))
+	header = d.header(payload)
+	assert.True(t, header.Time.After(d.lastTime))
+	assert.True(t, d.validHeader(header))
+}
+
+func TestDriverDefersConflictingPayloads(t *testing.T) {
+	ks := testKeys(4)
+	d := testDriver(t, ks)
+	vs := validatorSet(t, ks)
+	proposer := vs.Proposer(1, 0)
+	first := types.NewPartSetFromData(testPayload(1, 0))
+	second := types.NewPartSetFromData(testPayload(1, 1))
+	third := types.NewPartSetFromData(testPayload(1, 2))
+	value := func(parts *types.PartSet) tendermint.Hash {
+		return types.Header{Height: 1, Payload: parts.Header()}.Hash()
+	}
+
+	d.receive(signedProposal(t, ks, proposer, 1, 0, first))
+	assert.NotNil(t, d.payloads[value(first)])
+
+	// The payload of a conflicting proposal is not expected, receiving the
+	// proposal again doesn't change that, and further conflicting proposals
+	// are dropped.
+	d.receive(signedProposal(t, ks, proposer, 1, 0, second))
+	d.receive(signedProposal(t, ks, proposer, 1, 0, second))
+	d.receive(signedProposal(t, ks, proposer, 1, 0, third))
+	assert.Nil(t, d.payloads[value(second)])
+	assert.Len(t, d.pending[value(second)], 1)
+	assert.Nil(t, d.payloads[value(third)])
+	assert.Empty(t, d.pending[value(third)])
+
+	// Once a quorum prevotes for the conflicting value its payload is.
+	for _, id := range vs.IDs()[:vs.Quorum()] {
+		d.receive(signedVote(t, ks, id, algorithm.Prevote, 1, 0, value(second)))
+	}
+	assert.NotNil(t, d.payloads[value(second)])
+	assert.Empty(t, d.conflicting)
+
+	// As is the payload of a conflicting proposal received after the quorum.
+	d.newHeight(1)
+	d.receive(signedProposal(t, ks, proposer, 1, 0, first))
+	for _, id := range vs.IDs()[:vs.Quorum()] {
+		d.receive(signedVote(t, ks, id, algorithm.Precommit, 1, 0, value(second)))
+	}
+	d.receive(signedProposal(t, ks, proposer, 1, 0, second))
+	assert.NotNil(t, d.payloads[value(second)])
+	assert.Empty(t, d.conflicting)
+}
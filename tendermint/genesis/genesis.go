@@ -0,0 +1,195 @@
+// Package genesis defines the genesis document that bootstraps a chain.
+//
+// A genesis document is a JSON file holding the chain id, the initial height,
+// the initial validator set and the consensus params that every node of the
+// chain must agree on. Its hash, the SHA-256 hash of its compact JSON
+// encoding, lets nodes check that they were started from the same document.
+package genesis
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// MaxChainIDLength bounds the length of chain ids.
+const MaxChainIDLength = 50
+
+// Genesis is a genesis document.
+type Genesis struct {
+	// ChainID identifies the chain, messages signed for one chain are
+	// rejected by all others.
+	ChainID string `json:"chain_id"`
+	// InitialHeight is the first height of the chain.
+	InitialHeight uint64 `json:"initial_height"`
+	// Validators is the validator set of the initial height, in proposer
+	// order.
+	Validators      []Validator     `json:"validators"`
+	ConsensusParams ConsensusParams `json:"consensus_params"`
+}
+
+// Validator is a member of the initial validator set.
+type Validator struct {
+	// Address is the hex encoded address of PubKey, see keys.FormatAddress.
+	Address string            `json:"address"`
+	PubKey  ed25519.PublicKey `json:"pub_key"`
+}
+
+// ConsensusParams are the parameters of consensus, zero values leave the
+// defaults of consensus.Config in place.
+type ConsensusParams struct {
+	// TimeoutUnit scales the timeouts of the Algorithm.
+	TimeoutUnit Duration `json:"timeout_unit"`
+	// TimeoutCommit is the time waited after a decision before starting the
+	// next height.
+	TimeoutCommit Duration `json:"timeout_commit"`
+	// MaxProposalSize bounds the size of proposed payloads.
+	MaxProposalSize int `json:"max_proposal_size"`
+	// UpdateDelay is the number of heights after which the validator
+	// updates of a height take effect, zero selects
+	// types.DefaultValidatorUpdateDelay.
+	UpdateDelay uint64 `json:"update_delay"`
+}
+
+// Duration is a time.Duration encoded in JSON as a string such as "1.5s".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// New returns the genesis of a chain starting at height 1 with the holders of
+// pubs as validators and default consensus params.
+func New(chainID string, pubs []ed25519.PublicKey) *Genesis {
+	g := &Genesis{ChainID: chainID, InitialHeight: 1}
+	for _, pub := range pubs {
+		g.Validators = append(g.Validators, Validator{Address: keys.FormatAddress(keys.Address(pub)), PubKey: pub})
+	}
+	return g
+}
+
+// Parse decodes and validates a genesis document, unknown fields are
+// rejected.
+func Parse(b []byte) (*Genesis, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	g := &Genesis{}
+	if err := d.Decode(g); err != nil {
+		return nil, fmt.Errorf("invalid genesis: %w", err)
+	}
+	if d.More() {
+		return nil, fmt.Errorf("invalid genesis: trailing data")
+	}
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Load reads and validates the genesis document at path.
+func Load(path string) (*Genesis, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	g, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return g, nil
+}
+
+// Save writes the document to path in indented JSON.
+func (g *Genesis) Save(path string) error {
+	b, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// Validate checks that the document describes a chain that can be run.
+func (g *Genesis) Validate() error {
+	if g.ChainID == "" {
+		return fmt.Errorf("invalid genesis: empty chain id")
+	}
+	if len(g.ChainID) > MaxChainIDLength {
+		return fmt.Errorf("invalid genesis: chain id is longer than %d bytes", MaxChainIDLength)
+	}
+	for _, c := range []byte(g.ChainID) {
+		if c <= ' ' || c > '~' {
+			return fmt.Errorf("invalid genesis: chain id %q holds characters other than printable ASCII", g.ChainID)
+		}
+	}
+	if g.InitialHeight == 0 {
+		return fmt.Errorf("invalid genesis: initial height must be positive")
+	}
+	if _, err := g.ValidatorSet(); err != nil {
+		return fmt.Errorf("invalid genesis: %w", err)
+	}
+	p := g.ConsensusParams
+	if p.TimeoutUnit < 0 || p.TimeoutCommit < 0 || p.MaxProposalSize < 0 {
+		return fmt.Errorf("invalid genesis: negative consensus params %+v", p)
+	}
+	if p.UpdateDelay == 1 {
+		return fmt.Errorf("invalid genesis: validator update delay must be at least 2")
+	}
+	return nil
+}
+
+// ValidatorSet returns the validator set of the initial height.
+func (g *Genesis) ValidatorSet() (*types.ValidatorSet, error) {
+	validators := make([]types.Validator, len(g.Validators))
+	for i, v := range g.Validators {
+		if len(v.PubKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("validator %d has invalid public key", i)
+		}
+		validators[i] = types.NewValidator(v.PubKey)
+		if v.Address != keys.FormatAddress(validators[i].ID) {
+			return nil, fmt.Errorf("validator %d address %s does not match its public key", i, v.Address)
+		}
+	}
+	return types.NewValidatorSet(validators)
+}
+
+// Schedule returns a validator schedule starting at the initial height with
+// the update delay of the consensus params.
+func (g *Genesis) Schedule() (*types.ValidatorSchedule, error) {
+	vs, err := g.ValidatorSet()
+	if err != nil {
+		return nil, err
+	}
+	return types.NewValidatorSchedule(g.InitialHeight, vs, g.ConsensusParams.UpdateDelay)
+}
+
+// Hash returns the SHA-256 hash of the compact JSON encoding of the
+// document, which is the same for all documents that decode to the same
+// value whatever their formatting.
+func (g *Genesis) Hash() tendermint.Hash {
+	// Encoding a struct without maps is deterministic and can't fail.
+	b, _ := json.Marshal(g)
+	return sha256.Sum256(b)
+}
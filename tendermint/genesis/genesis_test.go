@@ -0,0 +1,106 @@
+package genesis
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPubs(n int) []ed25519.PublicKey {
+	pubs := make([]ed25519.PublicKey, n)
+	for i := range pubs {
+		seed := make([]byte, ed25519.SeedSize)
+		seed[0] = byte(i)
+		pubs[i] = ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	}
+	return pubs
+}
+
+func TestSaveLoad(t *testing.T) {
+	g := New("test-chain", testPubs(4))
+	g.InitialHeight = 10
+	g.ConsensusParams = ConsensusParams{TimeoutUnit: Duration(500 * time.Millisecond), TimeoutCommit: Duration(time.Second), MaxProposalSize: 1 << 20, UpdateDelay: 3}
+	require.NoError(t, g.Validate())
+
+	path := filepath.Join(t.TempDir(), "genesis.json")
+	require.NoError(t, g.Save(path))
+	loaded, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, g, loaded)
+	assert.Equal(t, g.Hash(), loaded.Hash())
+
+	vs, err := loaded.ValidatorSet()
+	require.NoError(t, err)
+	assert.Equal(t, 4, vs.Size())
+	s, err := loaded.Schedule()
+	require.NoError(t, err)
+	at, ok := s.At(10)
+	require.True(t, ok)
+	assert.Equal(t, vs.Hash(), at.Hash())
+	_, ok = s.At(9)
+	assert.False(t, ok)
+	assert.Equal(t, uint64(3), s.Delay())
+}
+
+func TestParse(t *testing.T) {
+	b, err := json.Marshal(New("test-chain", testPubs(1)))
+	require.NoError(t, err)
+	valid := string(b)
+
+	g, err := Parse([]byte(valid))
+	require.NoError(t, err)
+	assert.Equal(t, "test-chain", g.ChainID)
+	assert.Equal(t, `{"timeout_unit":"0s","timeout_commit":"0s","max_proposal_size":0,"update_delay":0}`, valid[strings.Index(valid, `{"timeout_unit"`):len(valid)-1])
+
+	for name, doc := range map[string]string{
+		"unknown field":     strings.Replace(valid, `"chain_id"`, `"chain":"x","chain_id"`, 1),
+		"trailing data":     valid + "{}",
+		"empty chain id":    strings.Replace(valid, `"test-chain"`, `""`, 1),
+		"long chain id":     strings.Replace(valid, `"test-chain"`, `"`+strings.Repeat("a", MaxChainIDLength+1)+`"`, 1),
+		"space in chain id": strings.Replace(valid, `"test-chain"`, `"test chain"`, 1),
+		"zero height":       strings.Replace(valid, `"initial_height":1`, `"initial_height":0`, 1),
+		"no validators":     valid[:strings.Index(valid, `"validators"`)] + `"validators":[],"consensus_params":{}}`,
+		"wrong address":     strings.Replace(valid, `"address":"`, `"address":"00`, 1),
+		"bad duration":      strings.Replace(valid, `"timeout_unit":"0s"`, `"timeout_unit":"soon"`, 1),
+		"numeric duration":  strings.Replace(valid, `"timeout_unit":"0s"`, `"timeout_unit":1000`, 1),
+		"negative duration": strings.Replace(valid, `"timeout_commit":"0s"`, `"timeout_commit":"-1s"`, 1),
+		"negative size":     strings.Replace(valid, `"max_proposal_size":0`, `"max_proposal_size":-1`, 1),
+		"delay of one":      strings.Replace(valid, `"update_delay":0`, `"update_delay":1`, 1),
+		"negative delay":    strings.Replace(valid, `"update_delay":0`, `"update_delay":-1`, 1),
+	} {
+		_, err := Parse([]byte(doc))
+		assert.Error(t, err, name)
+	}
+
+	// Duplicate validators are rejected.
+	g = New("test-chain", append(testPubs(2), testPubs(1)...))
+	assert.Error(t, g.Validate())
+}
+
+func TestHash(t *testing.T) {
+	g := New("test-chain", testPubs(3))
+	b, err := json.MarshalIndent(g, "", "    ")
+	require.NoError(t, err)
+	reformatted, err := Parse(b)
+	require.NoError(t, err)
+	assert.Equal(t, g.Hash(), reformatted.Hash())
+
+	for _, change := range []func(*Genesis){
+		func(g *Genesis) { g.ChainID = "other-chain" },
+		func(g *Genesis) { g.InitialHeight = 2 },
+		func(g *Genesis) { g.Validators = g.Validators[1:] },
+		func(g *Genesis) { g.Validators[0], g.Validators[1] = g.Validators[1], g.Validators[0] },
+		func(g *Genesis) { g.ConsensusParams.TimeoutCommit = Duration(time.Second) },
+		func(g *Genesis) { g.ConsensusParams.UpdateDelay = 3 },
+	} {
+		other := New("test-chain", testPubs(3))
+		change(other)
+		assert.NotEqual(t, g.Hash(), other.Hash())
+	}
+}
@@ -0,0 +1,41 @@
+// Package keys maps ed25519 public keys to the NodeIDs that identify nodes
+// and validators.
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// Address returns the NodeID of the holder of the given public key, the first
+// 20 bytes of the SHA-256 hash of the key.
+func Address(pub ed25519.PublicKey) algorithm.NodeID {
+	var id algorithm.NodeID
+	h := sha256.Sum256(pub)
+	copy(id[:], h[:])
+	return id
+}
+
+// FormatAddress returns the full hex encoding of id, NodeID.String only
+// encodes a prefix.
+func FormatAddress(id algorithm.NodeID) string {
+	return hex.EncodeToString(id[:])
+}
+
+// ParseAddress parses an address encoded by FormatAddress.
+func ParseAddress(s string) (algorithm.NodeID, error) {
+	var id algorithm.NodeID
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return id, fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	if len(b) != len(id) {
+		return id, fmt.Errorf("invalid address %q: expected %d bytes got %d", s, len(id), len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
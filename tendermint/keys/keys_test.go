@@ -0,0 +1,25 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddress(t *testing.T) {
+	pub := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+	id := Address(pub)
+	s := FormatAddress(id)
+	assert.Len(t, s, 40)
+
+	parsed, err := ParseAddress(s)
+	require.NoError(t, err)
+	assert.Equal(t, id, parsed)
+
+	_, err = ParseAddress(s[:38])
+	assert.Error(t, err)
+	_, err = ParseAddress("not hex")
+	assert.Error(t, err)
+}
@@ -0,0 +1,255 @@
+// Package kvstore implements a key value store application whose
+// transactions are "key=value" pairs.
+//
+// The store is deterministic, every node that executes the same decided
+// payloads, as encoded by mempool.EncodeTxs, reaches the same state and the
+// same application hash.
+//
+// Transactions whose key is ValidatorPrefix followed by the hex encoding of
+// an ed25519 public key update the validator set. A value of 1 adds the
+// holder of the key to the set and a value of 0 removes it, as a voting power
+// would. The validators are held in the store under their keys, so updates
+// that would not change the set, or would leave it empty, are skipped.
+//
+// The App takes snapshots of its state every Config.SnapshotInterval heights,
+// which statesync serves to nodes joining the chain.
+package kvstore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/mempool"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// ValidatorPrefix starts the keys of the transactions that update the
+// validator set.
+const ValidatorPrefix = "val:"
+
+const (
+	// DefaultKeepSnapshots is the default number of snapshots kept.
+	DefaultKeepSnapshots = 2
+	// DefaultChunkSize is the default size of the chunks of a snapshot.
+	DefaultChunkSize = 64 << 10
+)
+
+// Config configures an App, zero values are replaced by defaults.
+type Config struct {
+	// Validators are the initial validators, those of the genesis.
+	Validators []ed25519.PublicKey
+	// SnapshotInterval is the interval in heights at which snapshots are
+	// taken, if zero none are.
+	SnapshotInterval uint64
+	// KeepSnapshots is the number of most recent snapshots kept.
+	KeepSnapshots int
+	// ChunkSize bounds the size of the chunks snapshots are split into.
+	ChunkSize int
+}
+
+func (c *Config) setDefaults() {
+	if c.KeepSnapshots == 0 {
+		c.KeepSnapshots = DefaultKeepSnapshots
+	}
+	if c.ChunkSize == 0 {
+		c.ChunkSize = DefaultChunkSize
+	}
+}
+
+// App is the key value store, it is safe for concurrent use.
+type App struct {
+	cfg Config
+
+	mu     sync.RWMutex
+	state  map[string]string
+	height uint64
+	hash   tendermint.Hash
+	// validators is the number of validator keys in state.
+	validators int
+	snapshots  []snapshot
+	restore    *restore
+}
+
+// New creates an App holding only its initial validators.
+func New(cfg Config) *App {
+	cfg.setDefaults()
+	a := &App{cfg: cfg, state: make(map[string]string)}
+	for _, pub := range cfg.Validators {
+		key := validatorKey(pub)
+		if _, ok := a.state[key]; !ok {
+			a.state[key] = "1"
+			a.validators++
+		}
+	}
+	a.hash = a.computeHash()
+	return a
+}
+
+// ValidatorTx returns the transaction that adds the holder of pub to the
+// validator set, or removes it if remove is set.
+func ValidatorTx(pub ed25519.PublicKey, remove bool) []byte {
+	if remove {
+		return []byte(validatorKey(pub) + "=0")
+	}
+	return []byte(validatorKey(pub) + "=1")
+}
+
+func validatorKey(pub ed25519.PublicKey) string {
+	return ValidatorPrefix + hex.EncodeToString(pub)
+}
+
+// ParseTx splits a transaction into its key and value, the key must not be
+// empty. Validator transactions must have a valid public key and a value of 0
+// or 1.
+func ParseTx(tx []byte) (key, value string, err error) {
+	i := bytes.IndexByte(tx, '=')
+	if i <= 0 {
+		return "", "", fmt.Errorf("transaction %q is not of the form key=value", tx)
+	}
+	key, value = string(tx[:i]), string(tx[i+1:])
+	if _, ok := parseValidatorKey(key); ok && (value == "0" || value == "1") {
+		return key, value, nil
+	}
+	if strings.HasPrefix(key, ValidatorPrefix) {
+		return "", "", fmt.Errorf("transaction %q is not of the form %s<hex public key>=0|1", tx, ValidatorPrefix)
+	}
+	return key, value, nil
+}
+
+// parseValidatorKey returns the public key of a validator key.
+func parseValidatorKey(key string) (ed25519.PublicKey, bool) {
+	if !strings.HasPrefix(key, ValidatorPrefix) {
+		return nil, false
+	}
+	pub, err := hex.DecodeString(key[len(ValidatorPrefix):])
+	if err != nil || len(pub) != ed25519.PublicKeySize || key != validatorKey(pub) {
+		return nil, false
+	}
+	return pub, true
+}
+
+// CheckTx implements mempool.Application, all well formed transactions have
+// the same priority.
+func (a *App) CheckTx(tx []byte) (int64, error) {
+	_, _, err := ParseTx(tx)
+	return 0, err
+}
+
+// Execute applies the transactions of the payload decided at height, which
+// must follow the last height executed, and returns the validator updates
+// they result in. The first height executed may be any, since a chain may
+// start at any height. Malformed transactions are skipped, a malformed
+// payload is executed as if it were empty. It panics if height does not
+// follow the last height executed.
+func (a *App) Execute(height uint64, payload []byte) []types.ValidatorUpdate {
+	txs, _ := mempool.DecodeTxs(payload)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.height != 0 && height != a.height+1 {
+		panic(fmt.Sprintf("kvstore: executing height %d after height %d", height, a.height))
+	}
+	var updates []types.ValidatorUpdate
+	for _, tx := range txs {
+		k, v, err := ParseTx(tx)
+		if err != nil {
+			continue
+		}
+		pub, ok := parseValidatorKey(k)
+		if !ok {
+			a.state[k] = v
+			continue
+		}
+		_, member := a.state[k]
+		switch {
+		case v == "1" && !member:
+			a.state[k] = v
+			a.validators++
+			updates = append(updates, types.ValidatorUpdate{PubKey: pub})
+		case v == "0" && member && a.validators > 1:
+			delete(a.state, k)
+			a.validators--
+			updates = append(updates, types.ValidatorUpdate{PubKey: pub, Remove: true})
+		}
+	}
+	a.height = height
+	a.hash = a.computeHash()
+	if a.cfg.SnapshotInterval > 0 && height%a.cfg.SnapshotInterval == 0 {
+		a.takeSnapshot()
+	}
+	return updates
+}
+
+// Query returns the value of key.
+func (a *App) Query(key string) (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	v, ok := a.state[key]
+	return v, ok
+}
+
+// Height returns the last height executed, or 0 if none was.
+func (a *App) Height() uint64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.height
+}
+
+// AppHash returns the hash of the state resulting from the heights executed.
+func (a *App) AppHash() tendermint.Hash {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.hash
+}
+
+// computeHash hashes the pairs sorted by key, as encoded by encodeState. a.mu
+// must be held.
+func (a *App) computeHash() tendermint.Hash {
+	return sha256.Sum256(encodeState(nil, a.state))
+}
+
+// encodeState appends the pairs of state sorted by key to b, each key and
+// value prefixed by its big endian 4 byte length.
+func encodeState(b []byte, state map[string]string) []byte {
+	keys := make([]string, 0, len(state))
+	for k := range state {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(k)))
+		b = append(b, k...)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(state[k])))
+		b = append(b, state[k]...)
+	}
+	return b
+}
+
+// decodeState decodes the pairs encoded by encodeState, which must be in
+// strictly ascending order of key.
+func decodeState(b []byte) (map[string]string, error) {
+	state := make(map[string]string)
+	var last string
+	for len(b) > 0 {
+		var pair [2]string
+		for i := range pair {
+			if len(b) < 4 || uint64(binary.BigEndian.Uint32(b)) > uint64(len(b)-4) {
+				return nil, fmt.Errorf("truncated pair")
+			}
+			n := binary.BigEndian.Uint32(b)
+			pair[i], b = string(b[4:4+n]), b[4+n:]
+		}
+		if len(state) > 0 && pair[0] <= last {
+			return nil, fmt.Errorf("key %q out of order", pair[0])
+		}
+		state[pair[0]], last = pair[1], pair[0]
+	}
+	return state, nil
+}
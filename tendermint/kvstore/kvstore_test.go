@@ -0,0 +1,200 @@
+package kvstore
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/piersy/tendermint-go/tendermint/mempool"
+	"github.com/piersy/tendermint-go/tendermint/statesync"
+	"github.com/piersy/tendermint-go/tendermint/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPubs(n int) []ed25519.PublicKey {
+	pubs := make([]ed25519.PublicKey, n)
+	for i := range pubs {
+		seed := make([]byte, ed25519.SeedSize)
+		seed[0] = byte(i + 1)
+		pubs[i] = ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	}
+	return pubs
+}
+
+func TestApp(t *testing.T) {
+	a := New(Config{})
+	empty := a.AppHash()
+	_, err := a.CheckTx([]byte("a=1"))
+	assert.NoError(t, err)
+	_, err = a.CheckTx([]byte("=1"))
+	assert.Error(t, err)
+	_, err = a.CheckTx([]byte("a"))
+	assert.Error(t, err)
+
+	// Malformed transactions are skipped, later values overwrite earlier
+	// ones.
+	a.Execute(1, mempool.EncodeTxs([][]byte{[]byte("a=1"), []byte("b"), []byte("c=x=y"), []byte("a=2")}))
+	v, ok := a.Query("a")
+	assert.True(t, ok)
+	assert.Equal(t, "2", v)
+	v, _ = a.Query("c")
+	assert.Equal(t, "x=y", v)
+	_, ok = a.Query("b")
+	assert.False(t, ok)
+	assert.Equal(t, uint64(1), a.Height())
+	assert.NotEqual(t, empty, a.AppHash())
+
+	// The hash only depends on the state.
+	b := New(Config{})
+	b.Execute(1, mempool.EncodeTxs([][]byte{[]byte("c=x=y")}))
+	b.Execute(2, mempool.EncodeTxs([][]byte{[]byte("a=2")}))
+	assert.Equal(t, a.AppHash(), b.AppHash())
+	b.Execute(3, []byte{1})
+	assert.Equal(t, a.AppHash(), b.AppHash())
+	b.Execute(4, mempool.EncodeTxs([][]byte{[]byte("a=3")}))
+	assert.NotEqual(t, a.AppHash(), b.AppHash())
+
+	// Keys and values are delimited in the hash.
+	c, d := New(Config{}), New(Config{})
+	c.Execute(1, mempool.EncodeTxs([][]byte{[]byte("ab=c")}))
+	d.Execute(1, mempool.EncodeTxs([][]byte{[]byte("a=bc")}))
+	assert.NotEqual(t, c.AppHash(), d.AppHash())
+
+	// The first height may be any, the following must be consecutive.
+	e := New(Config{})
+	e.Execute(5, nil)
+	assert.Panics(t, func() { e.Execute(5, nil) })
+	assert.Panics(t, func() { e.Execute(7, nil) })
+	e.Execute(6, nil)
+	assert.Equal(t, uint64(6), e.Height())
+}
+
+func TestValidatorTxs(t *testing.T) {
+	pubs := testPubs(3)
+	for _, tx := range []string{
+		"val:00=1",
+		"val:" + strings.Repeat("zz", ed25519.PublicKeySize) + "=1",
+		ValidatorPrefix + strings.ToUpper(strings.TrimPrefix(string(ValidatorTx(pubs[0], false)), ValidatorPrefix)),
+		strings.TrimSuffix(string(ValidatorTx(pubs[0], false)), "1") + "2",
+	} {
+		_, err := New(Config{}).CheckTx([]byte(tx))
+		assert.Error(t, err, tx)
+	}
+
+	a := New(Config{Validators: pubs[:2]})
+	withValidators := a.AppHash()
+	assert.NotEqual(t, New(Config{}).AppHash(), withValidators)
+	v, ok := a.Query(strings.TrimSuffix(string(ValidatorTx(pubs[0], false)), "=1"))
+	assert.True(t, ok)
+	assert.Equal(t, "1", v)
+
+	// Updates that would not change the set are skipped.
+	updates := a.Execute(1, mempool.EncodeTxs([][]byte{
+		ValidatorTx(pubs[2], false),
+		ValidatorTx(pubs[2], false),
+		ValidatorTx(pubs[0], true),
+		ValidatorTx(pubs[0], true),
+	}))
+	assert.Equal(t, []types.ValidatorUpdate{{PubKey: pubs[2]}, {PubKey: pubs[0], Remove: true}}, updates)
+
+	// The set is never left empty.
+	updates = a.Execute(2, mempool.EncodeTxs([][]byte{ValidatorTx(pubs[1], true), ValidatorTx(pubs[2], true)}))
+	assert.Equal(t, []types.ValidatorUpdate{{PubKey: pubs[1], Remove: true}}, updates)
+	_, ok = a.Query(strings.TrimSuffix(string(ValidatorTx(pubs[2], false)), "=1"))
+	assert.True(t, ok)
+
+	// The updates apply to the validator set in the same way.
+	vs, err := types.NewValidatorSet([]types.Validator{types.NewValidator(pubs[0]), types.NewValidator(pubs[1])})
+	require.NoError(t, err)
+	b := New(Config{Validators: pubs[:2]})
+	for h, payload := range [][]byte{
+		mempool.EncodeTxs([][]byte{ValidatorTx(pubs[2], false), ValidatorTx(pubs[0], true)}),
+		mempool.EncodeTxs([][]byte{ValidatorTx(pubs[1], true)}),
+	} {
+		vs, err = vs.Update(b.Execute(uint64(h+1), payload))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, vs.Size())
+	assert.True(t, vs.Contains(types.NewValidator(pubs[2]).ID))
+}
+
+// restoreFrom restores s, a snapshot of a, into b.
+func restoreFrom(a, b *App, s statesync.Snapshot) error {
+	if err := b.OfferSnapshot(s, a.AppHash()); err != nil {
+		return err
+	}
+	for i := uint32(0); i < s.Chunks; i++ {
+		chunk, err := a.LoadChunk(s, i)
+		if err != nil {
+			return err
+		}
+		if err := b.ApplyChunk(i, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSnapshots(t *testing.T) {
+	pubs := testPubs(2)
+	a := New(Config{Validators: pubs, SnapshotInterval: 3, ChunkSize: 16})
+	for h := uint64(1); h <= 9; h++ {
+		txs := [][]byte{[]byte(fmt.Sprintf("key%d=value%d", h, h))}
+		if h == 7 {
+			txs = append(txs, ValidatorTx(pubs[0], true))
+		}
+		a.Execute(h, mempool.EncodeTxs(txs))
+	}
+
+	// The most recent snapshots are kept.
+	snapshots := a.Snapshots()
+	require.Len(t, snapshots, DefaultKeepSnapshots)
+	assert.Equal(t, uint64(6), snapshots[0].Height)
+	s := snapshots[1]
+	assert.Equal(t, uint64(9), s.Height)
+	assert.Greater(t, s.Chunks, uint32(1))
+	_, err := a.LoadChunk(s, s.Chunks)
+	assert.Error(t, err)
+
+	b := New(Config{Validators: pubs})
+	require.NoError(t, restoreFrom(a, b, s))
+	assert.Equal(t, a.AppHash(), b.AppHash())
+	assert.Equal(t, uint64(9), b.Height())
+	v, ok := b.Query("key9")
+	assert.True(t, ok)
+	assert.Equal(t, "value9", v)
+	// The restored validators are counted, so the last cannot be removed.
+	assert.Empty(t, b.Execute(10, mempool.EncodeTxs([][]byte{ValidatorTx(pubs[1], true)})))
+
+	// A snapshot is only restored if it results in the expected hash.
+	c := New(Config{})
+	require.NoError(t, c.OfferSnapshot(snapshots[0], a.AppHash()))
+	var applyErr error
+	for i := uint32(0); i < snapshots[0].Chunks; i++ {
+		chunk, err := a.LoadChunk(snapshots[0], i)
+		require.NoError(t, err)
+		applyErr = c.ApplyChunk(i, chunk)
+	}
+	assert.Error(t, applyErr)
+	assert.Equal(t, uint64(0), c.Height())
+
+	// Chunks must be applied in order and must match the snapshot.
+	require.NoError(t, c.OfferSnapshot(s, a.AppHash()))
+	assert.Error(t, c.ApplyChunk(1, nil))
+	require.NoError(t, c.OfferSnapshot(s, a.AppHash()))
+	for i := uint32(0); i < s.Chunks; i++ {
+		chunk, err := a.LoadChunk(s, i)
+		require.NoError(t, err)
+		if i == s.Chunks-1 {
+			chunk = append([]byte{}, chunk...)
+			chunk[0] ^= 1
+			assert.Error(t, c.ApplyChunk(i, chunk))
+		} else {
+			require.NoError(t, c.ApplyChunk(i, chunk))
+		}
+	}
+	assert.Equal(t, uint64(0), c.Height())
+	assert.Error(t, c.OfferSnapshot(statesync.Snapshot{Height: 9, Format: 2, Chunks: 1}, a.AppHash()))
+}
@@ -0,0 +1,135 @@
+package kvstore
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/statesync"
+)
+
+// snapshotFormat is the Format of our snapshots, whose data is the 8 byte big
+// endian height followed by the state as encoded by encodeState.
+const snapshotFormat = 1
+
+type snapshot struct {
+	statesync.Snapshot
+	data []byte
+}
+
+// restore is a snapshot being restored.
+type restore struct {
+	snapshot statesync.Snapshot
+	appHash  tendermint.Hash
+	data     []byte
+	next     uint32
+}
+
+// takeSnapshot snapshots the current state, dropping the oldest snapshot if
+// more than KeepSnapshots are held. a.mu must be held.
+func (a *App) takeSnapshot() {
+	data := binary.BigEndian.AppendUint64(nil, a.height)
+	data = encodeState(data, a.state)
+	s := snapshot{
+		Snapshot: statesync.Snapshot{
+			Height: a.height,
+			Format: snapshotFormat,
+			Chunks: uint32((len(data) + a.cfg.ChunkSize - 1) / a.cfg.ChunkSize),
+			Hash:   sha256.Sum256(data),
+		},
+		data: data,
+	}
+	a.snapshots = append(a.snapshots, s)
+	if len(a.snapshots) > a.cfg.KeepSnapshots {
+		a.snapshots = a.snapshots[len(a.snapshots)-a.cfg.KeepSnapshots:]
+	}
+}
+
+// Snapshots implements statesync.Application.
+func (a *App) Snapshots() []statesync.Snapshot {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	result := make([]statesync.Snapshot, len(a.snapshots))
+	for i, s := range a.snapshots {
+		result[i] = s.Snapshot
+	}
+	return result
+}
+
+// LoadChunk implements statesync.Application.
+func (a *App) LoadChunk(s statesync.Snapshot, index uint32) ([]byte, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, held := range a.snapshots {
+		if held.Snapshot != s {
+			continue
+		}
+		if index >= s.Chunks {
+			return nil, fmt.Errorf("snapshot of height %d has no chunk %d", s.Height, index)
+		}
+		start := int(index) * a.cfg.ChunkSize
+		end := start + a.cfg.ChunkSize
+		if end > len(held.data) {
+			end = len(held.data)
+		}
+		return held.data[start:end], nil
+	}
+	return nil, fmt.Errorf("unknown snapshot of height %d", s.Height)
+}
+
+// OfferSnapshot implements statesync.Application.
+func (a *App) OfferSnapshot(s statesync.Snapshot, appHash tendermint.Hash) error {
+	if s.Format != snapshotFormat {
+		return fmt.Errorf("unknown snapshot format %d", s.Format)
+	}
+	if s.Chunks == 0 {
+		return fmt.Errorf("snapshot of height %d has no chunks", s.Height)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.restore = &restore{snapshot: s, appHash: appHash}
+	return nil
+}
+
+// ApplyChunk implements statesync.Application. Once the last chunk is applied
+// the restored state replaces ours, provided it matches the snapshot and
+// hashes to the application hash it was offered with.
+func (a *App) ApplyChunk(index uint32, chunk []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r := a.restore
+	if r == nil {
+		return fmt.Errorf("no snapshot is being restored")
+	}
+	if index != r.next {
+		return fmt.Errorf("applying chunk %d, expected chunk %d", index, r.next)
+	}
+	r.data = append(r.data, chunk...)
+	r.next++
+	if r.next < r.snapshot.Chunks {
+		return nil
+	}
+	a.restore = nil
+	if sha256.Sum256(r.data) != r.snapshot.Hash {
+		return fmt.Errorf("restored snapshot does not match its hash")
+	}
+	if len(r.data) < 8 || binary.BigEndian.Uint64(r.data) != r.snapshot.Height {
+		return fmt.Errorf("restored snapshot is not of height %d", r.snapshot.Height)
+	}
+	state, err := decodeState(r.data[8:])
+	if err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if hash := sha256.Sum256(r.data[8:]); hash != r.appHash {
+		return fmt.Errorf("restored state hashes to %v, expected %v", tendermint.Hash(hash), r.appHash)
+	}
+	validators := 0
+	for k := range state {
+		if _, ok := parseValidatorKey(k); ok {
+			validators++
+		}
+	}
+	a.state, a.height, a.hash, a.validators = state, r.snapshot.Height, r.appHash, validators
+	return nil
+}
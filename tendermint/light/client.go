@@ -0,0 +1,347 @@
+package light
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/blocksync"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+const (
+	// DefaultTrustingPeriod is the default time for which a verified header
+	// is trusted.
+	DefaultTrustingPeriod = 7 * 24 * time.Hour
+	// DefaultMaxClockDrift is the default bound on how far ahead of our
+	// clock the time of a header may be.
+	DefaultMaxClockDrift = 10 * time.Second
+)
+
+// ErrLightBlockNotFound is returned by providers that don't hold the
+// requested height.
+var ErrLightBlockNotFound = errors.New("light block not found")
+
+// Provider serves light blocks, typically on behalf of a full node.
+type Provider interface {
+	// ID identifies the provider in errors.
+	ID() string
+	// LightBlock returns the light block at height, or the latest if height
+	// is 0.
+	LightBlock(ctx context.Context, height uint64) (*LightBlock, error)
+}
+
+// ConflictError is returned when a witness serves a header that conflicts
+// with the one verified from the primary and that also verifies from the
+// trusted state. Both can't have been decided, so at least a third of the
+// validators misbehaved.
+type ConflictError struct {
+	Witness string
+	Primary *LightBlock
+	Other   *LightBlock
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("witness %s serves conflicting header at height %d", e.Witness, e.Primary.Height())
+}
+
+// Config configures a Client.
+type Config struct {
+	// ChainID identifies the chain, headers certified by commits signed for
+	// other chains fail verification.
+	ChainID string
+	// TrustLevel is the trust level of skipping verification, it defaults
+	// to DefaultTrustLevel.
+	TrustLevel TrustLevel
+	// TrustingPeriod is the time for which a verified header is trusted, it
+	// defaults to DefaultTrustingPeriod. It must be shorter than the time
+	// for which validators remain accountable after leaving the validator
+	// set, see Client.
+	TrustingPeriod time.Duration
+	// MaxClockDrift bounds how far ahead of our clock the time of a header
+	// may be, it defaults to DefaultMaxClockDrift.
+	MaxClockDrift time.Duration
+	// Sequential disables skipping verification.
+	Sequential bool
+	// Witnesses are cross checked against the primary.
+	Witnesses []Provider
+}
+
+// Client verifies the light blocks served by a primary provider.
+//
+// A Client is only as safe as its trusted headers are recent. Signatures
+// prove that validators signed a header, not that they still have anything
+// to lose: validators that have left the set, or whose keys leaked after they
+// did, can sign a fork of a height they once validated and a client trusting
+// a header from before they left would accept it. To guard against such
+// long-range attacks a header is only verified from a trusted header
+// younger than Config.TrustingPeriod, and verification fails with
+// ErrTrustExpired once every trusted header below it is older. A Client that
+// is not updated within the trusting period must be recreated from a new
+// root obtained out of band.
+type Client struct {
+	cfg     Config
+	primary Provider
+
+	mu        sync.Mutex
+	witnesses []Provider
+	trusted   map[uint64]*LightBlock
+	heights   []uint64
+}
+
+// NewClient creates a client that trusts root, which must be obtained from a
+// source trusted out of band and be younger than the trusting period.
+func NewClient(root *LightBlock, primary Provider, cfg Config) (*Client, error) {
+	if cfg.TrustLevel == (TrustLevel{}) {
+		cfg.TrustLevel = DefaultTrustLevel
+	}
+	if cfg.TrustingPeriod == 0 {
+		cfg.TrustingPeriod = DefaultTrustingPeriod
+	}
+	if cfg.MaxClockDrift == 0 {
+		cfg.MaxClockDrift = DefaultMaxClockDrift
+	}
+	if err := cfg.TrustLevel.Validate(); err != nil {
+		return nil, err
+	}
+	if err := root.ValidateBasic(); err != nil {
+		return nil, err
+	}
+	if expires := root.Header.Time.Add(cfg.TrustingPeriod); !expires.After(time.Now()) {
+		return nil, fmt.Errorf("%w: root height %d expired at %v", ErrTrustExpired, root.Height(), expires)
+	}
+	c := &Client{
+		cfg:       cfg,
+		primary:   primary,
+		witnesses: append([]Provider{}, cfg.Witnesses...),
+		trusted:   make(map[uint64]*LightBlock),
+	}
+	c.trust(root)
+	return c, nil
+}
+
+// Witnesses returns the witnesses that have not been found faulty.
+func (c *Client) Witnesses() []Provider {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Provider{}, c.witnesses...)
+}
+
+// TrustedLightBlock returns the verified block at height.
+func (c *Client) TrustedLightBlock(height uint64) (*LightBlock, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lb, ok := c.trusted[height]
+	return lb, ok
+}
+
+// LatestTrusted returns the highest verified block.
+func (c *Client) LatestTrusted() *LightBlock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.trusted[c.heights[len(c.heights)-1]]
+}
+
+// Update verifies the latest block of the primary.
+func (c *Client) Update(ctx context.Context) (*LightBlock, error) {
+	lb, err := c.primary.LightBlock(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	if trusted, ok := c.TrustedLightBlock(lb.Height()); ok {
+		return trusted, nil
+	}
+	return c.verify(ctx, lb)
+}
+
+// VerifyLightBlockAtHeight verifies the primary's block at height, which must
+// be above the height of the root.
+func (c *Client) VerifyLightBlockAtHeight(ctx context.Context, height uint64) (*LightBlock, error) {
+	if trusted, ok := c.TrustedLightBlock(height); ok {
+		return trusted, nil
+	}
+	lb, err := c.primary.LightBlock(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+	if lb.Height() != height {
+		return nil, fmt.Errorf("primary %s served height %d for height %d", c.primary.ID(), lb.Height(), height)
+	}
+	return c.verify(ctx, lb)
+}
+
+// verify verifies target from the closest trusted block below it, cross
+// checks it with the witnesses and trusts the blocks verified on the way.
+func (c *Client) verify(ctx context.Context, target *LightBlock) (*LightBlock, error) {
+	from := c.closestBelow(target.Height())
+	if from == nil {
+		return nil, fmt.Errorf("height %d is below the trusted root", target.Height())
+	}
+	var verified []*LightBlock
+	var err error
+	if c.cfg.Sequential {
+		verified, err = c.verifySequential(ctx, c.primary, from, target)
+	} else {
+		verified, err = c.verifySkipping(ctx, c.primary, from, target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := c.detectConflicts(ctx, from, target); err != nil {
+		return nil, err
+	}
+	for _, lb := range verified {
+		c.trust(lb)
+	}
+	return target, nil
+}
+
+// verifySequential verifies every height from trusted to target, it returns
+// the blocks verified.
+func (c *Client) verifySequential(ctx context.Context, p Provider, trusted, target *LightBlock) ([]*LightBlock, error) {
+	var verified []*LightBlock
+	for height := trusted.Height() + 1; height <= target.Height(); height++ {
+		lb := target
+		if height < target.Height() {
+			var err error
+			if lb, err = fetch(ctx, p, height); err != nil {
+				return nil, err
+			}
+		}
+		if err := VerifyAdjacent(c.cfg.ChainID, trusted, lb, c.cfg.TrustingPeriod, c.cfg.MaxClockDrift, time.Now()); err != nil {
+			return nil, fmt.Errorf("verifying height %d from %s: %w", height, p.ID(), err)
+		}
+		verified = append(verified, lb)
+		trusted = lb
+	}
+	return verified, nil
+}
+
+// verifySkipping verifies target from trusted, bisecting whenever too few
+// trusted validators signed a commit. It returns the blocks verified.
+func (c *Client) verifySkipping(ctx context.Context, p Provider, trusted, target *LightBlock) ([]*LightBlock, error) {
+	var verified []*LightBlock
+	pending := []*LightBlock{target}
+	for len(pending) > 0 {
+		lb := pending[len(pending)-1]
+		err := Verify(c.cfg.ChainID, trusted, lb, c.cfg.TrustLevel, c.cfg.TrustingPeriod, c.cfg.MaxClockDrift, time.Now())
+		switch {
+		case err == nil:
+			verified = append(verified, lb)
+			trusted = lb
+			pending = pending[:len(pending)-1]
+		case errors.Is(err, ErrNotEnoughTrust):
+			// Adjacent heights never lack trust, so the pivot is strictly
+			// between the two.
+			pivot, err := fetch(ctx, p, trusted.Height()+(lb.Height()-trusted.Height())/2)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, pivot)
+		default:
+			return nil, fmt.Errorf("verifying height %d from %s: %w", lb.Height(), p.ID(), err)
+		}
+	}
+	return verified, nil
+}
+
+// detectConflicts compares target with the block each witness serves at its
+// height. A conflicting block that verifies from trusted is returned as a
+// ConflictError, a witness serving a block that doesn't verify is faulty and
+// is dropped. Witnesses that fail to respond are skipped.
+func (c *Client) detectConflicts(ctx context.Context, trusted, target *LightBlock) error {
+	var faulty []Provider
+	for _, w := range c.Witnesses() {
+		lb, err := fetch(ctx, w, target.Height())
+		if err != nil || lb.Header.Hash() == target.Header.Hash() {
+			continue
+		}
+		if _, err := c.verifySkipping(ctx, w, trusted, lb); err != nil {
+			faulty = append(faulty, w)
+			continue
+		}
+		return &ConflictError{Witness: w.ID(), Primary: target, Other: lb}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range faulty {
+		for i, w := range c.witnesses {
+			if w == f {
+				c.witnesses = append(c.witnesses[:i], c.witnesses[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func fetch(ctx context.Context, p Provider, height uint64) (*LightBlock, error) {
+	lb, err := p.LightBlock(ctx, height)
+	if err != nil {
+		return nil, fmt.Errorf("fetching height %d from %s: %w", height, p.ID(), err)
+	}
+	if lb.Height() != height {
+		return nil, fmt.Errorf("%s served height %d for height %d", p.ID(), lb.Height(), height)
+	}
+	return lb, nil
+}
+
+func (c *Client) trust(lb *LightBlock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.trusted[lb.Height()]; ok {
+		return
+	}
+	c.trusted[lb.Height()] = lb
+	c.heights = append(c.heights, lb.Height())
+	sort.Slice(c.heights, func(i, j int) bool { return c.heights[i] < c.heights[j] })
+}
+
+// closestBelow returns the highest trusted block below height.
+func (c *Client) closestBelow(height uint64) *LightBlock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := sort.Search(len(c.heights), func(i int) bool { return c.heights[i] >= height })
+	if i == 0 {
+		return nil
+	}
+	return c.trusted[c.heights[i-1]]
+}
+
+// BlockProvider is a Provider serving the blocks held in a blocksync.Store.
+type BlockProvider struct {
+	id         string
+	store      blocksync.Store
+	validators func(height uint64) (*types.ValidatorSet, bool)
+}
+
+// NewBlockProvider creates a provider serving the blocks in store, validators
+// returns the validator set that decided a height, see
+// types.ValidatorSchedule.At.
+func NewBlockProvider(id string, store blocksync.Store, validators func(height uint64) (*types.ValidatorSet, bool)) *BlockProvider {
+	return &BlockProvider{id: id, store: store, validators: validators}
+}
+
+// ID implements Provider.
+func (p *BlockProvider) ID() string {
+	return p.id
+}
+
+// LightBlock implements Provider.
+func (p *BlockProvider) LightBlock(_ context.Context, height uint64) (*LightBlock, error) {
+	if height == 0 {
+		height = p.store.Height()
+	}
+	b := p.store.Block(height)
+	if b == nil {
+		return nil, ErrLightBlockNotFound
+	}
+	vs, ok := p.validators(height)
+	if !ok {
+		return nil, ErrLightBlockNotFound
+	}
+	return NewLightBlock(b, vs)
+}
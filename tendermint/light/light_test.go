@@ -0,0 +1,305 @@
+package light
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/blocksync"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testChainID = "test-chain"
+
+// testStart is the time of the first height of test chains.
+var testStart = types.CanonicalTime(time.Now().Add(-24 * time.Hour))
+
+func testKey(i int) ed25519.PrivateKey {
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = byte(i + 1)
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+// chain generates light blocks whose validator sets are windows of four
+// consecutive test keys, the window moving on by shift keys every five
+// heights.
+type chain struct {
+	t     *testing.T
+	shift int
+	// fork is included in each payload so that chains with different forks
+	// conflict.
+	fork byte
+	// age moves the times of the headers back, heights are a minute apart
+	// from testStart otherwise.
+	age time.Duration
+}
+
+func (c chain) keys(height uint64) []ed25519.PrivateKey {
+	first := int(height-1) / 5 * c.shift
+	var ks []ed25519.PrivateKey
+	for i := first; i < first+4; i++ {
+		ks = append(ks, testKey(i))
+	}
+	return ks
+}
+
+func (c chain) validators(height uint64) *types.ValidatorSet {
+	var vals []types.Validator
+	for _, k := range c.keys(height) {
+		vals = append(vals, types.NewValidator(k.Public().(ed25519.PublicKey)))
+	}
+	vs, err := types.NewValidatorSet(vals)
+	require.NoError(c.t, err)
+	return vs
+}
+
+func (c chain) block(height uint64) *types.Block {
+	vs := c.validators(height)
+	payload := []byte{c.fork, byte(height)}
+	header := types.Header{
+		Height:             height,
+		Time:               testStart.Add(time.Duration(height)*time.Minute - c.age),
+		ValidatorsHash:     vs.Hash(),
+		NextValidatorsHash: c.validators(height + 1).Hash(),
+		Payload:            types.NewPartSetFromData(payload).Header(),
+	}
+	p := &algorithm.ConsensusMessage{Sender: vs.Proposer(height, 0), MsgType: algorithm.Propose, Height: height, Round: 0, Value: header.Hash(), ValidRound: -1}
+	proposer, _ := vs.Index(p.Sender)
+	sig, err := types.NewKeySigner(c.keys(height)[proposer]).SignMessage(testChainID, p)
+	require.NoError(c.t, err)
+	b := &types.Block{
+		Proposal: types.EncodeProposal(p, sig, header),
+		Payload:  payload,
+		Commit:   &types.Commit{Height: height, Round: 0, Value: p.Value},
+	}
+	for _, k := range c.keys(height) {
+		m := &algorithm.ConsensusMessage{Sender: keys.Address(k.Public().(ed25519.PublicKey)), MsgType: algorithm.Precommit, Height: height, Round: 0, Value: p.Value}
+		sig, err := types.NewKeySigner(k).SignMessage(testChainID, m)
+		require.NoError(c.t, err)
+		b.Commit.Precommits = append(b.Commit.Precommits, types.EncodeSigned(m, sig))
+	}
+	return b
+}
+
+func (c chain) lightBlock(height uint64) *LightBlock {
+	lb, err := NewLightBlock(c.block(height), c.validators(height))
+	require.NoError(c.t, err)
+	return lb
+}
+
+// provider serves the blocks of a chain up to height and counts requests, if
+// tamper is set the commits it serves lack a quorum.
+type provider struct {
+	id     string
+	c      chain
+	height uint64
+	tamper bool
+
+	mu       sync.Mutex
+	requests int
+}
+
+func (p *provider) ID() string {
+	return p.id
+}
+
+func (p *provider) LightBlock(_ context.Context, height uint64) (*LightBlock, error) {
+	p.mu.Lock()
+	p.requests++
+	p.mu.Unlock()
+	if height == 0 {
+		height = p.height
+	}
+	if height > p.height {
+		return nil, ErrLightBlockNotFound
+	}
+	lb := p.c.lightBlock(height)
+	if p.tamper {
+		lb.Commit.Precommits = lb.Commit.Precommits[:2]
+	}
+	return lb, nil
+}
+
+func TestTrustLevel(t *testing.T) {
+	assert.NoError(t, DefaultTrustLevel.Validate())
+	assert.NoError(t, TrustLevel{2, 3}.Validate())
+	assert.Error(t, TrustLevel{1, 4}.Validate())
+	assert.Error(t, TrustLevel{4, 3}.Validate())
+	assert.Error(t, TrustLevel{1, 0}.Validate())
+}
+
+func TestLightBlockEncoding(t *testing.T) {
+	lb := chain{t: t, shift: 1}.lightBlock(7)
+	encoded, err := lb.MarshalBinary()
+	require.NoError(t, err)
+	decoded := new(LightBlock)
+	require.NoError(t, decoded.UnmarshalBinary(encoded))
+	assert.Equal(t, lb, decoded)
+	assert.Error(t, decoded.UnmarshalBinary(encoded[:len(encoded)-1]))
+	assert.Error(t, decoded.UnmarshalBinary(encoded[:types.HeaderSize+10]))
+}
+
+func TestVerify(t *testing.T) {
+	c := chain{t: t, shift: 1}
+	trusted := c.lightBlock(5)
+	period, drift, now := DefaultTrustingPeriod, DefaultMaxClockDrift, time.Now()
+	require.NoError(t, VerifyAdjacent(testChainID, trusted, c.lightBlock(6), period, drift, now))
+	assert.Error(t, VerifyAdjacent(testChainID, trusted, c.lightBlock(7), period, drift, now))
+
+	// Three of the four validators at height 5 also validate height 10,
+	// beyond that too few remain.
+	require.NoError(t, VerifyNonAdjacent(testChainID, trusted, c.lightBlock(10), DefaultTrustLevel, period, drift, now))
+	require.NoError(t, VerifyNonAdjacent(testChainID, trusted, c.lightBlock(15), DefaultTrustLevel, period, drift, now))
+	assert.ErrorIs(t, VerifyNonAdjacent(testChainID, trusted, c.lightBlock(20), DefaultTrustLevel, period, drift, now), ErrNotEnoughTrust)
+	assert.ErrorIs(t, VerifyNonAdjacent(testChainID, trusted, c.lightBlock(15), TrustLevel{2, 3}, period, drift, now), ErrNotEnoughTrust)
+
+	// Blocks whose parts don't match are rejected.
+	bad := c.lightBlock(6)
+	bad.Validators = c.validators(20)
+	assert.Error(t, VerifyAdjacent(testChainID, trusted, bad, period, drift, now))
+	bad = c.lightBlock(6)
+	commit := *bad.Commit
+	commit.Precommits = commit.Precommits[:2]
+	bad.Commit = &commit
+	assert.Error(t, VerifyAdjacent(testChainID, trusted, bad, period, drift, now))
+	assert.Error(t, VerifyNonAdjacent(testChainID, trusted, &LightBlock{Header: bad.Header, Commit: bad.Commit, Validators: bad.Validators}, DefaultTrustLevel, period, drift, now))
+
+	// A header claiming a validator set other than the one the trusted
+	// header names for it is rejected even with a valid commit.
+	other := chain{t: t, shift: 4}
+	assert.Error(t, VerifyAdjacent(testChainID, trusted, other.lightBlock(6), period, drift, now))
+
+	// Commits signed for another chain are rejected.
+	assert.Error(t, VerifyAdjacent("other-chain", trusted, c.lightBlock(6), period, drift, now))
+	assert.Error(t, VerifyNonAdjacent("other-chain", trusted, c.lightBlock(10), DefaultTrustLevel, period, drift, now))
+
+	// Trust in a header expires after the trusting period, the headers of
+	// the test chain are a day old.
+	assert.ErrorIs(t, VerifyAdjacent(testChainID, trusted, c.lightBlock(6), time.Hour, drift, now), ErrTrustExpired)
+	assert.ErrorIs(t, VerifyNonAdjacent(testChainID, trusted, c.lightBlock(10), DefaultTrustLevel, time.Hour, drift, now), ErrTrustExpired)
+
+	// Later headers must be later in time, but not ahead of our clock.
+	earlier := chain{t: t, shift: 1, age: time.Hour}
+	assert.Error(t, VerifyAdjacent(testChainID, trusted, earlier.lightBlock(6), period, drift, now))
+	assert.Error(t, VerifyNonAdjacent(testChainID, trusted, earlier.lightBlock(10), DefaultTrustLevel, period, drift, now))
+	future := chain{t: t, shift: 1, age: -48 * time.Hour}
+	assert.Error(t, VerifyAdjacent(testChainID, trusted, future.lightBlock(6), period, drift, now))
+	assert.Error(t, VerifyNonAdjacent(testChainID, trusted, future.lightBlock(10), DefaultTrustLevel, period, drift, now))
+}
+
+func TestClientSkipping(t *testing.T) {
+	c := chain{t: t, shift: 1}
+	primary := &provider{id: "primary", c: c, height: 60}
+	client, err := NewClient(c.lightBlock(1), primary, Config{ChainID: testChainID})
+	require.NoError(t, err)
+
+	lb, err := client.VerifyLightBlockAtHeight(context.Background(), 60)
+	require.NoError(t, err)
+	assert.Equal(t, c.lightBlock(60).Header, lb.Header)
+	// Bisection needs far fewer blocks than sequential verification.
+	assert.Less(t, primary.requests, 20)
+	trusted, ok := client.TrustedLightBlock(60)
+	assert.True(t, ok)
+	assert.Equal(t, lb, trusted)
+
+	// Lower heights are verified from the closest trusted height below.
+	_, err = client.VerifyLightBlockAtHeight(context.Background(), 30)
+	require.NoError(t, err)
+	primary.height = 70
+	lb, err = client.Update(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(70), lb.Height())
+	assert.Equal(t, lb, client.LatestTrusted())
+}
+
+func TestClientSequential(t *testing.T) {
+	// The validator set is replaced entirely every five heights, which
+	// skipping verification can only follow one height at a time too.
+	c := chain{t: t, shift: 4}
+	for _, sequential := range []bool{true, false} {
+		primary := &provider{id: "primary", c: c, height: 20}
+		client, err := NewClient(c.lightBlock(1), primary, Config{ChainID: testChainID, Sequential: sequential})
+		require.NoError(t, err)
+		_, err = client.VerifyLightBlockAtHeight(context.Background(), 20)
+		require.NoError(t, err)
+		for h := uint64(5); h <= 6; h++ {
+			_, ok := client.TrustedLightBlock(h)
+			assert.True(t, ok, "height %d not trusted", h)
+		}
+	}
+}
+
+func TestClientTrustingPeriod(t *testing.T) {
+	c := chain{t: t, shift: 1}
+	primary := &provider{id: "primary", c: c, height: 30}
+
+	// A root older than the trusting period is refused.
+	_, err := NewClient(c.lightBlock(1), primary, Config{ChainID: testChainID, TrustingPeriod: time.Hour})
+	assert.ErrorIs(t, err, ErrTrustExpired)
+
+	// Once the trusted heights expire nothing more is verified, shortening
+	// the trusting period stands in for the passing of time.
+	client, err := NewClient(c.lightBlock(1), primary, Config{ChainID: testChainID})
+	require.NoError(t, err)
+	_, err = client.VerifyLightBlockAtHeight(context.Background(), 20)
+	require.NoError(t, err)
+	client.cfg.TrustingPeriod = time.Hour
+	for _, sequential := range []bool{false, true} {
+		client.cfg.Sequential = sequential
+		_, err = client.VerifyLightBlockAtHeight(context.Background(), 30)
+		assert.ErrorIs(t, err, ErrTrustExpired)
+	}
+	_, ok := client.TrustedLightBlock(30)
+	assert.False(t, ok)
+}
+
+func TestClientDetectsConflicts(t *testing.T) {
+	c := chain{t: t, shift: 1}
+	primary := &provider{id: "primary", c: c, height: 30}
+
+	// A witness serving a fork signed by the same validators reveals an
+	// attack.
+	forked := &provider{id: "forked", c: chain{t: t, shift: 1, fork: 1}, height: 30}
+	client, err := NewClient(c.lightBlock(1), primary, Config{ChainID: testChainID, Witnesses: []Provider{forked}})
+	require.NoError(t, err)
+	_, err = client.VerifyLightBlockAtHeight(context.Background(), 30)
+	var conflict *ConflictError
+	require.True(t, errors.As(err, &conflict), "got %v", err)
+	assert.Equal(t, "forked", conflict.Witness)
+	_, ok := client.TrustedLightBlock(30)
+	assert.False(t, ok)
+
+	// A witness serving headers that don't verify is dropped instead.
+	faulty := &provider{id: "faulty", c: chain{t: t, shift: 1, fork: 1}, height: 30, tamper: true}
+	agreeing := &provider{id: "agreeing", c: c, height: 30}
+	client, err = NewClient(c.lightBlock(1), primary, Config{ChainID: testChainID, Witnesses: []Provider{faulty, agreeing}})
+	require.NoError(t, err)
+	_, err = client.VerifyLightBlockAtHeight(context.Background(), 30)
+	require.NoError(t, err)
+	assert.Equal(t, []Provider{agreeing}, client.Witnesses())
+}
+
+func TestBlockProvider(t *testing.T) {
+	c := chain{t: t, shift: 1}
+	store := blocksync.NewMemStore()
+	for h := uint64(1); h <= 12; h++ {
+		require.NoError(t, store.Add(c.block(h)))
+	}
+	p := NewBlockProvider("store", store, func(height uint64) (*types.ValidatorSet, bool) {
+		return c.validators(height), true
+	})
+	client, err := NewClient(c.lightBlock(1), p, Config{ChainID: testChainID})
+	require.NoError(t, err)
+	lb, err := client.Update(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, c.lightBlock(12).Header, lb.Header)
+	_, err = p.LightBlock(context.Background(), 13)
+	assert.ErrorIs(t, err, ErrLightBlockNotFound)
+}
@@ -0,0 +1,235 @@
+// Package light verifies decided heights without running consensus.
+//
+// A light client starts from a trusted LightBlock, obtained out of band, and
+// verifies later heights from the commits that certify them. Headers commit
+// to the validator set of their height and of the next height, so the client
+// can follow the validator set as it changes.
+//
+// Verification is either sequential, each height verified from the previous
+// one, or skipping. Skipping verification accepts a height directly when the
+// validators trusted at an earlier height that signed its commit exceed the
+// trust level, by default one third of the trusted set, since then at least
+// one of them is correct. When they don't the client bisects, first verifying
+// a height between the two. Each verified height is cross checked against
+// witnesses, a witness serving a conflicting header that verifies from the
+// same trusted state is evidence of an attack.
+//
+// Trust in a header expires. Validators that have left the validator set, or
+// whose old keys have leaked, can sign a fork from any height they once
+// validated at no risk to themselves, a long-range attack that signatures
+// alone cannot detect. Headers therefore carry the time they were proposed,
+// and a header is only verified from a trusted header younger than the
+// trusting period, which must be shorter than the time validators remain
+// accountable for what they sign after leaving the set. Once the latest
+// trusted header is older, verification fails with ErrTrustExpired and a new
+// trusted header must be obtained out of band.
+package light
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// ErrNotEnoughTrust is returned when the trusted validators that signed a
+// commit don't reach the trust level.
+var ErrNotEnoughTrust = errors.New("not enough trusted validators signed the commit")
+
+// ErrTrustExpired is returned when verifying from a trusted header older than
+// the trusting period.
+var ErrTrustExpired = errors.New("trusted header is older than the trusting period")
+
+// TrustLevel is the fraction of a trusted validator set that must sign a
+// commit for skipping verification to accept it.
+type TrustLevel struct {
+	Numerator   int
+	Denominator int
+}
+
+// DefaultTrustLevel is one third, the least fraction guaranteed to include a
+// correct validator.
+var DefaultTrustLevel = TrustLevel{Numerator: 1, Denominator: 3}
+
+// Validate returns an error unless the level is between one third and one.
+func (l TrustLevel) Validate() error {
+	if l.Denominator <= 0 || 3*l.Numerator < l.Denominator || l.Numerator > l.Denominator {
+		return fmt.Errorf("trust level %d/%d is not between 1/3 and 1", l.Numerator, l.Denominator)
+	}
+	return nil
+}
+
+// LightBlock is what a light client needs of a height, its header, the commit
+// certifying the header and the validator set that decided the height.
+type LightBlock struct {
+	Header     types.Header
+	Commit     *types.Commit
+	Validators *types.ValidatorSet
+}
+
+// NewLightBlock returns the light block of a decided block, vs is the
+// validator set that decided it.
+func NewLightBlock(b *types.Block, vs *types.ValidatorSet) (*LightBlock, error) {
+	header, err := b.Header()
+	if err != nil {
+		return nil, err
+	}
+	return &LightBlock{Header: header, Commit: b.Commit, Validators: vs}, nil
+}
+
+// MarshalBinary encodes the light block as its header, the big endian 4 byte
+// length of the encoded commit, the commit and the validator set.
+func (lb *LightBlock) MarshalBinary() ([]byte, error) {
+	b, err := lb.Header.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := lb.Commit.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	vs, err := lb.Validators.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(commit)))
+	b = append(b, commit...)
+	return append(b, vs...), nil
+}
+
+// UnmarshalBinary decodes a light block encoded by MarshalBinary.
+func (lb *LightBlock) UnmarshalBinary(b []byte) error {
+	if len(b) < types.HeaderSize+4 {
+		return fmt.Errorf("light block has length %d", len(b))
+	}
+	if err := lb.Header.UnmarshalBinary(b[:types.HeaderSize]); err != nil {
+		return err
+	}
+	b = b[types.HeaderSize:]
+	n := binary.BigEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(n) {
+		return fmt.Errorf("light block commit has length %d, %d bytes remain", n, len(b)-4)
+	}
+	lb.Commit = new(types.Commit)
+	if err := lb.Commit.UnmarshalBinary(b[4 : 4+n]); err != nil {
+		return err
+	}
+	var err error
+	lb.Validators, err = types.UnmarshalValidatorSet(b[4+n:])
+	return err
+}
+
+// Height returns the height of the block.
+func (lb *LightBlock) Height() uint64 {
+	return lb.Header.Height
+}
+
+// ValidateBasic checks that the parts of the block are consistent, it does not
+// verify the commit.
+func (lb *LightBlock) ValidateBasic() error {
+	if lb.Commit == nil || lb.Validators == nil {
+		return fmt.Errorf("incomplete light block at height %d", lb.Header.Height)
+	}
+	if lb.Commit.Height != lb.Header.Height || lb.Commit.Value != lb.Header.Hash() {
+		return fmt.Errorf("commit for %v at height %d does not match header at height %d", lb.Commit.Value, lb.Commit.Height, lb.Header.Height)
+	}
+	if lb.Validators.Hash() != lb.Header.ValidatorsHash {
+		return fmt.Errorf("validator set does not match header at height %d", lb.Header.Height)
+	}
+	return nil
+}
+
+// Verify verifies untrusted from trusted on the chain identified by chainID,
+// sequentially if untrusted is the next height and by skipping otherwise. See
+// VerifyAdjacent for the checks made of the headers' times.
+func Verify(chainID string, trusted, untrusted *LightBlock, level TrustLevel, trustingPeriod, maxClockDrift time.Duration, now time.Time) error {
+	if untrusted.Height() == trusted.Height()+1 {
+		return VerifyAdjacent(chainID, trusted, untrusted, trustingPeriod, maxClockDrift, now)
+	}
+	return VerifyNonAdjacent(chainID, trusted, untrusted, level, trustingPeriod, maxClockDrift, now)
+}
+
+// VerifyAdjacent verifies the block at the height following trusted, the
+// trusted header determines its validator set. It returns an error wrapping
+// ErrTrustExpired if trusted is older than trustingPeriod at now, and fails
+// unless untrusted is later than trusted and at most maxClockDrift ahead of
+// now.
+func VerifyAdjacent(chainID string, trusted, untrusted *LightBlock, trustingPeriod, maxClockDrift time.Duration, now time.Time) error {
+	if untrusted.Height() != trusted.Height()+1 {
+		return fmt.Errorf("height %d does not follow trusted height %d", untrusted.Height(), trusted.Height())
+	}
+	if err := untrusted.ValidateBasic(); err != nil {
+		return err
+	}
+	if err := verifyTime(trusted, untrusted, trustingPeriod, maxClockDrift, now); err != nil {
+		return err
+	}
+	if untrusted.Header.ValidatorsHash != trusted.Header.NextValidatorsHash {
+		return fmt.Errorf("validator set at height %d is not the one trusted", untrusted.Height())
+	}
+	return untrusted.Commit.Verify(chainID, untrusted.Validators)
+}
+
+// VerifyNonAdjacent verifies a block beyond the height following trusted, it
+// returns an error wrapping ErrNotEnoughTrust if too few of the validators
+// trusted signed its commit. The headers' times are checked as by
+// VerifyAdjacent.
+func VerifyNonAdjacent(chainID string, trusted, untrusted *LightBlock, level TrustLevel, trustingPeriod, maxClockDrift time.Duration, now time.Time) error {
+	if untrusted.Height() <= trusted.Height()+1 {
+		return fmt.Errorf("height %d is not beyond trusted height %d", untrusted.Height(), trusted.Height())
+	}
+	if err := untrusted.ValidateBasic(); err != nil {
+		return err
+	}
+	if err := verifyTime(trusted, untrusted, trustingPeriod, maxClockDrift, now); err != nil {
+		return err
+	}
+	if err := verifyTrusting(chainID, untrusted.Commit, trusted.Validators, level); err != nil {
+		return err
+	}
+	return untrusted.Commit.Verify(chainID, untrusted.Validators)
+}
+
+// verifyTime checks that trusted has not expired at now and that untrusted
+// is later than trusted but not beyond now and maxClockDrift.
+func verifyTime(trusted, untrusted *LightBlock, trustingPeriod, maxClockDrift time.Duration, now time.Time) error {
+	if expires := trusted.Header.Time.Add(trustingPeriod); !expires.After(now) {
+		return fmt.Errorf("%w: trusted height %d expired at %v", ErrTrustExpired, trusted.Height(), expires)
+	}
+	if !untrusted.Header.Time.After(trusted.Header.Time) {
+		return fmt.Errorf("time %v of height %d is not after time %v of trusted height %d", untrusted.Header.Time, untrusted.Height(), trusted.Header.Time, trusted.Height())
+	}
+	if untrusted.Header.Time.After(now.Add(maxClockDrift)) {
+		return fmt.Errorf("time %v of height %d is ahead of our clock", untrusted.Header.Time, untrusted.Height())
+	}
+	return nil
+}
+
+// verifyTrusting checks that the members of vs that signed c exceed the
+// trust level, precommits from others are ignored.
+func verifyTrusting(chainID string, c *types.Commit, vs *types.ValidatorSet, level TrustLevel) error {
+	signed := make(map[algorithm.NodeID]bool)
+	for _, raw := range c.Precommits {
+		m, _, err := types.DecodeSigned(raw)
+		if err != nil {
+			return err
+		}
+		if !vs.Contains(m.Sender) || signed[m.Sender] {
+			continue
+		}
+		if _, err := types.VerifySigned(chainID, vs, raw); err != nil {
+			return err
+		}
+		if m.MsgType != algorithm.Precommit || m.Height != c.Height || m.Round != c.Round || m.Value != c.Value {
+			return fmt.Errorf("commit for %v at height %d round %d holds %v", c.Value, c.Height, c.Round, m)
+		}
+		signed[m.Sender] = true
+	}
+	if len(signed)*level.Denominator <= vs.Size()*level.Numerator {
+		return fmt.Errorf("%w: %d of %d", ErrNotEnoughTrust, len(signed), vs.Size())
+	}
+	return nil
+}
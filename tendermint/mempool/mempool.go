@@ -0,0 +1,382 @@
+// Package mempool holds the transactions waiting to be proposed.
+//
+// Transactions are validated by the application's CheckTx before they are
+// added to the Mempool, which keeps them ordered by the priority CheckTx
+// assigns. When the pool is full a transaction only gets in by evicting
+// transactions of lower priority. The proposer reaps the transactions of
+// highest priority into its proposal, and once a height is decided its
+// transactions are removed and the remaining ones rechecked against the new
+// application state. A Reactor gossips the pool to peers, so that any
+// proposer can include a transaction submitted to any node.
+//
+// Proposal payloads produced from the pool are lists of transactions, see
+// EncodeTxs.
+package mempool
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxTxs is the default bound on the number of transactions held.
+	DefaultMaxTxs = 5000
+	// DefaultMaxBytes is the default bound on the total size of the
+	// transactions held.
+	DefaultMaxBytes = 64 << 20
+	// DefaultMaxTxBytes is the default bound on the size of a transaction.
+	DefaultMaxTxBytes = 1 << 20
+	// DefaultCacheSize is the default number of transactions remembered
+	// after they leave the pool.
+	DefaultCacheSize = 10000
+	// DefaultGossipInterval is the default interval between gossip rounds.
+	DefaultGossipInterval = 100 * time.Millisecond
+)
+
+var (
+	// ErrTxInCache is returned for transactions that are held or were seen
+	// recently, such as those already decided.
+	ErrTxInCache = errors.New("transaction already seen")
+	// ErrTxTooLarge is returned for transactions larger than MaxTxBytes.
+	ErrTxTooLarge = errors.New("transaction too large")
+	// ErrMempoolFull is returned for transactions that would only fit by
+	// evicting transactions of equal or higher priority.
+	ErrMempoolFull = errors.New("mempool full")
+)
+
+// Application validates transactions against the current application state.
+type Application interface {
+	// CheckTx returns the priority of tx, or an error if tx is invalid.
+	CheckTx(tx []byte) (priority int64, err error)
+}
+
+// Config configures a Mempool.
+type Config struct {
+	// MaxTxs and MaxBytes bound the number and the total size of the
+	// transactions held.
+	MaxTxs   int
+	MaxBytes int
+	// MaxTxBytes bounds the size of a transaction.
+	MaxTxBytes int
+	// CacheSize is the number of transactions remembered after they leave
+	// the pool, so that they are not added again.
+	CacheSize int
+	// GossipInterval is the interval at which a Reactor sends peers the
+	// transactions they lack.
+	GossipInterval time.Duration
+}
+
+func (c *Config) setDefaults() {
+	if c.MaxTxs == 0 {
+		c.MaxTxs = DefaultMaxTxs
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = DefaultMaxBytes
+	}
+	if c.MaxTxBytes == 0 {
+		c.MaxTxBytes = DefaultMaxTxBytes
+	}
+	if c.CacheSize == 0 {
+		c.CacheSize = DefaultCacheSize
+	}
+	if c.GossipInterval == 0 {
+		c.GossipInterval = DefaultGossipInterval
+	}
+}
+
+// TxKey identifies a transaction.
+type TxKey [sha256.Size]byte
+
+// Key returns the key of tx.
+func Key(tx []byte) TxKey {
+	return sha256.Sum256(tx)
+}
+
+type entry struct {
+	tx       []byte
+	key      TxKey
+	priority int64
+	// seq orders entries by arrival.
+	seq uint64
+}
+
+// Mempool holds validated transactions, it is safe for concurrent use.
+type Mempool struct {
+	cfg Config
+	app Application
+
+	mu    sync.Mutex
+	txs   map[TxKey]*entry
+	bytes int
+	seq   uint64
+	cache *cache
+}
+
+// NewMempool creates an empty Mempool validating transactions with app.
+func NewMempool(cfg Config, app Application) *Mempool {
+	cfg.setDefaults()
+	return &Mempool{
+		cfg:   cfg,
+		app:   app,
+		txs:   make(map[TxKey]*entry),
+		cache: newCache(cfg.CacheSize),
+	}
+}
+
+// Size returns the number of transactions held.
+func (m *Mempool) Size() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.txs)
+}
+
+// SizeBytes returns the total size of the transactions held.
+func (m *Mempool) SizeBytes() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bytes
+}
+
+// Has returns true if the pool holds the transaction with the given key.
+func (m *Mempool) Has(key TxKey) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.txs[key] != nil
+}
+
+// CheckTx validates tx with the application and adds it to the pool,
+// evicting transactions of lower priority if the pool is full.
+func (m *Mempool) CheckTx(tx []byte) error {
+	if len(tx) == 0 {
+		return fmt.Errorf("empty transaction")
+	}
+	if len(tx) > m.cfg.MaxTxBytes {
+		return fmt.Errorf("%w: %d bytes", ErrTxTooLarge, len(tx))
+	}
+	key := Key(tx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.txs[key] != nil || !m.cache.add(key) {
+		return ErrTxInCache
+	}
+	priority, err := m.app.CheckTx(tx)
+	if err != nil {
+		// Invalid transactions may become valid, so they are not
+		// remembered.
+		m.cache.remove(key)
+		return err
+	}
+	victims, err := m.victims(len(tx), priority)
+	if err != nil {
+		m.cache.remove(key)
+		return err
+	}
+	for _, e := range victims {
+		m.removeEntry(e)
+		m.cache.remove(e.key)
+	}
+	m.seq++
+	m.txs[key] = &entry{tx: append([]byte{}, tx...), key: key, priority: priority, seq: m.seq}
+	m.bytes += len(tx)
+	return nil
+}
+
+// victims returns the entries to evict to make room for a transaction of the
+// given size and priority. The entries of lowest priority are evicted first,
+// and of those the most recent, it returns ErrMempoolFull if room can't be
+// made without evicting entries of equal or higher priority.
+func (m *Mempool) victims(size int, priority int64) ([]*entry, error) {
+	if size > m.cfg.MaxBytes {
+		return nil, ErrMempoolFull
+	}
+	count, bytes := len(m.txs)+1, m.bytes+size
+	if count <= m.cfg.MaxTxs && bytes <= m.cfg.MaxBytes {
+		return nil, nil
+	}
+	entries := m.sorted()
+	var victims []*entry
+	for i := len(entries) - 1; count > m.cfg.MaxTxs || bytes > m.cfg.MaxBytes; i-- {
+		if entries[i].priority >= priority {
+			return nil, ErrMempoolFull
+		}
+		victims = append(victims, entries[i])
+		count--
+		bytes -= len(entries[i].tx)
+	}
+	return victims, nil
+}
+
+// sorted returns the entries by decreasing priority, entries of equal
+// priority in the order they arrived.
+func (m *Mempool) sorted() []*entry {
+	entries := make([]*entry, 0, len(m.txs))
+	for _, e := range m.txs {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].priority != entries[j].priority {
+			return entries[i].priority > entries[j].priority
+		}
+		return entries[i].seq < entries[j].seq
+	})
+	return entries
+}
+
+func (m *Mempool) removeEntry(e *entry) {
+	delete(m.txs, e.key)
+	m.bytes -= len(e.tx)
+}
+
+// entries returns the entries held by decreasing priority.
+func (m *Mempool) entries() []*entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sorted()
+}
+
+// Txs returns the transactions held by decreasing priority.
+func (m *Mempool) Txs() [][]byte {
+	return m.Reap(-1)
+}
+
+// Reap returns the transactions of highest priority whose encoding by
+// EncodeTxs fits in maxBytes, or all transactions if maxBytes is negative.
+// The transactions stay in the pool until Update removes them.
+func (m *Mempool) Reap(maxBytes int) [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var txs [][]byte
+	size := 0
+	for _, e := range m.sorted() {
+		if maxBytes >= 0 && size+4+len(e.tx) > maxBytes {
+			// A smaller transaction of lower priority may still fit but
+			// skipping ahead of higher priorities would starve large
+			// transactions.
+			break
+		}
+		size += 4 + len(e.tx)
+		txs = append(txs, e.tx)
+	}
+	return txs
+}
+
+// Update removes the transactions decided at a height and rechecks the
+// remaining ones against the application state that resulted, dropping
+// those that are no longer valid. It must be called once the application has
+// executed the height.
+func (m *Mempool) Update(decided [][]byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tx := range decided {
+		key := Key(tx)
+		// Decided transactions are remembered so that they are not added
+		// again.
+		m.cache.add(key)
+		if e := m.txs[key]; e != nil {
+			m.removeEntry(e)
+		}
+	}
+	for _, e := range m.sorted() {
+		priority, err := m.app.CheckTx(e.tx)
+		if err != nil {
+			m.removeEntry(e)
+			m.cache.remove(e.key)
+			continue
+		}
+		e.priority = priority
+	}
+}
+
+// cache remembers a bounded number of keys, forgetting the oldest first.
+type cache struct {
+	size  int
+	keys  map[TxKey]bool
+	order []TxKey
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, keys: make(map[TxKey]bool)}
+}
+
+// add adds key, it returns false if key was already present.
+func (c *cache) add(key TxKey) bool {
+	if c.keys[key] {
+		return false
+	}
+	if len(c.keys) >= c.size {
+		// Keys removed explicitly leave stale entries in order, which are
+		// skipped.
+		for len(c.order) > 0 {
+			oldest := c.order[0]
+			c.order = c.order[1:]
+			if c.keys[oldest] {
+				delete(c.keys, oldest)
+				break
+			}
+		}
+	}
+	c.keys[key] = true
+	c.order = append(c.order, key)
+	if len(c.order) > 2*c.size {
+		c.compact()
+	}
+	return true
+}
+
+// compact drops the stale entries of order, keeping the most recent entry of
+// each key.
+func (c *cache) compact() {
+	seen := make(map[TxKey]bool, len(c.keys))
+	var order []TxKey
+	for i := len(c.order) - 1; i >= 0; i-- {
+		if key := c.order[i]; c.keys[key] && !seen[key] {
+			seen[key] = true
+			order = append(order, key)
+		}
+	}
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	c.order = order
+}
+
+func (c *cache) remove(key TxKey) {
+	delete(c.keys, key)
+}
+
+// EncodeTxs encodes transactions as a proposal payload, each transaction
+// prefixed by its big endian 4 byte length.
+func EncodeTxs(txs [][]byte) []byte {
+	size := 0
+	for _, tx := range txs {
+		size += 4 + len(tx)
+	}
+	b := make([]byte, 0, size)
+	for _, tx := range txs {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(tx)))
+		b = append(b, tx...)
+	}
+	return b
+}
+
+// DecodeTxs decodes a payload encoded by EncodeTxs.
+func DecodeTxs(b []byte) ([][]byte, error) {
+	var txs [][]byte
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("truncated transaction length")
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint64(len(b)-4) < uint64(n) {
+			return nil, fmt.Errorf("transaction of length %d exceeds remaining %d bytes", n, len(b)-4)
+		}
+		txs = append(txs, b[4:4+n])
+		b = b[4+n:]
+	}
+	return txs, nil
+}
@@ -0,0 +1,257 @@
+package mempool
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/consensus"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+	"github.com/piersy/tendermint-go/tendermint/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTimeout = 20 * time.Second
+
+// testApp prioritises transactions by their first byte and rejects those
+// marked invalid.
+type testApp struct {
+	mu      sync.Mutex
+	invalid map[string]bool
+}
+
+func newTestApp() *testApp {
+	return &testApp{invalid: make(map[string]bool)}
+}
+
+func (a *testApp) CheckTx(tx []byte) (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.invalid[string(tx)] {
+		return 0, fmt.Errorf("invalid transaction %q", tx)
+	}
+	return int64(tx[0]), nil
+}
+
+func (a *testApp) setInvalid(tx string, invalid bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.invalid[tx] = invalid
+}
+
+func TestCheckTx(t *testing.T) {
+	app := newTestApp()
+	m := NewMempool(Config{MaxTxBytes: 10}, app)
+	require.NoError(t, m.CheckTx([]byte("\x01a")))
+	assert.ErrorIs(t, m.CheckTx([]byte("\x01a")), ErrTxInCache)
+	assert.ErrorIs(t, m.CheckTx(bytes.Repeat([]byte{1}, 11)), ErrTxTooLarge)
+	assert.Error(t, m.CheckTx(nil))
+
+	// Rejected transactions may be submitted again once valid.
+	app.setInvalid("\x01b", true)
+	assert.Error(t, m.CheckTx([]byte("\x01b")))
+	app.setInvalid("\x01b", false)
+	require.NoError(t, m.CheckTx([]byte("\x01b")))
+	assert.Equal(t, 2, m.Size())
+	assert.Equal(t, 4, m.SizeBytes())
+	assert.True(t, m.Has(Key([]byte("\x01b"))))
+}
+
+func TestEviction(t *testing.T) {
+	m := NewMempool(Config{MaxTxs: 3, MaxBytes: 8}, newTestApp())
+	for _, tx := range []string{"\x05a", "\x03a", "\x04a"} {
+		require.NoError(t, m.CheckTx([]byte(tx)))
+	}
+	// A transaction of lower or equal priority than all held is rejected,
+	// one of higher priority evicts the lowest.
+	assert.ErrorIs(t, m.CheckTx([]byte("\x03b")), ErrMempoolFull)
+	require.NoError(t, m.CheckTx([]byte("\x06a")))
+	assert.Equal(t, [][]byte{[]byte("\x06a"), []byte("\x05a"), []byte("\x04a")}, m.Txs())
+
+	// The byte bound evicts as many transactions as needed.
+	require.NoError(t, m.CheckTx([]byte("\x07abc")))
+	assert.Equal(t, [][]byte{[]byte("\x07abc"), []byte("\x06a"), []byte("\x05a")}, m.Txs())
+	assert.ErrorIs(t, m.CheckTx([]byte("\x09abcdefgh")), ErrMempoolFull)
+	require.NoError(t, m.CheckTx([]byte("\x08abc")))
+	assert.Equal(t, [][]byte{[]byte("\x08abc"), []byte("\x07abc")}, m.Txs())
+
+	// Evicted transactions may be submitted again.
+	m.Update([][]byte{[]byte("\x07abc")})
+	require.NoError(t, m.CheckTx([]byte("\x04a")))
+}
+
+func TestReap(t *testing.T) {
+	m := NewMempool(Config{}, newTestApp())
+	for _, tx := range []string{"\x01a", "\x02aaaa", "\x02b", "\x03a"} {
+		require.NoError(t, m.CheckTx([]byte(tx)))
+	}
+	assert.Equal(t, [][]byte{[]byte("\x03a"), []byte("\x02aaaa"), []byte("\x02b"), []byte("\x01a")}, m.Reap(-1))
+	assert.Equal(t, [][]byte{[]byte("\x03a"), []byte("\x02aaaa")}, m.Reap(15))
+	assert.Empty(t, m.Reap(5))
+	assert.Equal(t, 4, m.Size())
+}
+
+func TestUpdate(t *testing.T) {
+	app := newTestApp()
+	m := NewMempool(Config{}, app)
+	for _, tx := range []string{"\x01a", "\x01b", "\x01c"} {
+		require.NoError(t, m.CheckTx([]byte(tx)))
+	}
+	// Decided transactions are removed and not added again, those made
+	// invalid by the decision are dropped.
+	app.setInvalid("\x01c", true)
+	m.Update([][]byte{[]byte("\x01a"), []byte("\x01d")})
+	assert.Equal(t, [][]byte{[]byte("\x01b")}, m.Txs())
+	assert.ErrorIs(t, m.CheckTx([]byte("\x01a")), ErrTxInCache)
+	assert.ErrorIs(t, m.CheckTx([]byte("\x01d")), ErrTxInCache)
+	app.setInvalid("\x01c", false)
+	require.NoError(t, m.CheckTx([]byte("\x01c")))
+}
+
+func TestCacheForgetsOldest(t *testing.T) {
+	c := newCache(2)
+	a, b, d := Key([]byte("a")), Key([]byte("b")), Key([]byte("d"))
+	assert.True(t, c.add(a))
+	assert.True(t, c.add(b))
+	assert.False(t, c.add(a))
+	assert.True(t, c.add(d))
+	assert.True(t, c.add(a))
+	for i := 0; i < 10; i++ {
+		c.remove(d)
+		c.add(d)
+	}
+	assert.LessOrEqual(t, len(c.order), 4)
+	assert.False(t, c.add(d))
+}
+
+func TestTxsEncoding(t *testing.T) {
+	txs := [][]byte{[]byte("a"), {}, []byte("bcd")}
+	decoded, err := DecodeTxs(EncodeTxs(txs))
+	require.NoError(t, err)
+	assert.Equal(t, txs, decoded)
+	_, err = DecodeTxs(EncodeTxs(txs)[:10])
+	assert.Error(t, err)
+	decoded, err = DecodeTxs(nil)
+	require.NoError(t, err)
+	assert.Empty(t, decoded)
+}
+
+func TestReactorRelaysTransactions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The nodes are connected in a line so the last node only receives
+	// transactions relayed by the middle one.
+	n := p2p.NewMemNetwork()
+	var pools []*Mempool
+	for i := 0; i < 3; i++ {
+		tr := n.Transport(algorithm.NodeID{byte(i + 1)})
+		defer tr.Close()
+		m := NewMempool(Config{GossipInterval: 5 * time.Millisecond}, newTestApp())
+		pools = append(pools, m)
+		r := NewReactor(m, tr)
+		go func() { _ = r.Run(ctx) }()
+	}
+	n.Disconnect(algorithm.NodeID{1}, algorithm.NodeID{3})
+	require.NoError(t, pools[0].CheckTx([]byte("\x01a")))
+	require.NoError(t, pools[2].CheckTx([]byte("\x01b")))
+	require.Eventually(t, func() bool {
+		for _, m := range pools {
+			if m.Size() != 2 {
+				return false
+			}
+		}
+		return true
+	}, testTimeout, time.Millisecond)
+}
+
+func TestMempoolFeedsConsensus(t *testing.T) {
+	var ks []ed25519.PrivateKey
+	var vals []types.Validator
+	for i := 0; i < 4; i++ {
+		seed := make([]byte, ed25519.SeedSize)
+		seed[0] = byte(i + 1)
+		k := ed25519.NewKeyFromSeed(seed)
+		ks = append(ks, k)
+		vals = append(vals, types.NewValidator(k.Public().(ed25519.PublicKey)))
+	}
+	vs, err := types.NewValidatorSet(vals)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Each validator proposes the transactions of its pool, transactions
+	// are submitted to the first one only.
+	n := p2p.NewMemNetwork()
+	var mu sync.Mutex
+	decided := make(map[string]int)
+	var pools []*Mempool
+	for i, k := range ks {
+		tr := n.Transport(keys.Address(k.Public().(ed25519.PublicKey)))
+		defer tr.Close()
+		mux := p2p.NewMux(tr, p2p.MuxConfig{})
+		consensusTransport, mempoolTransport := mux.Channels(consensus.Channel), mux.Channels(Channel)
+		mux.Start()
+		m := NewMempool(Config{GossipInterval: 5 * time.Millisecond}, newTestApp())
+		pools = append(pools, m)
+		first := i == 0
+		d := consensus.NewDriver(consensus.Config{
+			Signer:         types.NewKeySigner(k),
+			Validators:     vs,
+			TimeoutUnit:    20 * time.Millisecond,
+			GossipInterval: 5 * time.Millisecond,
+			Propose: func(uint64, int) []byte {
+				return EncodeTxs(m.Reap(100))
+			},
+			Valid: func(payload []byte) bool {
+				_, err := DecodeTxs(payload)
+				return err == nil
+			},
+			Decided: func(_ *algorithm.ConsensusMessage, b *types.Block) []types.ValidatorUpdate {
+				txs, _ := DecodeTxs(b.Payload)
+				if first {
+					mu.Lock()
+					for _, tx := range txs {
+						decided[string(tx)]++
+					}
+					mu.Unlock()
+				}
+				m.Update(txs)
+				return nil
+			},
+		}, consensusTransport)
+		r := NewReactor(m, mempoolTransport)
+		go func() { _ = d.Run(ctx) }()
+		go func() { _ = r.Run(ctx) }()
+	}
+	for i := 0; i < 30; i++ {
+		require.NoError(t, pools[0].CheckTx([]byte(fmt.Sprintf("\x01tx%d", i))))
+	}
+
+	// Proposals hold at most 100 bytes so the transactions are spread over
+	// several heights, each is decided exactly once.
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(decided) == 30
+	}, testTimeout, time.Millisecond)
+	mu.Lock()
+	for tx, count := range decided {
+		assert.Equal(t, 1, count, "transaction %q", tx)
+	}
+	mu.Unlock()
+	require.Eventually(t, func() bool {
+		for _, m := range pools {
+			if m.Size() != 0 {
+				return false
+			}
+		}
+		return true
+	}, testTimeout, time.Millisecond)
+}
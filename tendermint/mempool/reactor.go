@@ -0,0 +1,102 @@
+package mempool
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+)
+
+// Channel is the p2p channel that carries transactions.
+const Channel p2p.ChannelID = 0x30
+
+// kindTx is the first byte of a payload on Channel, it is followed by a
+// transaction.
+const kindTx byte = 1
+
+// ErrTransportClosed is returned by Run if the transport is closed.
+var ErrTransportClosed = errors.New("transport closed")
+
+// Reactor gossips the transactions of a Mempool, adding those received from
+// peers to it. On every gossip round each peer is sent the transactions in
+// the pool that it is not known to hold, those we sent it or received from
+// it.
+type Reactor struct {
+	mempool   *Mempool
+	transport p2p.Transport
+	// peers holds the keys of the pooled transactions each peer holds.
+	peers map[algorithm.NodeID]map[TxKey]bool
+}
+
+// NewReactor creates a Reactor gossiping m over t, call Run to start it.
+func NewReactor(m *Mempool, t p2p.Transport) *Reactor {
+	return &Reactor{mempool: m, transport: t, peers: make(map[algorithm.NodeID]map[TxKey]bool)}
+}
+
+// Run gossips transactions until ctx is cancelled or the transport is closed.
+// Run must only be called once.
+func (r *Reactor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.mempool.cfg.GossipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-r.transport.Receive():
+			if !ok {
+				return ErrTransportClosed
+			}
+			if e.Channel != Channel || len(e.Payload) < 2 || e.Payload[0] != kindTx {
+				continue
+			}
+			tx := e.Payload[1:]
+			r.peer(e.From)[Key(tx)] = true
+			// Invalid transactions and those we hold already are ignored.
+			_ = r.mempool.CheckTx(tx)
+		case e, ok := <-r.transport.PeerEvents():
+			if !ok {
+				return ErrTransportClosed
+			}
+			if e.Type == p2p.PeerDown {
+				delete(r.peers, e.Peer)
+			} else {
+				r.peer(e.Peer)
+			}
+		case <-ticker.C:
+			r.gossip()
+		}
+	}
+}
+
+// peer returns the keys of the transactions a peer holds, creating the entry
+// if needed since a peer's transactions may be received before the event
+// announcing it.
+func (r *Reactor) peer(id algorithm.NodeID) map[TxKey]bool {
+	known := r.peers[id]
+	if known == nil {
+		known = make(map[TxKey]bool)
+		r.peers[id] = known
+	}
+	return known
+}
+
+// gossip sends each peer the pooled transactions it lacks, by decreasing
+// priority. Transactions that left the pool are forgotten.
+func (r *Reactor) gossip() {
+	entries := r.mempool.entries()
+	for id, known := range r.peers {
+		held := make(map[TxKey]bool, len(entries))
+		for _, e := range entries {
+			if !known[e.key] {
+				if err := r.transport.Send(id, Channel, append([]byte{kindTx}, e.tx...)); err != nil {
+					// The transaction is offered again in the next round.
+					continue
+				}
+			}
+			held[e.key] = true
+		}
+		r.peers[id] = held
+	}
+}
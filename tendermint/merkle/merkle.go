@@ -0,0 +1,200 @@
+// Package merkle computes Merkle roots and inclusion proofs over ordered lists
+// of byte slices.
+//
+// Leaves and inner nodes are hashed with distinct prefixes as in RFC 6962, so
+// that a leaf can't be passed off as an inner node. A list of n items is split
+// into a left subtree holding the largest power of two smaller than n items
+// and a right subtree holding the rest.
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/piersy/tendermint-go/tendermint"
+)
+
+// MaxAunts bounds the length of a proof, it allows trees of up to 2^32
+// items.
+const MaxAunts = 32
+
+var (
+	leafPrefix  = []byte{0}
+	innerPrefix = []byte{1}
+)
+
+// LeafHash returns the hash of a leaf.
+func LeafHash(leaf []byte) tendermint.Hash {
+	h := sha256.New()
+	h.Write(leafPrefix)
+	h.Write(leaf)
+	var result tendermint.Hash
+	h.Sum(result[:0])
+	return result
+}
+
+func innerHash(left, right tendermint.Hash) tendermint.Hash {
+	h := sha256.New()
+	h.Write(innerPrefix)
+	h.Write(left[:])
+	h.Write(right[:])
+	var result tendermint.Hash
+	h.Sum(result[:0])
+	return result
+}
+
+// emptyHash is the root of an empty list.
+var emptyHash tendermint.Hash = sha256.Sum256(nil)
+
+// splitPoint returns the largest power of two smaller than n, n must be
+// greater than 1.
+func splitPoint(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+// Root returns the Merkle root of items.
+func Root(items [][]byte) tendermint.Hash {
+	switch len(items) {
+	case 0:
+		return emptyHash
+	case 1:
+		return LeafHash(items[0])
+	}
+	k := splitPoint(len(items))
+	return innerHash(Root(items[:k]), Root(items[k:]))
+}
+
+// Proof proves that a leaf is the item at Index of a list of Total items.
+type Proof struct {
+	Total int
+	Index int
+	// Aunts holds the hashes of the siblings of the nodes on the path from
+	// the leaf to the root, starting next to the leaf.
+	Aunts []tendermint.Hash
+}
+
+// Proofs returns the root of items and a proof for each item.
+func Proofs(items [][]byte) (tendermint.Hash, []*Proof) {
+	proofs := make([]*Proof, len(items))
+	for i := range items {
+		proofs[i] = &Proof{Total: len(items), Index: i}
+	}
+	root := buildProofs(items, proofs)
+	return root, proofs
+}
+
+// buildProofs returns the root of items, appending the aunts of each item to
+// the proof of the same index.
+func buildProofs(items [][]byte, proofs []*Proof) tendermint.Hash {
+	switch len(items) {
+	case 0:
+		return emptyHash
+	case 1:
+		return LeafHash(items[0])
+	}
+	k := splitPoint(len(items))
+	left := buildProofs(items[:k], proofs[:k])
+	right := buildProofs(items[k:], proofs[k:])
+	for _, p := range proofs[:k] {
+		p.Aunts = append(p.Aunts, right)
+	}
+	for _, p := range proofs[k:] {
+		p.Aunts = append(p.Aunts, left)
+	}
+	return innerHash(left, right)
+}
+
+// Verify returns an error unless the proof shows that leaf is the item at
+// p.Index of a list whose root is root.
+func (p *Proof) Verify(root tendermint.Hash, leaf []byte) error {
+	if p.Total <= 0 || p.Index < 0 || p.Index >= p.Total {
+		return fmt.Errorf("invalid proof index %d of %d", p.Index, p.Total)
+	}
+	computed, err := computeRoot(p.Index, p.Total, LeafHash(leaf), p.Aunts)
+	if err != nil {
+		return err
+	}
+	if computed != root {
+		return fmt.Errorf("proof does not match root %v", root)
+	}
+	return nil
+}
+
+// computeRoot walks from the leaf at index to the root, the aunts are
+// consumed from the end since the last aunt is the sibling of the subtree
+// closest to the root.
+func computeRoot(index, total int, leaf tendermint.Hash, aunts []tendermint.Hash) (tendermint.Hash, error) {
+	if total == 1 {
+		if len(aunts) != 0 {
+			return tendermint.Hash{}, fmt.Errorf("proof has %d unused aunts", len(aunts))
+		}
+		return leaf, nil
+	}
+	if len(aunts) == 0 {
+		return tendermint.Hash{}, fmt.Errorf("proof has too few aunts")
+	}
+	k := splitPoint(total)
+	sibling := aunts[len(aunts)-1]
+	if index < k {
+		left, err := computeRoot(index, k, leaf, aunts[:len(aunts)-1])
+		if err != nil {
+			return tendermint.Hash{}, err
+		}
+		return innerHash(left, sibling), nil
+	}
+	right, err := computeRoot(index-k, total-k, leaf, aunts[:len(aunts)-1])
+	if err != nil {
+		return tendermint.Hash{}, err
+	}
+	return innerHash(sibling, right), nil
+}
+
+// MarshalBinary encodes the proof as the big endian 4 byte total and index,
+// a byte holding the number of aunts and then the aunts.
+func (p *Proof) MarshalBinary() ([]byte, error) {
+	if len(p.Aunts) > MaxAunts {
+		return nil, fmt.Errorf("proof has %d aunts", len(p.Aunts))
+	}
+	b := make([]byte, 0, 9+len(p.Aunts)*len(tendermint.Hash{}))
+	b = binary.BigEndian.AppendUint32(b, uint32(p.Total))
+	b = binary.BigEndian.AppendUint32(b, uint32(p.Index))
+	b = append(b, byte(len(p.Aunts)))
+	for _, a := range p.Aunts {
+		b = append(b, a[:]...)
+	}
+	return b, nil
+}
+
+// DecodeProof decodes a proof encoded by MarshalBinary from the start of b, it
+// also returns the number of bytes consumed so that proofs can be followed by
+// other data.
+func DecodeProof(b []byte) (*Proof, int, error) {
+	if len(b) < 9 {
+		return nil, 0, fmt.Errorf("proof too short")
+	}
+	total := binary.BigEndian.Uint32(b)
+	index := binary.BigEndian.Uint32(b[4:])
+	n := int(b[8])
+	if n > MaxAunts {
+		return nil, 0, fmt.Errorf("proof has %d aunts", n)
+	}
+	size := 9 + n*len(tendermint.Hash{})
+	if len(b) < size {
+		return nil, 0, fmt.Errorf("proof too short for %d aunts", n)
+	}
+	if uint64(total) > 1<<31 || index >= total {
+		return nil, 0, fmt.Errorf("invalid proof index %d of %d", index, total)
+	}
+	p := &Proof{Total: int(total), Index: int(index)}
+	for i := 0; i < n; i++ {
+		var a tendermint.Hash
+		copy(a[:], b[9+i*len(a):])
+		p.Aunts = append(p.Aunts, a)
+	}
+	return p, size, nil
+}
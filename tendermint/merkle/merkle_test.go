@@ -0,0 +1,70 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func items(n int) [][]byte {
+	result := make([][]byte, n)
+	for i := range result {
+		result[i] = []byte(fmt.Sprintf("item %d", i))
+	}
+	return result
+}
+
+func TestRoot(t *testing.T) {
+	assert.Equal(t, tendermint.Hash(sha256.Sum256(nil)), Root(nil))
+	assert.Equal(t, LeafHash([]byte("a")), Root([][]byte{[]byte("a")}))
+	// Three items split into a left pair and a right single.
+	three := items(3)
+	expected := innerHash(innerHash(LeafHash(three[0]), LeafHash(three[1])), LeafHash(three[2]))
+	assert.Equal(t, expected, Root(three))
+	// A leaf is not confused with an inner node holding the same bytes.
+	left, right := LeafHash(three[0]), LeafHash(three[1])
+	assert.NotEqual(t, Root(three[:2]), Root([][]byte{append(left[:], right[:]...)}))
+}
+
+func TestProofs(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		list := items(n)
+		root, proofs := Proofs(list)
+		require.Equal(t, Root(list), root)
+		for i, p := range proofs {
+			require.NoError(t, p.Verify(root, list[i]), "item %d of %d", i, n)
+
+			encoded, err := p.MarshalBinary()
+			require.NoError(t, err)
+			decoded, size, err := DecodeProof(append(encoded, 0xff))
+			require.NoError(t, err)
+			assert.Equal(t, len(encoded), size)
+			assert.Equal(t, p, decoded)
+
+			assert.Error(t, p.Verify(root, []byte("other")))
+			if n > 1 {
+				wrong := *p
+				wrong.Index = (i + 1) % n
+				assert.Error(t, wrong.Verify(root, list[i]))
+				short := *p
+				short.Aunts = p.Aunts[1:]
+				assert.Error(t, short.Verify(root, list[i]))
+			}
+		}
+	}
+}
+
+func TestProofRejectsMalformedEncoding(t *testing.T) {
+	_, proofs := Proofs(items(4))
+	encoded, err := proofs[0].MarshalBinary()
+	require.NoError(t, err)
+	_, _, err = DecodeProof(encoded[:len(encoded)-1])
+	assert.Error(t, err)
+	encoded[7] = 9 // index beyond total
+	_, _, err = DecodeProof(encoded)
+	assert.Error(t, err)
+}
@@ -0,0 +1,270 @@
+// Package metrics implements counters, gauges and histograms that are
+// exposed in the Prometheus text exposition format.
+//
+// Metrics are created through a Registry, which serves them over HTTP with
+// Handler. Each metric may have labels, the values of which are given when
+// the metric is updated, and each distinct combination of label values is
+// exposed as a separate series.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the default upper bounds of histogram buckets, suited
+// to durations in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and writes them in the text exposition format. It
+// is safe for concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+	names   map[string]bool
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// metric holds the series of one metric by the key of their label values.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	// value is the value of a counter or gauge and the sum of a histogram's
+	// observations.
+	value float64
+	// counts holds the cumulative count of observations of each bucket of
+	// a histogram followed by the count of all observations.
+	counts []uint64
+}
+
+func (r *Registry) register(name, help, kind string, buckets []float64, labels []string) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: metric %s registered twice", name))
+	}
+	r.names[name] = true
+	m := &metric{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// get returns the series with the given label values, creating it if
+// needed, m.mu must be held.
+func (m *metric) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metrics: metric %s has %d labels, got %d values", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s := m.series[key]
+	if s == nil {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(m.buckets)+1)
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Counter is a metric that only increases.
+type Counter struct {
+	m *metric
+}
+
+// Counter registers a counter with the given labels, it panics if a metric
+// with the same name is registered.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, "counter", nil, labels)}
+}
+
+// Inc adds 1 to the series with the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series with the given label
+// values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: counter %s decreased", c.m.name))
+	}
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	c.m.get(labelValues).value += v
+}
+
+// Gauge is a metric that can go up and down.
+type Gauge struct {
+	m *metric
+}
+
+// Gauge registers a gauge with the given labels, it panics if a metric with
+// the same name is registered.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, "gauge", nil, labels)}
+}
+
+// Set sets the series with the given label values to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.get(labelValues).value = v
+}
+
+// Histogram is a metric that counts observations in buckets.
+type Histogram struct {
+	m *metric
+}
+
+// Histogram registers a histogram with the given bucket upper bounds, which
+// must be increasing, and labels. It uses DefaultBuckets if buckets is nil
+// and panics if a metric with the same name is registered.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			panic(fmt.Sprintf("metrics: histogram %s buckets are not increasing", name))
+		}
+	}
+	return &Histogram{r.register(name, help, "histogram", buckets, labels)}
+}
+
+// Observe records v in the series with the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+	s := h.m.get(labelValues)
+	s.value += v
+	for i, upper := range h.m.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.counts[len(h.m.buckets)]++
+}
+
+// WriteTo writes the metrics in the text exposition format, in the order
+// they were registered with series sorted by label values.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]*metric{}, r.metrics...)
+	r.mu.Unlock()
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, m := range metrics {
+		m.write(cw)
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// Handler returns an http.Handler serving the metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		_, _ = r.WriteTo(w)
+	})
+}
+
+func (m *metric) write(w *countingWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.printf("# HELP %s %s\n", m.name, helpEscaper.Replace(m.help))
+	w.printf("# TYPE %s %s\n", m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			w.printf("%s%s %s\n", m.name, m.labelPairs(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		for i, upper := range m.buckets {
+			w.printf("%s_bucket%s %d\n", m.name, m.labelPairs(s.labelValues, formatFloat(upper)), s.counts[i])
+		}
+		count := s.counts[len(m.buckets)]
+		w.printf("%s_bucket%s %d\n", m.name, m.labelPairs(s.labelValues, "+Inf"), count)
+		w.printf("%s_sum%s %s\n", m.name, m.labelPairs(s.labelValues, ""), formatFloat(s.value))
+		w.printf("%s_count%s %d\n", m.name, m.labelPairs(s.labelValues, ""), count)
+	}
+}
+
+// labelPairs formats the labels of a series, le is the upper bound of a
+// histogram bucket or empty.
+func (m *metric) labelPairs(values []string, le string) string {
+	var pairs []string
+	for i, label := range m.labels {
+		pairs = append(pairs, label+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) printf(format string, args ...any) {
+	if c.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(c.w, format, args...)
+	c.n += int64(n)
+	c.err = err
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryWritesTextFormat(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("requests_total", "Requests served.\nBy code.", "code")
+	g := r.Gauge("height", "Current height.")
+	h := r.Histogram("latency_seconds", "Request latency.", []float64{0.1, 1}, "path")
+	c.Inc("500")
+	c.Add(2, "200")
+	c.Inc(`a"b\`)
+	g.Set(7)
+	g.Set(8)
+	h.Observe(0.05, "/")
+	h.Observe(0.5, "/")
+	h.Observe(3, "/")
+
+	var b strings.Builder
+	n, err := r.WriteTo(&b)
+	require.NoError(t, err)
+	expected := `# HELP requests_total Requests served.\nBy code.
+# TYPE requests_total counter
+requests_total{code="200"} 2
+requests_total{code="500"} 1
+requests_total{code="a\"b\\"} 1
+# HELP height Current height.
+# TYPE height gauge
+height 8
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/",le="0.1"} 1
+latency_seconds_bucket{path="/",le="1"} 2
+latency_seconds_bucket{path="/",le="+Inf"} 3
+latency_seconds_sum{path="/"} 3.55
+latency_seconds_count{path="/"} 3
+`
+	assert.Equal(t, expected, b.String())
+	assert.Equal(t, int64(len(expected)), n)
+}
+
+func TestRegistryRejectsMisuse(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("c", "", "label")
+	assert.Panics(t, func() { r.Gauge("c", "") })
+	assert.Panics(t, func() { c.Inc() })
+	assert.Panics(t, func() { c.Add(-1, "a") })
+	assert.Panics(t, func() { r.Histogram("h", "", []float64{1, 1}) })
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Gauge("height", "Current height.").Set(3)
+	s := httptest.NewServer(r.Handler())
+	defer s.Close()
+
+	resp, err := http.Get(s.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, ContentType, resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "\nheight 3\n")
+}
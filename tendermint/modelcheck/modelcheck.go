@@ -0,0 +1,414 @@
+// Package modelcheck exhaustively explores the behaviours of a small cluster
+// of Algorithm instances.
+//
+// Every honest validator runs a real Algorithm backed by a Store and a
+// BasicOracle. Starting from the initial state the checker enumerates the
+// interleavings of message deliveries and timeouts up to a bound on the number
+// of rounds. Equivalent global states are only explored once and interleavings
+// that differ only in the order of independent actions are pruned, see
+// reduce.go. Byzantine validators are modelled as a pool of every message
+// they could send, each of which may be delivered to each honest validator at
+// any point. The invariants from the whitepaper are checked in every reachable
+// state and the first violation is reported along with the sequence of
+// actions that leads to it. A run cut short by MaxStates is marked Truncated,
+// finding no violation then says nothing about the unexplored states.
+package modelcheck
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// Height is the height at which all exploration takes place.
+const Height = 1
+
+// Config configures a model checking run.
+type Config struct {
+	// Validators is the total number of validators.
+	Validators int
+	// Byzantine is the number of validators that are Byzantine, they are
+	// the proposers of rounds [0, Byzantine) so that their proposals fall
+	// within the round bound.
+	Byzantine int
+	// Rounds bounds exploration to rounds [0, Rounds), a node that would
+	// start round Rounds stops taking part.
+	Rounds int
+	// Values is the number of distinct valid values, honest proposers
+	// propose value round % Values, Byzantine validators may propose and
+	// vote for any of them.
+	Values int
+	// InvalidProposals allows Byzantine proposers to propose an invalid
+	// value.
+	InvalidProposals bool
+	// MaxStates bounds the number of distinct states explored, zero means no
+	// bound.
+	MaxStates int
+}
+
+func (c *Config) setDefaults() {
+	if c.Validators == 0 {
+		c.Validators = 4
+	}
+	if c.Rounds == 0 {
+		c.Rounds = 1
+	}
+	if c.Values == 0 {
+		c.Values = 2
+	}
+}
+
+// Action is a single step in an execution, either the delivery of Msg to
+// Node or the firing of Timeout at Node.
+type Action struct {
+	Node    algorithm.NodeID
+	Msg     *algorithm.ConsensusMessage
+	Timeout *algorithm.Timeout
+}
+
+func (a Action) String() string {
+	if a.Msg != nil {
+		return fmt.Sprintf("deliver %v -> %v: %v", a.Msg.Sender, a.Node, a.Msg)
+	}
+	return fmt.Sprintf("timeout %v: %v r:%d", a.Node, a.Timeout.Type(), a.Timeout.Round())
+}
+
+// Violation describes a broken invariant and how to reach it.
+type Violation struct {
+	Invariant string
+	Detail    string
+	// Trace is the sequence of actions, from the initial state, that leads
+	// to the violation.
+	Trace []Action
+}
+
+func (v *Violation) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s violated: %s\n", v.Invariant, v.Detail)
+	for i, a := range v.Trace {
+		fmt.Fprintf(&b, "%3d %v\n", i, a)
+	}
+	return b.String()
+}
+
+// Result summarises a model checking run.
+type Result struct {
+	// States is the number of distinct states explored.
+	States int
+	// Transitions is the number of actions executed.
+	Transitions int
+	// Complete is true if every reachable state was explored, it is false if
+	// exploration was cut short by MaxStates or by finding a violation.
+	Complete bool
+	// Truncated is true if exploration was cut short by MaxStates.
+	Truncated bool
+	// Violation is the first violation found, or nil.
+	Violation *Violation
+}
+
+// Check explores the state space described by cfg.
+func Check(cfg Config) *Result {
+	cfg.setDefaults()
+	c := newChecker(cfg)
+	initial := c.initialState()
+	c.result.Complete = true
+	c.explore(initial)
+	return c.result
+}
+
+type checker struct {
+	cfg        Config
+	validators []algorithm.NodeID
+	vindex     map[algorithm.NodeID]int
+	byzantine  map[algorithm.NodeID]bool
+	values     []tendermint.Hash
+	invalid    tendermint.Hash
+
+	// msgs interns every message seen during exploration, messages are
+	// referred to by their index.
+	msgs  []*algorithm.ConsensusMessage
+	index map[algorithm.ConsensusMessage]int
+	// byzMsgs holds the indices of the messages Byzantine validators may
+	// send.
+	byzMsgs []int
+	// byzOrder holds, for each honest node, the order in which it is offered
+	// Byzantine messages.
+	byzOrder [][]int
+	// perms holds the symmetries of the state space and free marks the
+	// validators they permute.
+	perms [][]int
+	free  []bool
+
+	visited map[string]struct{}
+	// settled holds the values a node may decide once no node will send
+	// another message, keyed by the node's fingerprint and the messages
+	// sent by the others.
+	settled map[string][]tendermint.Hash
+	path    []Action
+	result  *Result
+}
+
+func newChecker(cfg Config) *checker {
+	c := &checker{
+		cfg:       cfg,
+		vindex:    make(map[algorithm.NodeID]int),
+		byzantine: make(map[algorithm.NodeID]bool),
+		index:     make(map[algorithm.ConsensusMessage]int),
+		visited:   make(map[string]struct{}),
+		settled:   make(map[string][]tendermint.Hash),
+		result:    &Result{},
+	}
+	for i := 0; i < cfg.Validators; i++ {
+		var id algorithm.NodeID
+		id[0] = byte(i + 1)
+		c.vindex[id] = len(c.validators)
+		c.validators = append(c.validators, id)
+	}
+	for r := 0; r < cfg.Byzantine; r++ {
+		c.byzantine[c.proposer(r)] = true
+	}
+	for i := 0; i < cfg.Values; i++ {
+		c.values = append(c.values, sha256.Sum256([]byte{byte(i)}))
+	}
+	c.invalid = sha256.Sum256([]byte("invalid"))
+	c.byzantineMessages()
+	c.orderByzantineMessages()
+	c.perms = c.symmetries()
+	return c
+}
+
+func (c *checker) proposer(round int) algorithm.NodeID {
+	return c.validators[(Height+round)%len(c.validators)]
+}
+
+func (c *checker) valid(v tendermint.Hash) bool {
+	for _, value := range c.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *checker) intern(m *algorithm.ConsensusMessage) int {
+	if i, ok := c.index[*m]; ok {
+		return i
+	}
+	c.index[*m] = len(c.msgs)
+	c.msgs = append(c.msgs, m)
+	return len(c.msgs) - 1
+}
+
+// byzantineMessages enumerates every message that the Byzantine validators
+// could usefully send within the round bound.
+func (c *checker) byzantineMessages() {
+	for _, id := range c.validators {
+		if !c.byzantine[id] {
+			continue
+		}
+		for r := 0; r < c.cfg.Rounds; r++ {
+			if c.proposer(r) == id {
+				proposals := append([]tendermint.Hash{}, c.values...)
+				if c.cfg.InvalidProposals {
+					proposals = append(proposals, c.invalid)
+				}
+				for _, v := range proposals {
+					for vr := -1; vr < r; vr++ {
+						c.byzMsgs = append(c.byzMsgs, c.intern(&algorithm.ConsensusMessage{
+							Sender: id, MsgType: algorithm.Propose, Height: Height, Round: r, Value: v, ValidRound: vr,
+						}))
+					}
+				}
+			}
+			for _, t := range []algorithm.Step{algorithm.Prevote, algorithm.Precommit} {
+				for _, v := range append([]tendermint.Hash{algorithm.NilValue}, c.values...) {
+					c.byzMsgs = append(c.byzMsgs, c.intern(&algorithm.ConsensusMessage{
+						Sender: id, MsgType: t, Height: Height, Round: r, Value: v,
+					}))
+				}
+			}
+		}
+	}
+}
+
+// orderByzantineMessages decides the order in which each honest node is
+// offered Byzantine messages. The order does not affect which states are
+// reachable, but when exploration is bounded it decides which are visited.
+// Honest node i is offered messages for value i % Values first and nil votes
+// last, so the earliest executions explored are those in which the Byzantine
+// validators try to drive honest nodes towards different decisions.
+func (c *checker) orderByzantineMessages() {
+	for i := 0; i < c.cfg.Validators-c.cfg.Byzantine; i++ {
+		rank := func(m int) int {
+			v := c.msgs[m].Value
+			for j, value := range c.values {
+				if v == value {
+					return (j - i%len(c.values) + len(c.values)) % len(c.values)
+				}
+			}
+			if v == algorithm.NilValue {
+				return len(c.values)
+			}
+			return len(c.values) + 1
+		}
+		order := append([]int{}, c.byzMsgs...)
+		sort.SliceStable(order, func(a, b int) bool {
+			return rank(order[a]) < rank(order[b])
+		})
+		c.byzOrder = append(c.byzOrder, order)
+	}
+}
+
+// state is a global state, it holds the honest nodes.
+type state struct {
+	nodes []*node
+}
+
+func (c *checker) initialState() *state {
+	s := &state{}
+	for _, id := range c.validators {
+		if c.byzantine[id] {
+			continue
+		}
+		n := &node{id: id, store: algorithm.NewStore()}
+		n.algo = algorithm.New(id, c.oracle(n.store))
+		s.nodes = append(s.nodes, n)
+		c.startRound(n, 0)
+	}
+	return s
+}
+
+func (c *checker) oracle(s *algorithm.Store) algorithm.Oracle {
+	return algorithm.NewBasicOracle(len(c.validators), Height, s)
+}
+
+// clone returns a copy of s in which node i may be modified, the other nodes
+// are shared with s and must not be.
+func (c *checker) clone(s *state, i int) *state {
+	result := &state{nodes: append([]*node{}, s.nodes...)}
+	result.nodes[i] = c.cloneNode(s.nodes[i])
+	return result
+}
+
+// explore performs a depth first search from s.
+func (c *checker) explore(s *state) {
+	if c.violated(s, nil) {
+		return
+	}
+	key := c.fingerprint(s)
+	if _, ok := c.visited[key]; ok {
+		return
+	}
+	if !c.count() {
+		return
+	}
+	c.visited[key] = struct{}{}
+
+	actions, settle := c.reduce(s, c.enabled(s))
+	if settle {
+		c.settle(s, actions)
+		return
+	}
+	for _, a := range actions {
+		next := c.clone(s, a.node)
+		c.apply(next, a)
+		c.result.Transitions++
+		c.path = append(c.path, a.action)
+		c.explore(next)
+		c.path = c.path[:len(c.path)-1]
+		if c.result.Violation != nil {
+			return
+		}
+	}
+}
+
+// violated checks the invariants in s, which is reached by following path
+// and then trace, it records the first violation found. Every state reached
+// is checked, not only those with a new fingerprint, since fingerprints omit
+// parts of the state that cannot lead to a violation but may hold one.
+func (c *checker) violated(s *state, trace []enabledAction) bool {
+	invariant, detail := c.checkInvariants(s)
+	if invariant == "" {
+		return false
+	}
+	path := append([]Action{}, c.path...)
+	for _, a := range trace {
+		path = append(path, a.action)
+	}
+	c.result.Complete = false
+	c.result.Violation = &Violation{
+		Invariant: invariant,
+		Detail:    detail,
+		Trace:     path,
+	}
+	return true
+}
+
+// count counts a newly explored state, it returns false if MaxStates states
+// have already been explored.
+func (c *checker) count() bool {
+	if c.cfg.MaxStates > 0 && c.result.States >= c.cfg.MaxStates {
+		c.result.Complete = false
+		c.result.Truncated = true
+		return false
+	}
+	c.result.States++
+	return true
+}
+
+// enabledAction identifies an action by the index of the node it applies to
+// and either a message index or a timeout index.
+type enabledAction struct {
+	node    int
+	msg     int
+	timeout int
+	action  Action
+}
+
+func (c *checker) enabled(s *state) []enabledAction {
+	var result []enabledAction
+	for i, n := range s.nodes {
+		if n.halted {
+			continue
+		}
+		deliverable := func(m int) {
+			if !n.received.has(m) {
+				result = append(result, enabledAction{node: i, msg: m, timeout: -1, action: Action{Node: n.id, Msg: c.msgs[m]}})
+			}
+		}
+		for _, other := range s.nodes {
+			for _, m := range other.sent {
+				deliverable(m)
+			}
+		}
+		for _, m := range c.byzOrder[i] {
+			deliverable(m)
+		}
+		for j := range n.timeouts {
+			t := n.timeouts[j]
+			result = append(result, enabledAction{node: i, msg: -1, timeout: j, action: Action{Node: n.id, Timeout: &t}})
+		}
+	}
+	return result
+}
+
+func (c *checker) apply(s *state, a enabledAction) {
+	n := s.nodes[a.node]
+	if a.msg >= 0 {
+		c.deliver(n, a.msg)
+		return
+	}
+	t := n.timeouts[a.timeout]
+	n.timeouts = append(n.timeouts[:a.timeout:a.timeout], n.timeouts[a.timeout+1:]...)
+	cm, rc := n.algo.OnTimeout(&t)
+	c.handle(n, rc, cm, nil)
+}
+
+func appendInt(b []byte, i int) []byte {
+	return binary.AppendVarint(b, int64(i))
+}
@@ -0,0 +1,73 @@
+package modelcheck
+
+import (
+	"testing"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHonestStateSpaceIsSafe(t *testing.T) {
+	for _, cfg := range []Config{
+		{Validators: 3, Rounds: 1},
+		{Validators: 2, Rounds: 3},
+		{Validators: 4, Rounds: 1},
+	} {
+		r := Check(cfg)
+		require.Nil(t, r.Violation, "%+v", cfg)
+		assert.True(t, r.Complete, "%+v", cfg)
+		assert.False(t, r.Truncated, "%+v", cfg)
+		assert.Greater(t, r.States, 1)
+	}
+}
+
+func TestOneByzantineIsSafe(t *testing.T) {
+	// The full space is too large for a unit test so we explore a bounded
+	// portion of it, the result must say so.
+	r := Check(Config{Validators: 4, Byzantine: 1, InvalidProposals: true, MaxStates: 5000})
+	require.Nil(t, r.Violation)
+	assert.False(t, r.Complete)
+	assert.True(t, r.Truncated)
+	assert.Equal(t, 5000, r.States)
+}
+
+func TestTwoByzantineBreakAgreement(t *testing.T) {
+	// Two out of four validators is more than f so agreement can be broken.
+	r := Check(Config{Validators: 4, Byzantine: 2, MaxStates: 100000})
+	require.NotNil(t, r.Violation)
+	assert.False(t, r.Complete)
+	assert.False(t, r.Truncated)
+	assert.Equal(t, "agreement", r.Violation.Invariant)
+	require.NotEmpty(t, r.Violation.Trace)
+	for _, a := range r.Violation.Trace {
+		assert.NotNil(t, a.Msg, "unexpected timeout in trace %v", r.Violation)
+	}
+}
+
+func TestEquivalentStatesShareFingerprints(t *testing.T) {
+	c := newChecker(Config{Validators: 4, Rounds: 1, Values: 2})
+	// Validator 1 proposes round 0, the other three are interchangeable.
+	require.Len(t, c.perms, 6)
+	deliver := func(s *state, to, from int, typ algorithm.Step) *state {
+		for _, a := range c.enabled(s) {
+			if m := a.action.Msg; a.node == to && m != nil && m.Sender == c.validators[from] && m.MsgType == typ {
+				next := c.clone(s, to)
+				c.apply(next, a)
+				return next
+			}
+		}
+		require.FailNow(t, "message not enabled")
+		return nil
+	}
+	// The proposer has proposed and prevoted, delivering the proposal to
+	// validator 0 or validator 2 leads to equivalent states.
+	s := c.initialState()
+	a, b := deliver(s, 0, 1, algorithm.Propose), deliver(s, 2, 1, algorithm.Propose)
+	assert.Equal(t, c.fingerprint(a), c.fingerprint(b))
+	assert.NotEqual(t, c.fingerprint(s), c.fingerprint(a))
+
+	// Validator 0 has prevoted as well, to validator 2 its prevote and the
+	// proposer's are alike.
+	assert.Equal(t, c.fingerprint(deliver(a, 2, 0, algorithm.Prevote)), c.fingerprint(deliver(a, 2, 1, algorithm.Prevote)))
+}
@@ -0,0 +1,247 @@
+package modelcheck
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// bitset is a set of message indices.
+type bitset []uint64
+
+func (b bitset) has(i int) bool {
+	return i/64 < len(b) && b[i/64]&(1<<(i%64)) != 0
+}
+
+func (b *bitset) add(i int) {
+	for len(*b) <= i/64 {
+		*b = append(*b, 0)
+	}
+	(*b)[i/64] |= 1 << (i % 64)
+}
+
+// node is an honest validator.
+type node struct {
+	id    algorithm.NodeID
+	algo  *algorithm.Algorithm
+	store *algorithm.Store
+	// added holds, in order, the messages that have been added to the store.
+	added []int
+	// received holds the messages that have been delivered to the node.
+	received bitset
+	// sent holds the messages broadcast by this node.
+	sent     []int
+	timeouts []algorithm.Timeout
+	decision *algorithm.ConsensusMessage
+	// halted is set once the node has decided or has tried to move beyond
+	// the round bound.
+	halted bool
+	// fingerprints caches the node's fingerprint under each symmetry,
+	// identifies is set if they differ.
+	fingerprints []string
+	identifies   bool
+}
+
+func (c *checker) cloneNode(n *node) *node {
+	result := &node{
+		id:       n.id,
+		store:    algorithm.NewStore(),
+		added:    append([]int{}, n.added...),
+		received: append(bitset{}, n.received...),
+		sent:     append([]int{}, n.sent...),
+		timeouts: append([]algorithm.Timeout{}, n.timeouts...),
+		decision: n.decision,
+		halted:   n.halted,
+	}
+	for _, m := range n.added {
+		c.addToStore(result.store, m)
+	}
+	result.algo = n.algo.Clone(c.oracle(result.store))
+	return result
+}
+
+// addToStore adds message m to s, marking proposed values as valid where
+// appropriate. It returns the error from the store.
+func (c *checker) addToStore(s *algorithm.Store, m int) error {
+	msg := c.msgs[m]
+	if msg.MsgType == algorithm.Propose && c.valid(msg.Value) {
+		s.SetValid(&msg.Value)
+	}
+	var hash [32]byte
+	// The index uniquely identifies the message so it serves as its hash.
+	hash[0], hash[1], hash[2], hash[3] = byte(m>>24), byte(m>>16), byte(m>>8), byte(m)
+	return s.AddMessage(msg, nil, hash)
+}
+
+func (c *checker) deliver(n *node, m int) {
+	n.received.add(m)
+	msg := c.msgs[m]
+	if msg.MsgType == algorithm.Propose && msg.Sender != c.proposer(msg.Round) {
+		return
+	}
+	n.added = append(n.added, m)
+	if err := c.addToStore(n.store, m); err != nil && !errors.Is(err, algorithm.ErrConflictingProposal) {
+		return
+	}
+	c.process(n, msg)
+}
+
+func (c *checker) process(n *node, m *algorithm.ConsensusMessage) {
+	rc, cm, to := n.algo.ReceiveMessage(m)
+	c.handle(n, rc, cm, to)
+}
+
+func (c *checker) handle(n *node, rc *algorithm.RoundChange, cm *algorithm.ConsensusMessage, to *algorithm.Timeout) {
+	if to != nil {
+		n.timeouts = append(n.timeouts, *to)
+	}
+	if cm != nil {
+		m := c.intern(cm)
+		n.sent = append(n.sent, m)
+		// Nodes receive their own messages immediately.
+		c.deliver(n, m)
+	}
+	if rc != nil && !n.halted {
+		if rc.Decision != nil {
+			n.decision = rc.Decision
+			n.halted = true
+			n.timeouts = nil
+			return
+		}
+		c.startRound(n, rc.Round)
+	}
+	n.pruneTimeouts()
+}
+
+// pruneTimeouts removes timeouts that would have no effect if they fired,
+// firing them is a no-op so removing them shrinks the state space without
+// losing behaviours.
+func (n *node) pruneTimeouts() {
+	if n.halted {
+		n.timeouts = nil
+		return
+	}
+	st := n.algo.State()
+	live := n.timeouts[:0]
+	for _, t := range n.timeouts {
+		if t.Round() != st.Round {
+			continue
+		}
+		if t.Type() != algorithm.Precommit && t.Type() != st.Step {
+			continue
+		}
+		live = append(live, t)
+	}
+	n.timeouts = live
+}
+
+func (c *checker) startRound(n *node, round int) {
+	if round >= c.cfg.Rounds {
+		n.halted = true
+		n.timeouts = nil
+		return
+	}
+	value := algorithm.NilValue
+	if c.proposer(round) == n.id {
+		value = c.values[round%len(c.values)]
+	}
+	cm, to := n.algo.StartRound(value, round)
+	c.handle(n, nil, cm, to)
+
+	// As a real node would, replay the messages we already hold for the new
+	// round since the Algorithm only evaluates upon conditions on receipt of
+	// a message.
+	for _, m := range n.store.RoundMessages(round) {
+		if n.halted || n.algo.State().Round != round {
+			return
+		}
+		c.process(n, m)
+	}
+}
+
+func flags(fs ...bool) byte {
+	var result byte
+	for i, f := range fs {
+		if f {
+			result |= 1 << i
+		}
+	}
+	return result
+}
+
+// checkInvariants returns the name of the first violated invariant and a
+// description of the violation, or empty strings if all invariants hold.
+func (c *checker) checkInvariants(s *state) (string, string) {
+	quorum := len(c.validators)*2/3 + 1
+	var decided *algorithm.ConsensusMessage
+	var decidedBy algorithm.NodeID
+	for _, n := range s.nodes {
+		st := n.algo.State()
+
+		// Lock and valid rounds never run ahead of the current round and a
+		// lock always implies a valid value at least as recent.
+		if st.LockedRound > st.Round || st.ValidRound > st.Round {
+			return "round-order", fmt.Sprintf("%v has round %d locked round %d valid round %d", n.id, st.Round, st.LockedRound, st.ValidRound)
+		}
+		if st.LockedRound > st.ValidRound {
+			return "lock-valid", fmt.Sprintf("%v has locked round %d greater than valid round %d", n.id, st.LockedRound, st.ValidRound)
+		}
+
+		// A lock on v in round r means we precommitted v in round r.
+		if st.LockedRound >= 0 {
+			precommit := algorithm.ConsensusMessage{Sender: n.id, MsgType: algorithm.Precommit, Height: Height, Round: st.LockedRound, Value: st.LockedValue}
+			if !n.sentMsg(c, precommit) {
+				return "lock-precommit", fmt.Sprintf("%v locked on %v in round %d without precommitting it", n.id, st.LockedValue, st.LockedRound)
+			}
+		}
+
+		// Honest nodes never sign two different messages for the same round
+		// and step.
+		signed := make(map[[2]int]*algorithm.ConsensusMessage)
+		for _, m := range n.sent {
+			msg := c.msgs[m]
+			k := [2]int{msg.Round, int(msg.MsgType)}
+			if prev, ok := signed[k]; ok && *prev != *msg {
+				return "no-double-sign", fmt.Sprintf("%v sent %v and %v", n.id, prev, msg)
+			}
+			signed[k] = msg
+		}
+
+		if n.decision == nil {
+			continue
+		}
+		d := n.decision
+		// Validity, decided values are valid and were proposed by the
+		// proposer of the decision round.
+		if !c.valid(d.Value) {
+			return "validity", fmt.Sprintf("%v decided invalid value %v", n.id, d.Value)
+		}
+		if d.MsgType != algorithm.Propose || d.Sender != c.proposer(d.Round) {
+			return "validity", fmt.Sprintf("%v decided %v which is not a proposal from the proposer", n.id, d)
+		}
+		// Decisions are backed by a quorum of precommits.
+		if count := n.store.CountPrecommits(d.Round, &d.Value); count < quorum {
+			return "decision-quorum", fmt.Sprintf("%v decided %v with only %d precommits", n.id, d.Value, count)
+		}
+		// Agreement.
+		if decided != nil && decided.Value != d.Value {
+			return "agreement", fmt.Sprintf("%v decided %v but %v decided %v", decidedBy, decided.Value, n.id, d.Value)
+		}
+		decided, decidedBy = d, n.id
+	}
+	return "", ""
+}
+
+func (n *node) sentMsg(c *checker, m algorithm.ConsensusMessage) bool {
+	i, ok := c.index[m]
+	if !ok {
+		return false
+	}
+	for _, s := range n.sent {
+		if s == i {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,440 @@
+package modelcheck
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// The state space is reduced in the following ways, none of which lose
+// reachable violations.
+//
+// Honest votes are counted rather than identified once a node has reached
+// their round. The Algorithm only consults the senders of a round's messages
+// through FThresh, for rounds beyond its own, and it only replays a round's
+// messages when starting that round. So two nodes that agree on everything
+// else and hold the same number of votes of each kind for their current and
+// earlier rounds behave identically whichever honest validators sent those
+// votes, and the order in which such votes are delivered within a step is
+// irrelevant. Of the deliveries that differ only by the sender of such a vote
+// one is explored.
+//
+// A node that has precommitted in the last round can only go on to decide,
+// which depends on the proposals and precommits it holds, to update its valid
+// value, which cannot violate an invariant, or to halt. So the rest of its
+// state, and the prevotes it is yet to receive, are left out of its
+// fingerprint, as is all but the sent messages and decision of a halted node.
+// To make up for this every state reached is checked, not only those with a
+// new fingerprint.
+//
+// Honest validators that propose in none of the explored rounds are
+// interchangeable, states that differ only by a permutation of them are
+// explored once.
+//
+// Deliveries and timeouts at different nodes commute, and a node that can no
+// longer send messages cannot affect any other node. So while some node that
+// can still send has an enabled action, only the actions of such nodes are
+// explored from a state; the actions of the others remain enabled and are
+// explored later in every execution. Once no node can send the nodes no
+// longer interact, the executions of each are explored on their own and the
+// values they may decide are combined.
+
+// symmetries records the honest validators that propose in none of the
+// explored rounds and returns the permutations of validator indices under
+// which the state space is symmetric, the identity comes first.
+func (c *checker) symmetries() [][]int {
+	proposers := make(map[algorithm.NodeID]bool)
+	for r := 0; r < c.cfg.Rounds; r++ {
+		proposers[c.proposer(r)] = true
+	}
+	var free []int
+	c.free = make([]bool, len(c.validators))
+	for i, id := range c.validators {
+		if !c.byzantine[id] && !proposers[id] {
+			free = append(free, i)
+			c.free[i] = true
+		}
+	}
+	identity := make([]int, len(c.validators))
+	for i := range identity {
+		identity[i] = i
+	}
+	var result [][]int
+	var permute func(k int)
+	permute = func(k int) {
+		if k == len(free) {
+			p := append([]int{}, identity...)
+			result = append(result, p)
+			return
+		}
+		for i := k; i < len(free); i++ {
+			identity[free[k]], identity[free[i]] = identity[free[i]], identity[free[k]]
+			permute(k + 1)
+			identity[free[k]], identity[free[i]] = identity[free[i]], identity[free[k]]
+		}
+	}
+	permute(0)
+	return result
+}
+
+// fingerprint returns the canonical representation of s. Usually the nodes'
+// fingerprints do not identify any interchangeable validator, then those of
+// the interchangeable nodes are sorted. Otherwise it is the least of the
+// representations of s under each symmetry.
+func (c *checker) fingerprint(s *state) string {
+	identified := false
+	for _, n := range s.nodes {
+		c.nodeFingerprint(n, 0)
+		identified = identified || n.identifies
+	}
+	if !identified {
+		b := strings.Builder{}
+		b.WriteByte('s')
+		var free []string
+		for _, n := range s.nodes {
+			if c.free[c.vindex[n.id]] {
+				free = append(free, c.nodeFingerprint(n, 0))
+				continue
+			}
+			b.WriteString(c.nodeFingerprint(n, 0))
+		}
+		sort.Strings(free)
+		for _, f := range free {
+			b.WriteString(f)
+		}
+		return b.String()
+	}
+
+	var result string
+	ordered := make([]*node, len(c.validators))
+	for i, perm := range c.perms {
+		for j := range ordered {
+			ordered[j] = nil
+		}
+		for _, n := range s.nodes {
+			ordered[perm[c.vindex[n.id]]] = n
+		}
+		b := strings.Builder{}
+		b.WriteByte('p')
+		for _, n := range ordered {
+			if n != nil {
+				b.WriteString(c.nodeFingerprint(n, i))
+			}
+		}
+		if i == 0 || b.String() < result {
+			result = b.String()
+		}
+	}
+	return result
+}
+
+// nodeFingerprint returns the fingerprint of n under symmetry i, nodes are
+// not modified once they are part of an explored state so it is computed
+// once.
+func (c *checker) nodeFingerprint(n *node, i int) string {
+	if n.fingerprints == nil {
+		n.fingerprints = make([]string, len(c.perms))
+		var b []byte
+		b, n.identifies = c.appendFingerprint(nil, n, c.perms[0])
+		n.fingerprints[0] = string(b)
+	}
+	if !n.identifies {
+		return n.fingerprints[0]
+	}
+	if n.fingerprints[i] == "" {
+		b, _ := c.appendFingerprint(nil, n, c.perms[i])
+		n.fingerprints[i] = string(b)
+	}
+	return n.fingerprints[i]
+}
+
+// appendFingerprint appends the fingerprint of n under perm to b, it also
+// returns whether the fingerprint identifies any interchangeable validator.
+// The node's own messages are not identified, its position in the state
+// identifies them.
+func (c *checker) appendFingerprint(b []byte, n *node, perm []int) ([]byte, bool) {
+	identifies := false
+	anonymous := func(m *algorithm.ConsensusMessage) int {
+		anyone := *m
+		anyone.Sender = algorithm.NodeID{}
+		return c.msgKey(&anyone, perm)
+	}
+	b = append(b, flags(n.halted))
+	if n.decision != nil {
+		b = appendInt(b, c.msgKey(n.decision, perm))
+	}
+	// The set of sent messages is part of the state, the order in which
+	// they were sent is not.
+	sent := make([]int, 0, len(n.sent))
+	for _, m := range n.sent {
+		sent = append(sent, anonymous(c.msgs[m]))
+	}
+	b = appendInts(b, sent)
+	if n.halted {
+		return b, false
+	}
+
+	st := n.algo.State()
+	finished := c.finished(n)
+	b = appendInt(b, st.Round)
+	b = append(b, byte(st.Step))
+	b = append(b, flags(st.Line47Executed))
+	if !finished {
+		b = appendInt(b, st.LockedRound)
+		b = appendInt(b, c.valueIndex(st.LockedValue))
+		b = appendInt(b, st.ValidRound)
+		b = appendInt(b, c.valueIndex(st.ValidValue))
+		b = append(b, flags(st.Line34Executed, st.Line36Executed))
+	}
+	timeouts := make([]int, 0, len(n.timeouts))
+	for _, t := range n.timeouts {
+		timeouts = append(timeouts, t.Round()*4+int(t.Type()))
+	}
+	b = appendInts(b, timeouts)
+
+	for r := 0; r < c.cfg.Rounds; r++ {
+		// Proposals are kept in the order the store holds them since it
+		// decides which is the proposal and which are conflicting.
+		var votes []int
+		for _, m := range n.store.RoundMessages(r) {
+			switch {
+			case m.MsgType == algorithm.Propose:
+				b = appendInt(b, c.msgKey(m, perm))
+			case m.Sender == n.id || finished && m.MsgType != algorithm.Precommit:
+			case !c.byzantine[m.Sender] && r <= st.Round:
+				votes = append(votes, anonymous(m))
+			default:
+				identifies = identifies || c.free[c.vindex[m.Sender]]
+				votes = append(votes, c.msgKey(m, perm))
+			}
+		}
+		b = appendInts(b, votes)
+	}
+	// Byzantine messages that were received but not stored, because they
+	// conflict with ones that were, can no longer be delivered.
+	var byzantine []int
+	for _, m := range c.byzMsgs {
+		if n.received.has(m) && !(finished && c.msgs[m].MsgType == algorithm.Prevote) {
+			byzantine = append(byzantine, m)
+		}
+	}
+	return appendInts(b, byzantine), identifies
+}
+
+// msgKey encodes m with its sender permuted by perm, the zero NodeID encodes
+// as an unidentified sender.
+func (c *checker) msgKey(m *algorithm.ConsensusMessage, perm []int) int {
+	sender := len(c.validators)
+	if i, ok := c.vindex[m.Sender]; ok {
+		sender = perm[i]
+	}
+	k := sender
+	k = k*3 + int(m.MsgType)
+	k = k*c.cfg.Rounds + m.Round
+	k = k*(len(c.values)+2) + c.valueIndex(m.Value) + 1
+	return k*(c.cfg.Rounds+1) + m.ValidRound + 1
+}
+
+// valueIndex returns the index of v in the valid values, len(values) for an
+// invalid value and -1 for nil.
+func (c *checker) valueIndex(v tendermint.Hash) int {
+	if v == algorithm.NilValue {
+		return -1
+	}
+	for i, value := range c.values {
+		if v == value {
+			return i
+		}
+	}
+	return len(c.values)
+}
+
+// appendInts appends the sorted ints to b.
+func appendInts(b []byte, ints []int) []byte {
+	sort.Ints(ints)
+	b = appendInt(b, len(ints))
+	for _, i := range ints {
+		b = appendInt(b, i)
+	}
+	return b
+}
+
+// finished returns true if n can no longer send messages, that is once it
+// has halted or has precommitted in the last round.
+func (c *checker) finished(n *node) bool {
+	if n.halted {
+		return true
+	}
+	for _, m := range n.sent {
+		msg := c.msgs[m]
+		if msg.MsgType == algorithm.Precommit && msg.Round == c.cfg.Rounds-1 {
+			return true
+		}
+	}
+	return false
+}
+
+// reduce returns the enabled actions that must be explored from s. Of the
+// deliveries of votes that lead to the same fingerprint only one is kept and
+// deliveries of prevotes to finished nodes are dropped. Then, if any of the
+// nodes that can still send messages has an action, only their actions are
+// returned, otherwise settle is true and the actions are those to settle.
+func (c *checker) reduce(s *state, enabled []enabledAction) (result []enabledAction, settle bool) {
+	var distinct []enabledAction
+	seen := make(map[[2]int]bool)
+	for _, a := range enabled {
+		if a.msg >= 0 {
+			n := s.nodes[a.node]
+			m := c.msgs[a.msg]
+			if c.finished(n) && m.MsgType == algorithm.Prevote {
+				continue
+			}
+			k := [2]int{a.node, -1 - a.msg}
+			if !c.byzantine[m.Sender] && m.Round <= n.algo.State().Round {
+				anyone := *m
+				anyone.Sender = algorithm.NodeID{}
+				k[1] = c.msgKey(&anyone, c.perms[0])
+			}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+		}
+		distinct = append(distinct, a)
+	}
+	for _, a := range distinct {
+		if !c.finished(s.nodes[a.node]) {
+			result = append(result, a)
+		}
+	}
+	if len(result) > 0 {
+		return result, false
+	}
+	return distinct, true
+}
+
+// settle explores the executions from s, a state in which no node will send
+// another message. Nodes no longer interact so the executions of each node
+// are explored on their own, and the values that nodes may decide are then
+// checked for agreement.
+func (c *checker) settle(s *state, enabled []enabledAction) {
+	acting := make(map[int]bool)
+	for _, a := range enabled {
+		acting[a.node] = true
+	}
+	values := make([][]tendermint.Hash, len(s.nodes))
+	for i, n := range s.nodes {
+		if !acting[i] {
+			if n.decision != nil {
+				values[i] = []tendermint.Hash{n.decision.Value}
+			}
+			continue
+		}
+		key := c.nodeFingerprint(n, 0) + string(c.appendOthersSent(nil, s, i))
+		if v, ok := c.settled[key]; ok {
+			values[i] = v
+			continue
+		}
+		decisions := make(map[tendermint.Hash][]enabledAction)
+		c.settleNode(s, i, make(map[string]struct{}), nil, decisions)
+		if c.result.Violation != nil || c.result.Truncated {
+			return
+		}
+		for v := range decisions {
+			values[i] = append(values[i], v)
+		}
+		c.settled[key] = values[i]
+	}
+
+	for i := range values {
+		for j := i + 1; j < len(values); j++ {
+			for _, vi := range values[i] {
+				for _, vj := range values[j] {
+					if vi != vj {
+						c.disagree(s, i, vi, j, vj)
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// appendOthersSent appends the messages sent by nodes other than i, without
+// their senders, which together with the fingerprint of node i determines
+// its executions once no node will send another message.
+func (c *checker) appendOthersSent(b []byte, s *state, i int) []byte {
+	var sent []int
+	for j, n := range s.nodes {
+		if j == i {
+			continue
+		}
+		for _, m := range n.sent {
+			anyone := *c.msgs[m]
+			anyone.Sender = algorithm.NodeID{}
+			sent = append(sent, c.msgKey(&anyone, c.perms[0]))
+		}
+	}
+	return appendInts(b, sent)
+}
+
+// settleNode explores the executions from s in which only node i acts,
+// recording in decisions the values it may decide along with the actions
+// that lead to them.
+func (c *checker) settleNode(s *state, i int, visited map[string]struct{}, trace []enabledAction, decisions map[tendermint.Hash][]enabledAction) {
+	if c.violated(s, trace) {
+		return
+	}
+	key := c.nodeFingerprint(s.nodes[i], 0)
+	if _, ok := visited[key]; ok {
+		return
+	}
+	if !c.count() {
+		return
+	}
+	visited[key] = struct{}{}
+	n := s.nodes[i]
+	if n.decision != nil {
+		if _, ok := decisions[n.decision.Value]; !ok {
+			decisions[n.decision.Value] = append([]enabledAction{}, trace...)
+		}
+	}
+	actions, _ := c.reduce(s, c.enabled(s))
+	for _, a := range actions {
+		if a.node != i {
+			continue
+		}
+		next := c.clone(s, i)
+		c.apply(next, a)
+		c.result.Transitions++
+		c.settleNode(next, i, visited, append(trace, a), decisions)
+		if c.result.Violation != nil || c.result.Truncated {
+			return
+		}
+	}
+}
+
+// disagree reports the violation of agreement in which, from s, node i
+// decides vi and node j decides vj.
+func (c *checker) disagree(s *state, i int, vi tendermint.Hash, j int, vj tendermint.Hash) {
+	var trace []enabledAction
+	for _, d := range []struct {
+		node  int
+		value tendermint.Hash
+	}{{i, vi}, {j, vj}} {
+		if s.nodes[d.node].decision != nil {
+			continue
+		}
+		decisions := make(map[tendermint.Hash][]enabledAction)
+		c.settleNode(s, d.node, make(map[string]struct{}), nil, decisions)
+		trace = append(trace, decisions[d.value]...)
+	}
+	for _, a := range trace {
+		next := c.clone(s, a.node)
+		c.apply(next, a)
+		s = next
+	}
+	c.violated(s, trace)
+}
@@ -0,0 +1,188 @@
+package p2p
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// MemNetwork connects MemTransports within a single process, it is intended
+// for tests. Transports are connected to every other transport on creation,
+// links can then be cut and restored with Disconnect and Connect.
+type MemNetwork struct {
+	mu         sync.Mutex
+	transports map[algorithm.NodeID]*MemTransport
+}
+
+// NewMemNetwork creates an empty network.
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{transports: make(map[algorithm.NodeID]*MemTransport)}
+}
+
+// Transport creates a transport for id and connects it to every other open
+// transport on the network. It panics if id already has an open transport.
+func (n *MemNetwork) Transport(id algorithm.NodeID) *MemTransport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.transports[id]; ok {
+		panic("transport already exists for " + id.String())
+	}
+	t := &MemTransport{
+		id:     id,
+		net:    n,
+		peers:  make(map[algorithm.NodeID]*MemTransport),
+		inbox:  newQueue[Envelope](0),
+		events: newQueue[PeerEvent](0),
+	}
+	for _, other := range n.transports {
+		link(t, other)
+	}
+	n.transports[id] = t
+	return t
+}
+
+// Connect restores the link between a and b, it has no effect if they are
+// already connected or either transport is closed.
+func (n *MemNetwork) Connect(a, b algorithm.NodeID) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ta, tb := n.transports[a], n.transports[b]
+	if ta == nil || tb == nil || a == b {
+		return
+	}
+	link(ta, tb)
+}
+
+// Disconnect cuts the link between a and b.
+func (n *MemNetwork) Disconnect(a, b algorithm.NodeID) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ta, tb := n.transports[a], n.transports[b]
+	if ta == nil || tb == nil {
+		return
+	}
+	unlink(ta, tb)
+}
+
+func link(a, b *MemTransport) {
+	if a.setPeer(b.id, b) {
+		a.events.push(PeerEvent{Peer: b.id, Type: PeerUp})
+	}
+	if b.setPeer(a.id, a) {
+		b.events.push(PeerEvent{Peer: a.id, Type: PeerUp})
+	}
+}
+
+func unlink(a, b *MemTransport) {
+	if a.setPeer(b.id, nil) {
+		a.events.push(PeerEvent{Peer: b.id, Type: PeerDown})
+	}
+	if b.setPeer(a.id, nil) {
+		b.events.push(PeerEvent{Peer: a.id, Type: PeerDown})
+	}
+}
+
+// MemTransport is a Transport connected to other transports on the same
+// MemNetwork.
+type MemTransport struct {
+	id  algorithm.NodeID
+	net *MemNetwork
+
+	mu     sync.Mutex
+	peers  map[algorithm.NodeID]*MemTransport
+	inbox  *queue[Envelope]
+	events *queue[PeerEvent]
+}
+
+// setPeer sets or, if peer is nil, removes the link to id. It returns true if
+// the set of peers changed.
+func (t *MemTransport) setPeer(id algorithm.NodeID, peer *MemTransport) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.peers[id]
+	if peer == nil {
+		delete(t.peers, id)
+		return ok
+	}
+	t.peers[id] = peer
+	return !ok
+}
+
+func (t *MemTransport) peer(id algorithm.NodeID) *MemTransport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.peers[id]
+}
+
+// ID implements Transport.
+func (t *MemTransport) ID() algorithm.NodeID {
+	return t.id
+}
+
+// Broadcast implements Transport.
+func (t *MemTransport) Broadcast(ch ChannelID, payload []byte) {
+	for _, p := range t.Peers() {
+		_ = t.Send(p, ch, payload)
+	}
+}
+
+// Send implements Transport.
+func (t *MemTransport) Send(peer algorithm.NodeID, ch ChannelID, payload []byte) error {
+	p := t.peer(peer)
+	if p == nil {
+		return ErrUnknownPeer
+	}
+	if !p.inbox.push(Envelope{From: t.id, Channel: ch, Payload: payload}) {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Receive implements Transport.
+func (t *MemTransport) Receive() <-chan Envelope {
+	return t.inbox.out
+}
+
+// PeerEvents implements Transport.
+func (t *MemTransport) PeerEvents() <-chan PeerEvent {
+	return t.events.out
+}
+
+// Peers implements Transport, peers are returned in ascending order.
+func (t *MemTransport) Peers() []algorithm.NodeID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := make([]algorithm.NodeID, 0, len(t.peers))
+	for id := range t.peers {
+		result = append(result, id)
+	}
+	sortIDs(result)
+	return result
+}
+
+// Close implements Transport, it removes the transport from the network so a
+// new transport can be created with the same id.
+func (t *MemTransport) Close() error {
+	n := t.net
+	n.mu.Lock()
+	if n.transports[t.id] != t {
+		n.mu.Unlock()
+		return ErrClosed
+	}
+	delete(n.transports, t.id)
+	for _, p := range n.transports {
+		unlink(t, p)
+	}
+	n.mu.Unlock()
+	t.inbox.close()
+	t.events.close()
+	return nil
+}
+
+func sortIDs(ids []algorithm.NodeID) {
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+}
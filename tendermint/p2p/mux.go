@@ -0,0 +1,131 @@
+package p2p
+
+import (
+	"sync"
+)
+
+// MuxConfig configures a Mux, zero values are replaced by defaults.
+type MuxConfig struct {
+	// ReceiveQueueSize bounds the number of payloads queued for each
+	// protocol, payloads for a protocol whose queue is full are dropped so
+	// that a protocol that is slow, or not yet receiving, doesn't hold up
+	// the others.
+	ReceiveQueueSize int
+}
+
+func (c *MuxConfig) setDefaults() {
+	if c.ReceiveQueueSize == 0 {
+		c.ReceiveQueueSize = DefaultReceiveQueueSize
+	}
+}
+
+// Mux shares a Transport between protocols. Each protocol gets its own
+// Transport from Channels that receives only the payloads of its channels
+// and every peer event, payloads on channels that no protocol registered are
+// dropped. Register all protocols before calling Start so that none misses
+// the first payloads or peer events.
+type Mux struct {
+	t   Transport
+	cfg MuxConfig
+
+	mu      sync.Mutex
+	routes  map[ChannelID]*muxTransport
+	members []*muxTransport
+}
+
+// NewMux creates a Mux over t.
+func NewMux(t Transport, cfg MuxConfig) *Mux {
+	cfg.setDefaults()
+	return &Mux{t: t, cfg: cfg, routes: make(map[ChannelID]*muxTransport)}
+}
+
+// Channels returns a Transport that receives the payloads of the given
+// channels. It panics if a channel is already registered.
+func (m *Mux) Channels(chs ...ChannelID) Transport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mt := &muxTransport{
+		Transport: m.t,
+		inbox:     newQueue[Envelope](m.cfg.ReceiveQueueSize),
+		events:    newQueue[PeerEvent](0),
+	}
+	for _, ch := range chs {
+		if _, ok := m.routes[ch]; ok {
+			panic("channel registered twice")
+		}
+		m.routes[ch] = mt
+	}
+	m.members = append(m.members, mt)
+	return mt
+}
+
+// Start starts delivering the payloads and peer events of the underlying
+// transport, the Transports returned by Channels are closed once it is
+// closed.
+func (m *Mux) Start() {
+	m.mu.Lock()
+	members := append([]*muxTransport{}, m.members...)
+	m.mu.Unlock()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for e := range m.t.Receive() {
+			m.mu.Lock()
+			mt := m.routes[e.Channel]
+			m.mu.Unlock()
+			if mt != nil {
+				mt.inbox.push(e)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for e := range m.t.PeerEvents() {
+			for _, mt := range members {
+				mt.events.push(e)
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		for _, mt := range members {
+			mt.close()
+		}
+	}()
+}
+
+// Close closes the underlying transport.
+func (m *Mux) Close() error {
+	return m.t.Close()
+}
+
+// muxTransport is a Transport returned by Mux.Channels, it sends through the
+// underlying transport.
+type muxTransport struct {
+	Transport
+	inbox  *queue[Envelope]
+	events *queue[PeerEvent]
+}
+
+// Receive implements Transport.
+func (t *muxTransport) Receive() <-chan Envelope {
+	return t.inbox.out
+}
+
+// PeerEvents implements Transport.
+func (t *muxTransport) PeerEvents() <-chan PeerEvent {
+	return t.events.out
+}
+
+// Close implements Transport, it only stops delivery to this Transport, the
+// underlying transport remains open.
+func (t *muxTransport) Close() error {
+	t.close()
+	return nil
+}
+
+func (t *muxTransport) close() {
+	t.inbox.close()
+	t.events.close()
+}
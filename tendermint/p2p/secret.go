@@ -0,0 +1,256 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxChunkSize is the largest plaintext sealed in a single frame, writes
+	// larger than this are split across frames.
+	maxChunkSize = 16 << 10
+	// keyInfo is the HKDF info prefix, it separates the keys derived here
+	// from keys derived by any other protocol from the same secret.
+	keyInfo = "tendermint-go/secret-connection/v1"
+)
+
+var errNonceExhausted = errors.New("nonce exhausted")
+
+// SecretConn is an authenticated and encrypted connection, established with
+// a Station-to-Station handshake similar to Tendermint's SecretConnection.
+//
+//  1. Each side sends a fresh X25519 public key and computes the shared
+//     secret.
+//  2. Two AES-256-GCM keys, one per direction, and a challenge are derived
+//     from the secret with HKDF-SHA256, the ephemeral keys are included in
+//     the HKDF info in a canonical order so both sides derive the same
+//     values.
+//  3. Over the encrypted connection each side sends its long term ed25519
+//     public key and its signature of the challenge.
+//
+// The signatures bind the connection to the long term keys, and since the
+// challenge depends on both ephemeral keys a signature cannot be replayed on
+// another connection. Data is sent in frames holding a 4 byte big endian
+// length followed by the sealed chunk, the length is authenticated as
+// additional data. Nonces are per direction counters, so frames cannot be
+// reordered, replayed or dropped without the receiver noticing.
+type SecretConn struct {
+	conn      net.Conn
+	remoteKey ed25519.PublicKey
+
+	sendMu    sync.Mutex
+	sendAEAD  cipher.AEAD
+	sendNonce uint64
+
+	recvMu    sync.Mutex
+	recvAEAD  cipher.AEAD
+	recvNonce uint64
+	recvBuf   []byte
+}
+
+// NewSecretConn performs the handshake over conn using key as the local long
+// term key. The caller should set a deadline on conn to bound the handshake.
+func NewSecretConn(conn net.Conn, key ed25519.PrivateKey) (*SecretConn, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	local := ephemeral.PublicKey().Bytes()
+	remote := make([]byte, len(local))
+	if err := exchange(conn, local, remote); err != nil {
+		return nil, fmt.Errorf("failed to exchange ephemeral keys: %w", err)
+	}
+	if bytes.Equal(local, remote) {
+		return nil, fmt.Errorf("remote reflected our ephemeral key")
+	}
+	remotePub, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return nil, err
+	}
+	// ECDH fails on low order points, which would otherwise let the remote
+	// force a known secret.
+	secret, err := ephemeral.ECDH(remotePub)
+	if err != nil {
+		return nil, err
+	}
+
+	lo, hi := local, remote
+	if bytes.Compare(lo, hi) > 0 {
+		lo, hi = hi, lo
+	}
+	info := append(append([]byte(keyInfo), lo...), hi...)
+	okm := hkdf(secret, nil, info, 96)
+	sendKey, recvKey, challenge := okm[:32], okm[32:64], okm[64:]
+	if !bytes.Equal(local, lo) {
+		sendKey, recvKey = recvKey, sendKey
+	}
+	sc := &SecretConn{conn: conn}
+	if sc.sendAEAD, err = newAEAD(sendKey); err != nil {
+		return nil, err
+	}
+	if sc.recvAEAD, err = newAEAD(recvKey); err != nil {
+		return nil, err
+	}
+
+	auth := append(append([]byte{}, key.Public().(ed25519.PublicKey)...), ed25519.Sign(key, challenge)...)
+	remoteAuth := make([]byte, len(auth))
+	if err := exchange(sc, auth, remoteAuth); err != nil {
+		return nil, fmt.Errorf("failed to exchange signatures: %w", err)
+	}
+	remoteKey := ed25519.PublicKey(remoteAuth[:ed25519.PublicKeySize])
+	if !ed25519.Verify(remoteKey, challenge, remoteAuth[ed25519.PublicKeySize:]) {
+		return nil, fmt.Errorf("remote signature of challenge is invalid")
+	}
+	sc.remoteKey = remoteKey
+	return sc, nil
+}
+
+// exchange writes out to rw while reading len(in) bytes into in, both sides
+// of a handshake write before reading so writes must not wait for reads.
+func exchange(rw io.ReadWriter, out, in []byte) error {
+	errs := make(chan error, 1)
+	go func() {
+		_, err := rw.Write(out)
+		errs <- err
+	}()
+	if _, err := io.ReadFull(rw, in); err != nil {
+		return err
+	}
+	return <-errs
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// RemoteKey returns the authenticated long term key of the remote.
+func (sc *SecretConn) RemoteKey() ed25519.PublicKey {
+	return sc.remoteKey
+}
+
+// Write implements net.Conn.
+func (sc *SecretConn) Write(b []byte) (int, error) {
+	sc.sendMu.Lock()
+	defer sc.sendMu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxChunkSize {
+			chunk = chunk[:maxChunkSize]
+		}
+		nonce, err := nextNonce(&sc.sendNonce, sc.sendAEAD.NonceSize())
+		if err != nil {
+			return written, err
+		}
+		frame := make([]byte, 4, 4+len(chunk)+sc.sendAEAD.Overhead())
+		binary.BigEndian.PutUint32(frame, uint32(len(chunk)+sc.sendAEAD.Overhead()))
+		frame = sc.sendAEAD.Seal(frame, nonce, chunk, frame[:4])
+		if _, err := sc.conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// Read implements net.Conn.
+func (sc *SecretConn) Read(b []byte) (int, error) {
+	sc.recvMu.Lock()
+	defer sc.recvMu.Unlock()
+	for len(sc.recvBuf) == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(sc.conn, header[:]); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size < uint32(sc.recvAEAD.Overhead()) || size > uint32(maxChunkSize+sc.recvAEAD.Overhead()) {
+			return 0, fmt.Errorf("invalid sealed frame size %d", size)
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(sc.conn, sealed); err != nil {
+			return 0, err
+		}
+		nonce, err := nextNonce(&sc.recvNonce, sc.recvAEAD.NonceSize())
+		if err != nil {
+			return 0, err
+		}
+		plain, err := sc.recvAEAD.Open(sealed[:0], nonce, sealed, header[:])
+		if err != nil {
+			return 0, fmt.Errorf("failed to open sealed frame: %w", err)
+		}
+		sc.recvBuf = plain
+	}
+	n := copy(b, sc.recvBuf)
+	sc.recvBuf = sc.recvBuf[n:]
+	return n, nil
+}
+
+// nextNonce returns the nonce for counter and increments it.
+func nextNonce(counter *uint64, size int) ([]byte, error) {
+	if *counter == math.MaxUint64 {
+		return nil, errNonceExhausted
+	}
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-8:], *counter)
+	*counter++
+	return nonce, nil
+}
+
+// Close implements net.Conn.
+func (sc *SecretConn) Close() error { return sc.conn.Close() }
+
+// LocalAddr implements net.Conn.
+func (sc *SecretConn) LocalAddr() net.Addr { return sc.conn.LocalAddr() }
+
+// RemoteAddr implements net.Conn.
+func (sc *SecretConn) RemoteAddr() net.Addr { return sc.conn.RemoteAddr() }
+
+// SetDeadline implements net.Conn.
+func (sc *SecretConn) SetDeadline(t time.Time) error { return sc.conn.SetDeadline(t) }
+
+// SetReadDeadline implements net.Conn.
+func (sc *SecretConn) SetReadDeadline(t time.Time) error { return sc.conn.SetReadDeadline(t) }
+
+// SetWriteDeadline implements net.Conn.
+func (sc *SecretConn) SetWriteDeadline(t time.Time) error { return sc.conn.SetWriteDeadline(t) }
+
+// hkdf implements HKDF (RFC 5869) with SHA-256, a nil salt is treated as a
+// string of zeros.
+func hkdf(secret, salt, info []byte, length int) []byte {
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, t []byte
+	for i := byte(1); len(out) < length; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(t)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		t = expand.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
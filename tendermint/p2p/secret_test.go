@@ -0,0 +1,141 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// secretPair establishes a SecretConn over each end of a, b.
+func secretPair(t *testing.T, a, b net.Conn) (*SecretConn, *SecretConn) {
+	type result struct {
+		sc  *SecretConn
+		err error
+	}
+	results := make(chan result)
+	go func() {
+		sc, err := NewSecretConn(b, testKey(1))
+		results <- result{sc, err}
+	}()
+	sa, err := NewSecretConn(a, testKey(0))
+	require.NoError(t, err)
+	r := <-results
+	require.NoError(t, r.err)
+	return sa, r.sc
+}
+
+func TestSecretConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	sa, sb := secretPair(t, a, b)
+	assert.Equal(t, testKey(1).Public(), sa.RemoteKey())
+	assert.Equal(t, testKey(0).Public(), sb.RemoteKey())
+
+	// Writes larger than a chunk are split and reassembled.
+	msg := bytes.Repeat([]byte("consensus"), maxChunkSize/4)
+	go func() {
+		_, err := sa.Write(msg)
+		assert.NoError(t, err)
+	}()
+	got := make([]byte, len(msg))
+	_, err := io.ReadFull(sb, got)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+
+	go func() {
+		_, err := sb.Write([]byte("reply"))
+		assert.NoError(t, err)
+	}()
+	got = make([]byte, 5)
+	_, err = io.ReadFull(sa, got)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("reply"), got)
+}
+
+// tap relays bytes between two connections, passing each chunk written by
+// one side through f before it reaches the other.
+func tap(from, to net.Conn, f func([]byte) []byte) {
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := from.Read(buf)
+			if err != nil {
+				to.Close()
+				return
+			}
+			if _, err := to.Write(f(append([]byte{}, buf[:n]...))); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestSecretConnHidesAndProtectsData(t *testing.T) {
+	a, a2 := net.Pipe()
+	b2, b := net.Pipe()
+	var wire bytes.Buffer
+	tamper := false
+	tap(a2, b2, func(p []byte) []byte {
+		wire.Write(p)
+		if tamper {
+			p[len(p)-1] ^= 1
+		}
+		return p
+	})
+	tap(b2, a2, func(p []byte) []byte { return p })
+	sa, sb := secretPair(t, a, b)
+
+	secret := []byte("the validator's secret plans")
+	go func() { _, _ = sa.Write(secret) }()
+	got := make([]byte, len(secret))
+	_, err := io.ReadFull(sb, got)
+	require.NoError(t, err)
+	assert.Equal(t, secret, got)
+	assert.NotContains(t, wire.String(), string(secret))
+
+	// Modified frames are rejected.
+	tamper = true
+	go func() { _, _ = sa.Write(secret) }()
+	_, err = io.ReadFull(sb, got)
+	assert.Error(t, err)
+}
+
+func TestSecretConnRejectsBadSignature(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	// The remote presents one key but signs the challenge with another, as
+	// an attacker trying to impersonate the holder of the key would have
+	// to.
+	go func() {
+		sc, err := impersonate(a, testKey(0), testKey(2).Public().(ed25519.PublicKey))
+		if err == nil {
+			sc.Close()
+		}
+	}()
+	_, err := NewSecretConn(b, testKey(1))
+	assert.Error(t, err)
+}
+
+// impersonate runs the handshake presenting pub while signing with key.
+func impersonate(conn net.Conn, key ed25519.PrivateKey, pub ed25519.PublicKey) (*SecretConn, error) {
+	fake := append(ed25519.PrivateKey{}, key...)
+	copy(fake[ed25519.SeedSize:], pub)
+	return NewSecretConn(conn, fake)
+}
+
+func TestHKDF(t *testing.T) {
+	// Test case 1 from RFC 5869.
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	okm := hkdf(ikm, salt, info, 42)
+	assert.Equal(t, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865", hex.EncodeToString(okm))
+}
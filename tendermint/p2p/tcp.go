@@ -0,0 +1,397 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+)
+
+const (
+	// DefaultMaxFrameSize is the default bound on the size of a payload sent
+	// over TCP.
+	DefaultMaxFrameSize = 4 << 20
+	// DefaultSendQueueSize is the default number of payloads that can be
+	// queued for a single peer before sends fail with ErrQueueFull.
+	DefaultSendQueueSize = 4096
+	// DefaultReceiveQueueSize is the default number of received payloads
+	// that can be queued before reading from peers stops.
+	DefaultReceiveQueueSize = 4096
+	// DefaultHandshakeTimeout is the default time allowed for a new
+	// connection to complete its handshake.
+	DefaultHandshakeTimeout = 10 * time.Second
+)
+
+var errDuplicateConnection = errors.New("duplicate connection")
+
+// TCPConfig configures a TCPTransport, zero values are replaced by defaults.
+type TCPConfig struct {
+	// MaxFrameSize bounds the size of a single payload, a peer sending a
+	// larger payload is disconnected.
+	MaxFrameSize int
+	// SendQueueSize bounds the number of payloads queued for each peer.
+	SendQueueSize int
+	// ReceiveQueueSize bounds the number of received payloads not yet
+	// delivered by Receive. While it is full no more payloads are read from
+	// any peer, so a slow receiver slows its peers down rather than
+	// exhausting memory.
+	ReceiveQueueSize int
+	// HandshakeTimeout bounds the time taken to establish a connection.
+	HandshakeTimeout time.Duration
+}
+
+func (c *TCPConfig) setDefaults() {
+	if c.MaxFrameSize == 0 {
+		c.MaxFrameSize = DefaultMaxFrameSize
+	}
+	if c.SendQueueSize == 0 {
+		c.SendQueueSize = DefaultSendQueueSize
+	}
+	if c.ReceiveQueueSize == 0 {
+		c.ReceiveQueueSize = DefaultReceiveQueueSize
+	}
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+}
+
+// TCPTransport is a Transport that maintains one TCP connection per peer.
+// Connections are authenticated and encrypted by SecretConn, a node's id is
+// the address of its long term key. Payloads are sent as length prefixed
+// frames, a 4 byte big endian length followed by the channel and payload.
+//
+// Either side of a pair of peers may dial the other, should both dial at once
+// the connection dialed by the peer with the lower id is kept, both sides
+// apply the same rule so they agree on the surviving connection. If one side
+// closes the losing connection before the other has seen the winner, the
+// other briefly reports the peer down and then up again.
+type TCPTransport struct {
+	key      ed25519.PrivateKey
+	id       algorithm.NodeID
+	cfg      TCPConfig
+	listener net.Listener
+
+	mu     sync.Mutex
+	closed bool
+	peers  map[algorithm.NodeID]*tcpPeer
+
+	inbox  *queue[Envelope]
+	events *queue[PeerEvent]
+	wg     sync.WaitGroup
+}
+
+// ListenTCP creates a TCPTransport for the holder of key that accepts
+// connections on addr, use port 0 to pick a free port and Addr to find out
+// which was chosen.
+func ListenTCP(key ed25519.PrivateKey, addr string, cfg TCPConfig) (*TCPTransport, error) {
+	cfg.setDefaults()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t := &TCPTransport{
+		key:      key,
+		id:       keys.Address(key.Public().(ed25519.PublicKey)),
+		cfg:      cfg,
+		listener: l,
+		peers:    make(map[algorithm.NodeID]*tcpPeer),
+		inbox:    newQueue[Envelope](cfg.ReceiveQueueSize),
+		events:   newQueue[PeerEvent](0),
+	}
+	t.wg.Add(1)
+	go t.accept()
+	return t, nil
+}
+
+// Addr returns the address the transport is listening on.
+func (t *TCPTransport) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+func (t *TCPTransport) accept() {
+	defer t.wg.Done()
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			// Errors are the remote's problem, they can dial again.
+			_, _ = t.setup(conn, false, nil)
+		}()
+	}
+}
+
+// Dial connects to the transport listening on addr and returns its id. The
+// address may be given as id@host:port, in which case the connection is only
+// established if the remote proves it holds the key for id. It is not an
+// error to dial a peer that is already connected, in which case one of the two
+// connections is closed.
+func (t *TCPTransport) Dial(addr string) (algorithm.NodeID, error) {
+	expected, hostport, err := ParseAddr(addr)
+	if err != nil {
+		return algorithm.NodeID{}, err
+	}
+	conn, err := net.DialTimeout("tcp", hostport, t.cfg.HandshakeTimeout)
+	if err != nil {
+		return algorithm.NodeID{}, err
+	}
+	return t.setup(conn, true, expected)
+}
+
+// ParseAddr splits an address of the form [id@]host:port, id is nil if the
+// address does not include one.
+func ParseAddr(addr string) (*algorithm.NodeID, string, error) {
+	i := strings.IndexByte(addr, '@')
+	if i < 0 {
+		return nil, addr, nil
+	}
+	id, err := keys.ParseAddress(addr[:i])
+	if err != nil {
+		return nil, "", err
+	}
+	return &id, addr[i+1:], nil
+}
+
+// setup performs the handshake on a new connection and registers the peer, if
+// expected is non nil the remote must have that id.
+func (t *TCPTransport) setup(conn net.Conn, outbound bool, expected *algorithm.NodeID) (algorithm.NodeID, error) {
+	if err := conn.SetDeadline(time.Now().Add(t.cfg.HandshakeTimeout)); err != nil {
+		conn.Close()
+		return algorithm.NodeID{}, err
+	}
+	sc, err := NewSecretConn(conn, t.key)
+	if err != nil {
+		conn.Close()
+		return algorithm.NodeID{}, fmt.Errorf("handshake failed: %w", err)
+	}
+	remote := keys.Address(sc.RemoteKey())
+	if remote == t.id {
+		conn.Close()
+		return remote, fmt.Errorf("connected to self")
+	}
+	if expected != nil && *expected != remote {
+		conn.Close()
+		return remote, fmt.Errorf("expected to connect to %s but connected to %s", keys.FormatAddress(*expected), keys.FormatAddress(remote))
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return remote, err
+	}
+	dialer := remote
+	if outbound {
+		dialer = t.id
+	}
+	err = t.addPeer(&tcpPeer{
+		id:     remote,
+		conn:   sc,
+		dialer: dialer,
+		send:   newQueue[[]byte](t.cfg.SendQueueSize),
+	})
+	if errors.Is(err, errDuplicateConnection) {
+		return remote, nil
+	}
+	return remote, err
+}
+
+// preferred returns true if the connection was dialed by the lower of the two
+// ids, see TCPTransport.
+func (t *TCPTransport) preferred(p *tcpPeer) bool {
+	lower := t.id
+	if bytes.Compare(p.id[:], t.id[:]) < 0 {
+		lower = p.id
+	}
+	return p.dialer == lower
+}
+
+func (t *TCPTransport) addPeer(p *tcpPeer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		p.close()
+		return ErrClosed
+	}
+	existing := t.peers[p.id]
+	if existing != nil {
+		if t.preferred(existing) || !t.preferred(p) {
+			p.close()
+			return errDuplicateConnection
+		}
+		// The peer remains connected so no events are emitted.
+		existing.close()
+	}
+	t.peers[p.id] = p
+	if existing == nil {
+		t.events.push(PeerEvent{Peer: p.id, Type: PeerUp})
+	}
+	t.wg.Add(2)
+	go t.read(p)
+	go t.write(p)
+	return nil
+}
+
+func (t *TCPTransport) removePeer(p *tcpPeer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p.close()
+	if t.peers[p.id] == p {
+		delete(t.peers, p.id)
+		t.events.push(PeerEvent{Peer: p.id, Type: PeerDown})
+	}
+}
+
+func (t *TCPTransport) read(p *tcpPeer) {
+	defer t.wg.Done()
+	defer t.removePeer(p)
+	r := bufio.NewReader(p.conn)
+	for {
+		ch, payload, err := readFrame(r, t.cfg.MaxFrameSize)
+		if err != nil {
+			return
+		}
+		if !t.inbox.wait(Envelope{From: p.id, Channel: ch, Payload: payload}) {
+			return
+		}
+	}
+}
+
+func (t *TCPTransport) write(p *tcpPeer) {
+	defer t.wg.Done()
+	for frame := range p.send.out {
+		if _, err := p.conn.Write(frame); err != nil {
+			t.removePeer(p)
+			return
+		}
+	}
+}
+
+// ID implements Transport.
+func (t *TCPTransport) ID() algorithm.NodeID {
+	return t.id
+}
+
+// Broadcast implements Transport.
+func (t *TCPTransport) Broadcast(ch ChannelID, payload []byte) {
+	frame := encodeFrame(ch, payload)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range t.peers {
+		p.send.push(frame)
+	}
+}
+
+// Send implements Transport.
+func (t *TCPTransport) Send(peer algorithm.NodeID, ch ChannelID, payload []byte) error {
+	if len(payload)+1 > t.cfg.MaxFrameSize {
+		return fmt.Errorf("payload of %d bytes exceeds maximum frame size", len(payload))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	p := t.peers[peer]
+	if p == nil {
+		return ErrUnknownPeer
+	}
+	if !p.send.push(encodeFrame(ch, payload)) {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// Receive implements Transport.
+func (t *TCPTransport) Receive() <-chan Envelope {
+	return t.inbox.out
+}
+
+// PeerEvents implements Transport.
+func (t *TCPTransport) PeerEvents() <-chan PeerEvent {
+	return t.events.out
+}
+
+// Peers implements Transport, peers are returned in ascending order.
+func (t *TCPTransport) Peers() []algorithm.NodeID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := make([]algorithm.NodeID, 0, len(t.peers))
+	for id := range t.peers {
+		result = append(result, id)
+	}
+	sortIDs(result)
+	return result
+}
+
+// Close implements Transport.
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrClosed
+	}
+	t.closed = true
+	for _, p := range t.peers {
+		p.close()
+	}
+	t.mu.Unlock()
+	err := t.listener.Close()
+	// Readers may be waiting for space in the inbox.
+	t.inbox.close()
+	t.wg.Wait()
+	t.events.close()
+	return err
+}
+
+type tcpPeer struct {
+	id   algorithm.NodeID
+	conn net.Conn
+	// dialer is the id of the side that dialed the connection.
+	dialer    algorithm.NodeID
+	send      *queue[[]byte]
+	closeOnce sync.Once
+}
+
+func (p *tcpPeer) close() {
+	p.closeOnce.Do(func() {
+		p.conn.Close()
+		p.send.close()
+	})
+}
+
+func encodeFrame(ch ChannelID, payload []byte) []byte {
+	frame := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(1+len(payload)))
+	frame[4] = byte(ch)
+	copy(frame[5:], payload)
+	return frame
+}
+
+// readFrame reads a frame written by encodeFrame, frames larger than max are
+// rejected.
+func readFrame(r io.Reader, max int) (ChannelID, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size == 0 || uint64(size) > uint64(max) {
+		return 0, nil, fmt.Errorf("frame size %d outside of (0, %d]", size, max)
+	}
+	payload := make([]byte, size-1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return ChannelID(header[4]), payload, nil
+}
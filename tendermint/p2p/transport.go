@@ -0,0 +1,188 @@
+// Package p2p provides the transports that carry messages between nodes.
+//
+// A Transport delivers opaque payloads to directly connected peers, peers are
+// identified by NodeID. Payloads are tagged with a ChannelID so that several
+// protocols, consensus, block sync and so on, can share one Transport.
+// Delivery between a pair of peers is reliable and ordered for as long as the
+// peers remain connected, there are no guarantees across reconnections.
+package p2p
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+var (
+	// ErrUnknownPeer is returned when sending to a peer that is not connected.
+	ErrUnknownPeer = errors.New("unknown peer")
+	// ErrQueueFull is returned when sending to a peer whose send queue is
+	// full, the payload is dropped.
+	ErrQueueFull = errors.New("send queue full")
+	// ErrClosed is returned when using a closed transport.
+	ErrClosed = errors.New("transport closed")
+)
+
+// ChannelID identifies the protocol that a payload belongs to.
+type ChannelID byte
+
+// Envelope is a payload received from a peer.
+type Envelope struct {
+	From    algorithm.NodeID
+	Channel ChannelID
+	Payload []byte
+}
+
+// PeerEventType distinguishes peers connecting from peers disconnecting.
+type PeerEventType uint8
+
+const (
+	PeerUp PeerEventType = iota
+	PeerDown
+)
+
+func (t PeerEventType) String() string {
+	if t == PeerUp {
+		return "up"
+	}
+	return "down"
+}
+
+// PeerEvent reports a change in the set of connected peers.
+type PeerEvent struct {
+	Peer algorithm.NodeID
+	Type PeerEventType
+}
+
+// Transport sends payloads to and receives payloads from connected peers.
+// Payloads passed to Broadcast and Send must not be modified afterwards since
+// they may be queued or shared between peers. Neither method blocks on a slow
+// peer.
+type Transport interface {
+	// ID returns the id of the local node.
+	ID() algorithm.NodeID
+	// Broadcast sends the payload to every connected peer, it does not
+	// deliver the payload locally.
+	Broadcast(ch ChannelID, payload []byte)
+	// Send sends the payload to the given peer.
+	Send(peer algorithm.NodeID, ch ChannelID, payload []byte) error
+	// Receive returns the channel on which payloads from peers are
+	// delivered, it is closed when the transport is closed.
+	Receive() <-chan Envelope
+	// PeerEvents returns the channel on which peer connections and
+	// disconnections are reported, it is closed when the transport is
+	// closed.
+	PeerEvents() <-chan PeerEvent
+	// Peers returns the currently connected peers.
+	Peers() []algorithm.NodeID
+	// Close disconnects from all peers and releases the transport's
+	// resources.
+	Close() error
+}
+
+// queue is a FIFO whose items are delivered in order on a channel, it allows
+// producers to hand off items without blocking on the consumer. A queue with a
+// limit of zero is unbounded.
+type queue[T any] struct {
+	mu     sync.Mutex
+	items  []T
+	limit  int
+	closed bool
+	// space is signalled when an item is delivered or the queue is closed.
+	space  *sync.Cond
+	signal chan struct{}
+	out    chan T
+	done   chan struct{}
+}
+
+func newQueue[T any](limit int) *queue[T] {
+	q := &queue[T]{
+		limit:  limit,
+		signal: make(chan struct{}, 1),
+		out:    make(chan T),
+		done:   make(chan struct{}),
+	}
+	q.space = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// push adds v to the queue, it returns false if the queue is full or closed.
+func (q *queue[T]) push(v T) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || q.full() {
+		return false
+	}
+	q.add(v)
+	return true
+}
+
+// wait adds v to the queue, waiting while the queue is full. It returns false
+// if the queue is closed.
+func (q *queue[T]) wait(v T) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed && q.full() {
+		q.space.Wait()
+	}
+	if q.closed {
+		return false
+	}
+	q.add(v)
+	return true
+}
+
+// full returns true if the queue holds limit items, q.mu must be held.
+func (q *queue[T]) full() bool {
+	return q.limit > 0 && len(q.items) >= q.limit
+}
+
+// add appends v and wakes run, q.mu must be held.
+func (q *queue[T]) add(v T) {
+	q.items = append(q.items, v)
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// close stops delivery and closes the output channel, queued items are
+// discarded.
+func (q *queue[T]) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+		q.space.Broadcast()
+	}
+}
+
+func (q *queue[T]) run() {
+	defer close(q.out)
+	for {
+		q.mu.Lock()
+		if len(q.items) == 0 {
+			q.mu.Unlock()
+			select {
+			case <-q.signal:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+		v := q.items[0]
+		var zero T
+		q.items[0] = zero
+		q.items = q.items[1:]
+		q.space.Signal()
+		q.mu.Unlock()
+		select {
+		case q.out <- v:
+		case <-q.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTimeout = 5 * time.Second
+
+func nodeID(i int) algorithm.NodeID {
+	var id algorithm.NodeID
+	id[0] = byte(i + 1)
+	return id
+}
+
+func testKey(i int) ed25519.PrivateKey {
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = byte(i + 1)
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+func receive(t *testing.T, tr Transport) Envelope {
+	t.Helper()
+	select {
+	case e := <-tr.Receive():
+		return e
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for payload")
+	}
+	return Envelope{}
+}
+
+func peerEvent(t *testing.T, tr Transport) PeerEvent {
+	t.Helper()
+	select {
+	case e := <-tr.PeerEvents():
+		return e
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for peer event")
+	}
+	return PeerEvent{}
+}
+
+// testTransports checks the behaviour common to all transports, a, b and c
+// must all be connected to each other.
+func testTransports(t *testing.T, a, b, c Transport) {
+	require.ElementsMatch(t, []algorithm.NodeID{b.ID(), c.ID()}, a.Peers())
+
+	require.NoError(t, a.Send(b.ID(), 1, []byte("hello")))
+	assert.Equal(t, Envelope{From: a.ID(), Channel: 1, Payload: []byte("hello")}, receive(t, b))
+
+	// Payloads between a pair of peers arrive in order.
+	for i := 0; i < 100; i++ {
+		a.Broadcast(2, []byte{byte(i)})
+	}
+	for _, tr := range []Transport{b, c} {
+		for i := 0; i < 100; i++ {
+			e := receive(t, tr)
+			require.Equal(t, Envelope{From: a.ID(), Channel: 2, Payload: []byte{byte(i)}}, e)
+		}
+	}
+
+	assert.ErrorIs(t, a.Send(nodeID(100), 1, nil), ErrUnknownPeer)
+}
+
+func TestMemTransport(t *testing.T) {
+	n := NewMemNetwork()
+	a, b, c := n.Transport(nodeID(0)), n.Transport(nodeID(1)), n.Transport(nodeID(2))
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	testTransports(t, a, b, c)
+
+	n.Disconnect(a.ID(), b.ID())
+	assert.Equal(t, []algorithm.NodeID{c.ID()}, a.Peers())
+	assert.ErrorIs(t, a.Send(b.ID(), 1, nil), ErrUnknownPeer)
+
+	// Skip the events generated when the transports connected.
+	for _, tr := range []Transport{a, b} {
+		for i := 0; i < 2; i++ {
+			require.Equal(t, PeerUp, peerEvent(t, tr).Type)
+		}
+	}
+	assert.Equal(t, PeerEvent{Peer: b.ID(), Type: PeerDown}, peerEvent(t, a))
+	assert.Equal(t, PeerEvent{Peer: a.ID(), Type: PeerDown}, peerEvent(t, b))
+
+	n.Connect(a.ID(), b.ID())
+	assert.Equal(t, PeerEvent{Peer: b.ID(), Type: PeerUp}, peerEvent(t, a))
+	require.NoError(t, a.Send(b.ID(), 1, []byte("again")))
+	assert.Equal(t, []byte("again"), receive(t, b).Payload)
+
+	require.NoError(t, c.Close())
+	assert.Equal(t, []algorithm.NodeID{b.ID()}, a.Peers())
+	_, ok := <-c.Receive()
+	assert.False(t, ok)
+}
+
+func listen(t *testing.T, i int, cfg TCPConfig) *TCPTransport {
+	tr, err := ListenTCP(testKey(i), "127.0.0.1:0", cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { tr.Close() })
+	return tr
+}
+
+func waitForPeers(t *testing.T, tr Transport, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool { return len(tr.Peers()) == n }, testTimeout, time.Millisecond)
+}
+
+func TestTCPTransport(t *testing.T) {
+	a, b, c := listen(t, 0, TCPConfig{}), listen(t, 1, TCPConfig{}), listen(t, 2, TCPConfig{})
+	id, err := a.Dial(b.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, b.ID(), id)
+	_, err = a.Dial(c.Addr().String())
+	require.NoError(t, err)
+	_, err = c.Dial(b.Addr().String())
+	require.NoError(t, err)
+	for _, tr := range []Transport{a, b, c} {
+		waitForPeers(t, tr, 2)
+	}
+	testTransports(t, a, b, c)
+
+	// Closing a transport disconnects it from its peers.
+	require.NoError(t, c.Close())
+	waitForPeers(t, a, 1)
+	assert.ErrorIs(t, c.Send(a.ID(), 1, nil), ErrClosed)
+}
+
+func TestTCPTransportAuthenticatesPeers(t *testing.T) {
+	a, b := listen(t, 0, TCPConfig{}), listen(t, 1, TCPConfig{})
+	assert.Equal(t, keys.Address(testKey(0).Public().(ed25519.PublicKey)), a.ID())
+
+	// Dialing with the wrong id fails, even though the address is right.
+	_, err := a.Dial(fmt.Sprintf("%s@%s", keys.FormatAddress(nodeID(5)), b.Addr()))
+	require.Error(t, err)
+	assert.Empty(t, a.Peers())
+
+	id, err := a.Dial(fmt.Sprintf("%s@%s", keys.FormatAddress(b.ID()), b.Addr()))
+	require.NoError(t, err)
+	assert.Equal(t, b.ID(), id)
+
+	_, err = a.Dial("zz@" + b.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestTCPTransportDuplicateConnections(t *testing.T) {
+	a, b := listen(t, 0, TCPConfig{}), listen(t, 1, TCPConfig{})
+	// Dial in both directions at once, exactly one connection survives and
+	// it is usable in both directions.
+	errs := make(chan error, 2)
+	go func() { _, err := a.Dial(b.Addr().String()); errs <- err }()
+	go func() { _, err := b.Dial(a.Addr().String()); errs <- err }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	waitForPeers(t, a, 1)
+	waitForPeers(t, b, 1)
+
+	// Once the duplicate has been resolved both sides see the peer as up.
+	for _, tr := range []Transport{a, b} {
+		var last PeerEvent
+		for {
+			select {
+			case last = <-tr.PeerEvents():
+				continue
+			case <-time.After(100 * time.Millisecond):
+			}
+			break
+		}
+		assert.Equal(t, PeerUp, last.Type)
+	}
+	require.NoError(t, a.Send(b.ID(), 1, []byte("ping")))
+	assert.Equal(t, []byte("ping"), receive(t, b).Payload)
+	require.NoError(t, b.Send(a.ID(), 1, []byte("pong")))
+	assert.Equal(t, []byte("pong"), receive(t, a).Payload)
+}
+
+func TestTCPTransportRejectsLargeFrames(t *testing.T) {
+	a := listen(t, 0, TCPConfig{MaxFrameSize: 16})
+	b := listen(t, 1, TCPConfig{})
+	_, err := b.Dial(a.Addr().String())
+	require.NoError(t, err)
+	waitForPeers(t, a, 1)
+
+	// A peer that sends a frame larger than we accept is disconnected.
+	require.NoError(t, b.Send(a.ID(), 1, make([]byte, 32)))
+	waitForPeers(t, a, 0)
+
+	// We refuse to send frames larger than the maximum.
+	_, err = a.Dial(b.Addr().String())
+	require.NoError(t, err)
+	assert.Error(t, a.Send(b.ID(), 1, make([]byte, 16)))
+}
+
+func TestTCPTransportReceiveQueue(t *testing.T) {
+	a := listen(t, 0, TCPConfig{ReceiveQueueSize: 2})
+	b := listen(t, 1, TCPConfig{})
+	_, err := b.Dial(a.Addr().String())
+	require.NoError(t, err)
+	waitForPeers(t, a, 1)
+
+	// While the inbox is full nothing more is read, payloads wait on the
+	// connection and are delivered in order once there is space.
+	for i := 0; i < 100; i++ {
+		require.NoError(t, b.Send(a.ID(), 1, []byte{byte(i)}))
+	}
+	time.Sleep(50 * time.Millisecond)
+	a.inbox.mu.Lock()
+	queued := len(a.inbox.items)
+	a.inbox.mu.Unlock()
+	assert.LessOrEqual(t, queued, 2)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, []byte{byte(i)}, receive(t, a).Payload)
+	}
+
+	// A transport whose readers are waiting for space can be closed.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, b.Send(a.ID(), 1, []byte{byte(i)}))
+	}
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, a.Close())
+}
+
+func TestTCPTransportHandshakeTimeout(t *testing.T) {
+	a := listen(t, 0, TCPConfig{HandshakeTimeout: 50 * time.Millisecond})
+	// A connection that never completes the handshake is closed after
+	// receiving the ephemeral key.
+	conn, err := net.Dial("tcp", a.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(testTimeout)))
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Len(t, b, 32)
+	assert.Empty(t, a.Peers())
+}
+
+func TestMux(t *testing.T) {
+	n := NewMemNetwork()
+	a, b := n.Transport(nodeID(0)), n.Transport(nodeID(1))
+	defer a.Close()
+	mux := NewMux(b, MuxConfig{})
+	first, second := mux.Channels(1), mux.Channels(2, 3)
+	mux.Start()
+
+	// Peer events are delivered to every protocol, payloads only to the
+	// protocol of their channel.
+	c := n.Transport(nodeID(2))
+	for _, tr := range []Transport{first, second} {
+		assert.Equal(t, PeerEvent{Peer: a.ID(), Type: PeerUp}, peerEvent(t, tr))
+		assert.Equal(t, PeerEvent{Peer: c.ID(), Type: PeerUp}, peerEvent(t, tr))
+	}
+	for _, ch := range []ChannelID{4, 3, 1, 2} {
+		require.NoError(t, a.Send(b.ID(), ch, []byte{byte(ch)}))
+	}
+	assert.Equal(t, Envelope{From: a.ID(), Channel: 3, Payload: []byte{3}}, receive(t, second))
+	assert.Equal(t, Envelope{From: a.ID(), Channel: 2, Payload: []byte{2}}, receive(t, second))
+	assert.Equal(t, Envelope{From: a.ID(), Channel: 1, Payload: []byte{1}}, receive(t, first))
+
+	// Protocols send through the shared transport.
+	require.NoError(t, first.Send(a.ID(), 5, []byte("hello")))
+	assert.Equal(t, Envelope{From: b.ID(), Channel: 5, Payload: []byte("hello")}, receive(t, a))
+	assert.Panics(t, func() { mux.Channels(3) })
+
+	// Closing the shared transport closes every protocol's transport.
+	require.NoError(t, mux.Close())
+	for _, tr := range []Transport{first, second} {
+		select {
+		case _, ok := <-tr.Receive():
+			assert.False(t, ok)
+		case <-time.After(testTimeout):
+			t.Fatal("receive channel not closed")
+		}
+	}
+	c.Close()
+}
+
+func TestMuxDropsPayloadsOfFullProtocols(t *testing.T) {
+	n := NewMemNetwork()
+	a, b := n.Transport(nodeID(0)), n.Transport(nodeID(1))
+	defer a.Close()
+	mux := NewMux(b, MuxConfig{ReceiveQueueSize: 1})
+	idle, busy := mux.Channels(1), mux.Channels(2)
+	mux.Start()
+	defer mux.Close()
+	assert.Equal(t, PeerEvent{Peer: a.ID(), Type: PeerUp}, peerEvent(t, busy))
+
+	// A protocol that doesn't receive doesn't hold up the others, its
+	// payloads beyond the limit are dropped.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, a.Send(b.ID(), 1, []byte{byte(i)}))
+		require.NoError(t, a.Send(b.ID(), 2, []byte{byte(i)}))
+		assert.Equal(t, []byte{byte(i)}, receive(t, busy).Payload)
+	}
+	assert.Equal(t, []byte{0}, receive(t, idle).Payload)
+	received := 1
+	for done := false; !done; {
+		select {
+		case <-idle.Receive():
+			received++
+		case <-time.After(50 * time.Millisecond):
+			done = true
+		}
+	}
+	assert.Less(t, received, 10)
+}
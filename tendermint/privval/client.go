@@ -0,0 +1,195 @@
+package privval
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// ClientConfig configures a Client, zero values are replaced by defaults.
+type ClientConfig struct {
+	// Key authenticates the node to signers reached over TCP, it is
+	// required for TCP addresses.
+	Key ed25519.PrivateKey
+	// Timeout bounds dialing the signer and each request.
+	Timeout time.Duration
+}
+
+func (c *ClientConfig) setDefaults() {
+	if c.Timeout == 0 {
+		c.Timeout = DefaultTimeout
+	}
+}
+
+// Client is a types.Signer that has messages signed by a remote signer. It
+// holds a single connection to the signer, which is dialed again when a
+// request fails on it.
+type Client struct {
+	cfg     ClientConfig
+	network string
+	address string
+	// expected is the id of the signer's key, given by TCP addresses.
+	expected *algorithm.NodeID
+	pub      ed25519.PublicKey
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Dial connects to the signer listening on addr, either unix://path or
+// tcp://id@host:port, and fetches its public key. TCP connections are only
+// established if the signer proves it holds the key for id, otherwise anyone
+// able to intercept the connection could pose as the signer.
+func Dial(addr string, cfg ClientConfig) (*Client, error) {
+	cfg.setDefaults()
+	network, address, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{cfg: cfg, network: network, address: address}
+	if network == "tcp" {
+		if cfg.Key == nil {
+			return nil, fmt.Errorf("a key is required to dial %s", addr)
+		}
+		if c.expected, c.address, err = p2p.ParseAddr(address); err != nil {
+			return nil, err
+		}
+		if c.expected == nil {
+			return nil, fmt.Errorf("the signer id is required to dial %s, expected tcp://id@host:port", addr)
+		}
+	}
+	pub, err := c.request([]byte{kindPubKey})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		c.Close()
+		return nil, fmt.Errorf("signer returned a public key of %d bytes", len(pub))
+	}
+	c.pub = pub
+	return c, nil
+}
+
+// PubKey implements types.Signer.
+func (c *Client) PubKey() ed25519.PublicKey {
+	return c.pub
+}
+
+// SignMessage implements types.Signer. The signature returned by the signer
+// is checked before it is returned.
+func (c *Client) SignMessage(chainID string, cm *algorithm.ConsensusMessage) ([]byte, error) {
+	req, err := encodeSignRequest(chainID, cm)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := c.request(req)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(c.pub, types.SignBytes(chainID, cm), sig) {
+		return nil, fmt.Errorf("signer returned an invalid signature for %v", cm)
+	}
+	return sig, nil
+}
+
+// signerError is an error reported by the signer, as opposed to a failure
+// to reach it.
+type signerError string
+
+func (e signerError) Error() string {
+	return "signer: " + string(e)
+}
+
+// request sends req and returns the result of the response. A request that
+// fails on an existing connection is retried once on a new one.
+func (c *Client) request(req []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reused := c.conn != nil
+	result, err := c.roundTrip(req)
+	var se signerError
+	if err != nil && !errors.As(err, &se) {
+		c.closeConn()
+		if reused {
+			result, err = c.roundTrip(req)
+			if err != nil && !errors.As(err, &se) {
+				c.closeConn()
+			}
+		}
+	}
+	return result, err
+}
+
+func (c *Client) roundTrip(req []byte) ([]byte, error) {
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.conn.SetDeadline(time.Now().Add(c.cfg.Timeout)); err != nil {
+		return nil, err
+	}
+	if err := writeFrame(c.conn, req); err != nil {
+		return nil, err
+	}
+	resp, err := readFrame(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != statusOK {
+		return nil, signerError(resp[1:])
+	}
+	return resp[1:], nil
+}
+
+func (c *Client) connect() error {
+	conn, err := net.DialTimeout(c.network, c.address, c.cfg.Timeout)
+	if err != nil {
+		return err
+	}
+	if c.network == "tcp" {
+		if err := conn.SetDeadline(time.Now().Add(c.cfg.Timeout)); err != nil {
+			conn.Close()
+			return err
+		}
+		sc, err := p2p.NewSecretConn(conn, c.cfg.Key)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("handshake failed: %w", err)
+		}
+		remote := keys.Address(sc.RemoteKey())
+		if *c.expected != remote {
+			conn.Close()
+			return fmt.Errorf("expected signer %s but connected to %s", keys.FormatAddress(*c.expected), keys.FormatAddress(remote))
+		}
+		conn = sc
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	return nil
+}
+
+func (c *Client) closeConn() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.r = nil, nil
+	}
+}
+
+// Close closes the connection to the signer.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeConn()
+	return nil
+}
@@ -0,0 +1,91 @@
+package privval
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/piersy/tendermint-go/tendermint/keys"
+)
+
+// keyFile is the encoding of the key of a FilePV.
+type keyFile struct {
+	Address string             `json:"address"`
+	PubKey  ed25519.PublicKey  `json:"pub_key"`
+	PrivKey ed25519.PrivateKey `json:"priv_key"`
+}
+
+// FilePV is a GuardedSigner whose key is held in a file next to its state,
+// the validator of a node that signs its own messages.
+type FilePV struct {
+	*GuardedSigner
+	keyPath string
+}
+
+// NewFilePV creates a FilePV for key that has signed nothing, call Save to
+// write its files.
+func NewFilePV(key ed25519.PrivateKey, keyPath, statePath string) *FilePV {
+	return &FilePV{GuardedSigner: newGuardedSigner(key, statePath), keyPath: keyPath}
+}
+
+// GenFilePV creates a FilePV for a new key and writes its files.
+func GenFilePV(keyPath, statePath string) (*FilePV, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pv := NewFilePV(key, keyPath, statePath)
+	return pv, pv.Save()
+}
+
+// LoadFilePV reads a FilePV from its files. Both must exist, a missing state
+// would forget what was signed.
+func LoadFilePV(keyPath, statePath string) (*FilePV, error) {
+	b, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	var f keyFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", keyPath, err)
+	}
+	if len(f.PrivKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s: invalid private key", keyPath)
+	}
+	if !f.PrivKey.Public().(ed25519.PublicKey).Equal(f.PubKey) {
+		return nil, fmt.Errorf("%s: public key does not match private key", keyPath)
+	}
+	pv := NewFilePV(f.PrivKey, keyPath, statePath)
+	if pv.last, err = loadState(statePath, f.PubKey); err != nil {
+		return nil, err
+	}
+	return pv, nil
+}
+
+// LoadOrGenFilePV reads the FilePV at keyPath and statePath, generating one if
+// the key file does not exist.
+func LoadOrGenFilePV(keyPath, statePath string) (*FilePV, error) {
+	if _, err := os.Stat(keyPath); errors.Is(err, fs.ErrNotExist) {
+		return GenFilePV(keyPath, statePath)
+	}
+	return LoadFilePV(keyPath, statePath)
+}
+
+// Save writes the key and state files, creating their directories if needed.
+func (pv *FilePV) Save() error {
+	for _, path := range []string{pv.keyPath, pv.path} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+	}
+	pub := pv.PubKey()
+	if err := writeJSON(pv.keyPath, &keyFile{Address: keys.FormatAddress(keys.Address(pub)), PubKey: pub, PrivKey: pv.key}); err != nil {
+		return err
+	}
+	return writeJSON(pv.path, pv.LastSigned())
+}
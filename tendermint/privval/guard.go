@@ -0,0 +1,157 @@
+package privval
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// LastSigned identifies the last message a validator signed, along with its
+// sign bytes and signature. The zero value means nothing has been signed,
+// heights start at 1.
+type LastSigned struct {
+	Height    uint64         `json:"height"`
+	Round     int            `json:"round"`
+	Step      algorithm.Step `json:"step"`
+	SignBytes []byte         `json:"sign_bytes,omitempty"`
+	Signature []byte         `json:"signature,omitempty"`
+}
+
+// Before reports whether cm comes strictly after the last signed message, in
+// the order of height, round and then step. Steps are ordered Propose,
+// Prevote, Precommit, the order in which the algorithm sends them.
+func (l LastSigned) Before(cm *algorithm.ConsensusMessage) bool {
+	if l.Height != cm.Height {
+		return l.Height < cm.Height
+	}
+	if l.Round != cm.Round {
+		return l.Round < cm.Round
+	}
+	return l.Step < cm.MsgType
+}
+
+// GuardedSigner is a Signer that only signs messages that come after the last
+// one it signed, so it never signs two messages for the same height, round and
+// step. Asking again for the last signed message returns its signature, so a
+// signature lost to a crash can be recovered. The last signed message is
+// persisted to a file before its signature is returned, so the guarantee holds
+// across restarts of the signer and of consensus.
+type GuardedSigner struct {
+	key  ed25519.PrivateKey
+	id   algorithm.NodeID
+	path string
+
+	mu   sync.Mutex
+	last LastSigned
+}
+
+// NewGuardedSigner creates a GuardedSigner for key that persists its state to
+// path, the state is loaded from path if it exists.
+func NewGuardedSigner(key ed25519.PrivateKey, path string) (*GuardedSigner, error) {
+	s := newGuardedSigner(key, path)
+	last, err := loadState(path, s.PubKey())
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	s.last = last
+	return s, err
+}
+
+func newGuardedSigner(key ed25519.PrivateKey, path string) *GuardedSigner {
+	return &GuardedSigner{key: key, id: keys.Address(key.Public().(ed25519.PublicKey)), path: path}
+}
+
+// loadState reads the state at path, which must have been signed with pub.
+func loadState(path string, pub ed25519.PublicKey) (LastSigned, error) {
+	var last LastSigned
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return last, err
+	}
+	if err := json.Unmarshal(b, &last); err != nil {
+		return last, fmt.Errorf("%s: %w", path, err)
+	}
+	if last.Height > 0 && !ed25519.Verify(pub, last.SignBytes, last.Signature) {
+		return last, fmt.Errorf("%s: last signature was not made by key %v", path, keys.Address(pub))
+	}
+	return last, nil
+}
+
+// PubKey implements types.Signer.
+func (s *GuardedSigner) PubKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// LastSigned returns the last message signed.
+func (s *GuardedSigner) LastSigned() LastSigned {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// SignMessage implements types.Signer. The last signed message is signed
+// again, other messages that do not come after it fail with ErrDoubleSign.
+func (s *GuardedSigner) SignMessage(chainID string, cm *algorithm.ConsensusMessage) ([]byte, error) {
+	if cm.Sender != s.id {
+		return nil, fmt.Errorf("refusing to sign a message from %v as %v", cm.Sender, s.id)
+	}
+	signBytes := types.SignBytes(chainID, cm)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last.Height == cm.Height && s.last.Round == cm.Round && s.last.Step == cm.MsgType && bytes.Equal(s.last.SignBytes, signBytes) {
+		return s.last.Signature, nil
+	}
+	if !s.last.Before(cm) {
+		return nil, fmt.Errorf("%w: %v does not come after height %d round %d step %v", ErrDoubleSign, cm, s.last.Height, s.last.Round, s.last.Step)
+	}
+	next := LastSigned{Height: cm.Height, Round: cm.Round, Step: cm.MsgType, SignBytes: signBytes, Signature: ed25519.Sign(s.key, signBytes)}
+	if err := writeJSON(s.path, next); err != nil {
+		return nil, err
+	}
+	s.last = next
+	return next.Signature, nil
+}
+
+// writeJSON atomically replaces the file at path with the encoding of v, by
+// writing a temporary file that is synced and renamed over it.
+func writeJSON(path string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,124 @@
+// Package privval lets a validator's consensus messages be signed by a
+// separate process, the signer, which holds the validator's key and refuses
+// to sign messages that would equivocate.
+//
+// A Server runs in the signer and listens on a Unix socket or TCP address, a
+// Client runs in the node, dials it and is used as the node's types.Signer.
+// Requests and responses are frames holding a 4 byte big endian length
+// followed by the body. The first byte of a request body is its kind:
+//
+//   - kindPubKey has no arguments, the response holds the signer's ed25519
+//     public key.
+//   - kindSign is followed by the uvarint length of the chain id, the chain
+//     id and the encoded ConsensusMessage, the response holds the signature
+//     of its types.SignBytes.
+//
+// The first byte of a response body is statusOK, followed by the result, or
+// statusError, followed by the reason the request failed.
+//
+// The signer should refuse to sign messages that would equivocate, as a
+// GuardedSigner does. A FilePV is a GuardedSigner that also keeps its key in a
+// file.
+//
+// TCP connections are authenticated and encrypted by p2p.SecretConn, the
+// signer only serves the node keys it authorizes and the node only accepts
+// the signer key given in its address. Unix sockets are protected by the
+// permissions of the socket file.
+package privval
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// DefaultTimeout is the default bound on dialing the signer and on each
+// request.
+const DefaultTimeout = 3 * time.Second
+
+// Request kinds.
+const (
+	kindPubKey byte = 1
+	kindSign   byte = 2
+)
+
+// Response statuses.
+const (
+	statusOK    byte = 0
+	statusError byte = 1
+)
+
+// maxFrameSize bounds the frames we read, requests and responses are small.
+const maxFrameSize = 1 << 12
+
+// ErrDoubleSign is returned when signing a message would equivocate.
+var ErrDoubleSign = errors.New("double sign")
+
+// parseAddr splits an address of the form unix://path or tcp://id@host:port
+// into its network and address.
+func parseAddr(addr string) (string, string, error) {
+	network, address, ok := strings.Cut(addr, "://")
+	if !ok || address == "" || (network != "unix" && network != "tcp") {
+		return "", "", fmt.Errorf("invalid signer address %q, expected unix://path or tcp://host:port", addr)
+	}
+	return network, address, nil
+}
+
+func writeFrame(w io.Writer, body []byte) error {
+	frame := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	copy(frame[4:], body)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size == 0 || size > maxFrameSize {
+		return nil, fmt.Errorf("frame size %d outside of (0, %d]", size, maxFrameSize)
+	}
+	body := make([]byte, size)
+	_, err := io.ReadFull(r, body)
+	return body, err
+}
+
+func encodeSignRequest(chainID string, cm *algorithm.ConsensusMessage) ([]byte, error) {
+	encoded, err := cm.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, 1+binary.MaxVarintLen64+len(chainID)+len(encoded))
+	b = append(b, kindSign)
+	b = binary.AppendUvarint(b, uint64(len(chainID)))
+	b = append(b, chainID...)
+	return append(b, encoded...), nil
+}
+
+// decodeSignRequest decodes the arguments of a kindSign request, the message
+// is validated.
+func decodeSignRequest(b []byte) (string, *algorithm.ConsensusMessage, error) {
+	n, read := binary.Uvarint(b)
+	if read <= 0 || n > uint64(len(b)-read) {
+		return "", nil, fmt.Errorf("invalid chain id length")
+	}
+	b = b[read:]
+	chainID := string(b[:n])
+	cm := new(algorithm.ConsensusMessage)
+	if err := cm.UnmarshalBinary(b[n:]); err != nil {
+		return "", nil, err
+	}
+	if err := cm.Validate(); err != nil {
+		return "", nil, err
+	}
+	return chainID, cm, nil
+}
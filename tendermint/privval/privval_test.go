@@ -0,0 +1,320 @@
+package privval
+
+import (
+	"context"
+	"crypto/ed25519"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/consensus"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+	"github.com/piersy/tendermint-go/tendermint/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testTimeout = 20 * time.Second
+	testChainID = "test-chain"
+)
+
+func testKeys(n int) []ed25519.PrivateKey {
+	result := make([]ed25519.PrivateKey, n)
+	for i := range result {
+		seed := make([]byte, ed25519.SeedSize)
+		seed[0] = byte(i + 1)
+		result[i] = ed25519.NewKeyFromSeed(seed)
+	}
+	return result
+}
+
+func id(k ed25519.PrivateKey) algorithm.NodeID {
+	return keys.Address(k.Public().(ed25519.PublicKey))
+}
+
+func message(k ed25519.PrivateKey, t algorithm.Step, height uint64, round int) *algorithm.ConsensusMessage {
+	cm := &algorithm.ConsensusMessage{Sender: id(k), MsgType: t, Height: height, Round: round, Value: tendermint.Hash{1}}
+	if t == algorithm.Propose {
+		cm.ValidRound = -1
+	}
+	return cm
+}
+
+// verify checks that sig is the signature of cm.
+func verify(t *testing.T, k ed25519.PrivateKey, cm *algorithm.ConsensusMessage, sig []byte) {
+	t.Helper()
+	assert.True(t, ed25519.Verify(k.Public().(ed25519.PublicKey), types.SignBytes(testChainID, cm), sig), "%v", cm)
+}
+
+func TestGuardedSigner(t *testing.T) {
+	k := testKeys(1)[0]
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := NewGuardedSigner(k, path)
+	require.NoError(t, err)
+
+	for _, cm := range []*algorithm.ConsensusMessage{
+		message(k, algorithm.Propose, 1, 0),
+		message(k, algorithm.Prevote, 1, 0),
+		message(k, algorithm.Precommit, 1, 0),
+		message(k, algorithm.Prevote, 1, 2),
+		message(k, algorithm.Prevote, 2, 0),
+	} {
+		sig, err := s.SignMessage(testChainID, cm)
+		require.NoError(t, err, "%v", cm)
+		verify(t, k, cm, sig)
+	}
+	last := s.LastSigned()
+	assert.Equal(t, LastSigned{Height: 2, Round: 0, Step: algorithm.Prevote}, LastSigned{Height: last.Height, Round: last.Round, Step: last.Step})
+
+	// The last signed message may be signed again, other messages at or
+	// before it are refused, even once the signer is restarted.
+	restarted, err := NewGuardedSigner(k, path)
+	require.NoError(t, err)
+	assert.Equal(t, last, restarted.LastSigned())
+	conflicting := message(k, algorithm.Prevote, 2, 0)
+	conflicting.Value = tendermint.Hash{2}
+	for _, signer := range []*GuardedSigner{s, restarted} {
+		sig, err := signer.SignMessage(testChainID, message(k, algorithm.Prevote, 2, 0))
+		require.NoError(t, err)
+		assert.Equal(t, last.Signature, sig)
+		_, err = signer.SignMessage("other-chain", message(k, algorithm.Prevote, 2, 0))
+		assert.ErrorIs(t, err, ErrDoubleSign)
+		for _, cm := range []*algorithm.ConsensusMessage{
+			conflicting,
+			message(k, algorithm.Propose, 2, 0),
+			message(k, algorithm.Precommit, 1, 3),
+		} {
+			_, err := signer.SignMessage(testChainID, cm)
+			assert.ErrorIs(t, err, ErrDoubleSign, "%v", cm)
+		}
+	}
+	_, err = restarted.SignMessage(testChainID, message(k, algorithm.Precommit, 2, 0))
+	assert.NoError(t, err)
+
+	// Only messages from the key's holder are signed.
+	_, err = restarted.SignMessage(testChainID, message(testKeys(2)[1], algorithm.Prevote, 3, 0))
+	assert.Error(t, err)
+}
+
+func TestFilePV(t *testing.T) {
+	dir := t.TempDir()
+	keyPath, statePath := filepath.Join(dir, "config", "key.json"), filepath.Join(dir, "data", "state.json")
+	_, err := LoadFilePV(keyPath, statePath)
+	assert.Error(t, err)
+	pv, err := LoadOrGenFilePV(keyPath, statePath)
+	require.NoError(t, err)
+	assert.Equal(t, LastSigned{}, pv.LastSigned())
+
+	// Identical messages are signed again, conflicting ones refused.
+	k := pv.key
+	cm := message(k, algorithm.Precommit, 3, 1)
+	sig, err := pv.SignMessage(testChainID, cm)
+	require.NoError(t, err)
+	verify(t, k, cm, sig)
+	again, err := pv.SignMessage(testChainID, message(k, algorithm.Precommit, 3, 1))
+	require.NoError(t, err)
+	assert.Equal(t, sig, again)
+	conflicting := message(k, algorithm.Precommit, 3, 1)
+	conflicting.Value = algorithm.NilValue
+	_, err = pv.SignMessage(testChainID, conflicting)
+	assert.ErrorIs(t, err, ErrDoubleSign)
+
+	// The state is persisted with the sign bytes of the last message.
+	loaded, err := LoadOrGenFilePV(keyPath, statePath)
+	require.NoError(t, err)
+	assert.Equal(t, k, loaded.key)
+	assert.Equal(t, LastSigned{Height: 3, Round: 1, Step: algorithm.Precommit, SignBytes: types.SignBytes(testChainID, cm), Signature: sig}, loaded.LastSigned())
+	again, err = loaded.SignMessage(testChainID, cm)
+	require.NoError(t, err)
+	assert.Equal(t, sig, again)
+	_, err = loaded.SignMessage(testChainID, conflicting)
+	assert.ErrorIs(t, err, ErrDoubleSign)
+
+	// A missing state or one signed with another key is not loaded.
+	other, err := GenFilePV(filepath.Join(dir, "other.json"), filepath.Join(dir, "other_state.json"))
+	require.NoError(t, err)
+	_, err = other.SignMessage(testChainID, message(other.key, algorithm.Prevote, 1, 0))
+	require.NoError(t, err)
+	_, err = LoadFilePV(keyPath, filepath.Join(dir, "other_state.json"))
+	assert.Error(t, err)
+	_, err = LoadFilePV(keyPath, filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestRemoteSigner(t *testing.T) {
+	ks := testKeys(3)
+	signerKey, nodeKey, other := ks[0], ks[1], ks[2]
+	for _, network := range []string{"unix", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			guarded, err := NewGuardedSigner(signerKey, filepath.Join(t.TempDir(), "state.json"))
+			require.NoError(t, err)
+			addr := "unix://" + filepath.Join(t.TempDir(), "signer.sock")
+			if network == "tcp" {
+				addr = "tcp://127.0.0.1:0"
+			}
+			s, err := Listen(addr, guarded, ServerConfig{Key: other, Authorized: []algorithm.NodeID{id(nodeKey)}})
+			require.NoError(t, err)
+			defer s.Close()
+			addr = network + "://" + s.Addr().String()
+			dialAddr := addr
+			if network == "tcp" {
+				dialAddr = "tcp://" + keys.FormatAddress(id(other)) + "@" + s.Addr().String()
+			}
+
+			c, err := Dial(dialAddr, ClientConfig{Key: nodeKey})
+			require.NoError(t, err)
+			defer c.Close()
+			assert.True(t, signerKey.Public().(ed25519.PublicKey).Equal(c.PubKey()))
+
+			cm := message(signerKey, algorithm.Prevote, 1, 0)
+			sig, err := c.SignMessage(testChainID, cm)
+			require.NoError(t, err)
+			verify(t, signerKey, cm, sig)
+			_, err = c.SignMessage(testChainID, message(signerKey, algorithm.Prevote, 1, 0))
+			assert.NoError(t, err)
+			_, err = c.SignMessage(testChainID, message(signerKey, algorithm.Propose, 1, 0))
+			assert.ErrorContains(t, err, ErrDoubleSign.Error())
+
+			// A restarted server is dialed again.
+			require.NoError(t, s.Close())
+			s, err = Listen(addr, guarded, ServerConfig{Key: other, Authorized: []algorithm.NodeID{id(nodeKey)}})
+			require.NoError(t, err)
+			defer s.Close()
+			cm = message(signerKey, algorithm.Precommit, 1, 0)
+			sig, err = c.SignMessage(testChainID, cm)
+			require.NoError(t, err)
+			verify(t, signerKey, cm, sig)
+
+			if network == "tcp" {
+				// Only authorized nodes are served, and nodes only talk to
+				// the signer they expect, which they must name.
+				_, err = Dial(dialAddr, ClientConfig{Key: other})
+				assert.Error(t, err)
+				_, err = Dial("tcp://"+keys.FormatAddress(id(nodeKey))+"@"+s.Addr().String(), ClientConfig{Key: nodeKey})
+				assert.Error(t, err)
+				_, err = Dial(addr, ClientConfig{Key: nodeKey})
+				assert.ErrorContains(t, err, "signer id is required")
+				_, err = Listen("tcp://127.0.0.1:0", guarded, ServerConfig{Key: other})
+				assert.ErrorContains(t, err, "authorized nodes are required")
+			}
+		})
+	}
+	_, err := Dial("http://127.0.0.1:1", ClientConfig{})
+	assert.Error(t, err)
+}
+
+// recordingSigner records the messages its Signer refused to sign.
+type recordingSigner struct {
+	types.Signer
+	mu      sync.Mutex
+	refused []*algorithm.ConsensusMessage
+}
+
+func (s *recordingSigner) SignMessage(chainID string, cm *algorithm.ConsensusMessage) ([]byte, error) {
+	sig, err := s.Signer.SignMessage(chainID, cm)
+	if err != nil {
+		s.mu.Lock()
+		s.refused = append(s.refused, cm)
+		s.mu.Unlock()
+	}
+	return sig, err
+}
+
+func TestConsensusCrash(t *testing.T) {
+	ks := testKeys(4)
+	var vals []types.Validator
+	for _, k := range ks {
+		vals = append(vals, types.NewValidator(k.Public().(ed25519.PublicKey)))
+	}
+	vs, err := types.NewValidatorSet(vals)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Each validator has its messages signed by its own signer.
+	n := p2p.NewMemNetwork()
+	var mu sync.Mutex
+	decided := make(map[algorithm.NodeID]uint64)
+	start := func(ctx context.Context, tr p2p.Transport, signer types.Signer, height uint64) <-chan struct{} {
+		d := consensus.NewDriver(consensus.Config{
+			ChainID:        testChainID,
+			Signer:         signer,
+			Validators:     vs,
+			Height:         height,
+			TimeoutUnit:    20 * time.Millisecond,
+			GossipInterval: 5 * time.Millisecond,
+			Decided: func(p *algorithm.ConsensusMessage, _ *types.Block) []types.ValidatorUpdate {
+				mu.Lock()
+				decided[tr.ID()] = p.Height
+				mu.Unlock()
+				return nil
+			},
+		}, tr)
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			_ = d.Run(ctx)
+		}()
+		return stopped
+	}
+	reached := func(height uint64) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, k := range ks {
+				if decided[id(k)] < height {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	var guarded []*GuardedSigner
+	var signers []*recordingSigner
+	var transports []p2p.Transport
+	for _, k := range ks {
+		g, err := NewGuardedSigner(k, filepath.Join(t.TempDir(), "state.json"))
+		require.NoError(t, err)
+		guarded = append(guarded, g)
+		s, err := Listen("unix://"+filepath.Join(t.TempDir(), "signer.sock"), g, ServerConfig{})
+		require.NoError(t, err)
+		defer s.Close()
+		c, err := Dial("unix://"+s.Addr().String(), ClientConfig{})
+		require.NoError(t, err)
+		defer c.Close()
+		signers = append(signers, &recordingSigner{Signer: c})
+		tr := n.Transport(id(k))
+		defer tr.Close()
+		transports = append(transports, tr)
+	}
+	crashCtx, crash := context.WithCancel(ctx)
+	crashed := start(crashCtx, transports[0], signers[0], 1)
+	for i, tr := range transports[1:] {
+		start(ctx, tr, signers[i+1], 1)
+	}
+	require.Eventually(t, reached(3), testTimeout, time.Millisecond)
+
+	// The first validator's consensus crashes and restarts without its state,
+	// it tries to sign the messages of the heights it already signed again.
+	// Its signer refuses them and the chain carries on.
+	crash()
+	<-crashed
+	transports[0].Close()
+	last := guarded[0].LastSigned()
+	tr := n.Transport(id(ks[0]))
+	defer tr.Close()
+	start(ctx, tr, signers[0], 1)
+	require.Eventually(t, reached(6), testTimeout, time.Millisecond)
+
+	signers[0].mu.Lock()
+	defer signers[0].mu.Unlock()
+	require.NotEmpty(t, signers[0].refused)
+	for _, cm := range signers[0].refused {
+		assert.False(t, last.Before(cm), "%v", cm)
+	}
+}
@@ -0,0 +1,191 @@
+package privval
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// ServerConfig configures a Server, zero values are replaced by defaults.
+type ServerConfig struct {
+	// Key authenticates the signer to nodes connecting over TCP, it is
+	// required for TCP addresses.
+	Key ed25519.PrivateKey
+	// Authorized are the ids of the node keys allowed to connect over TCP, it
+	// is required for TCP addresses. Any node that connects may have messages
+	// signed, so an unrestricted signer could be made to sign ahead of the
+	// validator or be kept busy.
+	Authorized []algorithm.NodeID
+	// HandshakeTimeout bounds the time taken to secure a TCP connection.
+	HandshakeTimeout time.Duration
+}
+
+func (c *ServerConfig) setDefaults() {
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = DefaultTimeout
+	}
+}
+
+// Server serves the requests of nodes on behalf of a signer, which should
+// refuse to sign messages that would equivocate as a GuardedSigner does.
+type Server struct {
+	signer   types.Signer
+	cfg      ServerConfig
+	network  string
+	listener net.Listener
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[net.Conn]bool
+	wg     sync.WaitGroup
+}
+
+// Listen creates a Server for signer that accepts connections on addr, either
+// unix://path or tcp://host:port. Use port 0 to pick a free port and Addr to
+// find out which was chosen. TCP addresses require cfg.Key and
+// cfg.Authorized.
+func Listen(addr string, signer types.Signer, cfg ServerConfig) (*Server, error) {
+	cfg.setDefaults()
+	network, address, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tcp" && cfg.Key == nil {
+		return nil, fmt.Errorf("a key is required to listen on %s", addr)
+	}
+	if network == "tcp" && len(cfg.Authorized) == 0 {
+		return nil, fmt.Errorf("authorized nodes are required to listen on %s", addr)
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{signer: signer, cfg: cfg, network: network, listener: l, conns: make(map[net.Conn]bool)}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			defer s.remove(conn)
+			// Errors are the node's problem, it can dial again.
+			_ = s.serve(conn)
+		}()
+	}
+}
+
+func (s *Server) remove(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn.Close()
+	delete(s.conns, conn)
+}
+
+// secure performs the handshake on a TCP connection and checks that the node
+// is authorized.
+func (s *Server) secure(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetDeadline(time.Now().Add(s.cfg.HandshakeTimeout)); err != nil {
+		return nil, err
+	}
+	sc, err := p2p.NewSecretConn(conn, s.cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	remote := keys.Address(sc.RemoteKey())
+	for _, id := range s.cfg.Authorized {
+		if id == remote {
+			return sc, nil
+		}
+	}
+	return nil, fmt.Errorf("node %s is not authorized", keys.FormatAddress(remote))
+}
+
+// serve answers the requests received on conn until it fails.
+func (s *Server) serve(conn net.Conn) error {
+	if s.network == "tcp" {
+		var err error
+		if conn, err = s.secure(conn); err != nil {
+			return err
+		}
+	}
+	r := bufio.NewReader(conn)
+	for {
+		req, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+		result, err := s.handle(req)
+		resp := append([]byte{statusOK}, result...)
+		if err != nil {
+			resp = append([]byte{statusError}, err.Error()...)
+		}
+		if err := writeFrame(conn, resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) handle(req []byte) ([]byte, error) {
+	switch req[0] {
+	case kindPubKey:
+		return s.signer.PubKey(), nil
+	case kindSign:
+		chainID, cm, err := decodeSignRequest(req[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid sign request: %w", err)
+		}
+		return s.signer.SignMessage(chainID, cm)
+	default:
+		return nil, fmt.Errorf("unknown request kind %d", req[0])
+	}
+}
+
+// Close stops the server, closing its connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
@@ -0,0 +1,194 @@
+package simulation
+
+import (
+	"math/rand"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// Context describes the state of a Byzantine node at the point that a
+// Strategy is consulted.
+type Context struct {
+	Self       algorithm.NodeID
+	Validators []algorithm.NodeID
+	Height     uint64
+	Round      int
+	// Proposal is the proposal the node holds for the current round, or nil.
+	Proposal *algorithm.ConsensusMessage
+	// Rand is the network's random source, strategies must use it rather
+	// than a global source to keep runs reproducible.
+	Rand *rand.Rand
+}
+
+// Delivery is a message addressed to a single node.
+type Delivery struct {
+	To  algorithm.NodeID
+	Msg *algorithm.ConsensusMessage
+}
+
+// Strategy controls the behaviour of a Byzantine node. The node runs an
+// honest Algorithm and every message that the Algorithm would broadcast is
+// passed to Outgoing, the returned deliveries are sent instead.
+type Strategy interface {
+	Outgoing(c *Context, m *algorithm.ConsensusMessage) []Delivery
+}
+
+// Forgetter is an optional interface for strategies, if Forget returns true
+// the node discards all of its Algorithm state (including any lock) before
+// starting the round described by c.
+type Forgetter interface {
+	Forget(c *Context) bool
+}
+
+// Broadcast returns deliveries of m to every validator.
+func Broadcast(c *Context, m *algorithm.ConsensusMessage) []Delivery {
+	result := make([]Delivery, 0, len(c.Validators))
+	for _, v := range c.Validators {
+		result = append(result, Delivery{To: v, Msg: m})
+	}
+	return result
+}
+
+// split sends a to the first half of the validators and b to the rest, the
+// sender itself always receives a. The first validator of the second half
+// receives both, so that the equivocation is visible to at least one honest
+// node.
+func split(c *Context, a, b *algorithm.ConsensusMessage) []Delivery {
+	result := make([]Delivery, 0, len(c.Validators)+1)
+	half := len(c.Validators) / 2
+	for i, v := range c.Validators {
+		switch {
+		case i < half || v == c.Self:
+			result = append(result, Delivery{To: v, Msg: a})
+		case i == half:
+			result = append(result, Delivery{To: v, Msg: a}, Delivery{To: v, Msg: b})
+		default:
+			result = append(result, Delivery{To: v, Msg: b})
+		}
+	}
+	return result
+}
+
+func with(m *algorithm.ConsensusMessage, f func(*algorithm.ConsensusMessage)) *algorithm.ConsensusMessage {
+	cp := *m
+	f(&cp)
+	return &cp
+}
+
+// DoublePropose sends conflicting proposals to different halves of the
+// network when the node is the proposer.
+type DoublePropose struct{}
+
+func (DoublePropose) Outgoing(c *Context, m *algorithm.ConsensusMessage) []Delivery {
+	if m.MsgType != algorithm.Propose {
+		return Broadcast(c, m)
+	}
+	other := with(m, func(cm *algorithm.ConsensusMessage) { cm.Value = randomValue(c) })
+	return split(c, m, other)
+}
+
+// DoubleVote sends conflicting prevotes and precommits to different halves of
+// the network. A vote for a value is paired with a nil vote, and a nil vote
+// with a vote for the round's proposal if there is one.
+type DoubleVote struct{}
+
+func (DoubleVote) Outgoing(c *Context, m *algorithm.ConsensusMessage) []Delivery {
+	if m.MsgType == algorithm.Propose {
+		return Broadcast(c, m)
+	}
+	other := with(m, func(cm *algorithm.ConsensusMessage) {
+		switch {
+		case cm.Value != algorithm.NilValue:
+			cm.Value = algorithm.NilValue
+		case c.Proposal != nil:
+			cm.Value = c.Proposal.Value
+		default:
+			cm.Value = randomValue(c)
+		}
+	})
+	return split(c, m, other)
+}
+
+// Amnesia forgets its lock at the start of every round after the first, so
+// it will happily prevote for values that conflict with an earlier
+// precommit.
+type Amnesia struct{}
+
+func (Amnesia) Outgoing(c *Context, m *algorithm.ConsensusMessage) []Delivery {
+	return Broadcast(c, m)
+}
+
+func (Amnesia) Forget(c *Context) bool {
+	return c.Round > 0
+}
+
+// Withhold sends messages of the given Types only to validators not in
+// Targets. If Types is empty all messages are withheld and if Targets is
+// empty every other validator is targeted.
+type Withhold struct {
+	Types   []algorithm.Step
+	Targets []algorithm.NodeID
+}
+
+func (w Withhold) Outgoing(c *Context, m *algorithm.ConsensusMessage) []Delivery {
+	if len(w.Types) > 0 && !m.MsgType.In(w.Types...) {
+		return Broadcast(c, m)
+	}
+	var result []Delivery
+	for i, v := range c.Validators {
+		if v != c.Self && w.targeted(i, v) {
+			continue
+		}
+		result = append(result, Delivery{To: v, Msg: m})
+	}
+	return result
+}
+
+func (w Withhold) targeted(i int, v algorithm.NodeID) bool {
+	if len(w.Targets) == 0 {
+		return i%2 == 0
+	}
+	for _, t := range w.Targets {
+		if t == v {
+			return true
+		}
+	}
+	return false
+}
+
+// StaleValidRound proposes with a ValidRound picked at random from the rounds
+// before the current one, claiming a polka that may never have happened, or
+// that happened for a different value.
+type StaleValidRound struct{}
+
+func (StaleValidRound) Outgoing(c *Context, m *algorithm.ConsensusMessage) []Delivery {
+	if m.MsgType != algorithm.Propose || m.Round == 0 {
+		return Broadcast(c, m)
+	}
+	stale := with(m, func(cm *algorithm.ConsensusMessage) {
+		cm.ValidRound = c.Rand.Intn(cm.Round+1) - 1
+	})
+	return Broadcast(c, stale)
+}
+
+// FutureRounds accompanies every vote with nil votes of the same type for
+// each of the next Ahead rounds, attempting to drag honest nodes into rounds
+// they have no reason to enter.
+type FutureRounds struct {
+	Ahead int
+}
+
+func (f FutureRounds) Outgoing(c *Context, m *algorithm.ConsensusMessage) []Delivery {
+	result := Broadcast(c, m)
+	if m.MsgType == algorithm.Propose {
+		return result
+	}
+	for i := 1; i <= f.Ahead; i++ {
+		future := with(m, func(cm *algorithm.ConsensusMessage) {
+			cm.Round += i
+			cm.Value = algorithm.NilValue
+		})
+		result = append(result, Broadcast(c, future)...)
+	}
+	return result
+}
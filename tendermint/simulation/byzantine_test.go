@@ -0,0 +1,77 @@
+package simulation
+
+import (
+	"testing"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHonestNetworkDecides(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		net := NewNetwork(Config{Seed: seed, Honest: 4, Heights: 5})
+		require.True(t, net.Run(), "seed %d", seed)
+		require.Empty(t, net.Violations(), "seed %d", seed)
+		for _, n := range net.Honest() {
+			assert.Len(t, n.Decisions(), 5)
+			assert.Empty(t, n.Evidence())
+		}
+	}
+}
+
+func TestRunIsDeterministic(t *testing.T) {
+	cfg := Config{Seed: 42, Honest: 3, Byzantine: []Strategy{DoubleVote{}}, Heights: 3}
+	a := NewNetwork(cfg)
+	b := NewNetwork(cfg)
+	a.Run()
+	b.Run()
+	assert.Equal(t, a.Trace().String(), b.Trace().String())
+}
+
+func TestByzantineStrategies(t *testing.T) {
+	strategies := map[string]Strategy{
+		"DoublePropose":   DoublePropose{},
+		"DoubleVote":      DoubleVote{},
+		"Amnesia":         Amnesia{},
+		"Withhold":        Withhold{},
+		"WithholdVotes":   Withhold{Types: []algorithm.Step{algorithm.Prevote, algorithm.Precommit}},
+		"StaleValidRound": StaleValidRound{},
+		"FutureRounds":    FutureRounds{Ahead: 3},
+	}
+	for name, s := range strategies {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			for _, honest := range []int{3, 5} {
+				for seed := int64(0); seed < 20; seed++ {
+					// n = 3f+1 with f Byzantine nodes all using the same strategy.
+					f := (honest - 1) / 2
+					var byz []Strategy
+					for i := 0; i < f; i++ {
+						byz = append(byz, s)
+					}
+					net := NewNetwork(Config{Seed: seed, Honest: honest, Byzantine: byz, Heights: 4})
+					if !net.Run() || len(net.Violations()) > 0 {
+						t.Fatalf("honest: %d seed: %d violations: %v\n%v", honest, seed, net.Violations(), net.Trace())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEquivocationIsDetected(t *testing.T) {
+	for _, s := range []Strategy{DoublePropose{}, DoubleVote{}} {
+		detected := false
+		for seed := int64(0); seed < 10 && !detected; seed++ {
+			net := NewNetwork(Config{Seed: seed, Honest: 3, Byzantine: []Strategy{s}, Heights: 4})
+			net.Run()
+			for _, e := range net.Trace().Events {
+				if e.Kind == EquivocationEvent {
+					detected = true
+				}
+			}
+		}
+		assert.True(t, detected, "%T", s)
+	}
+}
@@ -0,0 +1,211 @@
+package simulation
+
+import (
+	"fmt"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// Property identifies a property verified by a Checker.
+type Property uint8
+
+const (
+	// Agreement requires that no two honest nodes decide different values
+	// at the same height.
+	Agreement Property = iota
+	// Validity requires that every decided value was proposed by the
+	// proposer of the decision round and is valid.
+	Validity
+	// NoDoubleSign requires that no honest node sends two different messages
+	// of the same type for the same height and round.
+	NoDoubleSign
+	// Termination requires that once the network has stabilized every
+	// honest node decides each height within a bounded time.
+	Termination
+)
+
+func (p Property) String() string {
+	switch p {
+	case Agreement:
+		return "agreement"
+	case Validity:
+		return "validity"
+	case NoDoubleSign:
+		return "no-double-sign"
+	case Termination:
+		return "termination"
+	default:
+		return fmt.Sprintf("Property(%d)", p)
+	}
+}
+
+// Violation describes a property that did not hold for a trace.
+type Violation struct {
+	Property Property
+	Height   uint64
+	Node     algorithm.NodeID
+	// Event is the index in the trace of the event at which the violation
+	// became apparent, or the length of the trace if it only became apparent
+	// at the end.
+	Event  int
+	Detail string
+}
+
+func (v Violation) Error() string {
+	return fmt.Sprintf("%v violated at height %d by %v (event %d): %s", v.Property, v.Height, v.Node, v.Event, v.Detail)
+}
+
+// Checker verifies safety and liveness properties over a Trace.
+type Checker struct {
+	// Honest returns true for nodes whose behaviour is checked.
+	Honest func(algorithm.NodeID) bool
+	// Proposer returns the proposer for a height and round.
+	Proposer func(height uint64, round int) algorithm.NodeID
+	// Valid reports the validity of a value.
+	Valid func(tendermint.Hash) bool
+	// Heights is the number of heights that every honest node is expected to
+	// decide, it is only used by the Termination check.
+	Heights uint64
+	// GST is the time after which message delays are bounded.
+	GST uint64
+	// Bound is the maximum time an honest node may take to decide a height
+	// after GST, or after it decided the previous height, whichever is
+	// later. A zero Bound disables the Termination check.
+	Bound uint64
+}
+
+// Checker returns a Checker configured for this network.
+func (n *Network) Checker() *Checker {
+	return &Checker{
+		Honest:   func(id algorithm.NodeID) bool { return n.nodes[id].Honest() },
+		Proposer: n.Proposer,
+		Valid:    n.cfg.Valid,
+		Heights:  n.cfg.Heights,
+		GST:      n.cfg.GST,
+		Bound:    n.cfg.LivenessBound,
+	}
+}
+
+type signKey struct {
+	sender algorithm.NodeID
+	height uint64
+	round  int
+	step   algorithm.Step
+}
+
+type proposalKey struct {
+	height uint64
+	round  int
+	value  tendermint.Hash
+}
+
+// Check returns the violations found in t, at most one violation is reported
+// per property and height.
+func (c *Checker) Check(t *Trace) []Violation {
+	var result []Violation
+	reported := make(map[Property]map[uint64]bool)
+	report := func(v Violation) {
+		if reported[v.Property] == nil {
+			reported[v.Property] = make(map[uint64]bool)
+		}
+		if !reported[v.Property][v.Height] {
+			reported[v.Property][v.Height] = true
+			result = append(result, v)
+		}
+	}
+
+	signed := make(map[signKey]*algorithm.ConsensusMessage)
+	proposed := make(map[proposalKey]bool)
+	decided := make(map[uint64]*algorithm.ConsensusMessage)
+	decidedBy := make(map[uint64]algorithm.NodeID)
+	// lastDecision holds the time of each honest node's latest decision.
+	lastDecision := make(map[algorithm.NodeID]uint64)
+	heights := make(map[algorithm.NodeID]uint64)
+
+	var end uint64
+	for i, e := range t.Events {
+		end = e.Time
+		switch e.Kind {
+		case SendEvent:
+			m := e.Msg
+			if m.MsgType == algorithm.Propose && m.Sender == c.Proposer(m.Height, m.Round) {
+				proposed[proposalKey{m.Height, m.Round, m.Value}] = true
+			}
+			if !c.Honest(e.Node) {
+				continue
+			}
+			k := signKey{e.Node, m.Height, m.Round, m.MsgType}
+			if prev, ok := signed[k]; ok && *prev != *m {
+				report(Violation{Property: NoDoubleSign, Height: m.Height, Node: e.Node, Event: i,
+					Detail: fmt.Sprintf("sent %v and %v", prev, m)})
+			}
+			signed[k] = m
+		case DecideEvent:
+			if !c.Honest(e.Node) {
+				continue
+			}
+			if c.Bound > 0 {
+				start := lastDecision[e.Node]
+				if start < c.GST {
+					start = c.GST
+				}
+				if e.Time > start+c.Bound {
+					report(Violation{Property: Termination, Height: e.Height, Node: e.Node, Event: i,
+						Detail: fmt.Sprintf("decided at %d, expected by %d", e.Time, start+c.Bound)})
+				}
+			}
+			lastDecision[e.Node] = e.Time
+			heights[e.Node] = e.Height
+
+			d := e.Msg
+			if prev, ok := decided[e.Height]; ok && prev.Value != d.Value {
+				report(Violation{Property: Agreement, Height: e.Height, Node: e.Node, Event: i,
+					Detail: fmt.Sprintf("decided %v but %v decided %v", d.Value, decidedBy[e.Height], prev.Value)})
+			} else if !ok {
+				decided[e.Height] = d
+				decidedBy[e.Height] = e.Node
+			}
+			if !proposed[proposalKey{e.Height, d.Round, d.Value}] {
+				report(Violation{Property: Validity, Height: e.Height, Node: e.Node, Event: i,
+					Detail: fmt.Sprintf("decided %v which was not proposed by the proposer of round %d", d.Value, d.Round)})
+			} else if !c.Valid(d.Value) {
+				report(Violation{Property: Validity, Height: e.Height, Node: e.Node, Event: i,
+					Detail: fmt.Sprintf("decided invalid value %v", d.Value)})
+			}
+		}
+	}
+
+	// Nodes that have not reached the target height must not have been
+	// waiting longer than the bound when the trace ended.
+	if c.Bound > 0 && c.Heights > 0 {
+		for _, node := range c.honestNodes(t) {
+			if heights[node] >= c.Heights {
+				continue
+			}
+			start := lastDecision[node]
+			if start < c.GST {
+				start = c.GST
+			}
+			if end > start+c.Bound {
+				report(Violation{Property: Termination, Height: heights[node] + 1, Node: node, Event: len(t.Events),
+					Detail: fmt.Sprintf("undecided at %d, expected by %d", end, start+c.Bound)})
+			}
+		}
+	}
+	return result
+}
+
+// honestNodes returns the honest nodes that appear in t in order of first
+// appearance.
+func (c *Checker) honestNodes(t *Trace) []algorithm.NodeID {
+	var result []algorithm.NodeID
+	seen := make(map[algorithm.NodeID]bool)
+	for _, e := range t.Events {
+		if c.Honest(e.Node) && !seen[e.Node] {
+			seen[e.Node] = true
+			result = append(result, e.Node)
+		}
+	}
+	return result
+}
@@ -0,0 +1,165 @@
+package simulation
+
+import (
+	"testing"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// partition shows victim a shadow world at the given height in which every
+// non nil value has been altered, all other validators see the original
+// messages. With more than f partition nodes this is enough to break
+// agreement.
+type partition struct {
+	victim algorithm.NodeID
+	height uint64
+}
+
+func (p partition) Outgoing(c *Context, m *algorithm.ConsensusMessage) []Delivery {
+	if m.Height != p.height {
+		return Broadcast(c, m)
+	}
+	shadow := with(m, func(cm *algorithm.ConsensusMessage) {
+		if cm.Value != algorithm.NilValue {
+			cm.Value[0] ^= 0xff
+		}
+	})
+	var result []Delivery
+	for _, v := range c.Validators {
+		if v == p.victim {
+			result = append(result, Delivery{To: v, Msg: shadow})
+		} else {
+			result = append(result, Delivery{To: v, Msg: m})
+		}
+	}
+	return result
+}
+
+func TestAgreementViolationIsMinimized(t *testing.T) {
+	// Validator 2 is Byzantine and proposes at height 2.
+	p := partition{victim: ValidatorID(1), height: 2}
+	var cfg Config
+	var schedule []Event
+	for seed := int64(0); seed < 20; seed++ {
+		// Two Byzantine nodes out of four is more than f.
+		cfg = Config{Seed: seed, Honest: 2, Byzantine: []Strategy{p, p}, Heights: 3}
+		net := NewNetwork(cfg)
+		net.Run()
+		if Violated(Agreement)(net) {
+			schedule = Schedule(net.Trace())
+			break
+		}
+	}
+	require.NotNil(t, schedule, "expected an agreement violation")
+
+	// The full schedule reproduces the violation.
+	require.True(t, Violated(Agreement)(Replay(cfg, schedule)))
+
+	minimized := Minimize(cfg, schedule, Violated(Agreement))
+	assert.Less(t, len(minimized), len(schedule))
+	replayed := Replay(cfg, minimized)
+	require.True(t, Violated(Agreement)(replayed), "minimized trace:\n%v", replayed.Trace())
+
+	// Removing any single event from the minimized schedule hides the
+	// violation.
+	for i := range minimized {
+		reduced := append(append([]Event{}, minimized[:i]...), minimized[i+1:]...)
+		assert.False(t, Violated(Agreement)(Replay(cfg, reduced)), "event %d is not needed", i)
+	}
+}
+
+func TestReplayReproducesRun(t *testing.T) {
+	cfg := Config{Seed: 7, Honest: 3, Byzantine: []Strategy{DoubleVote{}}, Heights: 3}
+	net := NewNetwork(cfg)
+	require.True(t, net.Run())
+	replayed := Replay(cfg, Schedule(net.Trace()))
+	for i, n := range net.Honest() {
+		assert.Equal(t, n.Decisions(), replayed.Honest()[i].Decisions())
+	}
+}
+
+func TestTermination(t *testing.T) {
+	for seed := int64(0); seed < 10; seed++ {
+		cfg := Config{
+			Seed:          seed,
+			Honest:        4,
+			Heights:       5,
+			GST:           500,
+			PreGSTDelay:   200,
+			LivenessBound: 1000,
+		}
+		net := NewNetwork(cfg)
+		require.True(t, net.Run())
+		require.Empty(t, net.Violations(), "seed %d", seed)
+	}
+
+	// An unreasonably small bound is violated.
+	net := NewNetwork(Config{Seed: 1, Honest: 4, Heights: 2, LivenessBound: 1})
+	net.Run()
+	assert.True(t, Violated(Termination)(net))
+}
+
+func TestTerminationUndecided(t *testing.T) {
+	// Half the network is Byzantine and silent, so nothing can be decided.
+	silent := Withhold{Targets: []algorithm.NodeID{ValidatorID(0), ValidatorID(1)}}
+	net := NewNetwork(Config{Seed: 1, Honest: 2, Byzantine: []Strategy{silent, silent}, LivenessBound: 5})
+	assert.False(t, net.Run())
+	violations := net.Violations()
+	require.NotEmpty(t, violations)
+	assert.Equal(t, Termination, violations[0].Property)
+	assert.Equal(t, uint64(1), violations[0].Height)
+}
+
+func TestCheckerSafetyProperties(t *testing.T) {
+	honest := ValidatorID(0)
+	value := DefaultProposalValue(honest, 1, 0)
+	proposal := &algorithm.ConsensusMessage{Sender: honest, MsgType: algorithm.Propose, Height: 1, Round: 0, Value: value, ValidRound: -1}
+	c := &Checker{
+		Honest:   func(id algorithm.NodeID) bool { return id == honest },
+		Proposer: func(uint64, int) algorithm.NodeID { return honest },
+		Valid:    func(v tendermint.Hash) bool { return v == value },
+	}
+
+	// A decision for a value that was proposed and is valid is fine.
+	trace := &Trace{Events: []Event{
+		{Kind: SendEvent, Node: honest, Msg: proposal},
+		{Kind: DecideEvent, Node: honest, Height: 1, Msg: proposal},
+	}}
+	assert.Empty(t, c.Check(trace))
+
+	// A decision for a value that was never proposed.
+	unproposed := with(proposal, func(cm *algorithm.ConsensusMessage) { cm.Round = 1 })
+	trace = &Trace{Events: []Event{
+		{Kind: SendEvent, Node: honest, Msg: proposal},
+		{Kind: DecideEvent, Node: honest, Height: 1, Msg: unproposed},
+	}}
+	violations := c.Check(trace)
+	require.Len(t, violations, 1)
+	assert.Equal(t, Validity, violations[0].Property)
+
+	// A decision for a value that is not valid.
+	invalid := with(proposal, func(cm *algorithm.ConsensusMessage) { cm.Value[0]++ })
+	trace = &Trace{Events: []Event{
+		{Kind: SendEvent, Node: honest, Msg: invalid},
+		{Kind: DecideEvent, Node: honest, Height: 1, Msg: invalid},
+	}}
+	violations = c.Check(trace)
+	require.Len(t, violations, 1)
+	assert.Equal(t, Validity, violations[0].Property)
+
+	// Two different prevotes for the same round.
+	prevote := &algorithm.ConsensusMessage{Sender: honest, MsgType: algorithm.Prevote, Height: 1, Round: 0, Value: value}
+	nilPrevote := with(prevote, func(cm *algorithm.ConsensusMessage) { cm.Value = algorithm.NilValue })
+	trace = &Trace{Events: []Event{
+		{Kind: SendEvent, Node: honest, Msg: prevote},
+		{Kind: SendEvent, Node: honest, Msg: prevote},
+		{Kind: SendEvent, Node: honest, Msg: nilPrevote},
+	}}
+	violations = c.Check(trace)
+	require.Len(t, violations, 1)
+	assert.Equal(t, NoDoubleSign, violations[0].Property)
+	assert.Equal(t, 2, violations[0].Event)
+}
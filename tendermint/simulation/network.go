@@ -0,0 +1,273 @@
+// Package simulation provides a deterministic, single threaded network
+// simulator for running clusters of Algorithm instances.
+//
+// Messages and timeouts are modelled as events on a logical clock, message
+// delays are drawn from a seeded random source, so a run can be reproduced
+// exactly from its Config. Nodes can be honest or Byzantine, Byzantine nodes
+// run an honest core whose outgoing messages are rewritten by a Strategy.
+package simulation
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// Config configures a simulated network.
+type Config struct {
+	// Seed seeds the random source used for message delays and strategies.
+	Seed int64
+	// Honest is the number of honest validators.
+	Honest int
+	// Byzantine holds one strategy per Byzantine validator.
+	Byzantine []Strategy
+	// Heights is the number of heights that each honest node must decide
+	// before the run is considered complete.
+	Heights uint64
+	// MaxDelay is the maximum delay applied to a message sent at or after
+	// GST, delays are drawn uniformly from [1, MaxDelay].
+	MaxDelay uint64
+	// GST is the global stabilization time, messages sent before GST are
+	// delayed by up to PreGSTDelay instead of MaxDelay.
+	GST         uint64
+	PreGSTDelay uint64
+	// LivenessBound configures the Termination check of the network's
+	// Checker, zero disables it.
+	LivenessBound uint64
+	// TimeoutUnit scales the Delay of timeouts returned by Algorithm.
+	TimeoutUnit uint64
+	// MaxEvents bounds the length of a run.
+	MaxEvents int
+	// Valid decides the validity of proposed values, if nil all values are
+	// considered valid.
+	Valid func(tendermint.Hash) bool
+	// ProposalValue returns the value that the given node proposes at the
+	// given height and round, if nil a value derived from the arguments is
+	// used.
+	ProposalValue func(node algorithm.NodeID, height uint64, round int) tendermint.Hash
+}
+
+func (c *Config) setDefaults() {
+	if c.Heights == 0 {
+		c.Heights = 1
+	}
+	if c.MaxDelay == 0 {
+		c.MaxDelay = 5
+	}
+	if c.PreGSTDelay == 0 {
+		c.PreGSTDelay = c.MaxDelay
+	}
+	if c.TimeoutUnit == 0 {
+		c.TimeoutUnit = 10
+	}
+	if c.MaxEvents == 0 {
+		c.MaxEvents = 100000
+	}
+	if c.Valid == nil {
+		c.Valid = func(tendermint.Hash) bool { return true }
+	}
+	if c.ProposalValue == nil {
+		c.ProposalValue = DefaultProposalValue
+	}
+}
+
+// DefaultProposalValue derives a proposal value from the node, height and
+// round, so that every proposal in a run is distinct.
+func DefaultProposalValue(node algorithm.NodeID, height uint64, round int) tendermint.Hash {
+	var b [20 + 8 + 8]byte
+	copy(b[:], node[:])
+	binary.BigEndian.PutUint64(b[20:], height)
+	binary.BigEndian.PutUint64(b[28:], uint64(round))
+	return sha256.Sum256(b[:])
+}
+
+// Network is a simulated network of validators.
+type Network struct {
+	cfg        Config
+	rand       *rand.Rand
+	now        uint64
+	seq        uint64
+	queue      eventQueue
+	validators []algorithm.NodeID
+	nodes      map[algorithm.NodeID]*Node
+	trace      Trace
+	processed  int
+	// replay is non nil when the network is following a schedule rather
+	// than its event queue.
+	replay *replayState
+}
+
+// NewNetwork builds a network from cfg, validators are assigned ids in order
+// with the honest validators first.
+func NewNetwork(cfg Config) *Network {
+	cfg.setDefaults()
+	n := &Network{
+		cfg:   cfg,
+		rand:  rand.New(rand.NewSource(cfg.Seed)),
+		nodes: make(map[algorithm.NodeID]*Node),
+	}
+	total := cfg.Honest + len(cfg.Byzantine)
+	for i := 0; i < total; i++ {
+		n.validators = append(n.validators, ValidatorID(i))
+	}
+	for i, id := range n.validators {
+		var strategy Strategy
+		if i >= cfg.Honest {
+			strategy = cfg.Byzantine[i-cfg.Honest]
+		}
+		n.nodes[id] = newNode(id, n, strategy)
+	}
+	return n
+}
+
+// ValidatorID returns the id of the i'th validator of a simulated network.
+// The index is held in the leading bytes so that it shows up in
+// NodeID.String.
+func ValidatorID(i int) algorithm.NodeID {
+	var id algorithm.NodeID
+	binary.BigEndian.PutUint32(id[:], uint32(i)<<8)
+	return id
+}
+
+// Validators returns the ids of all the validators in the network.
+func (n *Network) Validators() []algorithm.NodeID {
+	return n.validators
+}
+
+// Node returns the node with the given id.
+func (n *Network) Node(id algorithm.NodeID) *Node {
+	return n.nodes[id]
+}
+
+// Honest returns the honest nodes in the network.
+func (n *Network) Honest() []*Node {
+	var result []*Node
+	for _, id := range n.validators {
+		if n.nodes[id].Honest() {
+			result = append(result, n.nodes[id])
+		}
+	}
+	return result
+}
+
+// Trace returns the events recorded so far.
+func (n *Network) Trace() *Trace {
+	return &n.trace
+}
+
+// Proposer returns the proposer for the given height and round.
+func (n *Network) Proposer(height uint64, round int) algorithm.NodeID {
+	return Proposer(n.validators, height, round)
+}
+
+// Proposer selects a proposer from validators in round robin fashion.
+func Proposer(validators []algorithm.NodeID, height uint64, round int) algorithm.NodeID {
+	return validators[(height+uint64(round))%uint64(len(validators))]
+}
+
+// Run starts all nodes and processes events until every honest node has
+// decided Config.Heights heights, there are no more events, or
+// Config.MaxEvents events have been processed. It returns true if every
+// honest node reached the target height.
+func (n *Network) Run() bool {
+	for _, id := range n.validators {
+		n.nodes[id].start()
+	}
+	for n.queue.Len() > 0 && n.processed < n.cfg.MaxEvents {
+		if n.done() {
+			return true
+		}
+		e := heap.Pop(&n.queue).(*event)
+		n.now = e.time
+		n.processed++
+		node := n.nodes[e.to]
+		switch {
+		case e.msg != nil:
+			n.trace.add(Event{Time: n.now, Kind: DeliverEvent, From: e.from, Node: e.to, Msg: e.msg})
+			node.deliver(e.msg)
+		case e.timeout != nil:
+			n.trace.add(Event{Time: n.now, Kind: TimeoutEvent, Node: e.to, Timeout: e.timeout})
+			node.onTimeout(e.timeout)
+		}
+	}
+	return n.done()
+}
+
+// Violations checks the trace recorded so far with the network's Checker.
+func (n *Network) Violations() []Violation {
+	return n.Checker().Check(&n.trace)
+}
+
+func (n *Network) done() bool {
+	for _, node := range n.Honest() {
+		if uint64(len(node.decisions)) < n.cfg.Heights {
+			return false
+		}
+	}
+	return true
+}
+
+// send queues m for delivery to the given node after a random delay.
+func (n *Network) send(from, to algorithm.NodeID, m *algorithm.ConsensusMessage) {
+	if _, ok := n.nodes[to]; !ok {
+		panic(fmt.Sprintf("unknown recipient %v", to))
+	}
+	if n.replay != nil {
+		n.replay.sent(from, to, m)
+		return
+	}
+	maxDelay := n.cfg.MaxDelay
+	if n.now < n.cfg.GST {
+		maxDelay = n.cfg.PreGSTDelay
+	}
+	delay := uint64(1) + uint64(n.rand.Int63n(int64(maxDelay)))
+	n.push(&event{time: n.now + delay, from: from, to: to, msg: m})
+}
+
+func (n *Network) schedule(node algorithm.NodeID, t *algorithm.Timeout) {
+	if n.replay != nil {
+		n.replay.scheduled(node, t)
+		return
+	}
+	n.push(&event{time: n.now + uint64(t.Delay)*n.cfg.TimeoutUnit, to: node, timeout: t})
+}
+
+func (n *Network) push(e *event) {
+	e.seq = n.seq
+	n.seq++
+	heap.Push(&n.queue, e)
+}
+
+type event struct {
+	time    uint64
+	seq     uint64
+	from    algorithm.NodeID
+	to      algorithm.NodeID
+	msg     *algorithm.ConsensusMessage
+	timeout *algorithm.Timeout
+}
+
+// eventQueue orders events by time, events with the same time are ordered by
+// the order in which they were queued.
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].time != q[j].time {
+		return q[i].time < q[j].time
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
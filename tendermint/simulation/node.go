@@ -0,0 +1,254 @@
+package simulation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// Node is a simulated validator. It drives an Algorithm in the way a real
+// node would, it tracks heights, filters messages from non proposers, adds
+// messages to the Store and feeds them to the Algorithm. A Node with a
+// non nil Strategy is Byzantine.
+type Node struct {
+	id       algorithm.NodeID
+	net      *Network
+	strategy Strategy
+
+	height uint64
+	round  int
+	store  *algorithm.Store
+	algo   *algorithm.Algorithm
+	// future holds messages received for heights we have not reached yet.
+	future []*algorithm.ConsensusMessage
+
+	decisions []*algorithm.ConsensusMessage
+	evidence  []error
+	// history holds the stores of decided heights so that we can help
+	// lagging nodes, helped records the nodes we have helped at each height.
+	history map[uint64]*algorithm.Store
+	helped  map[uint64]map[algorithm.NodeID]bool
+}
+
+func newNode(id algorithm.NodeID, net *Network, strategy Strategy) *Node {
+	return &Node{
+		id:       id,
+		net:      net,
+		strategy: strategy,
+		history:  make(map[uint64]*algorithm.Store),
+		helped:   make(map[uint64]map[algorithm.NodeID]bool),
+	}
+}
+
+// ID returns the id of this node.
+func (n *Node) ID() algorithm.NodeID {
+	return n.id
+}
+
+// Honest returns true if this node is not running a Byzantine strategy.
+func (n *Node) Honest() bool {
+	return n.strategy == nil
+}
+
+// Height returns the height the node is currently working on.
+func (n *Node) Height() uint64 {
+	return n.height
+}
+
+// Decisions returns the proposals decided by this node, the decision for
+// height h is at index h-1.
+func (n *Node) Decisions() []*algorithm.ConsensusMessage {
+	return n.decisions
+}
+
+// Evidence returns the equivocation errors reported by the node's Store.
+func (n *Node) Evidence() []error {
+	return n.evidence
+}
+
+func (n *Node) start() {
+	n.height = 1
+	n.newHeight()
+}
+
+func (n *Node) newHeight() {
+	n.store = algorithm.NewStore()
+	n.algo = algorithm.New(n.id, algorithm.NewBasicOracle(len(n.net.validators), n.height, n.store))
+	n.round = -1
+	n.startRound(0)
+
+	future := n.future
+	n.future = nil
+	for _, m := range future {
+		n.deliver(m)
+	}
+}
+
+func (n *Node) startRound(round int) {
+	if f, ok := n.strategy.(Forgetter); ok && f.Forget(n.context()) {
+		n.algo = algorithm.New(n.id, algorithm.NewBasicOracle(len(n.net.validators), n.height, n.store))
+	}
+	height := n.height
+	n.round = round
+	value := algorithm.NilValue
+	if n.net.Proposer(height, round) == n.id {
+		value = n.net.cfg.ProposalValue(n.id, height, round)
+	}
+	cm, to := n.algo.StartRound(value, round)
+	n.handle(nil, cm, to)
+
+	// Messages for this round may have arrived before we entered it, the
+	// Algorithm only evaluates upon conditions on receipt of a message so
+	// we replay them now.
+	for _, m := range n.store.RoundMessages(round) {
+		if n.height != height || n.round != round {
+			return
+		}
+		n.process(m)
+	}
+}
+
+func (n *Node) deliver(m *algorithm.ConsensusMessage) {
+	if m.Height < n.height {
+		n.help(m)
+		return
+	}
+	if m.Height > n.height {
+		n.future = append(n.future, m)
+		return
+	}
+	if !n.isValidator(m.Sender) {
+		return
+	}
+	if m.MsgType == algorithm.Propose && m.Sender != n.net.Proposer(m.Height, m.Round) {
+		return
+	}
+	if m.MsgType == algorithm.Propose && n.net.cfg.Valid(m.Value) {
+		n.store.SetValid(&m.Value)
+	}
+	raw := encode(m)
+	if err := n.store.AddMessage(m, raw, sha256.Sum256(raw)); err != nil {
+		n.evidence = append(n.evidence, err)
+		n.net.trace.add(Event{Time: n.net.now, Kind: EquivocationEvent, Node: n.id, Height: n.height, Msg: m})
+		if !errors.Is(err, algorithm.ErrConflictingProposal) {
+			return
+		}
+	}
+	n.process(m)
+}
+
+func (n *Node) process(m *algorithm.ConsensusMessage) {
+	rc, cm, to := n.algo.ReceiveMessage(m)
+	n.handle(rc, cm, to)
+}
+
+func (n *Node) onTimeout(t *algorithm.Timeout) {
+	cm, rc := n.algo.OnTimeout(t)
+	n.handle(rc, cm, nil)
+}
+
+func (n *Node) handle(rc *algorithm.RoundChange, cm *algorithm.ConsensusMessage, to *algorithm.Timeout) {
+	if cm != nil {
+		n.broadcast(cm)
+	}
+	if to != nil {
+		n.net.schedule(n.id, to)
+	}
+	if rc != nil {
+		if rc.Decision != nil {
+			n.decide(rc.Decision)
+			n.height++
+			n.newHeight()
+			return
+		}
+		n.startRound(rc.Round)
+	}
+}
+
+func (n *Node) decide(p *algorithm.ConsensusMessage) {
+	n.decisions = append(n.decisions, p)
+	n.history[n.height] = n.store
+	n.net.trace.add(Event{Time: n.net.now, Kind: DecideEvent, Node: n.id, Height: n.height, Msg: p})
+}
+
+// help sends the proposal and precommits that allowed us to decide at the
+// height of m to the sender of m, since the sender has evidently not decided
+// that height yet. Without this a node that misses the precommits for a
+// height would never progress.
+func (n *Node) help(m *algorithm.ConsensusMessage) {
+	if !n.Honest() || n.helped[m.Height][m.Sender] {
+		return
+	}
+	if n.helped[m.Height] == nil {
+		n.helped[m.Height] = make(map[algorithm.NodeID]bool)
+	}
+	n.helped[m.Height][m.Sender] = true
+	d := n.decisions[m.Height-1]
+	for _, cm := range n.history[m.Height].RoundMessages(d.Round) {
+		if cm.MsgType != algorithm.Prevote {
+			n.net.send(n.id, m.Sender, cm)
+		}
+	}
+}
+
+func (n *Node) broadcast(cm *algorithm.ConsensusMessage) {
+	if n.strategy == nil {
+		n.net.trace.add(Event{Time: n.net.now, Kind: SendEvent, Node: n.id, Height: n.height, Msg: cm})
+		for _, v := range n.net.validators {
+			n.net.send(n.id, v, cm)
+		}
+		return
+	}
+	sent := make(map[algorithm.ConsensusMessage]bool)
+	for _, d := range n.strategy.Outgoing(n.context(), cm) {
+		if !sent[*d.Msg] {
+			sent[*d.Msg] = true
+			n.net.trace.add(Event{Time: n.net.now, Kind: SendEvent, Node: n.id, Height: n.height, Msg: d.Msg})
+		}
+		n.net.send(n.id, d.To, d.Msg)
+	}
+}
+
+func (n *Node) context() *Context {
+	c := &Context{
+		Self:       n.id,
+		Validators: n.net.validators,
+		Height:     n.height,
+		Round:      n.round,
+		Rand:       n.net.rand,
+	}
+	if msgs := n.store.RoundMessages(n.round); len(msgs) > 0 && msgs[0].MsgType == algorithm.Propose {
+		c.Proposal = msgs[0]
+	}
+	return c
+}
+
+func (n *Node) isValidator(id algorithm.NodeID) bool {
+	for _, v := range n.net.validators {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// encode returns the raw bytes stored alongside m, the encoding is
+// deterministic so that equal messages have equal hashes.
+func encode(m *algorithm.ConsensusMessage) []byte {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(m); err != nil {
+		panic(err)
+	}
+	return b.Bytes()
+}
+
+// randomValue returns a random non nil value.
+func randomValue(c *Context) tendermint.Hash {
+	var v tendermint.Hash
+	c.Rand.Read(v[:])
+	return v
+}
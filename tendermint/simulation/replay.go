@@ -0,0 +1,163 @@
+package simulation
+
+import (
+	"sort"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// Schedule extracts the deliveries and timeouts from t, these are the only
+// inputs to the nodes of a network so they are sufficient to reproduce the
+// run with Replay.
+func Schedule(t *Trace) []Event {
+	var result []Event
+	for _, e := range t.Events {
+		if e.Kind == DeliverEvent || e.Kind == TimeoutEvent {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+type deliveryKey struct {
+	from algorithm.NodeID
+	to   algorithm.NodeID
+	msg  algorithm.ConsensusMessage
+}
+
+type timeoutKey struct {
+	node    algorithm.NodeID
+	timeout algorithm.Timeout
+}
+
+// replayState tracks the messages and timeouts that the nodes of a replaying
+// network have produced but which have not yet been consumed by the
+// schedule.
+type replayState struct {
+	deliveries map[deliveryKey]int
+	timeouts   map[timeoutKey]int
+	// injected holds the Byzantine messages injected so far.
+	injected map[algorithm.ConsensusMessage]bool
+}
+
+func (r *replayState) sent(from, to algorithm.NodeID, m *algorithm.ConsensusMessage) {
+	r.deliveries[deliveryKey{from, to, *m}]++
+}
+
+func (r *replayState) scheduled(node algorithm.NodeID, t *algorithm.Timeout) {
+	r.timeouts[timeoutKey{node, *t}]++
+}
+
+// Replay builds a network from cfg and drives its honest nodes with schedule
+// instead of the event queue. Byzantine nodes are not run, instead any
+// delivery from a Byzantine node in the schedule is injected as is, since a
+// Byzantine node may send anything. Deliveries from honest nodes and
+// timeouts are only applied if the honest node has actually produced them
+// in the replay, others are skipped, this allows arbitrary subsets of a
+// schedule to be replayed.
+func Replay(cfg Config, schedule []Event) *Network {
+	n := NewNetwork(cfg)
+	n.replay = &replayState{
+		deliveries: make(map[deliveryKey]int),
+		timeouts:   make(map[timeoutKey]int),
+		injected:   make(map[algorithm.ConsensusMessage]bool),
+	}
+	for _, node := range n.Honest() {
+		node.start()
+	}
+	for _, e := range schedule {
+		node := n.nodes[e.Node]
+		if node == nil || !node.Honest() {
+			continue
+		}
+		switch e.Kind {
+		case DeliverEvent:
+			if n.nodes[e.From].Honest() {
+				k := deliveryKey{e.From, e.Node, *e.Msg}
+				if n.replay.deliveries[k] == 0 {
+					continue
+				}
+				n.replay.deliveries[k]--
+			}
+			n.now = e.Time
+			if !n.nodes[e.From].Honest() && !n.replay.injected[*e.Msg] {
+				n.replay.injected[*e.Msg] = true
+				n.trace.add(Event{Time: n.now, Kind: SendEvent, Node: e.From, Height: e.Msg.Height, Msg: e.Msg})
+			}
+			n.trace.add(Event{Time: n.now, Kind: DeliverEvent, From: e.From, Node: e.Node, Msg: e.Msg})
+			node.deliver(e.Msg)
+		case TimeoutEvent:
+			k := timeoutKey{e.Node, *e.Timeout}
+			if n.replay.timeouts[k] == 0 {
+				continue
+			}
+			n.replay.timeouts[k]--
+			n.now = e.Time
+			n.trace.add(Event{Time: n.now, Kind: TimeoutEvent, Node: e.Node, Timeout: e.Timeout})
+			node.onTimeout(e.Timeout)
+		}
+	}
+	return n
+}
+
+// Minimize returns a minimal subset of schedule for which fails still
+// returns true when the subset is replayed. It first finds the shortest
+// failing prefix and then applies delta debugging to remove events from it.
+// If the full schedule does not fail it is returned unchanged.
+func Minimize(cfg Config, schedule []Event, fails func(*Network) bool) []Event {
+	if !fails(Replay(cfg, schedule)) {
+		return schedule
+	}
+	// Shortest failing prefix.
+	l := sort.Search(len(schedule), func(i int) bool {
+		return fails(Replay(cfg, schedule[:i]))
+	})
+	schedule = schedule[:l]
+
+	// Delta debugging, try removing chunks of decreasing size.
+	chunks := 2
+	for len(schedule) >= 2 {
+		size := (len(schedule) + chunks - 1) / chunks
+		reduced := false
+		for start := 0; start < len(schedule); start += size {
+			end := start + size
+			if end > len(schedule) {
+				end = len(schedule)
+			}
+			complement := make([]Event, 0, len(schedule)-(end-start))
+			complement = append(complement, schedule[:start]...)
+			complement = append(complement, schedule[end:]...)
+			if fails(Replay(cfg, complement)) {
+				schedule = complement
+				if chunks > 2 {
+					chunks--
+				}
+				reduced = true
+				break
+			}
+		}
+		if !reduced {
+			if size == 1 {
+				break
+			}
+			chunks *= 2
+			if chunks > len(schedule) {
+				chunks = len(schedule)
+			}
+		}
+	}
+	return schedule
+}
+
+// Violated returns a predicate for Minimize that reports whether the given
+// property is violated by a network's trace.
+func Violated(p Property) func(*Network) bool {
+	return func(n *Network) bool {
+		for _, v := range n.Violations() {
+			if v.Property == p {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,82 @@
+package simulation
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// EventKind identifies the type of an Event.
+type EventKind uint8
+
+const (
+	// DeliverEvent records the delivery of Msg from From to Node.
+	DeliverEvent EventKind = iota
+	// TimeoutEvent records Timeout firing at Node.
+	TimeoutEvent
+	// DecideEvent records Node deciding Msg at Height.
+	DecideEvent
+	// EquivocationEvent records Node detecting an equivocating Msg.
+	EquivocationEvent
+	// SendEvent records Node sending Msg, which it created, to at least one
+	// other node.
+	SendEvent
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case DeliverEvent:
+		return "deliver"
+	case TimeoutEvent:
+		return "timeout"
+	case DecideEvent:
+		return "decide"
+	case EquivocationEvent:
+		return "equivocation"
+	case SendEvent:
+		return "send"
+	default:
+		return fmt.Sprintf("EventKind(%d)", k)
+	}
+}
+
+// Event is a single entry in a Trace.
+type Event struct {
+	Time    uint64
+	Kind    EventKind
+	Node    algorithm.NodeID
+	From    algorithm.NodeID
+	Height  uint64
+	Msg     *algorithm.ConsensusMessage
+	Timeout *algorithm.Timeout
+}
+
+func (e Event) String() string {
+	switch e.Kind {
+	case DeliverEvent:
+		return fmt.Sprintf("%6d %v %v<-%v %v", e.Time, e.Kind, e.Node, e.From, e.Msg)
+	case TimeoutEvent:
+		return fmt.Sprintf("%6d %v %v delay:%d", e.Time, e.Kind, e.Node, e.Timeout.Delay)
+	default:
+		return fmt.Sprintf("%6d %v %v h:%-3d %v", e.Time, e.Kind, e.Node, e.Height, e.Msg)
+	}
+}
+
+// Trace is the ordered record of events in a run.
+type Trace struct {
+	Events []Event
+}
+
+func (t *Trace) add(e Event) {
+	t.Events = append(t.Events, e)
+}
+
+func (t *Trace) String() string {
+	var b strings.Builder
+	for _, e := range t.Events {
+		b.WriteString(e.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
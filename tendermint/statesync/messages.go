@@ -0,0 +1,118 @@
+package statesync
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The first byte of each payload on Channel identifies its kind.
+const (
+	// kindSnapshotsRequest asks a peer to advertise its snapshots, it has no
+	// body.
+	kindSnapshotsRequest byte = iota + 1
+	// kindSnapshot is followed by an encoded Snapshot.
+	kindSnapshot
+	// kindChunkRequest is followed by an encoded chunkID.
+	kindChunkRequest
+	// kindChunk is followed by an encoded chunkID, a byte set to 1 if the
+	// chunk is held and the chunk.
+	kindChunk
+	// kindLightBlockRequest is followed by the big endian 8 byte height, 0
+	// asks for the latest height.
+	kindLightBlockRequest
+	// kindLightBlock is followed by the requested height and the encoded
+	// light block, which is missing if the height is not held.
+	kindLightBlock
+)
+
+// snapshotSize is the size of an encoded Snapshot.
+const snapshotSize = 8 + 4 + 4 + 32
+
+func (s Snapshot) encode() []byte {
+	b := make([]byte, 1, 1+snapshotSize)
+	b[0] = kindSnapshot
+	b = binary.BigEndian.AppendUint64(b, s.Height)
+	b = binary.BigEndian.AppendUint32(b, s.Format)
+	b = binary.BigEndian.AppendUint32(b, s.Chunks)
+	return append(b, s.Hash[:]...)
+}
+
+func decodeSnapshot(b []byte) (Snapshot, error) {
+	if len(b) != snapshotSize {
+		return Snapshot{}, fmt.Errorf("snapshot has length %d", len(b))
+	}
+	s := Snapshot{
+		Height: binary.BigEndian.Uint64(b),
+		Format: binary.BigEndian.Uint32(b[8:]),
+		Chunks: binary.BigEndian.Uint32(b[12:]),
+	}
+	copy(s.Hash[:], b[16:])
+	if s.Height == 0 || s.Chunks == 0 {
+		return Snapshot{}, fmt.Errorf("invalid snapshot %+v", s)
+	}
+	return s, nil
+}
+
+// chunkID identifies a chunk of a snapshot.
+type chunkID struct {
+	height uint64
+	format uint32
+	index  uint32
+}
+
+const chunkIDSize = 8 + 4 + 4
+
+func (c chunkID) encode(kind byte) []byte {
+	b := []byte{kind}
+	b = binary.BigEndian.AppendUint64(b, c.height)
+	b = binary.BigEndian.AppendUint32(b, c.format)
+	return binary.BigEndian.AppendUint32(b, c.index)
+}
+
+func decodeChunkID(b []byte) (chunkID, error) {
+	if len(b) < chunkIDSize {
+		return chunkID{}, fmt.Errorf("chunk id has length %d", len(b))
+	}
+	return chunkID{
+		height: binary.BigEndian.Uint64(b),
+		format: binary.BigEndian.Uint32(b[8:]),
+		index:  binary.BigEndian.Uint32(b[12:]),
+	}, nil
+}
+
+// encodeChunk encodes a chunk response, chunk is nil if the chunk is not
+// held.
+func encodeChunk(id chunkID, chunk []byte) []byte {
+	b := id.encode(kindChunk)
+	if chunk == nil {
+		return append(b, 0)
+	}
+	return append(append(b, 1), chunk...)
+}
+
+// decodeChunk decodes a chunk response, the chunk is nil if it is not held.
+func decodeChunk(b []byte) (chunkID, []byte, error) {
+	id, err := decodeChunkID(b)
+	if err != nil {
+		return chunkID{}, nil, err
+	}
+	b = b[chunkIDSize:]
+	if len(b) == 0 || b[0] > 1 {
+		return chunkID{}, nil, fmt.Errorf("invalid chunk response")
+	}
+	if b[0] == 0 {
+		return id, nil, nil
+	}
+	return id, append([]byte{}, b[1:]...), nil
+}
+
+func encodeHeight(kind byte, height uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte{kind}, height)
+}
+
+func decodeHeight(b []byte) (uint64, error) {
+	if len(b) < 8 {
+		return 0, fmt.Errorf("height has length %d", len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
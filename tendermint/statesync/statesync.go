@@ -0,0 +1,475 @@
+// Package statesync lets a new node join without replaying the decided
+// heights, by restoring a snapshot of the application state taken by its
+// peers.
+//
+// Applications take snapshots of their state at heights of their choosing and
+// split them into chunks. Every node runs a Reactor, which advertises the
+// snapshots of its Application and serves their chunks and the light blocks
+// of the heights it holds. A new node calls Sync, which discovers the
+// snapshots of its peers and restores the most recent one it can verify. The
+// application hash that a snapshot taken at height H must result in is that
+// of the header of height H+1, which a light client verifies from a header
+// trusted out of band. The light blocks that follow also give the validator
+// sets that the updates of the heights before the snapshot determined. Once
+// restored the node fetches the remaining heights with block sync and then
+// runs consensus, both starting from the State returned by Sync.
+//
+// The trusted header must be recent. Validators that have since left the
+// validator set can sign a fork of any height they once validated, and a node
+// syncing from an old header would restore the forged state they offer
+// without any way to tell. Sync therefore refuses a trusted header older than
+// the light client's trusting period, Config.TrustingPeriod, which must be
+// shorter than the time validators remain accountable after leaving the set.
+// See light.Client.
+package statesync
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/blocksync"
+	"github.com/piersy/tendermint-go/tendermint/light"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+	"github.com/piersy/tendermint-go/tendermint/types"
+)
+
+// Channel is the p2p channel that carries state sync messages.
+const Channel p2p.ChannelID = 0x60
+
+const (
+	// DefaultDiscoveryTime is the default time Sync waits for peers to
+	// advertise their snapshots.
+	DefaultDiscoveryTime = time.Second
+	// DefaultRequestTimeout is the default time allowed for a peer to serve a
+	// chunk or a light block.
+	DefaultRequestTimeout = 5 * time.Second
+)
+
+var (
+	// ErrTransportClosed is returned by Run if the transport is closed.
+	ErrTransportClosed = errors.New("transport closed")
+	// ErrNoSnapshot is returned by Sync if no snapshot could be restored.
+	ErrNoSnapshot = errors.New("no snapshot restored")
+	errTimeout    = errors.New("request timed out")
+)
+
+// Snapshot describes a snapshot of the application state resulting from the
+// heights up to and including Height.
+type Snapshot struct {
+	Height uint64
+	// Format is an application defined version of the snapshot's encoding.
+	Format uint32
+	// Chunks is the number of chunks the snapshot is split into.
+	Chunks uint32
+	// Hash is an application defined hash of the snapshot's contents, it is
+	// not verified against anything but lets the application check the
+	// chunks it restores.
+	Hash tendermint.Hash
+}
+
+// Application is the part of an application that takes and restores
+// snapshots, its methods may be called concurrently with each other.
+type Application interface {
+	// Snapshots returns the snapshots the application holds.
+	Snapshots() []Snapshot
+	// LoadChunk returns a chunk of a snapshot the application holds.
+	LoadChunk(s Snapshot, index uint32) ([]byte, error)
+	// OfferSnapshot starts restoring s, whose restored state must hash to
+	// appHash. It returns an error if the application rejects s. Offering
+	// another snapshot abandons any restore in progress.
+	OfferSnapshot(s Snapshot, appHash tendermint.Hash) error
+	// ApplyChunk applies a chunk of the snapshot being restored, chunks are
+	// applied in order.
+	ApplyChunk(index uint32, chunk []byte) error
+	// AppHash returns the hash of the application state.
+	AppHash() tendermint.Hash
+}
+
+// State is the state of a node that restored a snapshot, from which it
+// continues with block sync and consensus.
+type State struct {
+	// Height is the first height after the snapshot.
+	Height uint64
+	// AppHash is the hash of the restored application state.
+	AppHash tendermint.Hash
+	// Schedule gives the validator sets from Height on.
+	Schedule *types.ValidatorSchedule
+}
+
+// Config configures a Reactor.
+type Config struct {
+	// App takes and restores snapshots.
+	App Application
+	// Store holds the blocks whose light blocks are served to peers, and
+	// Validators gives the validator set that decided each of them.
+	Store      blocksync.Store
+	Validators func(height uint64) (*types.ValidatorSet, bool)
+	// ChainID identifies the chain whose light blocks are verified.
+	ChainID string
+	// TrustHeight and TrustHash identify a header obtained from a trusted
+	// source, from which Sync verifies the snapshots. They are only needed
+	// to call Sync.
+	TrustHeight uint64
+	TrustHash   tendermint.Hash
+	// TrustLevel is the trust level of the light client, it defaults to
+	// light.DefaultTrustLevel.
+	TrustLevel light.TrustLevel
+	// TrustingPeriod is the time for which the light client trusts a
+	// header, including the one identified by TrustHash, it defaults to
+	// light.DefaultTrustingPeriod.
+	TrustingPeriod time.Duration
+	// ValidatorUpdateDelay is the delay of the validator schedule, it
+	// defaults to types.DefaultValidatorUpdateDelay.
+	ValidatorUpdateDelay uint64
+	// DiscoveryTime is the time Sync waits for peers to advertise their
+	// snapshots.
+	DiscoveryTime time.Duration
+	// RequestTimeout is the time allowed for a peer to serve a chunk or a
+	// light block.
+	RequestTimeout time.Duration
+}
+
+func (c *Config) setDefaults() {
+	if c.ValidatorUpdateDelay == 0 {
+		c.ValidatorUpdateDelay = types.DefaultValidatorUpdateDelay
+	}
+	if c.DiscoveryTime == 0 {
+		c.DiscoveryTime = DefaultDiscoveryTime
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = DefaultRequestTimeout
+	}
+}
+
+// Reactor serves snapshots and light blocks to peers and restores snapshots
+// served by them.
+type Reactor struct {
+	cfg       Config
+	transport p2p.Transport
+
+	mu sync.Mutex
+	// syncing is set while Sync discovers snapshots, offers holds the peers
+	// that advertised each snapshot.
+	syncing bool
+	offers  map[Snapshot][]algorithm.NodeID
+	// waiters holds the requests waiting for a response.
+	waiters map[requestKey]chan []byte
+}
+
+// requestKey matches a response to its request.
+type requestKey struct {
+	peer  algorithm.NodeID
+	kind  byte
+	chunk chunkID
+}
+
+// NewReactor creates a Reactor that communicates over t, call Run to start
+// it.
+func NewReactor(cfg Config, t p2p.Transport) *Reactor {
+	cfg.setDefaults()
+	return &Reactor{
+		cfg:       cfg,
+		transport: t,
+		offers:    make(map[Snapshot][]algorithm.NodeID),
+		waiters:   make(map[requestKey]chan []byte),
+	}
+}
+
+// Run serves peers and passes on the responses to the requests of Sync until
+// ctx is cancelled or the transport is closed. Run must only be called once.
+func (r *Reactor) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-r.transport.Receive():
+			if !ok {
+				return ErrTransportClosed
+			}
+			if e.Channel == Channel && len(e.Payload) > 0 {
+				r.receive(e)
+			}
+		case e, ok := <-r.transport.PeerEvents():
+			if !ok {
+				return ErrTransportClosed
+			}
+			r.mu.Lock()
+			syncing := r.syncing
+			r.mu.Unlock()
+			if e.Type == p2p.PeerUp && syncing {
+				_ = r.transport.Send(e.Peer, Channel, []byte{kindSnapshotsRequest})
+			}
+		}
+	}
+}
+
+func (r *Reactor) receive(e p2p.Envelope) {
+	payload := e.Payload[1:]
+	switch e.Payload[0] {
+	case kindSnapshotsRequest:
+		for _, s := range r.cfg.App.Snapshots() {
+			_ = r.transport.Send(e.From, Channel, s.encode())
+		}
+	case kindSnapshot:
+		if s, err := decodeSnapshot(payload); err == nil {
+			r.mu.Lock()
+			if r.syncing {
+				r.offers[s] = append(r.offers[s], e.From)
+			}
+			r.mu.Unlock()
+		}
+	case kindChunkRequest:
+		if id, err := decodeChunkID(payload); err == nil {
+			r.serveChunk(e.From, id)
+		}
+	case kindChunk:
+		if id, chunk, err := decodeChunk(payload); err == nil {
+			r.respond(requestKey{peer: e.From, kind: kindChunk, chunk: id}, chunk)
+		}
+	case kindLightBlockRequest:
+		if height, err := decodeHeight(payload); err == nil {
+			r.serveLightBlock(e.From, height)
+		}
+	case kindLightBlock:
+		if height, err := decodeHeight(payload); err == nil {
+			r.respond(requestKey{peer: e.From, kind: kindLightBlock, chunk: chunkID{height: height}}, payload[8:])
+		}
+	}
+}
+
+// serveChunk sends a peer a chunk of one of our snapshots, or a response
+// saying that we don't hold it.
+func (r *Reactor) serveChunk(id algorithm.NodeID, c chunkID) {
+	var chunk []byte
+	for _, s := range r.cfg.App.Snapshots() {
+		if s.Height == c.height && s.Format == c.format && c.index < s.Chunks {
+			if loaded, err := r.cfg.App.LoadChunk(s, c.index); err == nil {
+				chunk = append([]byte{}, loaded...)
+			}
+			break
+		}
+	}
+	_ = r.transport.Send(id, Channel, encodeChunk(c, chunk))
+}
+
+// serveLightBlock sends a peer the light block at height, or at our latest
+// height if height is 0. The light block is left out if we don't hold it.
+func (r *Reactor) serveLightBlock(id algorithm.NodeID, height uint64) {
+	response := encodeHeight(kindLightBlock, height)
+	if r.cfg.Store != nil {
+		h := height
+		if h == 0 {
+			h = r.cfg.Store.Height()
+		}
+		b := r.cfg.Store.Block(h)
+		vs, ok := r.cfg.Validators(h)
+		if b != nil && ok {
+			if lb, err := light.NewLightBlock(b, vs); err == nil {
+				if encoded, err := lb.MarshalBinary(); err == nil {
+					response = append(response, encoded...)
+				}
+			}
+		}
+	}
+	_ = r.transport.Send(id, Channel, response)
+}
+
+// respond passes a response to the request waiting for it, responses that
+// nobody waits for are dropped.
+func (r *Reactor) respond(key requestKey, response []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ch := r.waiters[key]; ch != nil {
+		delete(r.waiters, key)
+		ch <- response
+	}
+}
+
+// request sends a request to a peer and waits for the response matching key.
+func (r *Reactor) request(ctx context.Context, key requestKey, request []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	r.mu.Lock()
+	r.waiters[key] = ch
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.waiters, key)
+		r.mu.Unlock()
+	}()
+	if err := r.transport.Send(key.peer, Channel, request); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(r.cfg.RequestTimeout)
+	defer timer.Stop()
+	select {
+	case response := <-ch:
+		return response, nil
+	case <-timer.C:
+		return nil, errTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Sync discovers the snapshots of our peers and restores the most recent one
+// that it can verify, trying the others in turn if that fails. It must be
+// called while Run is running and returns ErrNoSnapshot if no snapshot could
+// be restored, in which case it may be called again later.
+func (r *Reactor) Sync(ctx context.Context) (*State, error) {
+	if r.cfg.TrustHeight == 0 {
+		return nil, fmt.Errorf("no trusted height to sync from")
+	}
+	r.mu.Lock()
+	r.syncing = true
+	r.offers = make(map[Snapshot][]algorithm.NodeID)
+	r.mu.Unlock()
+	r.transport.Broadcast(Channel, []byte{kindSnapshotsRequest})
+	timer := time.NewTimer(r.cfg.DiscoveryTime)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	r.mu.Lock()
+	r.syncing = false
+	type offer struct {
+		Snapshot
+		peers []algorithm.NodeID
+	}
+	var offers []offer
+	for s, peers := range r.offers {
+		offers = append(offers, offer{s, peers})
+	}
+	r.mu.Unlock()
+	// The most recent snapshots come first, and of those the ones offered
+	// by the most peers.
+	sort.Slice(offers, func(i, j int) bool {
+		if offers[i].Height != offers[j].Height {
+			return offers[i].Height > offers[j].Height
+		}
+		return len(offers[i].peers) > len(offers[j].peers)
+	})
+	errs := []error{ErrNoSnapshot}
+	for _, o := range offers {
+		state, err := r.restore(ctx, o.Snapshot, o.peers)
+		if err == nil {
+			return state, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, fmt.Errorf("snapshot at height %d: %w", o.Height, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// restore verifies the application hash and validator sets that follow the
+// snapshot s, then restores it from the peers that offered it.
+func (r *Reactor) restore(ctx context.Context, s Snapshot, peers []algorithm.NodeID) (*State, error) {
+	var witnesses []light.Provider
+	for _, id := range peers[1:] {
+		witnesses = append(witnesses, &peerProvider{r: r, id: id})
+	}
+	primary := &peerProvider{r: r, id: peers[0]}
+	root, err := primary.LightBlock(ctx, r.cfg.TrustHeight)
+	if err != nil {
+		return nil, err
+	}
+	if root.Height() != r.cfg.TrustHeight || root.Header.Hash() != r.cfg.TrustHash {
+		return nil, fmt.Errorf("%s served a header other than the one trusted", primary.ID())
+	}
+	client, err := light.NewClient(root, primary, light.Config{ChainID: r.cfg.ChainID, TrustLevel: r.cfg.TrustLevel, TrustingPeriod: r.cfg.TrustingPeriod, Witnesses: witnesses})
+	if err != nil {
+		return nil, err
+	}
+	// The header following the snapshot holds the hash of the state it
+	// restores, it and the headers up to the delay give the validator sets
+	// already determined at the snapshot.
+	var appHash tendermint.Hash
+	var sets []*types.ValidatorSet
+	for h := s.Height + 1; h <= s.Height+r.cfg.ValidatorUpdateDelay; h++ {
+		lb, err := client.VerifyLightBlockAtHeight(ctx, h)
+		if err != nil {
+			return nil, err
+		}
+		if h == s.Height+1 {
+			appHash = lb.Header.AppHash
+		}
+		sets = append(sets, lb.Validators)
+	}
+
+	if err := r.cfg.App.OfferSnapshot(s, appHash); err != nil {
+		return nil, fmt.Errorf("snapshot rejected: %w", err)
+	}
+	for i := uint32(0); i < s.Chunks; i++ {
+		chunk, err := r.fetchChunk(ctx, s, i, peers)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.cfg.App.ApplyChunk(i, chunk); err != nil {
+			return nil, fmt.Errorf("applying chunk %d: %w", i, err)
+		}
+	}
+	if r.cfg.App.AppHash() != appHash {
+		return nil, fmt.Errorf("restored state has hash %x, expected %x", r.cfg.App.AppHash(), appHash)
+	}
+	schedule, err := types.RestoreValidatorSchedule(s.Height+1, sets, r.cfg.ValidatorUpdateDelay)
+	if err != nil {
+		return nil, err
+	}
+	return &State{Height: s.Height + 1, AppHash: appHash, Schedule: schedule}, nil
+}
+
+// fetchChunk requests a chunk from each of peers in turn, starting from a
+// different peer for each chunk to spread the load.
+func (r *Reactor) fetchChunk(ctx context.Context, s Snapshot, index uint32, peers []algorithm.NodeID) ([]byte, error) {
+	id := chunkID{height: s.Height, format: s.Format, index: index}
+	for i := range peers {
+		peer := peers[(int(index)+i)%len(peers)]
+		chunk, err := r.request(ctx, requestKey{peer: peer, kind: kindChunk, chunk: id}, id.encode(kindChunkRequest))
+		if err == nil && chunk != nil {
+			return chunk, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("no peer served chunk %d", index)
+}
+
+// peerProvider is a light.Provider requesting light blocks from a peer.
+type peerProvider struct {
+	r  *Reactor
+	id algorithm.NodeID
+}
+
+// ID implements light.Provider.
+func (p *peerProvider) ID() string {
+	return hex.EncodeToString(p.id[:])
+}
+
+// LightBlock implements light.Provider.
+func (p *peerProvider) LightBlock(ctx context.Context, height uint64) (*light.LightBlock, error) {
+	key := requestKey{peer: p.id, kind: kindLightBlock, chunk: chunkID{height: height}}
+	response, err := p.r.request(ctx, key, encodeHeight(kindLightBlockRequest, height))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) == 0 {
+		return nil, light.ErrLightBlockNotFound
+	}
+	lb := new(light.LightBlock)
+	if err := lb.UnmarshalBinary(response); err != nil {
+		return nil, err
+	}
+	return lb, nil
+}
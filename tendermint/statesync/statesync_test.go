@@ -0,0 +1,312 @@
+package statesync
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/blocksync"
+	"github.com/piersy/tendermint-go/tendermint/consensus"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+	"github.com/piersy/tendermint-go/tendermint/light"
+	"github.com/piersy/tendermint-go/tendermint/p2p"
+	"github.com/piersy/tendermint-go/tendermint/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTimeout = 20 * time.Second
+
+func testKeys(n int) []ed25519.PrivateKey {
+	result := make([]ed25519.PrivateKey, n)
+	for i := range result {
+		seed := make([]byte, ed25519.SeedSize)
+		seed[0] = byte(i + 1)
+		result[i] = ed25519.NewKeyFromSeed(seed)
+	}
+	return result
+}
+
+func validatorSet(t *testing.T, ks []ed25519.PrivateKey) *types.ValidatorSet {
+	var vals []types.Validator
+	for _, k := range ks {
+		vals = append(vals, types.NewValidator(k.Public().(ed25519.PublicKey)))
+	}
+	vs, err := types.NewValidatorSet(vals)
+	require.NoError(t, err)
+	return vs
+}
+
+// chunkSize is small so that snapshots span several chunks.
+const chunkSize = 50
+
+// testApp executes a payload by appending its hash to its state and takes
+// snapshots at heights 5 and 10. A lying app advertises snapshots of a
+// corrupted state one height later instead.
+type testApp struct {
+	liar bool
+
+	mu        sync.Mutex
+	height    uint64
+	state     []byte
+	snapshots map[Snapshot][]byte
+	// restoring is the snapshot being restored and restored the chunks
+	// applied so far.
+	restoring Snapshot
+	restored  []byte
+}
+
+func newTestApp(liar bool) *testApp {
+	return &testApp{liar: liar, snapshots: make(map[Snapshot][]byte)}
+}
+
+func (a *testApp) execute(height uint64, payload []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	h := sha256.Sum256(payload)
+	a.height = height
+	a.state = append(a.state, h[:]...)
+	if height%5 != 0 || height > 10 {
+		return
+	}
+	data := binary.BigEndian.AppendUint64(nil, height)
+	data = append(data, a.state...)
+	if a.liar {
+		data = binary.BigEndian.AppendUint64(nil, height+1)
+		data = append(data, bytes.Repeat([]byte{0xff}, len(a.state)+sha256.Size)...)
+	}
+	s := Snapshot{
+		Height: binary.BigEndian.Uint64(data),
+		Format: 1,
+		Chunks: uint32((len(data) + chunkSize - 1) / chunkSize),
+		Hash:   sha256.Sum256(data),
+	}
+	a.snapshots[s] = data
+}
+
+func (a *testApp) Snapshots() []Snapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var result []Snapshot
+	for s := range a.snapshots {
+		result = append(result, s)
+	}
+	return result
+}
+
+func (a *testApp) LoadChunk(s Snapshot, index uint32) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	data, ok := a.snapshots[s]
+	if !ok {
+		return nil, fmt.Errorf("unknown snapshot")
+	}
+	end := (int(index) + 1) * chunkSize
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[int(index)*chunkSize : end], nil
+}
+
+func (a *testApp) OfferSnapshot(s Snapshot, _ tendermint.Hash) error {
+	if s.Format != 1 {
+		return fmt.Errorf("unknown format %d", s.Format)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.restoring, a.restored = s, nil
+	return nil
+}
+
+func (a *testApp) ApplyChunk(index uint32, chunk []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.restored = append(a.restored, chunk...)
+	if index < a.restoring.Chunks-1 {
+		return nil
+	}
+	if sha256.Sum256(a.restored) != a.restoring.Hash {
+		return fmt.Errorf("restored snapshot does not match its hash")
+	}
+	a.height = binary.BigEndian.Uint64(a.restored)
+	a.state = a.restored[8:]
+	return nil
+}
+
+func (a *testApp) AppHash() tendermint.Hash {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return sha256.Sum256(a.state)
+}
+
+func TestMessageEncoding(t *testing.T) {
+	s := Snapshot{Height: 10, Format: 1, Chunks: 3, Hash: sha256.Sum256([]byte("snapshot"))}
+	decoded, err := decodeSnapshot(s.encode()[1:])
+	require.NoError(t, err)
+	assert.Equal(t, s, decoded)
+	_, err = decodeSnapshot(Snapshot{Height: 10}.encode()[1:])
+	assert.Error(t, err)
+
+	id := chunkID{height: 10, format: 1, index: 2}
+	decodedID, chunk, err := decodeChunk(encodeChunk(id, []byte("chunk"))[1:])
+	require.NoError(t, err)
+	assert.Equal(t, id, decodedID)
+	assert.Equal(t, []byte("chunk"), chunk)
+	_, chunk, err = decodeChunk(encodeChunk(id, nil)[1:])
+	require.NoError(t, err)
+	assert.Nil(t, chunk)
+	_, _, err = decodeChunk(id.encode(kindChunk)[1:])
+	assert.Error(t, err)
+}
+
+func TestStateSyncHandsOverToBlockSync(t *testing.T) {
+	ks := testKeys(4)
+	vs := validatorSet(t, ks)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The validators run consensus, serve the blocks they decide and the
+	// snapshots of their apps. The last one advertises corrupted snapshots.
+	n := p2p.NewMemNetwork()
+	var stores []*blocksync.MemStore
+	var apps []*testApp
+	for i, k := range ks {
+		tr := n.Transport(keys.Address(k.Public().(ed25519.PublicKey)))
+		defer tr.Close()
+		mux := p2p.NewMux(tr, p2p.MuxConfig{})
+		consensusTransport, blocksyncTransport, statesyncTransport := mux.Channels(consensus.Channel), mux.Channels(blocksync.Channel), mux.Channels(Channel)
+		mux.Start()
+		store := blocksync.NewMemStore()
+		app := newTestApp(i == len(ks)-1)
+		stores, apps = append(stores, store), append(apps, app)
+		schedule, err := types.NewValidatorSchedule(1, vs, 0)
+		require.NoError(t, err)
+		d := consensus.NewDriver(consensus.Config{
+			Signer:         types.NewKeySigner(k),
+			Schedule:       schedule,
+			TimeoutUnit:    20 * time.Millisecond,
+			GossipInterval: 5 * time.Millisecond,
+			AppHash:        func(uint64) tendermint.Hash { return app.AppHash() },
+			Decided: func(p *algorithm.ConsensusMessage, b *types.Block) []types.ValidatorUpdate {
+				app.execute(p.Height, b.Payload)
+				_ = store.Add(b)
+				return nil
+			},
+		}, consensusTransport)
+		br := blocksync.NewReactor(blocksync.Config{Store: store, Validators: schedule.At, Interval: 5 * time.Millisecond}, blocksyncTransport)
+		sr := NewReactor(Config{App: app, Store: store, Validators: schedule.At}, statesyncTransport)
+		go func() { _ = d.Run(ctx) }()
+		go func() { _ = br.Run(ctx) }()
+		go func() { _ = sr.Run(ctx) }()
+	}
+	require.Eventually(t, func() bool {
+		for _, s := range stores {
+			if s.Height() < 13 {
+				return false
+			}
+		}
+		return true
+	}, testTimeout, time.Millisecond)
+	root, err := stores[0].Block(1).Header()
+	require.NoError(t, err)
+
+	// A node whose trusted header is older than its trusting period refuses
+	// every snapshot.
+	staleTransport := n.Transport(algorithm.NodeID{0xfe})
+	defer staleTransport.Close()
+	stale := NewReactor(Config{
+		App:            newTestApp(false),
+		TrustHeight:    1,
+		TrustHash:      root.Hash(),
+		TrustingPeriod: time.Nanosecond,
+		DiscoveryTime:  100 * time.Millisecond,
+	}, staleTransport)
+	go func() { _ = stale.Run(ctx) }()
+	_, err = stale.Sync(ctx)
+	assert.ErrorIs(t, err, light.ErrTrustExpired)
+
+	// A new node restores the honest snapshot at height 10, the corrupted
+	// snapshot at height 11 is tried first and rejected.
+	tr := n.Transport(algorithm.NodeID{0xff})
+	defer tr.Close()
+	mux := p2p.NewMux(tr, p2p.MuxConfig{})
+	consensusTransport, blocksyncTransport, statesyncTransport := mux.Channels(consensus.Channel), mux.Channels(blocksync.Channel), mux.Channels(Channel)
+	mux.Start()
+	app := newTestApp(false)
+	sr := NewReactor(Config{
+		App:           app,
+		TrustHeight:   1,
+		TrustHash:     root.Hash(),
+		DiscoveryTime: 100 * time.Millisecond,
+	}, statesyncTransport)
+	go func() { _ = sr.Run(ctx) }()
+	state, err := sr.Sync(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), state.Height)
+	header, err := stores[0].Block(11).Header()
+	require.NoError(t, err)
+	assert.Equal(t, header.AppHash, state.AppHash)
+	assert.Equal(t, header.AppHash, app.AppHash())
+
+	// It then syncs the following heights and runs consensus, it only
+	// accepts proposals if its app hash matches that of the validators.
+	var mu sync.Mutex
+	var synced, decided []uint64
+	store := blocksync.NewMemStore()
+	execute := func(p *algorithm.ConsensusMessage, b *types.Block) {
+		app.execute(p.Height, b.Payload)
+		_ = store.Add(b)
+		_ = state.Schedule.Apply(p.Height, nil)
+	}
+	br := blocksync.NewReactor(blocksync.Config{
+		Store:      store,
+		Validators: state.Schedule.At,
+		Height:     state.Height,
+		Interval:   5 * time.Millisecond,
+		Apply: func(p *algorithm.ConsensusMessage, b *types.Block) error {
+			execute(p, b)
+			mu.Lock()
+			synced = append(synced, p.Height)
+			mu.Unlock()
+			return nil
+		},
+		Synced: func(height uint64) {
+			d := consensus.NewDriver(consensus.Config{
+				Schedule:       state.Schedule,
+				Height:         height,
+				TimeoutUnit:    20 * time.Millisecond,
+				GossipInterval: 5 * time.Millisecond,
+				AppHash:        func(uint64) tendermint.Hash { return app.AppHash() },
+				Decided: func(p *algorithm.ConsensusMessage, b *types.Block) []types.ValidatorUpdate {
+					execute(p, b)
+					mu.Lock()
+					decided = append(decided, p.Height)
+					mu.Unlock()
+					return nil
+				},
+			}, consensusTransport)
+			go func() { _ = d.Run(ctx) }()
+		},
+	}, blocksyncTransport)
+	go func() { _ = br.Run(ctx) }()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(decided) >= 3
+	}, testTimeout, time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	heights := append(append([]uint64{}, synced...), decided...)
+	for i, h := range heights {
+		assert.Equal(t, state.Height+uint64(i), h)
+	}
+}
@@ -0,0 +1,137 @@
+package types
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// Commit certifies a decision, it holds the signed precommits of a quorum of
+// validators for the decided value in the round in which it was decided.
+type Commit struct {
+	Height uint64
+	Round  int
+	Value  tendermint.Hash
+	// Precommits holds the precommits as encoded by EncodeSigned.
+	Precommits [][]byte
+}
+
+// NewCommit builds the commit for the decided proposal p from the precommits
+// for its value held in store.
+func NewCommit(store *algorithm.Store, p *algorithm.ConsensusMessage) *Commit {
+	c := &Commit{Height: p.Height, Round: p.Round, Value: p.Value}
+	for _, m := range store.RoundMessages(p.Round) {
+		if m.MsgType == algorithm.Precommit && m.Value == p.Value {
+			c.Precommits = append(c.Precommits, store.Raw(m))
+		}
+	}
+	return c
+}
+
+// Verify checks that the commit holds valid precommits for its value from a
+// quorum of vs, signed for the chain identified by chainID.
+func (c *Commit) Verify(chainID string, vs *ValidatorSet) error {
+	if c.Value == algorithm.NilValue {
+		return fmt.Errorf("commit for nil value")
+	}
+	senders := make(map[algorithm.NodeID]bool, len(c.Precommits))
+	for _, raw := range c.Precommits {
+		m, err := VerifySigned(chainID, vs, raw)
+		if err != nil {
+			return err
+		}
+		if m.MsgType != algorithm.Precommit || m.Height != c.Height || m.Round != c.Round || m.Value != c.Value {
+			return fmt.Errorf("commit for %v at height %d round %d holds %v", c.Value, c.Height, c.Round, m)
+		}
+		if senders[m.Sender] {
+			return fmt.Errorf("commit holds duplicate precommit from %v", m.Sender)
+		}
+		senders[m.Sender] = true
+	}
+	if len(senders) < vs.Quorum() {
+		return fmt.Errorf("commit has %d precommits, quorum is %d", len(senders), vs.Quorum())
+	}
+	return nil
+}
+
+// MarshalBinary encodes the commit as the big endian 8 byte height, 4 byte
+// round, the value and a 2 byte count followed by the precommits.
+func (c *Commit) MarshalBinary() ([]byte, error) {
+	if len(c.Precommits) > 1<<16-1 {
+		return nil, fmt.Errorf("commit has %d precommits", len(c.Precommits))
+	}
+	b := make([]byte, 0, 46+len(c.Precommits)*SignedSize)
+	b = binary.BigEndian.AppendUint64(b, c.Height)
+	b = binary.BigEndian.AppendUint32(b, uint32(c.Round))
+	b = append(b, c.Value[:]...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(c.Precommits)))
+	for _, raw := range c.Precommits {
+		if len(raw) != SignedSize {
+			return nil, fmt.Errorf("precommit has length %d", len(raw))
+		}
+		b = append(b, raw...)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a commit encoded by MarshalBinary, the precommits
+// are not verified.
+func (c *Commit) UnmarshalBinary(b []byte) error {
+	if len(b) < 46 {
+		return fmt.Errorf("commit has length %d", len(b))
+	}
+	n := int(binary.BigEndian.Uint16(b[44:]))
+	if len(b) != 46+n*SignedSize {
+		return fmt.Errorf("commit of %d precommits has length %d", n, len(b))
+	}
+	c.Height = binary.BigEndian.Uint64(b)
+	c.Round = int(binary.BigEndian.Uint32(b[8:]))
+	copy(c.Value[:], b[12:])
+	c.Precommits = make([][]byte, n)
+	for i := range c.Precommits {
+		c.Precommits[i] = b[46+i*SignedSize : 46+(i+1)*SignedSize]
+	}
+	return nil
+}
+
+// Block is a decided height, the decided proposal, its payload and the
+// commit certifying the decision.
+type Block struct {
+	// Proposal is the decided proposal as encoded by EncodeProposal.
+	Proposal []byte
+	Payload  []byte
+	Commit   *Commit
+}
+
+// Header returns the header of the decided proposal.
+func (b *Block) Header() (Header, error) {
+	return ProposalHeader(b.Proposal)
+}
+
+// Verify checks that the block was decided by vs at height on the chain
+// identified by chainID, it returns the decided proposal.
+func (b *Block) Verify(chainID string, vs *ValidatorSet, height uint64) (*algorithm.ConsensusMessage, error) {
+	p, err := VerifySigned(chainID, vs, b.Proposal)
+	if err != nil {
+		return nil, err
+	}
+	if p.MsgType != algorithm.Propose || p.Height != height || p.Sender != vs.Proposer(p.Height, p.Round) {
+		return nil, fmt.Errorf("block for height %d holds %v", height, p)
+	}
+	if b.Commit.Height != height || b.Commit.Round != p.Round || b.Commit.Value != p.Value {
+		return nil, fmt.Errorf("commit for %v at height %d round %d does not match %v", b.Commit.Value, b.Commit.Height, b.Commit.Round, p)
+	}
+	header, _ := ProposalHeader(b.Proposal)
+	if header.ValidatorsHash != vs.Hash() {
+		return nil, fmt.Errorf("header of %v is for validator set %v", p, header.ValidatorsHash)
+	}
+	if NewPartSetFromData(b.Payload).Header() != header.Payload {
+		return nil, fmt.Errorf("payload does not match %v", p)
+	}
+	if err := b.Commit.Verify(chainID, vs); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
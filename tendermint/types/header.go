@@ -0,0 +1,89 @@
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint"
+)
+
+// HeaderSize is the size of an encoded Header.
+const HeaderSize = 2*8 + 3*32 + PartSetHeaderSize
+
+// Header describes a proposed height, a proposal's value is the hash of its
+// header so a commit for the value certifies everything the header commits
+// to. Light clients follow the validator set from one height to the next
+// through the validator set hashes, and learn the application state that the
+// preceding heights resulted in through the application hash.
+type Header struct {
+	Height uint64
+	// Time is the proposer's time when proposing, see CanonicalTime. It is
+	// later than the time of the previous height, so light clients can tell
+	// how old a header is.
+	Time time.Time
+	// ValidatorsHash is the hash of the validator set deciding Height,
+	// NextValidatorsHash is that of the validator set deciding Height+1.
+	ValidatorsHash     tendermint.Hash
+	NextValidatorsHash tendermint.Hash
+	// AppHash is the hash of the application state resulting from the
+	// heights before Height.
+	AppHash tendermint.Hash
+	// Payload identifies the parts of the proposed payload.
+	Payload PartSetHeader
+}
+
+// Hash returns the hash of the header, see Header.
+func (h Header) Hash() tendermint.Hash {
+	b, _ := h.MarshalBinary()
+	return sha256.Sum256(b)
+}
+
+// MarshalBinary encodes the header as the big endian 8 byte height, the big
+// endian 8 byte time in nanoseconds since the Unix epoch, the validator set
+// hashes, the application hash and the payload's part set
+// header.
+func (h Header) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, HeaderSize)
+	b = binary.BigEndian.AppendUint64(b, h.Height)
+	var nanos int64
+	if !h.Time.IsZero() {
+		nanos = h.Time.UnixNano()
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(nanos))
+	b = append(b, h.ValidatorsHash[:]...)
+	b = append(b, h.NextValidatorsHash[:]...)
+	b = append(b, h.AppHash[:]...)
+	payload, _ := h.Payload.MarshalBinary()
+	return append(b, payload...), nil
+}
+
+// UnmarshalBinary decodes a header encoded by MarshalBinary.
+func (h *Header) UnmarshalBinary(b []byte) error {
+	if len(b) != HeaderSize {
+		return fmt.Errorf("header has length %d, expected %d", len(b), HeaderSize)
+	}
+	if err := h.Payload.UnmarshalBinary(b[112:]); err != nil {
+		return err
+	}
+	h.Height = binary.BigEndian.Uint64(b)
+	h.Time = time.Time{}
+	if nanos := int64(binary.BigEndian.Uint64(b[8:])); nanos != 0 {
+		h.Time = time.Unix(0, nanos).UTC()
+	}
+	copy(h.ValidatorsHash[:], b[16:])
+	copy(h.NextValidatorsHash[:], b[48:])
+	copy(h.AppHash[:], b[80:])
+	return nil
+}
+
+// CanonicalTime returns t as a header decodes it, in UTC with nanosecond
+// precision and without a monotonic clock reading, so that headers holding
+// the same time compare equal.
+func CanonicalTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Time{}
+	}
+	return time.Unix(0, t.UnixNano()).UTC()
+}
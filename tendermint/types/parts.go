@@ -0,0 +1,191 @@
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/merkle"
+)
+
+// PartSize is the size of every part of a payload except the last, which may
+// be shorter.
+const PartSize = 64 << 10
+
+// PartSetHeaderSize is the size of an encoded PartSetHeader.
+const PartSetHeaderSize = 4 + 32
+
+// ErrPartSetMismatch is returned by AddPart for parts that don't belong to
+// the part set.
+var ErrPartSetMismatch = errors.New("part does not belong to part set")
+
+// PartSetHeader identifies the parts of a payload, the payload is split into
+// Total parts whose Merkle root is Root. A proposal's value is the hash of the
+// header of its payload, so votes for the value commit to the payload.
+type PartSetHeader struct {
+	Total int
+	Root  tendermint.Hash
+}
+
+// Hash returns the hash of the header, see PartSetHeader.
+func (h PartSetHeader) Hash() tendermint.Hash {
+	b, _ := h.MarshalBinary()
+	return sha256.Sum256(b)
+}
+
+// MarshalBinary encodes the header as the big endian 4 byte total followed by
+// the root.
+func (h PartSetHeader) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, PartSetHeaderSize)
+	b = binary.BigEndian.AppendUint32(b, uint32(h.Total))
+	return append(b, h.Root[:]...), nil
+}
+
+// UnmarshalBinary decodes a header encoded by MarshalBinary.
+func (h *PartSetHeader) UnmarshalBinary(b []byte) error {
+	if len(b) != PartSetHeaderSize {
+		return fmt.Errorf("part set header has length %d, expected %d", len(b), PartSetHeaderSize)
+	}
+	total := binary.BigEndian.Uint32(b)
+	if total == 0 || total > 1<<merkle.MaxAunts-1 {
+		return fmt.Errorf("invalid part set total %d", total)
+	}
+	h.Total = int(total)
+	copy(h.Root[:], b[4:])
+	return nil
+}
+
+// Part is one chunk of a payload with the proof that it belongs to the
+// payload's part set.
+type Part struct {
+	Index int
+	Bytes []byte
+	Proof *merkle.Proof
+}
+
+// MarshalBinary encodes the part as its proof followed by its bytes, the
+// index of the part is that of the proof.
+func (p *Part) MarshalBinary() ([]byte, error) {
+	b, err := p.Proof.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(b, p.Bytes...), nil
+}
+
+// DecodePart decodes a part encoded by Part.MarshalBinary, the part is not
+// verified until it is added to a PartSet.
+func DecodePart(b []byte) (*Part, error) {
+	proof, n, err := merkle.DecodeProof(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Part{Index: proof.Index, Bytes: b[n:], Proof: proof}, nil
+}
+
+// PartSet holds the parts of a payload, it is either created complete from the
+// payload or from a header and then filled by adding parts as they arrive.
+type PartSet struct {
+	header PartSetHeader
+	parts  []*Part
+	count  int
+}
+
+// NewPartSetFromData splits data into parts, an empty payload has a single
+// empty part.
+func NewPartSetFromData(data []byte) *PartSet {
+	var chunks [][]byte
+	for len(data) > PartSize {
+		chunks = append(chunks, data[:PartSize])
+		data = data[PartSize:]
+	}
+	chunks = append(chunks, data)
+	root, proofs := merkle.Proofs(chunks)
+	ps := &PartSet{
+		header: PartSetHeader{Total: len(chunks), Root: root},
+		parts:  make([]*Part, len(chunks)),
+		count:  len(chunks),
+	}
+	for i, c := range chunks {
+		ps.parts[i] = &Part{Index: i, Bytes: c, Proof: proofs[i]}
+	}
+	return ps
+}
+
+// NewPartSetFromHeader creates an empty part set for the payload identified
+// by h.
+func NewPartSetFromHeader(h PartSetHeader) *PartSet {
+	return &PartSet{header: h, parts: make([]*Part, h.Total)}
+}
+
+// Header returns the header of the part set.
+func (ps *PartSet) Header() PartSetHeader {
+	return ps.header
+}
+
+// Total returns the number of parts of the payload.
+func (ps *PartSet) Total() int {
+	return ps.header.Total
+}
+
+// Count returns the number of parts held.
+func (ps *PartSet) Count() int {
+	return ps.count
+}
+
+// IsComplete returns true if all the parts are held.
+func (ps *PartSet) IsComplete() bool {
+	return ps.count == ps.header.Total
+}
+
+// Has returns true if part i is held.
+func (ps *PartSet) Has(i int) bool {
+	return i >= 0 && i < len(ps.parts) && ps.parts[i] != nil
+}
+
+// Part returns part i or nil if it is not held.
+func (ps *PartSet) Part(i int) *Part {
+	if !ps.Has(i) {
+		return nil
+	}
+	return ps.parts[i]
+}
+
+// AddPart verifies and adds a part, it returns false if the part was already
+// held. All parts but the last must be PartSize long.
+func (ps *PartSet) AddPart(p *Part) (bool, error) {
+	if p.Index < 0 || p.Index >= ps.header.Total || p.Proof.Index != p.Index || p.Proof.Total != ps.header.Total {
+		return false, fmt.Errorf("%w: part %d of %d", ErrPartSetMismatch, p.Index, p.Proof.Total)
+	}
+	last := p.Index == ps.header.Total-1
+	if len(p.Bytes) > PartSize || (!last && len(p.Bytes) != PartSize) {
+		return false, fmt.Errorf("%w: part %d has length %d", ErrPartSetMismatch, p.Index, len(p.Bytes))
+	}
+	if ps.parts[p.Index] != nil {
+		return false, nil
+	}
+	if err := p.Proof.Verify(ps.header.Root, p.Bytes); err != nil {
+		return false, fmt.Errorf("%w: %v", ErrPartSetMismatch, err)
+	}
+	ps.parts[p.Index] = p
+	ps.count++
+	return true, nil
+}
+
+// Data returns the payload, or nil if the part set is incomplete.
+func (ps *PartSet) Data() []byte {
+	if !ps.IsComplete() {
+		return nil
+	}
+	size := 0
+	for _, p := range ps.parts {
+		size += len(p.Bytes)
+	}
+	data := make([]byte, 0, size)
+	for _, p := range ps.parts {
+		data = append(data, p.Bytes...)
+	}
+	return data
+}
@@ -0,0 +1,124 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DefaultValidatorUpdateDelay is the default number of heights after which
+// validator updates take effect.
+const DefaultValidatorUpdateDelay = 2
+
+// ValidatorSchedule tracks the validator set of each height as validator
+// updates take effect. The updates resulting from the block decided at height
+// H take effect at height H+delay, a delay of at least two means that the set
+// of the height following a proposal is known when the proposal is made, so
+// that headers can commit to it. It is safe for concurrent use.
+type ValidatorSchedule struct {
+	delay uint64
+
+	mu sync.RWMutex
+	// sets holds each set with the first height it decides, in height
+	// order.
+	sets []scheduledSet
+	// applied is the last height whose updates were applied.
+	applied uint64
+}
+
+type scheduledSet struct {
+	height uint64
+	set    *ValidatorSet
+}
+
+// NewValidatorSchedule creates a schedule in which vs decides height and the
+// heights that follow until updates change it, updates are applied from
+// height on. A delay of zero selects DefaultValidatorUpdateDelay, it returns
+// an error if the delay is one.
+func NewValidatorSchedule(height uint64, vs *ValidatorSet, delay uint64) (*ValidatorSchedule, error) {
+	if delay == 0 {
+		delay = DefaultValidatorUpdateDelay
+	}
+	if delay < 2 {
+		return nil, fmt.Errorf("validator update delay %d is less than 2", delay)
+	}
+	if height == 0 {
+		return nil, fmt.Errorf("schedule starts at height 0")
+	}
+	return &ValidatorSchedule{
+		delay:   delay,
+		sets:    []scheduledSet{{height: height, set: vs}},
+		applied: height - 1,
+	}, nil
+}
+
+// RestoreValidatorSchedule creates a schedule for a node that starts at height
+// without the earlier heights, for instance from a snapshot. The updates of
+// the earlier heights determine the sets of height up to height+delay-1,
+// which sets holds in order. A delay of zero selects
+// DefaultValidatorUpdateDelay.
+func RestoreValidatorSchedule(height uint64, sets []*ValidatorSet, delay uint64) (*ValidatorSchedule, error) {
+	if delay == 0 {
+		delay = DefaultValidatorUpdateDelay
+	}
+	if uint64(len(sets)) != delay {
+		return nil, fmt.Errorf("restoring schedule with delay %d from %d sets", delay, len(sets))
+	}
+	s, err := NewValidatorSchedule(height, sets[0], delay)
+	if err != nil {
+		return nil, err
+	}
+	for i, vs := range sets[1:] {
+		if vs.Hash() != s.sets[len(s.sets)-1].set.Hash() {
+			s.sets = append(s.sets, scheduledSet{height: height + 1 + uint64(i), set: vs})
+		}
+	}
+	return s, nil
+}
+
+// Delay returns the number of heights after which updates take effect.
+func (s *ValidatorSchedule) Delay() uint64 {
+	return s.delay
+}
+
+// Applied returns the last height whose updates were applied.
+func (s *ValidatorSchedule) Applied() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.applied
+}
+
+// At returns the validator set that decides height, it returns false if
+// height precedes the schedule or the set depends on updates that were not
+// applied yet.
+func (s *ValidatorSchedule) At(height uint64) (*ValidatorSet, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if height < s.sets[0].height || height > s.applied+s.delay {
+		return nil, false
+	}
+	i := sort.Search(len(s.sets), func(i int) bool { return s.sets[i].height > height })
+	return s.sets[i-1].set, true
+}
+
+// Apply applies the updates resulting from the block decided at height, which
+// must follow the last height applied. Invalid updates are rejected as a
+// whole, leaving the schedule unchanged apart from recording height as
+// applied, so that all nodes agree on the sets whatever the updates.
+func (s *ValidatorSchedule) Apply(height uint64, updates []ValidatorUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if height != s.applied+1 {
+		return fmt.Errorf("applying height %d after height %d", height, s.applied)
+	}
+	s.applied = height
+	if len(updates) == 0 {
+		return nil
+	}
+	next, err := s.sets[len(s.sets)-1].set.Update(updates)
+	if err != nil {
+		return fmt.Errorf("updates of height %d: %w", height, err)
+	}
+	s.sets = append(s.sets, scheduledSet{height: height + s.delay, set: next})
+	return nil
+}
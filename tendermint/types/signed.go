@@ -0,0 +1,147 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+)
+
+// SignBytesVersion is the version of the encoding returned by SignBytes.
+const SignBytesVersion = 1
+
+const (
+	// SignedSize is the size of an encoded signed vote.
+	SignedSize = algorithm.EncodedSize + ed25519.SignatureSize
+	// SignedProposalSize is the size of an encoded signed proposal.
+	SignedProposalSize = SignedSize + HeaderSize
+)
+
+// Signer signs the messages broadcast by a validator.
+type Signer interface {
+	// PubKey returns the public key of the validator.
+	PubKey() ed25519.PublicKey
+	// SignMessage returns the signature of cm for the chain identified by
+	// chainID, an error means the message must not be broadcast.
+	SignMessage(chainID string, cm *algorithm.ConsensusMessage) ([]byte, error)
+}
+
+// KeySigner is a Signer holding the validator's key in memory.
+type KeySigner struct {
+	key ed25519.PrivateKey
+}
+
+// NewKeySigner returns a Signer that signs with key.
+func NewKeySigner(key ed25519.PrivateKey) *KeySigner {
+	return &KeySigner{key: key}
+}
+
+// PubKey implements Signer.
+func (s *KeySigner) PubKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// SignMessage implements Signer.
+func (s *KeySigner) SignMessage(chainID string, cm *algorithm.ConsensusMessage) ([]byte, error) {
+	return ed25519.Sign(s.key, SignBytes(chainID, cm)), nil
+}
+
+// SignBytes returns the bytes that are signed for cm on the chain identified
+// by chainID. They are the version, the message type, the uvarint length of
+// the chain id, the chain id and the encoded message, so that a signature is
+// only valid for one kind of message on one chain.
+func SignBytes(chainID string, cm *algorithm.ConsensusMessage) []byte {
+	b, err := cm.MarshalBinary()
+	if err != nil {
+		panic(fmt.Sprintf("failed to encode %v: %v", cm, err))
+	}
+	prefix := make([]byte, 0, 2+binary.MaxVarintLen64+len(chainID)+len(b))
+	prefix = append(prefix, SignBytesVersion, byte(cm.MsgType))
+	prefix = binary.AppendUvarint(prefix, uint64(len(chainID)))
+	prefix = append(prefix, chainID...)
+	return append(prefix, b...)
+}
+
+// EncodeSigned returns the encoding of a signed vote, the encoded message
+// followed by its signature. These are the raw bytes that are stored in the
+// Store and sent between peers.
+func EncodeSigned(cm *algorithm.ConsensusMessage, sig []byte) []byte {
+	b, err := cm.MarshalBinary()
+	if err != nil {
+		panic(fmt.Sprintf("failed to encode %v: %v", cm, err))
+	}
+	return append(b, sig...)
+}
+
+// EncodeProposal returns the encoding of a signed proposal, which is that of
+// a vote followed by the header of the proposal. The header is not signed
+// since the proposal's value is its hash.
+func EncodeProposal(cm *algorithm.ConsensusMessage, sig []byte, header Header) []byte {
+	b, _ := header.MarshalBinary()
+	return append(EncodeSigned(cm, sig), b...)
+}
+
+// DecodeSigned decodes and validates a message encoded by EncodeSigned or
+// EncodeProposal, it does not verify the signature.
+func DecodeSigned(raw []byte) (*algorithm.ConsensusMessage, []byte, error) {
+	if len(raw) < algorithm.EncodedSize {
+		return nil, nil, fmt.Errorf("signed message has length %d", len(raw))
+	}
+	cm := new(algorithm.ConsensusMessage)
+	if err := cm.UnmarshalBinary(raw[:algorithm.EncodedSize]); err != nil {
+		return nil, nil, err
+	}
+	if err := cm.Validate(); err != nil {
+		return nil, nil, err
+	}
+	size := SignedSize
+	if cm.MsgType == algorithm.Propose {
+		size = SignedProposalSize
+	}
+	if len(raw) != size {
+		return nil, nil, fmt.Errorf("signed %v has length %d, expected %d", cm.MsgType, len(raw), size)
+	}
+	if cm.MsgType == algorithm.Propose {
+		header, err := ProposalHeader(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.Hash() != cm.Value {
+			return nil, nil, fmt.Errorf("proposal value %v is not the hash of its header", cm.Value)
+		}
+		if header.Height != cm.Height {
+			return nil, nil, fmt.Errorf("proposal for height %d carries header for height %d", cm.Height, header.Height)
+		}
+	}
+	return cm, raw[algorithm.EncodedSize:SignedSize], nil
+}
+
+// ProposalHeader returns the header carried by a proposal encoded by
+// EncodeProposal.
+func ProposalHeader(raw []byte) (Header, error) {
+	var h Header
+	if len(raw) != SignedProposalSize {
+		return h, fmt.Errorf("signed proposal has length %d, expected %d", len(raw), SignedProposalSize)
+	}
+	err := h.UnmarshalBinary(raw[SignedSize:])
+	return h, err
+}
+
+// VerifySigned decodes a signed message and checks that it was signed for the
+// chain identified by chainID by its sender, who must be a member of vs.
+// Messages signed for other chains fail with an invalid signature.
+func VerifySigned(chainID string, vs *ValidatorSet, raw []byte) (*algorithm.ConsensusMessage, error) {
+	cm, sig, err := DecodeSigned(raw)
+	if err != nil {
+		return nil, err
+	}
+	i, ok := vs.Index(cm.Sender)
+	if !ok {
+		return nil, fmt.Errorf("sender %v is not a validator", cm.Sender)
+	}
+	if !ed25519.Verify(vs.Get(i).PubKey, SignBytes(chainID, cm), sig) {
+		return nil, fmt.Errorf("invalid signature from %v for chain %q", cm.Sender, chainID)
+	}
+	return cm, nil
+}
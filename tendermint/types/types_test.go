@@ -0,0 +1,342 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testChainID = "test-chain"
+
+func testKey(i int) ed25519.PrivateKey {
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = byte(i + 1)
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+func testValidators(t *testing.T, n int) *ValidatorSet {
+	var vals []Validator
+	for i := 0; i < n; i++ {
+		vals = append(vals, NewValidator(testKey(i).Public().(ed25519.PublicKey)))
+	}
+	vs, err := NewValidatorSet(vals)
+	require.NoError(t, err)
+	return vs
+}
+
+func TestValidatorSet(t *testing.T) {
+	vs := testValidators(t, 4)
+	assert.Equal(t, 4, vs.Size())
+	assert.Equal(t, 3, vs.Quorum())
+	for i, id := range vs.IDs() {
+		index, ok := vs.Index(id)
+		assert.True(t, ok)
+		assert.Equal(t, i, index)
+	}
+	assert.Equal(t, vs.Get(1).ID, vs.Proposer(1, 0))
+	assert.Equal(t, vs.Get(0).ID, vs.Proposer(1, 3))
+
+	// The hash depends on the order of the validators.
+	reordered := vs.Validators()
+	reordered[0], reordered[1] = reordered[1], reordered[0]
+	other, err := NewValidatorSet(reordered)
+	require.NoError(t, err)
+	assert.NotEqual(t, vs.Hash(), other.Hash())
+
+	encoded, err := vs.MarshalBinary()
+	require.NoError(t, err)
+	decoded, err := UnmarshalValidatorSet(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, vs, decoded)
+	_, err = UnmarshalValidatorSet(encoded[:len(encoded)-1])
+	assert.Error(t, err)
+
+	_, err = NewValidatorSet(nil)
+	assert.Error(t, err)
+	_, err = NewValidatorSet(append(vs.Validators(), vs.Get(0)))
+	assert.Error(t, err)
+	bad := vs.Get(0)
+	bad.ID = vs.Get(1).ID
+	_, err = NewValidatorSet([]Validator{bad})
+	assert.Error(t, err)
+}
+
+func pub(i int) ed25519.PublicKey {
+	return testKey(i).Public().(ed25519.PublicKey)
+}
+
+func TestValidatorSetUpdate(t *testing.T) {
+	vs := testValidators(t, 3)
+	updated, err := vs.Update([]ValidatorUpdate{{PubKey: pub(0), Remove: true}, {PubKey: pub(3)}})
+	require.NoError(t, err)
+	assert.Equal(t, []algorithm.NodeID{vs.Get(1).ID, vs.Get(2).ID, NewValidator(pub(3)).ID}, updated.IDs())
+	assert.Equal(t, 3, vs.Size())
+
+	for _, updates := range [][]ValidatorUpdate{
+		{{PubKey: pub(1)}},
+		{{PubKey: pub(3), Remove: true}},
+		{{PubKey: pub(0), Remove: true}, {PubKey: pub(1), Remove: true}, {PubKey: pub(2), Remove: true}},
+		{{PubKey: pub(0)[:4]}},
+	} {
+		_, err := vs.Update(updates)
+		assert.Error(t, err)
+	}
+}
+
+func TestValidatorSchedule(t *testing.T) {
+	vs := testValidators(t, 3)
+	_, err := NewValidatorSchedule(1, vs, 1)
+	assert.Error(t, err)
+	s, err := NewValidatorSchedule(1, vs, 0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(DefaultValidatorUpdateDelay), s.Delay())
+
+	// Updates from height 1 take effect at height 3.
+	assert.Error(t, s.Apply(2, nil))
+	require.NoError(t, s.Apply(1, []ValidatorUpdate{{PubKey: pub(3)}}))
+	assert.Equal(t, uint64(1), s.Applied())
+	for h := uint64(1); h <= 2; h++ {
+		set, ok := s.At(h)
+		assert.True(t, ok)
+		assert.Equal(t, vs, set)
+	}
+	added, ok := s.At(3)
+	assert.True(t, ok)
+	assert.Equal(t, 4, added.Size())
+	_, ok = s.At(4)
+	assert.False(t, ok)
+	_, ok = s.At(0)
+	assert.False(t, ok)
+
+	// Invalid updates leave the sets unchanged.
+	assert.Error(t, s.Apply(2, []ValidatorUpdate{{PubKey: pub(5), Remove: true}}))
+	require.NoError(t, s.Apply(3, []ValidatorUpdate{{PubKey: pub(0), Remove: true}}))
+	set, ok := s.At(4)
+	assert.True(t, ok)
+	assert.Equal(t, added, set)
+	set, ok = s.At(5)
+	assert.True(t, ok)
+	assert.Equal(t, added.IDs()[1:], set.IDs())
+	set, _ = s.At(1)
+	assert.Equal(t, vs, set)
+
+	// A restored schedule knows the sets up to the delay.
+	_, err = RestoreValidatorSchedule(4, []*ValidatorSet{vs}, 0)
+	assert.Error(t, err)
+	s, err = RestoreValidatorSchedule(4, []*ValidatorSet{vs, added}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), s.Applied())
+	set, _ = s.At(4)
+	assert.Equal(t, vs, set)
+	set, _ = s.At(5)
+	assert.Equal(t, added, set)
+	_, ok = s.At(3)
+	assert.False(t, ok)
+	require.NoError(t, s.Apply(4, nil))
+	set, _ = s.At(6)
+	assert.Equal(t, added, set)
+}
+
+func TestSignedMessages(t *testing.T) {
+	vs := testValidators(t, 4)
+	signer := NewKeySigner(testKey(2))
+	cm := &algorithm.ConsensusMessage{Sender: vs.Get(2).ID, MsgType: algorithm.Prevote, Height: 4, Round: 1, Value: algorithm.NilValue}
+	sig, err := signer.SignMessage(testChainID, cm)
+	require.NoError(t, err)
+	raw := EncodeSigned(cm, sig)
+
+	verified, err := VerifySigned(testChainID, vs, raw)
+	require.NoError(t, err)
+	assert.Equal(t, cm, verified)
+
+	// Tampering with the message or claiming another sender is detected.
+	tampered := append([]byte{}, raw...)
+	tampered[algorithm.EncodedSize-1] ^= 1
+	_, err = VerifySigned(testChainID, vs, tampered)
+	assert.Error(t, err)
+
+	forged := *cm
+	forged.Sender = vs.Get(0).ID
+	_, err = VerifySigned(testChainID, vs, EncodeSigned(&forged, sig))
+	assert.Error(t, err)
+
+	outsider := *cm
+	outsider.Sender = algorithm.NodeID{1}
+	_, err = VerifySigned(testChainID, vs, EncodeSigned(&outsider, sig))
+	assert.Error(t, err)
+
+	_, err = VerifySigned(testChainID, vs, raw[1:])
+	assert.Error(t, err)
+
+	// Signatures are only valid for the chain they were made for.
+	_, err = VerifySigned("other-chain", vs, raw)
+	assert.ErrorContains(t, err, "invalid signature")
+}
+
+func TestSignBytes(t *testing.T) {
+	cm := &algorithm.ConsensusMessage{MsgType: algorithm.Precommit, Height: 4, Round: 1, Value: algorithm.NilValue}
+	encoded, err := cm.MarshalBinary()
+	require.NoError(t, err)
+	b := SignBytes("ab", cm)
+	assert.Equal(t, append([]byte{SignBytesVersion, byte(algorithm.Precommit), 2, 'a', 'b'}, encoded...), b)
+
+	// The chain id is length prefixed, so that no chain id and message can
+	// produce the sign bytes of another chain id and message.
+	assert.NotEqual(t, b, SignBytes("a", cm))
+	assert.NotEqual(t, SignBytes("", cm), SignBytes("a", cm))
+	prevote := *cm
+	prevote.MsgType = algorithm.Prevote
+	assert.NotEqual(t, b[1:2], SignBytes("ab", &prevote)[1:2])
+}
+
+func TestSignedProposals(t *testing.T) {
+	vs := testValidators(t, 4)
+	signer := NewKeySigner(testKey(1))
+	header := Header{Height: 4, Time: CanonicalTime(time.Now()), ValidatorsHash: vs.Hash(), NextValidatorsHash: vs.Hash(), AppHash: sha256.Sum256([]byte("state")), Payload: NewPartSetFromData([]byte("payload")).Header()}
+	cm := &algorithm.ConsensusMessage{Sender: vs.Get(1).ID, MsgType: algorithm.Propose, Height: 4, Round: 0, Value: header.Hash(), ValidRound: -1}
+	sig, err := signer.SignMessage(testChainID, cm)
+	require.NoError(t, err)
+	raw := EncodeProposal(cm, sig, header)
+	require.Len(t, raw, SignedProposalSize)
+
+	verified, err := VerifySigned(testChainID, vs, raw)
+	require.NoError(t, err)
+	assert.Equal(t, cm, verified)
+	decoded, err := ProposalHeader(raw)
+	require.NoError(t, err)
+	assert.Equal(t, header, decoded)
+	// The zero time is preserved.
+	zero := header
+	zero.Time = time.Time{}
+	decoded, err = ProposalHeader(EncodeProposal(cm, sig, zero))
+	require.NoError(t, err)
+	assert.True(t, decoded.Time.IsZero())
+
+	// The header must be the one the value commits to and be for the
+	// proposal's height.
+	other := header
+	other.Payload = NewPartSetFromData([]byte("other")).Header()
+	_, err = VerifySigned(testChainID, vs, EncodeProposal(cm, sig, other))
+	assert.Error(t, err)
+	wrongHeight := *cm
+	wrongHeight.Height = 5
+	sig, err = signer.SignMessage(testChainID, &wrongHeight)
+	require.NoError(t, err)
+	_, err = VerifySigned(testChainID, vs, EncodeProposal(&wrongHeight, sig, header))
+	assert.Error(t, err)
+
+	var decodedHeader Header
+	encoded, err := header.MarshalBinary()
+	require.NoError(t, err)
+	require.NoError(t, decodedHeader.UnmarshalBinary(encoded))
+	assert.Equal(t, header, decodedHeader)
+	assert.Error(t, decodedHeader.UnmarshalBinary(encoded[1:]))
+	// A proposal must carry a header.
+	_, err = VerifySigned(testChainID, vs, EncodeSigned(cm, sig))
+	assert.Error(t, err)
+}
+
+func TestPartSet(t *testing.T) {
+	data := make([]byte, 2*PartSize+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	full := NewPartSetFromData(data)
+	require.Equal(t, 3, full.Total())
+	require.True(t, full.IsComplete())
+	assert.Equal(t, data, full.Data())
+
+	// Parts are transferred in encoded form and may arrive in any order.
+	ps := NewPartSetFromHeader(full.Header())
+	assert.Nil(t, ps.Data())
+	for _, i := range []int{2, 0, 1} {
+		encoded, err := full.Part(i).MarshalBinary()
+		require.NoError(t, err)
+		part, err := DecodePart(encoded)
+		require.NoError(t, err)
+		added, err := ps.AddPart(part)
+		require.NoError(t, err)
+		assert.True(t, added)
+		assert.True(t, ps.Has(i))
+	}
+	added, err := ps.AddPart(full.Part(0))
+	require.NoError(t, err)
+	assert.False(t, added)
+	require.True(t, ps.IsComplete())
+	assert.Equal(t, data, ps.Data())
+
+	// Parts with altered bytes or from another payload are rejected.
+	ps = NewPartSetFromHeader(full.Header())
+	tampered := *full.Part(1)
+	tampered.Bytes = append([]byte{}, tampered.Bytes...)
+	tampered.Bytes[0] ^= 1
+	_, err = ps.AddPart(&tampered)
+	assert.ErrorIs(t, err, ErrPartSetMismatch)
+	_, err = ps.AddPart(NewPartSetFromData([]byte("other")).Part(0))
+	assert.ErrorIs(t, err, ErrPartSetMismatch)
+	assert.Equal(t, 0, ps.Count())
+
+	empty := NewPartSetFromData(nil)
+	assert.Equal(t, 1, empty.Total())
+	assert.Equal(t, []byte{}, empty.Data())
+
+	var h PartSetHeader
+	encoded, err := full.Header().MarshalBinary()
+	require.NoError(t, err)
+	require.NoError(t, h.UnmarshalBinary(encoded))
+	assert.Equal(t, full.Header(), h)
+	assert.Error(t, h.UnmarshalBinary(make([]byte, PartSetHeaderSize)))
+}
+
+func TestBlock(t *testing.T) {
+	vs := testValidators(t, 4)
+	payload := []byte("payload")
+	header := Header{Height: 5, ValidatorsHash: vs.Hash(), NextValidatorsHash: vs.Hash(), Payload: NewPartSetFromData(payload).Header()}
+	p := &algorithm.ConsensusMessage{Sender: vs.Proposer(5, 1), MsgType: algorithm.Propose, Height: 5, Round: 1, Value: header.Hash(), ValidRound: -1}
+	proposer, _ := vs.Index(p.Sender)
+	sig, err := NewKeySigner(testKey(proposer)).SignMessage(testChainID, p)
+	require.NoError(t, err)
+	b := &Block{Proposal: EncodeProposal(p, sig, header), Payload: payload, Commit: &Commit{Height: 5, Round: 1, Value: p.Value}}
+	for i := 0; i < 3; i++ {
+		m := &algorithm.ConsensusMessage{Sender: vs.Get(i).ID, MsgType: algorithm.Precommit, Height: 5, Round: 1, Value: p.Value}
+		sig, err := NewKeySigner(testKey(i)).SignMessage(testChainID, m)
+		require.NoError(t, err)
+		b.Commit.Precommits = append(b.Commit.Precommits, EncodeSigned(m, sig))
+	}
+	verified, err := b.Verify(testChainID, vs, 5)
+	require.NoError(t, err)
+	assert.Equal(t, p, verified)
+	_, err = b.Verify(testChainID, vs, 6)
+	assert.Error(t, err)
+	decoded, err := b.Header()
+	require.NoError(t, err)
+	assert.Equal(t, header, decoded)
+
+	encoded, err := b.Commit.MarshalBinary()
+	require.NoError(t, err)
+	var c Commit
+	require.NoError(t, c.UnmarshalBinary(encoded))
+	assert.Equal(t, b.Commit, &c)
+	assert.Error(t, c.UnmarshalBinary(encoded[:len(encoded)-1]))
+
+	// A commit needs a quorum of distinct precommits for its value.
+	short := *b.Commit
+	short.Precommits = short.Precommits[:2]
+	assert.Error(t, short.Verify(testChainID, vs))
+	duplicated := short
+	duplicated.Precommits = append(duplicated.Precommits, short.Precommits[0])
+	assert.Error(t, duplicated.Verify(testChainID, vs))
+	other := *b.Commit
+	other.Value[0] ^= 1
+	assert.Error(t, other.Verify(testChainID, vs))
+
+	tampered := *b
+	tampered.Payload = []byte("other")
+	_, err = tampered.Verify(testChainID, vs, 5)
+	assert.Error(t, err)
+}
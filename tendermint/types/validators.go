@@ -0,0 +1,178 @@
+// Package types defines the validator sets, signed messages and decided blocks
+// shared by the packages that run and verify consensus.
+package types
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/piersy/tendermint-go/tendermint"
+	"github.com/piersy/tendermint-go/tendermint/algorithm"
+	"github.com/piersy/tendermint-go/tendermint/keys"
+)
+
+// Validator is a member of a validator set, all validators have equal voting
+// power.
+type Validator struct {
+	ID     algorithm.NodeID
+	PubKey ed25519.PublicKey
+}
+
+// NewValidator returns the validator holding pub.
+func NewValidator(pub ed25519.PublicKey) Validator {
+	return Validator{ID: keys.Address(pub), PubKey: pub}
+}
+
+// ValidatorSet is an ordered set of validators, the order determines the
+// proposer schedule and the index of each validator in vote bit arrays.
+type ValidatorSet struct {
+	validators []Validator
+	index      map[algorithm.NodeID]int
+}
+
+// NewValidatorSet creates a validator set holding the given validators in the
+// given order, it returns an error if the set is empty or contains
+// duplicates.
+func NewValidatorSet(validators []Validator) (*ValidatorSet, error) {
+	if len(validators) == 0 {
+		return nil, fmt.Errorf("validator set is empty")
+	}
+	vs := &ValidatorSet{
+		validators: append([]Validator{}, validators...),
+		index:      make(map[algorithm.NodeID]int, len(validators)),
+	}
+	for i, v := range validators {
+		if len(v.PubKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("validator %d has invalid public key", i)
+		}
+		if v.ID != keys.Address(v.PubKey) {
+			return nil, fmt.Errorf("validator %d id %v does not match its public key", i, v.ID)
+		}
+		if _, ok := vs.index[v.ID]; ok {
+			return nil, fmt.Errorf("duplicate validator %v", v.ID)
+		}
+		vs.index[v.ID] = i
+	}
+	return vs, nil
+}
+
+// Size returns the number of validators.
+func (vs *ValidatorSet) Size() int {
+	return len(vs.validators)
+}
+
+// Validators returns the validators in order.
+func (vs *ValidatorSet) Validators() []Validator {
+	return append([]Validator{}, vs.validators...)
+}
+
+// IDs returns the ids of the validators in order.
+func (vs *ValidatorSet) IDs() []algorithm.NodeID {
+	result := make([]algorithm.NodeID, len(vs.validators))
+	for i, v := range vs.validators {
+		result[i] = v.ID
+	}
+	return result
+}
+
+// Index returns the index of the validator with the given id.
+func (vs *ValidatorSet) Index(id algorithm.NodeID) (int, bool) {
+	i, ok := vs.index[id]
+	return i, ok
+}
+
+// Get returns the validator at index i.
+func (vs *ValidatorSet) Get(i int) Validator {
+	return vs.validators[i]
+}
+
+// Contains returns true if id is a validator.
+func (vs *ValidatorSet) Contains(id algorithm.NodeID) bool {
+	_, ok := vs.index[id]
+	return ok
+}
+
+// Proposer selects a proposer in round robin fashion.
+func (vs *ValidatorSet) Proposer(height uint64, round int) algorithm.NodeID {
+	return vs.validators[(height+uint64(round))%uint64(len(vs.validators))].ID
+}
+
+// Quorum returns the number of validators needed for a quorum, more than two
+// thirds of the set.
+func (vs *ValidatorSet) Quorum() int {
+	return len(vs.validators)*2/3 + 1
+}
+
+// Hash returns a hash committing to the validators and their order.
+func (vs *ValidatorSet) Hash() tendermint.Hash {
+	h := sha256.New()
+	for _, v := range vs.validators {
+		h.Write(v.PubKey)
+	}
+	var result tendermint.Hash
+	h.Sum(result[:0])
+	return result
+}
+
+// ValidatorUpdate adds a validator to a set or removes it from the set.
+type ValidatorUpdate struct {
+	PubKey ed25519.PublicKey
+	// Remove is set if the validator leaves the set.
+	Remove bool
+}
+
+// Update returns the set resulting from applying updates in order, added
+// validators join the end of the set. It returns an error if an update adds a
+// validator already in the set, removes one that is not or leaves the set
+// empty, vs itself is never modified.
+func (vs *ValidatorSet) Update(updates []ValidatorUpdate) (*ValidatorSet, error) {
+	validators := vs.Validators()
+	for _, u := range updates {
+		if len(u.PubKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("update has invalid public key")
+		}
+		v := NewValidator(u.PubKey)
+		i := -1
+		for j, w := range validators {
+			if w.ID == v.ID {
+				i = j
+				break
+			}
+		}
+		switch {
+		case u.Remove && i < 0:
+			return nil, fmt.Errorf("removed validator %v is not in the set", v.ID)
+		case u.Remove:
+			validators = append(validators[:i], validators[i+1:]...)
+		case i >= 0:
+			return nil, fmt.Errorf("added validator %v is already in the set", v.ID)
+		default:
+			validators = append(validators, v)
+		}
+	}
+	return NewValidatorSet(validators)
+}
+
+// MarshalBinary encodes the set as the big endian 2 byte number of validators
+// followed by their public keys in order.
+func (vs *ValidatorSet) MarshalBinary() ([]byte, error) {
+	b := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(vs.validators)*ed25519.PublicKeySize), uint16(len(vs.validators)))
+	for _, v := range vs.validators {
+		b = append(b, v.PubKey...)
+	}
+	return b, nil
+}
+
+// UnmarshalValidatorSet decodes a set encoded by MarshalBinary.
+func UnmarshalValidatorSet(b []byte) (*ValidatorSet, error) {
+	if len(b) < 2 || len(b) != 2+int(binary.BigEndian.Uint16(b))*ed25519.PublicKeySize {
+		return nil, fmt.Errorf("validator set has invalid length %d", len(b))
+	}
+	var validators []Validator
+	for b = b[2:]; len(b) > 0; b = b[ed25519.PublicKeySize:] {
+		validators = append(validators, NewValidator(append(ed25519.PublicKey{}, b[:ed25519.PublicKeySize]...)))
+	}
+	return NewValidatorSet(validators)
+}